@@ -3,6 +3,9 @@ package ble
 // AdvHandler handles advertisement.
 type AdvHandler func(a Advertisement)
 
+// PeriodicAdvHandler handles periodic advertisements.
+type PeriodicAdvHandler func(a PeriodicAdvertisement)
+
 // AdvFilter returns true if the advertisement matches specified condition.
 type AdvFilter func(a Advertisement) bool
 
@@ -19,8 +22,20 @@ type Advertisement interface {
 	RSSI() int
 	Addr() Addr
 	AddrType() uint8
+
+	// IdentityAddr returns the identity address of a bonded device advertising with a
+	// resolvable private address, or nil if the address could not be resolved.
+	IdentityAddr() Addr
 	Timestamp() int64
 
+	// PrimaryPHY and SecondaryPHY return the PHYs the advertisement was received on.
+	// SecondaryPHY is 0 for legacy advertisements, which have no auxiliary packets.
+	PrimaryPHY() uint8
+	SecondaryPHY() uint8
+
+	// SID returns the advertising set ID, or 0xFF if the advertisement has none.
+	SID() uint8
+
 	ToMap() (map[string]interface{}, error)
 	Data() []byte
 	SrData() []byte
@@ -42,6 +57,10 @@ var AdvertisementMapKeys = struct {
 	Controller         string
 	Timestamp          string
 	AdvertisementError string
+	IdentityAddress    string
+	PrimaryPHY         string
+	SecondaryPHY       string
+	SID                string
 }{
 	MAC:                "mac",
 	RSSI:               "rssi",
@@ -58,6 +77,10 @@ var AdvertisementMapKeys = struct {
 	Controller:         "controllerMac",
 	Timestamp:          "timestamp",
 	AdvertisementError: "advertisementError",
+	IdentityAddress:    "identityMac",
+	PrimaryPHY:         "primaryPhy",
+	SecondaryPHY:       "secondaryPhy",
+	SID:                "sid",
 }
 
 // ServiceData ...
@@ -76,3 +99,45 @@ type AdvertisingParameters struct {
 	AdvertisingChannelMap   uint8
 	AdvertisingFilterPolicy uint8
 }
+
+// Advertising event properties of an AdvertisingSet. [Vol 2, Part E, 7.8.53]
+const (
+	AdvPropConnectable    = 0x0001
+	AdvPropScannable      = 0x0002
+	AdvPropDirected       = 0x0004
+	AdvPropHighDutyCycle  = 0x0008
+	AdvPropLegacy         = 0x0010
+	AdvPropAnonymous      = 0x0020
+	AdvPropIncludeTxPower = 0x0040
+)
+
+// AdvertisingSet describes one of several advertisements which can be sent
+// concurrently using LE Advertising Extensions.
+type AdvertisingSet struct {
+	Handle       uint8
+	Properties   uint16
+	IntervalMin  uint32 // N * 0.625 msec
+	IntervalMax  uint32 // N * 0.625 msec
+	PrimaryPHY   uint8  // PHY1M or PHYCoded
+	SecondaryPHY uint8
+	SID          uint8
+	TxPower      *int8 // dBm, nil: no preference
+
+	// Data and ScanResponse may exceed 31 bytes unless the set uses legacy PDUs.
+	Data         []byte
+	ScanResponse []byte
+}
+
+// PeriodicAdvertisement holds the data of a periodic advertising event,
+// reassembled from all of the reports it was delivered in.
+type PeriodicAdvertisement struct {
+	Addr      Addr
+	SID       uint8
+	TxPower   int8
+	RSSI      int8
+	Timestamp int64
+	Data      []byte
+
+	// Fields holds Data decoded by the parser package, keyed by AdvertisementMapKeys.
+	Fields map[string]interface{}
+}
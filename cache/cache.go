@@ -1,105 +1,357 @@
 package cache
 
 import (
+	"container/list"
+	"encoding/json"
 	"fmt"
-	jsoniter "github.com/json-iterator/go"
-	"github.com/rigado/ble"
 	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
+	"time"
+
+	"github.com/rigado/ble"
+	"github.com/rigado/ble/internal/atomicfile"
+)
+
+// schemaVersion is the version of the entry files. Entries of other versions are
+// dropped, and rediscovered.
+const schemaVersion = 1
+
+const (
+	entryExt          = ".json"
+	migrateExt        = ".migrating"
+	defaultMemEntries = 32
 )
 
+// Options configures a cache.
+type Options struct {
+	// TTL is how long a profile stays cached after it's stored; 0 means forever.
+	TTL time.Duration
+
+	// MaxEntries is the number of devices cached, the least recently used ones
+	// being evicted; 0 means no limit.
+	MaxEntries int
+
+	// MemEntries is the number of profiles also kept in memory; 0 means the default,
+	// a negative value none.
+	MemEntries int
+}
+
+// entry is the file of a device.
+type entry struct {
+	Version int             `json:"version"`
+	Stored  time.Time       `json:"stored"`
+	Profile json.RawMessage `json:"profile"`
+}
+
+// gattCache stores the profile of each device in a file of the directory dir.
+// The files are replaced atomically, so a power cut loses an update at most.
 type gattCache struct {
-	filename string
-	sync.RWMutex
+	dir  string
+	opts Options
+	sync.Mutex
+
+	ready bool
+	used  map[string]time.Time // last use of the entries, for LRU eviction
+
+	// front is the in-memory cache of the most recently used entries.
+	front    *list.List // of *frontEntry, most recent first
+	frontIdx map[string]*list.Element
 }
 
-func New(filename string) ble.GattCache {
-	gc := gattCache{
-		filename: filename,
-	}
+type frontEntry struct {
+	key string
+	e   *entry
+}
 
-	return &gc
+// New returns a cache storing the profiles in the directory dir, one file per
+// device. If dir is the file of the former single file cache, its profiles are
+// migrated to a directory of the same name.
+func New(dir string) ble.GattCache {
+	return NewWithOptions(dir, Options{})
 }
 
-func (gc *gattCache) Store(mac ble.Addr, profile ble.Profile, replace bool) error {
-	gc.Lock()
-	defer gc.Unlock()
+// NewWithOptions returns a cache like New, configured by opts.
+func NewWithOptions(dir string, opts Options) ble.GattCache {
+	if opts.MemEntries == 0 {
+		opts.MemEntries = defaultMemEntries
+	}
+	return &gattCache{
+		dir:      dir,
+		opts:     opts,
+		front:    list.New(),
+		frontIdx: make(map[string]*list.Element),
+	}
+}
 
-	cache, err := gc.loadExisting()
+func (gc *gattCache) Store(mac ble.Addr, profile ble.Profile, replace bool) error {
+	key, err := entryKey(mac)
 	if err != nil {
 		return err
 	}
 
-	_, ok := cache[mac.String()]
-	if ok && !replace {
-		return fmt.Errorf("cache already contains gatt db for %s", mac.String())
+	gc.Lock()
+	defer gc.Unlock()
+	if err := gc.init(); err != nil {
+		return err
 	}
 
-	cache[mac.String()] = profile
+	if _, ok := gc.used[key]; ok && !replace {
+		if _, err := gc.load(key); err == nil {
+			return fmt.Errorf("cache already contains gatt db for %s", mac.String())
+		}
+	}
 
-	err = gc.storeCache(cache)
+	p, err := json.Marshal(profile)
 	if err != nil {
 		return err
 	}
-
+	if err := gc.store(key, &entry{Version: schemaVersion, Stored: time.Now(), Profile: p}); err != nil {
+		return err
+	}
+	gc.evict()
 	return nil
 }
 
 func (gc *gattCache) Load(mac ble.Addr) (ble.Profile, error) {
-	gc.RLock()
-	defer gc.RUnlock()
-
-	cache, err := gc.loadExisting()
+	key, err := entryKey(mac)
 	if err != nil {
 		return ble.Profile{}, err
 	}
 
-	p, ok := cache[mac.String()]
-	if !ok {
-		return ble.Profile{}, fmt.Errorf("gatt db for %s not found in cache", mac.String())
+	gc.Lock()
+	defer gc.Unlock()
+	if err := gc.init(); err != nil {
+		return ble.Profile{}, err
+	}
+
+	e, err := gc.load(key)
+	if err != nil {
+		return ble.Profile{}, fmt.Errorf("gatt db for %s not found in cache: %v", mac.String(), err)
 	}
 
+	var p ble.Profile
+	if err := json.Unmarshal(e.Profile, &p); err != nil {
+		gc.remove(key)
+		return ble.Profile{}, fmt.Errorf("invalid gatt db for %s: %v", mac.String(), err)
+	}
 	return p, nil
 }
 
+// Clear removes all the profiles. Only the entry files and the temporary files
+// of the cache are removed, the other files of the directory are left alone.
 func (gc *gattCache) Clear() error {
 	gc.Lock()
 	defer gc.Unlock()
 
-	err := os.Remove(gc.filename)
+	gc.ready = false
+	gc.used = nil
+	gc.front.Init()
+	gc.frontIdx = make(map[string]*list.Element)
+
+	files, err := ioutil.ReadDir(gc.dir)
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-
+	for _, fi := range files {
+		name := fi.Name()
+		if fi.IsDir() || !(isTempFile(name) || strings.HasSuffix(name, entryExt)) {
+			continue
+		}
+		if err := os.Remove(filepath.Join(gc.dir, name)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
 	return nil
 }
 
-func (gc *gattCache) loadExisting() (map[string]ble.Profile, error) {
-	_, err := os.Stat(gc.filename)
-	if os.IsNotExist(err) {
-		return map[string]ble.Profile{}, nil
+// entryKey returns the name of the file of the device mac, without extension.
+func entryKey(mac ble.Addr) (string, error) {
+	key := strings.ToLower(strings.ReplaceAll(mac.String(), ":", ""))
+	if key == "" || strings.ContainsAny(key, `/\.`) {
+		return "", fmt.Errorf("invalid address %q", mac.String())
+	}
+	return key, nil
+}
+
+// isTempFile reports whether name is the temporary file atomicfile.WriteFile
+// writes an entry to, "." + key + entryExt + "-*".
+func isTempFile(name string) bool {
+	i := strings.LastIndex(name, entryExt+"-")
+	return strings.HasPrefix(name, ".") && i > 1 && !strings.ContainsAny(name[1:i], `/\.`)
+}
+
+func (gc *gattCache) path(key string) string {
+	return filepath.Join(gc.dir, key+entryExt)
+}
+
+// init migrates the former single file cache, if any, and indexes the entries.
+func (gc *gattCache) init() error {
+	if gc.ready {
+		return nil
 	}
 
-	in, err := ioutil.ReadFile(gc.filename)
+	fi, err := os.Stat(gc.dir)
+	switch {
+	case err == nil && !fi.IsDir():
+		// The former cache is moved aside, so the directory can take its name.
+		if err := os.Rename(gc.dir, gc.dir+migrateExt); err != nil {
+			return err
+		}
+	case err != nil && !os.IsNotExist(err):
+		return err
+	}
+	if err := os.MkdirAll(gc.dir, 0755); err != nil {
+		return err
+	}
+	// The migration is resumed if it was interrupted.
+	if err := gc.migrate(gc.dir + migrateExt); err != nil {
+		return err
+	}
+
+	files, err := ioutil.ReadDir(gc.dir)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	gc.used = make(map[string]time.Time)
+	for _, fi := range files {
+		name := fi.Name()
+		switch {
+		case isTempFile(name):
+			// The temporary file of an interrupted write.
+			os.Remove(filepath.Join(gc.dir, name))
+		case strings.HasSuffix(name, entryExt):
+			gc.used[strings.TrimSuffix(name, entryExt)] = fi.ModTime()
+		}
 	}
+	gc.ready = true
+	gc.evict()
+	return nil
+}
 
-	var cache map[string]ble.Profile
-	err = jsoniter.Unmarshal(in, &cache)
+// migrate stores the profiles of the former single file cache legacy as entries,
+// and removes it.
+func (gc *gattCache) migrate(legacy string) error {
+	in, err := ioutil.ReadFile(legacy)
+	if os.IsNotExist(err) {
+		return nil
+	}
 	if err != nil {
-		return nil, err
+		return err
 	}
 
-	return cache, nil
+	var profiles map[string]json.RawMessage
+	if len(in) != 0 {
+		if err := json.Unmarshal(in, &profiles); err != nil {
+			return fmt.Errorf("can't migrate gatt cache %s: %v", legacy, err)
+		}
+	}
+
+	now := time.Now()
+	for mac, p := range profiles {
+		key, err := entryKey(ble.NewAddr(mac))
+		if err != nil {
+			continue
+		}
+		if err := gc.write(key, &entry{Version: schemaVersion, Stored: now, Profile: p}); err != nil {
+			return err
+		}
+	}
+	return os.Remove(legacy)
 }
 
-func (gc *gattCache) storeCache(cache map[string]ble.Profile) error {
-	out, err := jsoniter.Marshal(cache)
+// load returns the entry key, from memory if it's there, or its file.
+func (gc *gattCache) load(key string) (*entry, error) {
+	if _, ok := gc.used[key]; !ok {
+		return nil, os.ErrNotExist
+	}
+
+	var e *entry
+	if el, ok := gc.frontIdx[key]; ok {
+		e = el.Value.(*frontEntry).e
+	} else {
+		in, err := ioutil.ReadFile(gc.path(key))
+		if err != nil {
+			delete(gc.used, key)
+			return nil, err
+		}
+		e = &entry{}
+		if err := json.Unmarshal(in, e); err != nil || e.Version != schemaVersion {
+			gc.remove(key)
+			return nil, fmt.Errorf("entry version %d, want %d: %v", e.Version, schemaVersion, err)
+		}
+	}
+
+	if gc.opts.TTL > 0 && time.Since(e.Stored) > gc.opts.TTL {
+		gc.remove(key)
+		return nil, fmt.Errorf("entry expired")
+	}
+	gc.used[key] = time.Now()
+	gc.remember(key, e)
+	return e, nil
+}
+
+// store writes the entry key, and keeps it in memory.
+func (gc *gattCache) store(key string, e *entry) error {
+	if err := gc.write(key, e); err != nil {
+		return err
+	}
+	gc.used[key] = time.Now()
+	gc.remember(key, e)
+	return nil
+}
+
+// write replaces the file of the entry key atomically.
+func (gc *gattCache) write(key string, e *entry) error {
+	out, err := json.Marshal(e)
 	if err != nil {
 		return err
 	}
+	return atomicfile.WriteFile(gc.path(key), out, 0644)
+}
+
+// remove removes the entry key.
+func (gc *gattCache) remove(key string) {
+	delete(gc.used, key)
+	if el, ok := gc.frontIdx[key]; ok {
+		gc.front.Remove(el)
+		delete(gc.frontIdx, key)
+	}
+	os.Remove(gc.path(key))
+}
 
-	return ioutil.WriteFile(gc.filename, out, 0644)
+// remember keeps the entry key in memory, dropping the least recently used ones.
+func (gc *gattCache) remember(key string, e *entry) {
+	if gc.opts.MemEntries < 0 {
+		return
+	}
+	if el, ok := gc.frontIdx[key]; ok {
+		el.Value.(*frontEntry).e = e
+		gc.front.MoveToFront(el)
+		return
+	}
+	gc.frontIdx[key] = gc.front.PushFront(&frontEntry{key: key, e: e})
+	for gc.front.Len() > gc.opts.MemEntries {
+		el := gc.front.Back()
+		gc.front.Remove(el)
+		delete(gc.frontIdx, el.Value.(*frontEntry).key)
+	}
+}
+
+// evict removes the least recently used entries beyond MaxEntries.
+func (gc *gattCache) evict() {
+	for gc.opts.MaxEntries > 0 && len(gc.used) > gc.opts.MaxEntries {
+		var lru string
+		for key, t := range gc.used {
+			if lru == "" || t.Before(gc.used[lru]) {
+				lru = key
+			}
+		}
+		gc.remove(lru)
+	}
 }
@@ -1,14 +1,19 @@
 package cache
 
 import (
-	"github.com/rigado/ble"
+	"encoding/json"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/rigado/ble"
 )
 
 func TestGattCache_Store(t *testing.T) {
-	defer os.Remove("./test.cache")
+	defer os.RemoveAll("./test.cache")
 	p := ble.Profile{}
 
 	svc := ble.NewService(ble.MustParse("180d"))
@@ -30,3 +35,123 @@ func TestGattCache_Store(t *testing.T) {
 		t.Fatalf("stored and loaded caches are not equal")
 	}
 }
+
+func testProfile() ble.Profile {
+	p := ble.Profile{}
+	svc := ble.NewService(ble.MustParse("180d"))
+	svc.NewCharacteristic(ble.MustParse("2f37"))
+	p.Services = append(p.Services, svc)
+	return p
+}
+
+func TestGattCache_Migrate(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "gatt.cache")
+	p := testProfile()
+
+	out, err := json.Marshal(map[string]ble.Profile{"12:34:56:78:90:ab": p})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(file, out, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	loaded, err := New(file).Load(ble.NewAddr("12:34:56:78:90:ab"))
+	if err != nil {
+		t.Fatalf("expected to find migrated mac in cache but did not: %s", err)
+	}
+	if !reflect.DeepEqual(p, loaded) {
+		t.Fatalf("stored and migrated caches are not equal")
+	}
+	if fi, err := os.Stat(file); err != nil || !fi.IsDir() {
+		t.Fatalf("cache not migrated to a directory: %v", err)
+	}
+
+	// The entries outlive the in-memory cache.
+	c := NewWithOptions(file, Options{MemEntries: -1})
+	if _, err := c.Load(ble.NewAddr("12:34:56:78:90:ab")); err != nil {
+		t.Fatalf("expected to find mac in reopened cache but did not: %s", err)
+	}
+}
+
+func TestGattCache_TTL(t *testing.T) {
+	c := NewWithOptions(t.TempDir(), Options{TTL: 50 * time.Millisecond})
+	addr := ble.NewAddr("12:34:56:78:90:ab")
+	if err := c.Store(addr, testProfile(), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Load(addr); err != nil {
+		t.Fatalf("expected to find mac in cache but did not: %s", err)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	if _, err := c.Load(addr); err == nil {
+		t.Fatal("expected expired mac not to be found")
+	}
+}
+
+func TestGattCache_Evict(t *testing.T) {
+	c := NewWithOptions(t.TempDir(), Options{MaxEntries: 2})
+	a, b, d := ble.NewAddr("00:00:00:00:00:0a"), ble.NewAddr("00:00:00:00:00:0b"), ble.NewAddr("00:00:00:00:00:0d")
+	for _, addr := range []ble.Addr{a, b} {
+		if err := c.Store(addr, testProfile(), false); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// b is the least recently used once a is loaded.
+	if _, err := c.Load(a); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Store(d, testProfile(), false); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.Load(b); err == nil {
+		t.Fatal("expected least recently used mac to be evicted")
+	}
+	for _, addr := range []ble.Addr{a, d} {
+		if _, err := c.Load(addr); err != nil {
+			t.Fatalf("expected to find %s in cache but did not: %s", addr, err)
+		}
+	}
+}
+
+func TestGattCache_Clear(t *testing.T) {
+	dir := t.TempDir()
+	others := []string{filepath.Join(dir, "notes.txt"), filepath.Join(dir, ".hidden")}
+	for _, other := range others {
+		if err := ioutil.WriteFile(other, []byte("not an entry"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	c := New(dir)
+	addr := ble.NewAddr("12:34:56:78:90:ab")
+	if err := c.Store(addr, testProfile(), false); err != nil {
+		t.Fatal(err)
+	}
+	// The temporary file of an interrupted write.
+	temp := filepath.Join(dir, ".1234567890ab.json-123456")
+	if err := ioutil.WriteFile(temp, []byte("{"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Clear(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.Load(addr); err == nil {
+		t.Fatal("profile loaded after clear")
+	}
+	for _, other := range others {
+		if _, err := os.Stat(other); err != nil {
+			t.Fatalf("file of the directory removed: %v", err)
+		}
+	}
+	if _, err := os.Stat(temp); !os.IsNotExist(err) {
+		t.Fatalf("temporary file not removed: %v", err)
+	}
+	if err := c.Store(addr, testProfile(), false); err != nil {
+		t.Fatalf("store after clear: %v", err)
+	}
+}
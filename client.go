@@ -2,6 +2,9 @@ package ble
 
 import "time"
 
+// AutoConnectHandler handles the clients of the devices connected by Device.AutoConnect.
+type AutoConnectHandler func(c Client)
+
 // A Client is a GATT client.
 type Client interface {
 	// Addr returns platform specific unique ID of the remote peripheral, e.g. MAC on Linux, Client UUID on OS X.
@@ -43,6 +46,9 @@ type Client interface {
 	// ReadLongCharacteristic reads a characteristic value which is longer than the MTU. [Vol 3, Part G, 4.8.3]
 	ReadLongCharacteristic(c *Characteristic) ([]byte, error)
 
+	// ReadMultipleCharacteristics reads the values of several characteristics from a server. [Vol 3, Part G, 4.8.5]
+	ReadMultipleCharacteristics(cs []*Characteristic) ([][]byte, error)
+
 	// WriteCharacteristic writes a characteristic value to a server. [Vol 3, Part G, 4.9.3]
 	WriteCharacteristic(c *Characteristic, value []byte, noRsp bool) error
 
@@ -58,6 +64,17 @@ type Client interface {
 	// ExchangeMTU set the ATT_MTU to the maximum possible value that can be supported by both devices [Vol 3, Part G, 4.3.1]
 	ExchangeMTU(rxMTU int) (txMTU int, err error)
 
+	// SetDataLength requests the maximum payload size and transmission time of the link layer data PDUs
+	// sent to the remote peripheral. The negotiated values are available with Conn().DataLength(). [Vol 2, Part E, 7.8.33]
+	SetDataLength(txOctets, txTime uint16) error
+
+	// SetPHY requests the PHYs used with the remote peripheral, as bitmasks of PHYMask1M, PHYMask2M
+	// and PHYMaskCoded; 0 means no preference. opts selects the coding on the LE Coded PHY. [Vol 2, Part E, 7.8.49]
+	SetPHY(tx, rx uint8, opts uint16) error
+
+	// PHY returns the PHYs used to transmit to, and receive from, the remote peripheral. [Vol 2, Part E, 7.8.47]
+	PHY() (tx, rx uint8, err error)
+
 	// Subscribe subscribes to indication (if ind is set true), or notification of a characteristic value. [Vol 3, Part G, 4.10 & 4.11]
 	Subscribe(c *Characteristic, ind bool, h NotificationHandler) error
 
@@ -3,6 +3,7 @@ package ble
 import (
 	"context"
 	"io"
+	"net"
 	"time"
 )
 
@@ -28,6 +29,13 @@ type Conn interface {
 	// RemoteAddr returns remote device's address.
 	RemoteAddr() Addr
 
+	// IdentityAddr returns the identity address of a bonded remote device using a
+	// resolvable private address, or nil if the address could not be resolved.
+	IdentityAddr() Addr
+
+	// Bonded reports whether the local device stores a bond with the remote device.
+	Bonded() bool
+
 	// ReadRSSI returns the remote device's RSSI.
 	ReadRSSI() (int8, error)
 
@@ -43,6 +51,31 @@ type Conn interface {
 	// SetTxMTU sets the ATT_MTU which the remote device is capable of accepting.
 	SetTxMTU(mtu int)
 
+	// SetDataLength requests the maximum payload size and transmission time of the
+	// link layer data PDUs the local device sends. [Vol 2, Part E, 7.8.33]
+	SetDataLength(txOctets, txTime uint16) error
+
+	// DataLength returns the data length in use on the connection.
+	DataLength() DataLength
+
+	// SetPHY requests the PHYs the connection transmits and receives on, as bitmasks of
+	// PHYMask1M, PHYMask2M and PHYMaskCoded; 0 means no preference. It returns once the
+	// controller completed the PHY update procedure. [Vol 2, Part E, 7.8.49]
+	SetPHY(tx, rx uint8, opts uint16) error
+
+	// PHY returns the PHYs the connection transmits and receives on, e.g. PHY2M.
+	PHY() (tx, rx uint8, err error)
+
+	// SetPHYHandler sets the handler called whenever the PHYs of the connection change.
+	SetPHYHandler(h PHYHandler)
+
+	// ConnParams returns the parameters currently used by the connection.
+	ConnParams() ConnParams
+
+	// RequestConnectionParameters asks the central, as a peripheral, to change the connection
+	// parameters. It returns once the central applied new parameters, or ErrConnParamsRejected.
+	RequestConnectionParameters(ctx context.Context, min, max, latency, timeout uint16) error
+
 	// Disconnected returns a receiving channel, which is closed when the connection disconnects.
 	Disconnected() <-chan struct{}
 
@@ -51,18 +84,127 @@ type Conn interface {
 	StartEncryption(change chan EncryptionChangedInfo) error
 
 	OpenLECreditBasedConnection(psm uint16) (LECreditBasedConnection, error)
+
+	// OpenEnhancedCreditBasedConnections opens n, up to 5, channels in the Enhanced Credit Based
+	// Flow Control Mode on the SPSM psm, with the local MTU, MPS and initial credits of opts.
+	// The remote device may open only some of them; an error is returned if it opened none.
+	OpenEnhancedCreditBasedConnections(psm uint16, n int, opts L2CAPOptions) ([]LECreditBasedConnection, error)
+
+	// ReconfigureCreditBasedConnections changes the local MTU and MPS of channels opened in the
+	// Enhanced Credit Based Flow Control Mode. The MTU can't be reduced, nor the MPS of several channels.
+	ReconfigureCreditBasedConnections(chs []LECreditBasedConnection, mtu, mps uint16) error
+
+	// DisconnectCreditBasedConnections closes the channels chs, and disconnects them from the remote device.
+	DisconnectCreditBasedConnections(chs []LECreditBasedConnection) error
 	ConnectionHandle() uint8
 }
 
+// ConnParams holds the parameters of a connection. Interval is in units of
+// 1.25 ms, and Timeout, the supervision timeout, in units of 10 ms. [Vol 6, Part B, 4.5.1]
+type ConnParams struct {
+	Interval, Latency, Timeout uint16
+}
+
+// ConnParamsRequest holds the range of connection parameters requested by a remote
+// device, or the ones proposed in reply. [Vol 2, Part E, 7.7.65.6]
+type ConnParamsRequest struct {
+	IntervalMin, IntervalMax uint16
+	Latency, Timeout         uint16
+}
+
+// ConnParamsPolicy decides on the connection parameter requests of remote devices.
+// It returns the parameters to accept, which may differ from req to counter-propose,
+// or false to reject the request. Counter-proposals only apply to the Connection
+// Parameters Request Link Layer procedure; an L2CAP Connection Parameter Update
+// Request is rejected instead.
+type ConnParamsPolicy func(c Conn, req ConnParamsRequest) (ConnParamsRequest, bool)
+
+// PHYHandler handles the PHY changes of a connection.
+type PHYHandler func(tx, rx uint8)
+
+// DataLength holds the maximum payload sizes and transmission times of the link
+// layer data PDUs of a connection. [Vol 6, Part B, 4.5.10]
+type DataLength struct {
+	MaxTxOctets, MaxTxTime uint16
+	MaxRxOctets, MaxRxTime uint16
+}
+
+// DefaultDataLength is the data length of a connection before it's changed.
+var DefaultDataLength = DataLength{
+	MaxTxOctets: 27, MaxTxTime: 328,
+	MaxRxOctets: 27, MaxRxTime: 328,
+}
+
 type LECreditBasedConnection interface {
 	Send(bb []byte) error
 	Subscribe() (<-chan []byte, error)
 	Unsubscribe() error
 	Close() error
 	Info() LECreditBasedConnectionInfo
+
+	// NetConn returns the channel as a net.Conn, which segments the data written into
+	// SDUs, blocks writes until the remote device gives credits, and gives credits back
+	// as the data is read. The channel can't be subscribed to afterwards.
+	NetConn() (net.Conn, error)
+
+	// Conn returns the connection the channel is opened on.
+	Conn() Conn
 }
 
 type LECreditBasedConnectionInfo struct {
 	LocalCID, RemoteCID uint16
 	MTU, MPS            uint16
 }
+
+// PSMEATT is the LE PSM of the Enhanced ATT bearers. [Vol 3, Part F, 3.2.11]
+const PSMEATT = 0x0027
+
+// L2CAPSecurity is the security a remote device needs to open an LE credit based channel.
+type L2CAPSecurity int
+
+// Security requirements of the channels accepted by an L2CAPListener.
+const (
+	L2CAPSecurityNone           L2CAPSecurity = iota // No security required.
+	L2CAPSecurityEncryption                          // The link must be encrypted.
+	L2CAPSecurityAuthentication                      // The link must be encrypted with a key generated with MITM protection.
+)
+
+// L2CAPOptions are the parameters of the LE credit based channels accepted by an L2CAPListener.
+// Zero values are replaced by defaults.
+type L2CAPOptions struct {
+	// MTU is the largest SDU the local device accepts, at least 23.
+	MTU uint16
+
+	// MPS is the largest PDU payload the local device accepts, 23 to 65533.
+	MPS uint16
+
+	// InitialCredits is the number of PDUs the remote device may send right after opening the channel.
+	InitialCredits uint16
+
+	// Security is the security the link needs to open a channel.
+	Security L2CAPSecurity
+
+	// MinKeySize is the smallest size, 7 to 16 octets, of the key the link needs to
+	// be encrypted with to open a channel. 0 doesn't check the key size.
+	MinKeySize uint8
+
+	// Authorize, if not nil, is called before a channel is opened, which is refused
+	// if it returns false. It's called on the event loop, and mustn't block.
+	Authorize func(c Conn) bool
+
+	// Backlog is the number of opened channels waiting to be accepted.
+	// Further channels are refused until Accept is called.
+	Backlog int
+}
+
+// L2CAPListener accepts the LE credit based channels opened by remote devices on an LE PSM.
+type L2CAPListener interface {
+	// Accept waits for and returns the next channel opened on the PSM.
+	Accept() (LECreditBasedConnection, error)
+
+	// Close stops listening. Channels that were accepted stay open.
+	Close() error
+
+	// PSM returns the LE PSM the listener accepts channels on.
+	PSM() uint16
+}
@@ -7,6 +7,27 @@ const DefaultMTU = 23
 // The maximum length of an attribute value shall be 512 octets [Vol 3, Part F, 3.2.9]
 const MaxMTU = 512 + 3
 
+// LE PHYs [Vol 2, Part E, 7.7.65.13]
+const (
+	PHY1M    = 0x01
+	PHY2M    = 0x02
+	PHYCoded = 0x03
+)
+
+// LE PHY preferences of LE Set PHY and LE Set Default PHY [Vol 2, Part E, 7.8.49]
+const (
+	PHYMask1M    = 1 << 0
+	PHYMask2M    = 1 << 1
+	PHYMaskCoded = 1 << 2
+)
+
+// Coding preferences of LE Set PHY, when transmitting on the LE Coded PHY [Vol 2, Part E, 7.8.49]
+const (
+	CodedPHYNoPreference = 0x00
+	CodedPHYS2           = 0x01
+	CodedPHYS8           = 0x02
+)
+
 // UUIDs ...
 var (
 	GAPUUID         = UUID16(0x1800) // Generic Access
@@ -31,6 +52,8 @@ var (
 	PeferredParamsUUID           = UUID16(0x2A04)
 	CentralAddressResolutionUUID = UUID16(0x2AA6)
 	ServiceChangedUUID           = UUID16(0x2A05)
+	ClientSupportedFeaturesUUID  = UUID16(0x2B29)
+	DatabaseHashUUID             = UUID16(0x2B2A)
 	SystemIDUUID                 = UUID16(0x2A23)
 	ModelNumberUUID              = UUID16(0x2A24)
 	SerialNumberUUID             = UUID16(0x2A25)
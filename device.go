@@ -9,6 +9,9 @@ type Device interface {
 	// AddService adds a service to database.
 	AddService(svc *Service) error
 
+	// RemoveService removes a service from database.
+	RemoveService(svc *Service) error
+
 	// RemoveAllServices removes all services that are currently in the database.
 	RemoveAllServices() error
 
@@ -44,6 +47,13 @@ type Device interface {
 
 	StopAdvertising() error
 
+	// StartAdvertisingSet configures and enables an extended advertising set.
+	// Several sets, identified by their handle, can be advertised at once.
+	StartAdvertisingSet(set AdvertisingSet) error
+
+	// StopAdvertisingSet disables and removes the advertising set with the given handle.
+	StopAdvertisingSet(handle uint8) error
+
 	// Scan starts scanning. Duplicated advertisements will be filtered out if allowDup is set to false, async handling
 	Scan(ctx context.Context, allowDup bool, h AdvHandler) error
 
@@ -53,9 +63,41 @@ type Device interface {
 	// StopScan stops scanning. Used in conjunction with nonblocking scan
 	StopScan() error
 
+	// SyncPeriodic synchronizes to the periodic advertising of advertising set sid of a device,
+	// and passes the periodic advertisements to h until ctx is done.
+	// The device must be scanning while the sync is created.
+	// It returns ErrSyncLost if the synchronization is lost.
+	SyncPeriodic(ctx context.Context, a Addr, sid uint8, h PeriodicAdvHandler) error
+
 	// Dial ...
 	Dial(ctx context.Context, a Addr) (Client, error)
 
+	// AddToAcceptList adds a device to the filter accept list.
+	// Bonded devices using resolvable private addresses are added by their identity address.
+	AddToAcceptList(a Addr) error
+
+	// RemoveFromAcceptList removes a device from the filter accept list.
+	RemoveFromAcceptList(a Addr) error
+
+	// ClearAcceptList removes all devices from the filter accept list.
+	ClearAcceptList() error
+
+	// AcceptListSize returns the number of devices the filter accept list can hold.
+	AcceptListSize() (int, error)
+
+	// ScanAcceptList scans like Scan, but reports the devices on the filter accept list only.
+	ScanAcceptList(ctx context.Context, allowDup bool, h AdvHandler) error
+
+	// DialAcceptList connects to the first device on the filter accept list that is available.
+	DialAcceptList(ctx context.Context) (Client, error)
+
+	// AutoConnect keeps a connection pending to the devices addrs, and passes each connected device to h,
+	// after starting encryption if it's bonded. Disconnected devices are connected again. It blocks until ctx is done.
+	AutoConnect(ctx context.Context, addrs []Addr, h AutoConnectHandler) error
+
+	// ListenL2CAP accepts the LE credit based channels remote devices open on the LE PSM psm.
+	ListenL2CAP(psm uint16, opts L2CAPOptions) (L2CAPListener, error)
+
 	// Address ...
 	Address() Addr
 
@@ -12,6 +12,12 @@ var ErrEIRPacketTooLong = errors.New("max packet length is 31")
 // ErrNotImplemented means the functionality is not implemented.
 var ErrNotImplemented = errors.New("not implemented")
 
+// ErrSyncLost means the synchronization to a periodic advertising train was lost.
+var ErrSyncLost = errors.New("periodic advertising sync lost")
+
+// ErrConnParamsRejected means the remote device rejected the requested connection parameters.
+var ErrConnParamsRejected = errors.New("connection parameters rejected")
+
 // ErrEncryptionAlreadyEnabled means that encryption is enabled and shouldn't be enabled again
 var ErrEncryptionAlreadyEnabled = errors.New("encryption already enabled")
 
@@ -38,13 +44,15 @@ const (
 	ErrInsuffEnc         ATTError = 0x0f // ErrInsuffEnc means the attribute requires encryption before it can be read or written.
 	ErrUnsuppGrpType     ATTError = 0x10 // ErrUnsuppGrpType means the attribute type is not a supported grouping attribute as defined by a higher layer specification.
 	ErrInsuffResources   ATTError = 0x11 // ErrInsuffResources means insufficient resources to complete the request.
+	ErrDBOutOfSync       ATTError = 0x12 // ErrDBOutOfSync means the server requests the client to rediscover the database.
+	ErrValueNotAllowed   ATTError = 0x13 // ErrValueNotAllowed means the attribute parameter value was not allowed.
 )
 
 func (e ATTError) Error() string {
 	switch i := int(e); {
-	case i < 0x11:
+	case i <= 0x13:
 		return errName[e]
-	case i >= 0x12 && i <= 0x7F: // Reserved for future use.
+	case i >= 0x14 && i <= 0x7F: // Reserved for future use.
 		return fmt.Sprintf("reserved error code (0x%02X)", i)
 	case i >= 0x80 && i <= 0x9F: // Application error, defined by higher level.
 		return fmt.Sprintf("application error code (0x%02X)", i)
@@ -75,4 +83,6 @@ var errName = map[ATTError]string{
 	ErrInsuffEnc:         "insufficient encryption",
 	ErrUnsuppGrpType:     "unsupported group type",
 	ErrInsuffResources:   "insufficient resources",
+	ErrDBOutOfSync:       "database out of sync",
+	ErrValueNotAllowed:   "value not allowed",
 }
@@ -27,6 +27,14 @@ func AddService(svc *Service) error {
 	return defaultDevice.AddService(svc)
 }
 
+// RemoveService removes a service from database.
+func RemoveService(svc *Service) error {
+	if defaultDevice == nil {
+		return ErrDefaultDevice
+	}
+	return defaultDevice.RemoveService(svc)
+}
+
 // RemoveAllServices removes all services that are currently in the database.
 func RemoveAllServices() error {
 	if defaultDevice == nil {
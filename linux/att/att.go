@@ -2,8 +2,9 @@ package att
 
 import (
 	"errors"
-)
 
+	"github.com/rigado/ble"
+)
 
 var (
 	// ErrInvalidArgument means one or more of the arguments are invalid.
@@ -15,19 +16,55 @@ var (
 	// ErrSeqProtoTimeout means the request hasn't been acknowledged in 30 seconds.
 	// [Vol 3, Part F, 3.3.3]
 	ErrSeqProtoTimeout = errors.New("req timeout")
+
+	// ErrNotConfigured means the client didn't configure the indications sent.
+	ErrNotConfigured = errors.New("indications not configured")
 )
 
 var rspOfReq = map[byte]byte{
-	ExchangeMTURequestCode:     ExchangeMTUResponseCode,
-	FindInformationRequestCode: FindInformationResponseCode,
-	FindByTypeValueRequestCode: FindByTypeValueResponseCode,
-	ReadByTypeRequestCode:      ReadByTypeResponseCode,
-	ReadRequestCode:            ReadResponseCode,
-	ReadBlobRequestCode:        ReadBlobResponseCode,
-	ReadMultipleRequestCode:    ReadMultipleResponseCode,
-	ReadByGroupTypeRequestCode: ReadByGroupTypeResponseCode,
-	WriteRequestCode:           WriteResponseCode,
-	PrepareWriteRequestCode:    PrepareWriteResponseCode,
-	ExecuteWriteRequestCode:    ExecuteWriteResponseCode,
-	HandleValueIndicationCode:  HandleValueConfirmationCode,
+	ExchangeMTURequestCode:          ExchangeMTUResponseCode,
+	FindInformationRequestCode:      FindInformationResponseCode,
+	FindByTypeValueRequestCode:      FindByTypeValueResponseCode,
+	ReadByTypeRequestCode:           ReadByTypeResponseCode,
+	ReadRequestCode:                 ReadResponseCode,
+	ReadBlobRequestCode:             ReadBlobResponseCode,
+	ReadMultipleRequestCode:         ReadMultipleResponseCode,
+	ReadByGroupTypeRequestCode:      ReadByGroupTypeResponseCode,
+	ReadMultipleVariableRequestCode: ReadMultipleVariableResponseCode,
+	WriteRequestCode:                WriteResponseCode,
+	PrepareWriteRequestCode:         PrepareWriteResponseCode,
+	ExecuteWriteRequestCode:         ExecuteWriteResponseCode,
+	HandleValueIndicationCode:       HandleValueConfirmationCode,
+}
+
+// BearerMTU returns the ATT_MTU of an enhanced ATT bearer opened on the channel
+// of info, the MTU of the channel capped at ble.MaxMTU. [Vol 3, Part F, 3.4.2]
+func BearerMTU(info ble.LECreditBasedConnectionInfo) int {
+	if int(info.MTU) > ble.MaxMTU {
+		return ble.MaxMTU
+	}
+	return int(info.MTU)
+}
+
+// Signer is implemented by connections that can sign attribute protocol PDUs
+// with the signing keys distributed during pairing. [Vol 3, Part H, 2.4.5]
+type Signer interface {
+	// Encrypted reports whether the link is encrypted, in which case signed
+	// writes are not used. [Vol 3, Part C, 10.4.2]
+	Encrypted() bool
+
+	// Sign returns the 12 byte authentication signature of data.
+	Sign(data []byte) ([]byte, error)
+
+	// VerifySignature checks the authentication signature of data.
+	VerifySignature(data, signature []byte) error
 }
+
+// signedData returns the opcode, handle and value covered by the signature.
+func (r SignedWriteCommand) signedData() []byte { return r[:len(r)-12] }
+
+// value returns the attribute value, which is followed by the signature.
+func (r SignedWriteCommand) value() []byte { return r[3 : len(r)-12] }
+
+// signature returns the authentication signature at the end of the command.
+func (r SignedWriteCommand) signature() []byte { return r[len(r)-12:] }
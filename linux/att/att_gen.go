@@ -392,6 +392,42 @@ func (r ReadByGroupTypeResponse) AttributeDataList() []byte { return r[2:] }
 // SetAttributeDataList ...
 func (r ReadByGroupTypeResponse) SetAttributeDataList(v []byte) { copy(r[2:], v) }
 
+// ReadMultipleVariableRequestCode ...
+const ReadMultipleVariableRequestCode = 0x20
+
+// ReadMultipleVariableRequest implements Read Multiple Variable Request (0x20) [Vol 3, Part F, 3.4.4.11].
+type ReadMultipleVariableRequest []byte
+
+// AttributeOpcode ...
+func (r ReadMultipleVariableRequest) AttributeOpcode() uint8 { return r[0] }
+
+// SetAttributeOpcode ...
+func (r ReadMultipleVariableRequest) SetAttributeOpcode() { r[0] = 0x20 }
+
+// SetOfHandles ...
+func (r ReadMultipleVariableRequest) SetOfHandles() []byte { return r[1:] }
+
+// SetSetOfHandles ...
+func (r ReadMultipleVariableRequest) SetSetOfHandles(v []byte) { copy(r[1:], v) }
+
+// ReadMultipleVariableResponseCode ...
+const ReadMultipleVariableResponseCode = 0x21
+
+// ReadMultipleVariableResponse implements Read Multiple Variable Response (0x21) [Vol 3, Part F, 3.4.4.12].
+type ReadMultipleVariableResponse []byte
+
+// AttributeOpcode ...
+func (r ReadMultipleVariableResponse) AttributeOpcode() uint8 { return r[0] }
+
+// SetAttributeOpcode ...
+func (r ReadMultipleVariableResponse) SetAttributeOpcode() { r[0] = 0x21 }
+
+// LengthValueTupleList ...
+func (r ReadMultipleVariableResponse) LengthValueTupleList() []byte { return r[1:] }
+
+// SetLengthValueTupleList ...
+func (r ReadMultipleVariableResponse) SetLengthValueTupleList(v []byte) { copy(r[1:], v) }
+
 // WriteRequestCode ...
 const WriteRequestCode = 0x12
 
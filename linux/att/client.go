@@ -6,6 +6,7 @@ import (
 
 	"fmt"
 	"io"
+	"sync"
 	"time"
 
 	"github.com/rigado/ble"
@@ -18,13 +19,15 @@ type NotificationHandler interface {
 
 // Client implementation an Attribute Protocol Client.
 type Client struct {
-	l2c  ble.Conn
-	rspc chan []byte
-	inc  chan []byte
+	l2c ble.Conn
+
+	// The requests are spread over the bearers, the unenhanced one first.
+	// A bearer has one transaction at a time. [Vol 3, Part F, 3.3.2]
+	att     *bearer
+	mu      sync.Mutex
+	cond    *sync.Cond
+	bearers []*bearer
 
-	rxBuf      []byte
-	chTxBuf    chan []byte
-	chErr      chan error
 	handler    NotificationHandler
 	done       chan bool
 	connClosed chan struct{}
@@ -33,21 +36,47 @@ type Client struct {
 	ble.Logger
 }
 
+// bearer is an ATT bearer, the unenhanced one over the ATT fixed channel, or an
+// enhanced one over an LE credit based channel. [Vol 3, Part F, 3.2.11]
+type bearer struct {
+	rw       io.ReadWriter
+	txMTU    func() int
+	enhanced bool
+
+	rspc  chan []byte
+	inc   chan []byte
+	chErr chan error
+	rxBuf []byte
+	txBuf []byte
+
+	busy bool // A transaction is in progress, guarded by Client.mu.
+}
+
+func newBearer(rw io.ReadWriter, txMTU func() int, enhanced bool) *bearer {
+	return &bearer{
+		rw:       rw,
+		txMTU:    txMTU,
+		enhanced: enhanced,
+		rspc:     make(chan []byte),
+		inc:      make(chan []byte, 10),
+		chErr:    make(chan error, 1),
+		rxBuf:    make([]byte, ble.MaxMTU),
+		txBuf:    make([]byte, txMTU()),
+	}
+}
+
 // NewClient returns an Attribute Protocol Client.
 func NewClient(l2c ble.Conn, h NotificationHandler, done chan bool, l ble.Logger) *Client {
 	c := &Client{
 		l2c:        l2c,
-		rspc:       make(chan []byte),
-		inc:        make(chan []byte, 10),
-		chTxBuf:    make(chan []byte, 1),
-		rxBuf:      make([]byte, ble.MaxMTU),
-		chErr:      make(chan error, 1),
+		att:        newBearer(l2c, l2c.TxMTU, false),
 		handler:    h,
 		done:       done,
 		connClosed: make(chan struct{}),
 		Logger:     l,
 	}
-	c.chTxBuf <- make([]byte, l2c.TxMTU())
+	c.cond = sync.NewCond(&c.mu)
+	c.bearers = []*bearer{c.att}
 
 	go func() {
 		<-l2c.Disconnected()
@@ -67,6 +96,72 @@ func (c *Client) WithServer(db *DB) *Client {
 	return c
 }
 
+// AddBearer adds an enhanced ATT bearer, an LE credit based channel opened on
+// PSM 0x0027 whose ATT_MTU is mtu. The bearer is removed once rw is closed.
+// [Vol 3, Part F, 3.2.11]
+func (c *Client) AddBearer(rw io.ReadWriter, mtu int) error {
+	if mtu < ble.DefaultMTU || mtu > ble.MaxMTU {
+		return ErrInvalidArgument
+	}
+	b := newBearer(rw, func() int { return mtu }, true)
+
+	c.mu.Lock()
+	c.bearers = append(c.bearers, b)
+	c.mu.Unlock()
+	c.cond.Broadcast()
+
+	go c.loop(b)
+	return nil
+}
+
+func (c *Client) removeBearer(b *bearer) {
+	c.mu.Lock()
+	for i, bb := range c.bearers {
+		if bb == b {
+			c.bearers = append(c.bearers[:i], c.bearers[i+1:]...)
+			break
+		}
+	}
+	c.mu.Unlock()
+	c.cond.Broadcast()
+}
+
+// acquire waits for a bearer without a transaction in progress, whose ATT_MTU fits
+// a PDU of n bytes. If only isn't nil, it's the only bearer used.
+func (c *Client) acquire(n int, only *bearer) (*bearer, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for {
+		fits := false
+		for _, b := range c.bearers {
+			if (only != nil && b != only) || b.txMTU() < n {
+				continue
+			}
+			fits = true
+			if b.busy {
+				continue
+			}
+			b.busy = true
+			// The ATT_MTU of the unenhanced bearer changes if it's exchanged.
+			if mtu := b.txMTU(); len(b.txBuf) != mtu {
+				b.txBuf = make([]byte, mtu)
+			}
+			return b, nil
+		}
+		if !fits {
+			return nil, ErrInvalidArgument
+		}
+		c.cond.Wait()
+	}
+}
+
+func (c *Client) release(b *bearer) {
+	c.mu.Lock()
+	b.busy = false
+	c.mu.Unlock()
+	c.cond.Broadcast()
+}
+
 // ExchangeMTU informs the server of the client’s maximum receive MTU size and
 // request the server to respond with its maximum receive MTU size. [Vol 3, Part F, 3.4.2.1]
 func (c *Client) ExchangeMTU(clientRxMTU int) (serverRxMTU int, err error) {
@@ -74,20 +169,21 @@ func (c *Client) ExchangeMTU(clientRxMTU int) (serverRxMTU int, err error) {
 		return 0, ErrInvalidArgument
 	}
 
-	// Acquire and reuse the txBuf, and release it after usage.
-	// The same txBuf, or a newly allocate one, if the txMTU is changed,
-	// will be released back to the channel.
-	txBuf := <-c.chTxBuf
-	defer func() { c.chTxBuf <- txBuf }()
+	// The ATT_MTU of enhanced bearers isn't exchanged. [Vol 3, Part F, 3.4.2]
+	bb, err := c.acquire(3, c.att)
+	if err != nil {
+		return 0, err
+	}
+	defer c.release(bb)
 
 	// Let L2CAP know the MTU we can handle.
 	c.l2c.SetRxMTU(clientRxMTU)
 
-	req := ExchangeMTURequest(txBuf[:3])
+	req := ExchangeMTURequest(bb.txBuf[:3])
 	req.SetAttributeOpcode()
 	req.SetClientRxMTU(uint16(clientRxMTU))
 
-	b, err := c.sendReq(req)
+	b, err := c.sendReq(bb, req)
 	if err != nil {
 		return 0, err
 	}
@@ -105,14 +201,10 @@ func (c *Client) ExchangeMTU(clientRxMTU int) (serverRxMTU int, err error) {
 		return 0, ErrInvalidResponse
 	}
 
+	// Let L2CAP know the MTU that the remote device can handle.
+	// The txBuf is re-allocated when the bearer is acquired next.
 	txMTU := int(rsp.ServerRxMTU())
-	if len(txBuf) != txMTU {
-		// Let L2CAP know the MTU that the remote device can handle.
-		c.l2c.SetTxMTU(txMTU)
-		// Put a re-allocated txBuf back to the channel.
-		// The txBuf has been captured in deferred function.
-		txBuf = make([]byte, txMTU)
-	}
+	c.l2c.SetTxMTU(txMTU)
 
 	return txMTU, nil
 }
@@ -129,16 +221,19 @@ func (c *Client) FindInformation(starth, endh uint16) (fmt int, data []byte, err
 		return 0x00, nil, ErrInvalidArgument
 	}
 
-	// Acquire and reuse the txBuf, and release it after usage.
-	txBuf := <-c.chTxBuf
-	defer func() { c.chTxBuf <- txBuf }()
+	// Acquire a bearer, and release it after usage.
+	bb, err := c.acquire(5, nil)
+	if err != nil {
+		return 0x00, nil, err
+	}
+	defer c.release(bb)
 
-	req := FindInformationRequest(txBuf[:5])
+	req := FindInformationRequest(bb.txBuf[:5])
 	req.SetAttributeOpcode()
 	req.SetStartingHandle(starth)
 	req.SetEndingHandle(endh)
 
-	b, err := c.sendReq(req)
+	b, err := c.sendReq(bb, req)
 	if err != nil {
 		return 0x00, nil, err
 	}
@@ -183,17 +278,20 @@ func (c *Client) ReadByType(starth, endh uint16, uuid ble.UUID) (int, []byte, er
 		return 0, nil, ErrInvalidArgument
 	}
 
-	// Acquire and reuse the txBuf, and release it after usage.
-	txBuf := <-c.chTxBuf
-	defer func() { c.chTxBuf <- txBuf }()
+	// Acquire a bearer, and release it after usage.
+	bb, err := c.acquire(5+len(uuid), nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer c.release(bb)
 
-	req := ReadByTypeRequest(txBuf[:5+len(uuid)])
+	req := ReadByTypeRequest(bb.txBuf[:5+len(uuid)])
 	req.SetAttributeOpcode()
 	req.SetStartingHandle(starth)
 	req.SetEndingHandle(endh)
 	req.SetAttributeType(uuid)
 
-	b, err := c.sendReq(req)
+	b, err := c.sendReq(bb, req)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -217,15 +315,22 @@ func (c *Client) ReadByType(starth, endh uint16, uuid ble.UUID) (int, []byte, er
 // value in a Read Response. [Vol 3, Part F, 3.4.4.3 & 3.4.4.4]
 func (c *Client) Read(handle uint16) ([]byte, error) {
 
-	// Acquire and reuse the txBuf, and release it after usage.
-	txBuf := <-c.chTxBuf
-	defer func() { c.chTxBuf <- txBuf }()
+	// Acquire a bearer, and release it after usage.
+	bb, err := c.acquire(3, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(bb)
+
+	return c.read(bb, handle)
+}
 
-	req := ReadRequest(txBuf[:3])
+func (c *Client) read(bb *bearer, handle uint16) ([]byte, error) {
+	req := ReadRequest(bb.txBuf[:3])
 	req.SetAttributeOpcode()
 	req.SetAttributeHandle(handle)
 
-	b, err := c.sendReq(req)
+	b, err := c.sendReq(bb, req)
 	if err != nil {
 		return nil, err
 	}
@@ -250,16 +355,23 @@ func (c *Client) Read(handle uint16) ([]byte, error) {
 // [Vol 3, Part F, 3.4.4.5 & 3.4.4.6]
 func (c *Client) ReadBlob(handle, offset uint16) ([]byte, error) {
 
-	// Acquire and reuse the txBuf, and release it after usage.
-	txBuf := <-c.chTxBuf
-	defer func() { c.chTxBuf <- txBuf }()
+	// Acquire a bearer, and release it after usage.
+	bb, err := c.acquire(5, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(bb)
 
-	req := ReadBlobRequest(txBuf[:5])
+	return c.readBlob(bb, handle, offset)
+}
+
+func (c *Client) readBlob(bb *bearer, handle, offset uint16) ([]byte, error) {
+	req := ReadBlobRequest(bb.txBuf[:5])
 	req.SetAttributeOpcode()
 	req.SetAttributeHandle(handle)
 	req.SetValueOffset(offset)
 
-	b, err := c.sendReq(req)
+	b, err := c.sendReq(bb, req)
 	if err != nil {
 		return nil, err
 	}
@@ -279,6 +391,35 @@ func (c *Client) ReadBlob(handle, offset uint16) ([]byte, error) {
 	return rsp.PartAttributeValue(), nil
 }
 
+// ReadLong reads a value longer than ATT_MTU-1 with a Read Request, followed by
+// Read Blob Requests until a response isn't full. All the requests are sent on the
+// same bearer, whose ATT_MTU tells whether a response is full. [Vol 3, Part G, 4.8.3]
+func (c *Client) ReadLong(handle uint16) ([]byte, error) {
+	// Acquire a bearer, and release it after usage.
+	bb, err := c.acquire(5, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(bb)
+
+	// The maximum length of an attribute value shall be 512 octects [Vol 3, 3.2.9]
+	buffer := make([]byte, 0, 512)
+
+	read, err := c.read(bb, handle)
+	if err != nil {
+		return nil, err
+	}
+	buffer = append(buffer, read...)
+
+	for len(read) >= len(bb.txBuf)-1 {
+		if read, err = c.readBlob(bb, handle, uint16(len(buffer))); err != nil {
+			return nil, err
+		}
+		buffer = append(buffer, read...)
+	}
+	return buffer, nil
+}
+
 // ReadMultiple requests the server to read two or more values of a set of
 // attributes and return their values in a Read Multiple Response.
 // Only values that have a known fixed size can be read, with the exception of
@@ -287,15 +428,18 @@ func (c *Client) ReadBlob(handle, offset uint16) ([]byte, error) {
 // [Vol 3, Part F, 3.4.4.7 & 3.4.4.8]
 func (c *Client) ReadMultiple(handles []uint16) ([]byte, error) {
 	// Should request to read two or more values.
-	if len(handles) < 2 || len(handles)*2 > c.l2c.TxMTU()-1 {
+	if len(handles) < 2 {
 		return nil, ErrInvalidArgument
 	}
 
-	// Acquire and reuse the txBuf, and release it after usage.
-	txBuf := <-c.chTxBuf
-	defer func() { c.chTxBuf <- txBuf }()
+	// Acquire a bearer, and release it after usage.
+	bb, err := c.acquire(1+len(handles)*2, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer c.release(bb)
 
-	req := ReadMultipleRequest(txBuf[:1+len(handles)*2])
+	req := ReadMultipleRequest(bb.txBuf[:1+len(handles)*2])
 	req.SetAttributeOpcode()
 	p := req.SetOfHandles()
 	for _, h := range handles {
@@ -303,7 +447,7 @@ func (c *Client) ReadMultiple(handles []uint16) ([]byte, error) {
 		p = p[2:]
 	}
 
-	b, err := c.sendReq(req)
+	b, err := c.sendReq(bb, req)
 	if err != nil {
 		return nil, err
 	}
@@ -323,6 +467,73 @@ func (c *Client) ReadMultiple(handles []uint16) ([]byte, error) {
 	return rsp.SetOfValues(), nil
 }
 
+// ReadMultipleVariable requests the server to read two or more values of a set
+// of attributes that have a variable or unknown value length, and return their
+// values in a Read Multiple Variable Length Response. The values that don't fit
+// in the response are left out, and the last one may be truncated: lengths are
+// the lengths of the values declared by the server, longer than the values
+// received if truncated. [Vol 3, Part F, 3.4.4.11 & 3.4.4.12]
+func (c *Client) ReadMultipleVariable(handles []uint16) (values [][]byte, lengths []int, err error) {
+	// Should request to read two or more values.
+	if len(handles) < 2 {
+		return nil, nil, ErrInvalidArgument
+	}
+
+	// Acquire a bearer, and release it after usage.
+	bb, err := c.acquire(1+len(handles)*2, nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer c.release(bb)
+
+	req := ReadMultipleVariableRequest(bb.txBuf[:1+len(handles)*2])
+	req.SetAttributeOpcode()
+	p := req.SetOfHandles()
+	for _, h := range handles {
+		binary.LittleEndian.PutUint16(p, h)
+		p = p[2:]
+	}
+
+	b, err := c.sendReq(bb, req)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Convert and validate the response.
+	rsp := ReadMultipleVariableResponse(b)
+	switch {
+	case len(rsp) < 1:
+		return nil, nil, ErrInvalidResponse
+	case rsp[0] == ErrorResponseCode && len(rsp) == 5:
+		return nil, nil, ble.ATTError(rsp[4])
+	case rsp[0] == ErrorResponseCode && len(rsp) != 5:
+		fallthrough
+	case rsp[0] != rsp.AttributeOpcode():
+		return nil, nil, ErrInvalidResponse
+	}
+
+	values = make([][]byte, 0, len(handles))
+	lengths = make([]int, 0, len(handles))
+	for p := rsp.LengthValueTupleList(); len(p) > 0; {
+		if len(p) < 2 {
+			return nil, nil, ErrInvalidResponse
+		}
+		n := int(binary.LittleEndian.Uint16(p))
+		p = p[2:]
+		lengths = append(lengths, n)
+		// Only the last value may be truncated to fit in the response.
+		if n > len(p) {
+			n = len(p)
+		}
+		values = append(values, p[:n])
+		p = p[n:]
+	}
+	if len(values) > len(handles) {
+		return nil, nil, ErrInvalidResponse
+	}
+	return values, lengths, nil
+}
+
 // ReadByGroupType obtains the values of attributes where the attribute type is known,
 // the type of a grouping attribute as defined by a higher layer specification, but
 // the handle is not known. [Vol 3, Part F, 3.4.4.9 & 3.4.4.10]
@@ -331,17 +542,20 @@ func (c *Client) ReadByGroupType(starth, endh uint16, uuid ble.UUID) (int, []byt
 		return 0, nil, ErrInvalidArgument
 	}
 
-	// Acquire and reuse the txBuf, and release it after usage.
-	txBuf := <-c.chTxBuf
-	defer func() { c.chTxBuf <- txBuf }()
+	// Acquire a bearer, and release it after usage.
+	bb, err := c.acquire(5+len(uuid), nil)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer c.release(bb)
 
-	req := ReadByGroupTypeRequest(txBuf[:5+len(uuid)])
+	req := ReadByGroupTypeRequest(bb.txBuf[:5+len(uuid)])
 	req.SetAttributeOpcode()
 	req.SetStartingHandle(starth)
 	req.SetEndingHandle(endh)
 	req.SetAttributeGroupType(uuid)
 
-	b, err := c.sendReq(req)
+	b, err := c.sendReq(bb, req)
 	if err != nil {
 		return 0, nil, err
 	}
@@ -367,20 +581,19 @@ func (c *Client) ReadByGroupType(starth, endh uint16, uuid ble.UUID) (int, []byt
 // Write requests the server to write the value of an attribute and acknowledge that
 // this has been achieved in a Write Response. [Vol 3, Part F, 3.4.5.1 & 3.4.5.2]
 func (c *Client) Write(handle uint16, value []byte) error {
-	if len(value) > c.l2c.TxMTU()-3 {
-		return ErrInvalidArgument
+	// Acquire a bearer, and release it after usage.
+	bb, err := c.acquire(3+len(value), nil)
+	if err != nil {
+		return err
 	}
+	defer c.release(bb)
 
-	// Acquire and reuse the txBuf, and release it after usage.
-	txBuf := <-c.chTxBuf
-	defer func() { c.chTxBuf <- txBuf }()
-
-	req := WriteRequest(txBuf[:3+len(value)])
+	req := WriteRequest(bb.txBuf[:3+len(value)])
 	req.SetAttributeOpcode()
 	req.SetAttributeHandle(handle)
 	req.SetAttributeValue(value)
 
-	b, err := c.sendReq(req)
+	b, err := c.sendReq(bb, req)
 	if err != nil {
 		return err
 	}
@@ -401,40 +614,73 @@ func (c *Client) Write(handle uint16, value []byte) error {
 // WriteCommand requests the server to write the value of an attribute, typically
 // into a control-point attribute. [Vol 3, Part F, 3.4.5.3]
 func (c *Client) WriteCommand(handle uint16, value []byte) error {
-	if len(value) > c.l2c.TxMTU()-3 {
-		return ErrInvalidArgument
+	// Acquire a bearer, and release it after usage.
+	bb, err := c.acquire(3+len(value), nil)
+	if err != nil {
+		return err
 	}
+	defer c.release(bb)
 
-	// Acquire and reuse the txBuf, and release it after usage.
-	txBuf := <-c.chTxBuf
-	defer func() { c.chTxBuf <- txBuf }()
-
-	req := WriteCommand(txBuf[:3+len(value)])
+	req := WriteCommand(bb.txBuf[:3+len(value)])
 	req.SetAttributeOpcode()
 	req.SetAttributeHandle(handle)
 	req.SetAttributeValue(value)
 
-	return c.sendCmd(req)
+	return c.sendCmd(bb, req)
 }
 
 // SignedWrite requests the server to write the value of an attribute with an authentication
 // signature, typically into a control-point attribute. [Vol 3, Part F, 3.4.5.4]
 func (c *Client) SignedWrite(handle uint16, value []byte, signature [12]byte) error {
-	if len(value) > c.l2c.TxMTU()-15 {
-		return ErrInvalidArgument
+	return c.signedWrite(handle, value, func(req SignedWriteCommand) error {
+		copy(req.signature(), signature[:])
+		return nil
+	})
+}
+
+// SignAndWrite is like SignedWrite, with the signature generated with the signing
+// key distributed during pairing.
+func (c *Client) SignAndWrite(handle uint16, value []byte) error {
+	s, ok := c.l2c.(Signer)
+	if !ok {
+		return fmt.Errorf("signing not supported")
 	}
+	return c.signedWrite(handle, value, func(req SignedWriteCommand) error {
+		sig, err := s.Sign(req.signedData())
+		if err != nil {
+			return err
+		}
+		copy(req.signature(), sig)
+		return nil
+	})
+}
 
-	// Acquire and reuse the txBuf, and release it after usage.
-	txBuf := <-c.chTxBuf
-	defer func() { c.chTxBuf <- txBuf }()
+// signedWrite sends a Signed Write Command, whose signature is set by sign.
+func (c *Client) signedWrite(handle uint16, value []byte, sign func(req SignedWriteCommand) error) error {
+	// Signed writes are sent on the unenhanced bearer, as enhanced bearers
+	// are encrypted. [Vol 3, Part F, 3.2.11]
+	bb, err := c.acquire(15+len(value), c.att)
+	if err != nil {
+		return err
+	}
+	defer c.release(bb)
 
-	req := SignedWriteCommand(txBuf[:15+len(value)])
+	req := SignedWriteCommand(bb.txBuf[:15+len(value)])
 	req.SetAttributeOpcode()
 	req.SetAttributeHandle(handle)
 	req.SetAttributeValue(value)
-	req.SetAuthenticationSignature(signature)
+	if err := sign(req); err != nil {
+		return err
+	}
 
-	return c.sendCmd(req)
+	return c.sendCmd(bb, req)
+}
+
+// CanSign reports whether signed writes should be used on this connection,
+// which is the case for unencrypted links. [Vol 3, Part C, 10.4.2]
+func (c *Client) CanSign() bool {
+	s, ok := c.l2c.(Signer)
+	return ok && !s.Encrypted()
 }
 
 // PrepareWrite requests the server to prepare to write the value of an attribute.
@@ -442,20 +688,19 @@ func (c *Client) SignedWrite(handle uint16, value []byte, signature [12]byte) er
 // the Client can verify that the value was received correctly.
 // [Vol 3, Part F, 3.4.6.1 & 3.4.6.2]
 func (c *Client) PrepareWrite(handle uint16, offset uint16, value []byte) (uint16, uint16, []byte, error) {
-	if len(value) > c.l2c.TxMTU()-5 {
-		return 0, 0, nil, ErrInvalidArgument
+	// The prepare queue is executed on the bearer it's prepared on, the unenhanced one.
+	bb, err := c.acquire(5+len(value), c.att)
+	if err != nil {
+		return 0, 0, nil, err
 	}
+	defer c.release(bb)
 
-	// Acquire and reuse the txBuf, and release it after usage.
-	txBuf := <-c.chTxBuf
-	defer func() { c.chTxBuf <- txBuf }()
-
-	req := PrepareWriteRequest(txBuf[:5+len(value)])
+	req := PrepareWriteRequest(bb.txBuf[:5+len(value)])
 	req.SetAttributeOpcode()
 	req.SetAttributeHandle(handle)
 	req.SetValueOffset(offset)
 
-	b, err := c.sendReq(req)
+	b, err := c.sendReq(bb, req)
 	if err != nil {
 		return 0, 0, nil, err
 	}
@@ -480,15 +725,18 @@ func (c *Client) PrepareWrite(handle uint16, offset uint16, value []byte) (uint1
 // handled by the server as an atomic operation. [Vol 3, Part F, 3.4.6.3 & 3.4.6.4]
 func (c *Client) ExecuteWrite(flags uint8) error {
 
-	// Acquire and reuse the txBuf, and release it after usage.
-	txBuf := <-c.chTxBuf
-	defer func() { c.chTxBuf <- txBuf }()
+	// Acquire the bearer the values were prepared on, and release it after usage.
+	bb, err := c.acquire(2, c.att)
+	if err != nil {
+		return err
+	}
+	defer c.release(bb)
 
-	req := ExecuteWriteRequest(txBuf[:1])
+	req := ExecuteWriteRequest(bb.txBuf[:2])
 	req.SetAttributeOpcode()
 	req.SetFlags(flags)
 
-	rspBytes, err := c.sendReq(req)
+	rspBytes, err := c.sendReq(bb, req)
 	if err != nil {
 		return err
 	}
@@ -506,19 +754,19 @@ func (c *Client) ExecuteWrite(flags uint8) error {
 	return nil
 }
 
-func (c *Client) sendCmd(b []byte) error {
-	_, err := c.l2c.Write(b)
+func (c *Client) sendCmd(bb *bearer, b []byte) error {
+	_, err := bb.rw.Write(b)
 	return err
 }
 
-func (c *Client) sendReq(b []byte) (rsp []byte, err error) {
+func (c *Client) sendReq(bb *bearer, b []byte) (rsp []byte, err error) {
 	c.Debugf("req: %x", b)
-	if _, err := c.l2c.Write(b); err != nil {
+	if _, err := bb.rw.Write(b); err != nil {
 		return nil, fmt.Errorf("send ATT request failed: %w", err)
 	}
 	for {
 		select {
-		case rsp := <-c.rspc:
+		case rsp := <-bb.rspc:
 			if rsp[0] == ErrorResponseCode || rsp[0] == rspOfReq[b[0]] {
 				return rsp, nil
 			}
@@ -528,11 +776,11 @@ func (c *Client) sendReq(b []byte) (rsp []byte, err error) {
 			// the response to our request.
 			errRsp := newErrorResponse(rsp[0], 0x0000, ble.ErrReqNotSupp)
 			c.Debugf("rsp: %x", b)
-			_, err := c.l2c.Write(errRsp)
+			_, err := bb.rw.Write(errRsp)
 			if err != nil {
 				return nil, fmt.Errorf("unexpected ATT response received: %w", err)
 			}
-		case err := <-c.chErr:
+		case err := <-bb.chErr:
 			return nil, fmt.Errorf("ATT request failed: %w", err)
 		case <-time.After(2 * time.Second):
 			return nil, fmt.Errorf("ATT request timeout: %w", ErrSeqProtoTimeout)
@@ -541,21 +789,23 @@ func (c *Client) sendReq(b []byte) (rsp []byte, err error) {
 
 }
 
-func (c *Client) sendResp(rsp []byte) error {
-	// Acquire and reuse the txBuf, and release it after usage.
-	txBuf := <-c.chTxBuf
-	defer func() { c.chTxBuf <- txBuf }()
+func (c *Client) sendResp(bb *bearer, rsp []byte) error {
+	// Acquire the bearer, and release it after usage.
+	if _, err := c.acquire(0, bb); err != nil {
+		return fmt.Errorf("send ATT response failed: %w", err)
+	}
+	defer c.release(bb)
 	if c.l2c == nil {
 		return fmt.Errorf("ble conn was nil")
 	}
-	if _, err := c.l2c.Write(rsp); err != nil {
+	if _, err := bb.rw.Write(rsp); err != nil {
 		return fmt.Errorf("send ATT request failed: %w", err)
 	}
 
 	return nil
 }
 
-func (c *Client) asyncReqLoop() {
+func (c *Client) asyncReqLoop(bb *bearer) {
 	for {
 		// keep trying?
 		select {
@@ -573,12 +823,16 @@ func (c *Client) asyncReqLoop() {
 			//ok
 		}
 
-		in := <-c.inc
+		in, ok := <-bb.inc
+		if !ok {
+			c.Debug("exited async loop: bearer closed")
+			return
+		}
 		rsp := c.server.HandleRequest(in)
 		if rsp == nil {
 			continue
 		}
-		err := c.sendResp(rsp)
+		err := c.sendResp(bb, rsp)
 		if err != nil {
 			c.Errorf("failed to send async att response for: %X", in[0])
 		}
@@ -587,6 +841,10 @@ func (c *Client) asyncReqLoop() {
 
 // Loop ...
 func (c *Client) Loop() {
+	c.loop(c.att)
+}
+
+func (c *Client) loop(bb *bearer) {
 
 	type asyncWork struct {
 		handle func([]byte)
@@ -603,12 +861,17 @@ func (c *Client) Loop() {
 
 	//start up async response handling
 	if c.server != nil {
-		go c.asyncReqLoop()
+		go c.asyncReqLoop(bb)
 		defer func() {
-			close(c.inc)
+			close(bb.inc)
 		}()
 	}
 
+	// An enhanced bearer is closed on its own, before the connection.
+	if bb.enhanced {
+		defer c.removeBearer(bb)
+	}
+
 	confirmation := []byte{HandleValueConfirmationCode}
 	for {
 		// keep trying?
@@ -627,7 +890,7 @@ func (c *Client) Loop() {
 			//ok
 		}
 
-		n, err := c.l2c.Read(c.rxBuf)
+		n, err := bb.rw.Read(bb.rxBuf)
 		// keep trying?
 		select {
 		case <-c.done:
@@ -641,23 +904,28 @@ func (c *Client) Loop() {
 				c.Debug("exited async loop: l2c nil")
 				return
 			} else if err != nil {
-				if errors.Is(err, io.ErrClosedPipe) {
+				if errors.Is(err, io.ErrClosedPipe) || (bb.enhanced && errors.Is(err, io.EOF)) {
 					c.Debugf("input channel closed while reading due to disconnection or connection failure")
-					c.chErr <- fmt.Errorf("disconnected")
+					err = fmt.Errorf("disconnected")
 				} else {
-					c.Errorf("client: read %v", err)
-
 					// We don't expect any error from the bearer (L2CAP ACL-U)
 					// Pass it along to the pending request, if any, and escape.
-					c.chErr <- err
+					c.Errorf("client: read %v", err)
+				}
+				select {
+				case bb.chErr <- err:
+				default:
 				}
 				return
 			}
 			//ok
 		}
+		if n == 0 {
+			continue
+		}
 
 		b := make([]byte, n)
-		copy(b, c.rxBuf)
+		copy(b, bb.rxBuf)
 		c.Debugf("rx: %x", b)
 
 		//all incoming requests are even numbered
@@ -670,7 +938,7 @@ func (c *Client) Loop() {
 			case <-c.connClosed:
 				c.Debug("exited async loop: conn closed")
 				return
-			case c.inc <- b:
+			case bb.inc <- b:
 				continue
 			default:
 				c.Errorf("failed to enqueue request for %x", b[0])
@@ -679,7 +947,7 @@ func (c *Client) Loop() {
 		}
 
 		if (b[0] != HandleValueNotificationCode) && (b[0] != HandleValueIndicationCode) {
-			c.Debugf("a rx: %x", c.rxBuf[:n])
+			c.Debugf("a rx: %x", bb.rxBuf[:n])
 			select {
 			case <-c.done:
 				c.Info("exited client loop: closed after rsp rx")
@@ -687,7 +955,7 @@ func (c *Client) Loop() {
 			case <-c.connClosed:
 				c.Debug("exited client async loop: conn closed")
 				return
-			case c.rspc <- b:
+			case bb.rspc <- b:
 				continue
 			}
 		}
@@ -709,9 +977,10 @@ func (c *Client) Loop() {
 		}
 
 		// Always write aknowledgement for an indication, even it was an invalid request.
+		// The confirmation is sent on the bearer the indication was received on.
 		if b[0] == HandleValueIndicationCode {
 			c.Debugf("write confirmation for indication")
-			_, _ = c.l2c.Write(confirmation)
+			_, _ = bb.rw.Write(confirmation)
 		}
 	}
 }
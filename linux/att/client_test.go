@@ -0,0 +1,109 @@
+package att
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"testing"
+
+	"github.com/rigado/ble"
+)
+
+// pipeConn is one end of a connection of the default ATT_MTU, for the methods
+// used by the client and the server.
+type pipeConn struct {
+	ble.Conn
+	p    net.Conn
+	done chan struct{}
+}
+
+func (c *pipeConn) Read(b []byte) (int, error)  { return c.p.Read(b) }
+func (c *pipeConn) Write(b []byte) (int, error) { return c.p.Write(b) }
+func (c *pipeConn) Close() error                { return c.p.Close() }
+func (c *pipeConn) TxMTU() int                  { return ble.DefaultMTU }
+func (c *pipeConn) RxMTU() int                  { return ble.DefaultMTU }
+func (c *pipeConn) Disconnected() <-chan struct{} {
+	return c.done
+}
+
+// testClient returns a client of a server of the database db.
+func testClient(t *testing.T, db *DB) *Client {
+	cc, sc := net.Pipe()
+	done := make(chan struct{})
+	t.Cleanup(func() {
+		cc.Close()
+		sc.Close()
+		close(done)
+	})
+
+	s, err := NewServer(db, &pipeConn{p: sc, done: done}, ble.GetLogger())
+	if err != nil {
+		t.Fatal(err)
+	}
+	go s.Loop()
+
+	c := NewClient(&pipeConn{p: cc, done: done}, nil, make(chan bool), ble.GetLogger())
+	go c.Loop()
+	return c
+}
+
+func TestClientReadMultiple(t *testing.T) {
+	short := []byte("0123456789")
+	long := bytes.Repeat([]byte("abcdefghij"), 2)
+	c := testClient(t, testDB(short, long))
+
+	// The values are concatenated, and truncated to the ATT_MTU.
+	b, err := c.ReadMultiple([]uint16{3, 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := append(append([]byte{}, short...), long[:ble.DefaultMTU-1-len(short)]...); !bytes.Equal(b, want) {
+		t.Fatalf("read %q, want %q", b, want)
+	}
+
+	if _, err := c.ReadMultiple([]uint16{3}); err != ErrInvalidArgument {
+		t.Fatalf("single handle read returned %v", err)
+	}
+	if _, err := c.ReadMultiple([]uint16{3, 0x40}); err != ble.ErrInvalidHandle {
+		t.Fatalf("invalid handle read returned %v", err)
+	}
+}
+
+func TestClientReadMultipleVariable(t *testing.T) {
+	short := []byte("0123456789")
+	long := bytes.Repeat([]byte("abcdefghij"), 2)
+	c := testClient(t, testDB(short, long))
+
+	// The last value is truncated to the ATT_MTU.
+	vv, lengths, err := c.ReadMultipleVariable([]uint16{3, 5})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]byte{short, long[:ble.DefaultMTU-1-2-len(short)-2]}; !reflect.DeepEqual(vv, want) {
+		t.Fatalf("read %q, want %q", vv, want)
+	}
+	if want := []int{len(short), len(long)}; !reflect.DeepEqual(lengths, want) {
+		t.Fatalf("lengths %v, want %v", lengths, want)
+	}
+
+	// The values that don't fit are left out.
+	vv, lengths, err = c.ReadMultipleVariable([]uint16{5, 3})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := [][]byte{long}; !reflect.DeepEqual(vv, want) {
+		t.Fatalf("read %q, want %q", vv, want)
+	}
+	if want := []int{len(long)}; !reflect.DeepEqual(lengths, want) {
+		t.Fatalf("lengths %v, want %v", lengths, want)
+	}
+}
+
+func TestClientExecuteWrite(t *testing.T) {
+	c := testClient(t, testDB([]byte("short"), []byte("long")))
+
+	// The request carries the flags, cancelling the prepared writes.
+	if err := c.ExecuteWrite(0); err != nil {
+		t.Fatal(err)
+	}
+}
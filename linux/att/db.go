@@ -1,40 +1,58 @@
 package att
 
 import (
+	"bytes"
+	"crypto/aes"
 	"encoding/binary"
+	"fmt"
+	"sort"
+	"sync"
 
+	"github.com/aead/cmac"
 	"github.com/rigado/ble"
 )
 
-// A DB is a contiguous range of attributes.
+// A DB is a range of attributes, sorted by handle. Services can be added and
+// removed while clients are connected. The handles of the other attributes stay
+// the same, removed services leave gaps. [Vol 3, Part G, 7.1]
 type DB struct {
+	// The attributes aren't modified in place, but replaced, so the slices
+	// returned by subrange stay valid.
+	mu    sync.RWMutex
 	attrs []*attr
 	base  uint16 // handle for first attr in attrs
+	hash  []byte // Database Hash, computed once the attributes change
+
+	// outOfSync reports whether a request is refused, as the client is change-unaware.
+	outOfSync func(c ble.Conn, req []byte) bool
+
 	ble.Logger
 }
 
-const (
-	tooSmall = -1
-	tooLarge = -2
+// Types of the attributes whose handle, type and value are hashed, and of those
+// whose handle and type only are hashed. [Vol 3, Part G, 7.3.1]
+var (
+	hashValueTypes = []ble.UUID{
+		ble.PrimaryServiceUUID, ble.SecondaryServiceUUID, ble.IncludeUUID,
+		ble.CharacteristicUUID, ble.UUID16(0x2900),
+	}
+	hashTypes = []ble.UUID{
+		ble.UUID16(0x2901), ble.ClientCharacteristicConfigUUID,
+		ble.ServerCharacteristicConfigUUID, ble.UUID16(0x2904), ble.UUID16(0x2905),
+	}
 )
 
-// idx returns the idx into attrs corresponding to attr a.
-// If h is too small, idx returns tooSmall (-1).
-// If h is too large, idx returns tooLarge (-2).
+// idx returns the idx of the first attr whose handle is h or more.
 func (r *DB) idx(h int) int {
-	if h < int(r.base) {
-		return tooSmall
-	}
-	if h >= int(r.base)+len(r.attrs) {
-		return tooLarge
-	}
-	return h - int(r.base)
+	return sort.Search(len(r.attrs), func(i int) bool { return int(r.attrs[i].h) >= h })
 }
 
 // at returns attr a.
 func (r *DB) at(h uint16) (a *attr, ok bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
 	i := r.idx(int(h))
-	if i < 0 {
+	if i == len(r.attrs) || r.attrs[i].h != h {
 		return nil, false
 	}
 	return r.attrs[i], true
@@ -43,22 +61,12 @@ func (r *DB) at(h uint16) (a *attr, ok bool) {
 // subrange returns attributes in range [start, end]; it may return an empty slice.
 // subrange does not panic for out-of-range start or end.
 func (r *DB) subrange(start, end uint16) []*attr {
-	startidx := r.idx(int(start))
-	switch startidx {
-	case tooSmall:
-		startidx = 0
-	case tooLarge:
-		return []*attr{}
-	}
-
-	endidx := r.idx(int(end) + 1) // [start, end] includes its upper bound!
-	switch endidx {
-	case tooSmall:
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if start > end {
 		return []*attr{}
-	case tooLarge:
-		endidx = len(r.attrs)
 	}
-	return r.attrs[startidx:endidx]
+	return r.attrs[r.idx(int(start)):r.idx(int(end)+1)] // [start, end] includes its upper bound!
 }
 
 // NewDB ...
@@ -66,11 +74,8 @@ func NewDB(ss []*ble.Service, base uint16, l ble.Logger) *DB {
 	h := base
 	var attrs []*attr
 	var aa []*attr
-	for i, s := range ss {
+	for _, s := range ss {
 		h, aa = genSvcAttr(s, h)
-		if i == len(ss)-1 {
-			aa[0].endh = 0xFFFF
-		}
 		attrs = append(attrs, aa...)
 	}
 
@@ -79,6 +84,116 @@ func NewDB(ss []*ble.Service, base uint16, l ble.Logger) *DB {
 	return d
 }
 
+// AddService adds the service s in the first range of free handles large enough.
+// It returns the handles of the service.
+func (r *DB) AddService(s *ble.Service) (start, end uint16, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := svcAttrCount(s)
+	h, i := int(r.base), 0
+	for ; i < len(r.attrs) && int(r.attrs[i].h) < h+n; i++ {
+		h = int(r.attrs[i].h) + 1
+	}
+	if h+n-1 > 0xFFFF {
+		return 0, 0, fmt.Errorf("no %d free handles for service %v", n, s.UUID)
+	}
+
+	_, aa := genSvcAttr(s, uint16(h))
+	attrs := make([]*attr, 0, len(r.attrs)+len(aa))
+	attrs = append(attrs, r.attrs[:i]...)
+	attrs = append(attrs, aa...)
+	attrs = append(attrs, r.attrs[i:]...)
+	r.attrs = attrs
+
+	r.hash = nil
+
+	r.DumpAttributes(aa)
+	return s.Handle, s.EndHandle, nil
+}
+
+// RemoveService removes the service s. It returns the handles the service had.
+func (r *DB) RemoveService(s *ble.Service) (start, end uint16, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	i := r.idx(int(s.Handle))
+	if i == len(r.attrs) || r.attrs[i].h != s.Handle || !r.attrs[i].typ.Equal(ble.PrimaryServiceUUID) {
+		return 0, 0, fmt.Errorf("service %v not found", s.UUID)
+	}
+	j := r.idx(int(r.attrs[i].endh) + 1)
+
+	attrs := make([]*attr, 0, len(r.attrs)-(j-i))
+	attrs = append(attrs, r.attrs[:i]...)
+	attrs = append(attrs, r.attrs[j:]...)
+	r.attrs = attrs
+	r.hash = nil
+
+	return s.Handle, s.EndHandle, nil
+}
+
+// Hash returns the Database Hash, the AES-CMAC with a zero key of the service,
+// characteristic and descriptor declarations, in handle order. [Vol 3, Part G, 7.3]
+func (r *DB) Hash() ([]byte, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.hash != nil {
+		return r.hash, nil
+	}
+
+	var m bytes.Buffer
+	for _, a := range r.attrs {
+		if !ble.Contains(hashValueTypes, a.typ) && !ble.Contains(hashTypes, a.typ) {
+			continue
+		}
+		binary.Write(&m, binary.LittleEndian, a.h)
+		m.Write(a.typ)
+		if ble.Contains(hashValueTypes, a.typ) {
+			m.Write(a.v)
+		}
+	}
+
+	c, err := aes.NewCipher(make([]byte, 16))
+	if err != nil {
+		return nil, err
+	}
+	sum, err := cmac.Sum(m.Bytes(), c, 16)
+	if err != nil {
+		return nil, err
+	}
+	r.hash = sum
+	return sum, nil
+}
+
+// SetOutOfSync sets the function reporting whether a request of the client c is
+// refused with a Database Out Of Sync error, as the client is change-unaware.
+// The commands of change-unaware clients are ignored. [Vol 3, Part G, 2.5.2.1]
+func (r *DB) SetOutOfSync(f func(c ble.Conn, req []byte) bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.outOfSync = f
+}
+
+// isOutOfSync reports whether the request req of the client c is refused.
+func (r *DB) isOutOfSync(c ble.Conn, req []byte) bool {
+	r.mu.RLock()
+	f := r.outOfSync
+	r.mu.RUnlock()
+	return f != nil && f(c, req)
+}
+
+// svcAttrCount returns the number of attributes of the service s.
+func svcAttrCount(s *ble.Service) int {
+	n := 1
+	for _, c := range s.Characteristics {
+		n += 2 + len(c.Descriptors)
+		if c.CCCD == nil && (c.NotifyHandler != nil || c.IndicateHandler != nil) {
+			n++
+		}
+	}
+	return n
+}
+
 func genSvcAttr(s *ble.Service, h uint16) (uint16, []*attr) {
 	a := &attr{
 		h:   h,
@@ -95,6 +210,7 @@ func genSvcAttr(s *ble.Service, h uint16) (uint16, []*attr) {
 	}
 
 	a.endh = h - 1
+	s.Handle, s.EndHandle = a.h, a.endh
 	return h, attrs
 }
 
@@ -117,7 +233,8 @@ func genCharAttr(c *ble.Characteristic, h uint16) (uint16, []*attr) {
 
 	c.Handle = h
 	c.ValueHandle = vh
-	if c.NotifyHandler != nil || c.IndicateHandler != nil {
+	// The CCCD is only added once, if the service is added again.
+	if c.CCCD == nil && (c.NotifyHandler != nil || c.IndicateHandler != nil) {
 		c.CCCD = newCCCD(c)
 		c.Descriptors = append(c.Descriptors, c.CCCD)
 	}
@@ -166,13 +283,17 @@ func newCCCD(c *ble.Characteristic) *ble.Descriptor {
 	d := ble.NewDescriptor(ble.ClientCharacteristicConfigUUID)
 
 	d.HandleRead(ble.ReadHandlerFunc(func(req ble.Request, rsp ble.ResponseWriter) {
-		cccs := req.Conn().(*conn).cccs
-		ccc := cccs[c.Handle]
+		cn := req.Conn().(*conn)
+		cn.mu.Lock()
+		ccc := cn.cccs[c.Handle]
+		cn.mu.Unlock()
 		binary.Write(rsp, binary.LittleEndian, ccc)
 	}))
 
 	d.HandleWrite(ble.WriteHandlerFunc(func(req ble.Request, rsp ble.ResponseWriter) {
 		cn := req.Conn().(*conn)
+		cn.mu.Lock()
+		defer cn.mu.Unlock()
 		old := cn.cccs[c.Handle]
 		ccc := binary.LittleEndian.Uint16(req.Data())
 
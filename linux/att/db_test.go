@@ -0,0 +1,72 @@
+package att
+
+import (
+	"bytes"
+	"crypto/aes"
+	"encoding/hex"
+	"strings"
+	"testing"
+
+	"github.com/aead/cmac"
+	"github.com/rigado/ble"
+)
+
+func TestDBHash(t *testing.T) {
+	// A database in the shape of the example of [Vol 3, Part G, Appendix B].
+	gap := ble.NewService(ble.GAPUUID)
+	gap.NewCharacteristic(ble.DeviceNameUUID).Property = ble.CharRead | ble.CharWrite
+	gap.NewCharacteristic(ble.AppearanceUUID).Property = ble.CharRead
+
+	gatt := ble.NewService(ble.GATTUUID)
+	gatt.NewCharacteristic(ble.ServiceChangedUUID).HandleIndicate(
+		ble.NotifyHandlerFunc(func(req ble.Request, n ble.Notifier) {}))
+	gatt.NewCharacteristic(ble.ClientSupportedFeaturesUUID).Property = ble.CharRead | ble.CharWrite
+	gatt.NewCharacteristic(ble.DatabaseHashUUID).Property = ble.CharRead
+
+	svc := ble.NewService(ble.MustParse("00010000-0001-1000-8000-00805F9B34FB"))
+	c := svc.NewCharacteristic(ble.MustParse("00010001-0001-1000-8000-00805F9B34FB"))
+	c.SetValue([]byte("value"))
+	c.NewDescriptor(ble.UUID16(0x2901)).SetValue([]byte("description"))
+	c.NewDescriptor(ble.UUID16(0x2904)).SetValue([]byte{0x19, 0x00, 0x00, 0x27, 0x01, 0x00, 0x00})
+	c.NewDescriptor(ble.UUID16(0x2900)).SetValue([]byte{0x00, 0x00})
+
+	db := NewDB([]*ble.Service{gap, gatt, svc}, 1, ble.GetLogger())
+
+	// Each declaration is the handle, the type and, for service, include,
+	// characteristic and extended properties declarations, the value, all
+	// little endian. [Vol 3, Part G, 7.3.1]
+	m, err := hex.DecodeString(strings.Replace(strings.Join([]string{
+		"0100 0028 0018",
+		"0200 0328 0A 0300 002A",
+		"0400 0328 02 0500 012A",
+		"0600 0028 0118",
+		"0700 0328 20 0800 052A",
+		"0900 0229",
+		"0A00 0328 0A 0B00 292B",
+		"0C00 0328 02 0D00 2A2B",
+		"0E00 0028 FB349B5F800000800010010000000100",
+		"0F00 0328 02 1000 FB349B5F800000800010010001000100",
+		"1100 0129",
+		"1200 0429",
+		"1300 0029 0000",
+	}, " "), " ", "", -1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	ciph, err := aes.NewCipher(make([]byte, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := cmac.Sum(m, ciph, 16)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := db.Hash()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(h, want) {
+		t.Fatalf("hash % X, want % X", h, want)
+	}
+}
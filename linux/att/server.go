@@ -5,6 +5,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"sync"
 	"time"
 
 	"github.com/rigado/ble"
@@ -12,7 +13,10 @@ import (
 
 type conn struct {
 	ble.Conn
-	svr  *Server
+	svr *Server
+
+	// The bearers of the connection share the cccs. [Vol 3, Part G, 3.3.3.3]
+	mu   sync.Mutex
 	cccs map[uint16]uint16
 	nn   map[uint16]ble.Notifier
 	in   map[uint16]ble.Notifier
@@ -23,6 +27,11 @@ type Server struct {
 	conn *conn
 	db   *DB
 
+	// bearer is the ATT bearer the requests are served on, the connection itself,
+	// or an LE credit based channel if enhanced. [Vol 3, Part F, 3.2.11]
+	bearer   io.ReadWriteCloser
+	enhanced bool
+
 	// Refer to [Vol 3, Part F, 3.3.2 & 3.3.3] for the requirement of
 	// sequential request-response protocol, and transactions.
 	rxMTU     int
@@ -56,7 +65,8 @@ func NewServer(db *DB, l2c ble.Conn, l ble.Logger) (*Server, error) {
 			in:   make(map[uint16]ble.Notifier),
 			nn:   make(map[uint16]ble.Notifier),
 		},
-		db: db,
+		db:     db,
+		bearer: l2c,
 
 		rxMTU:     mtu,
 		txBuf:     make([]byte, ble.DefaultMTU),
@@ -73,8 +83,41 @@ func NewServer(db *DB, l2c ble.Conn, l ble.Logger) (*Server, error) {
 	return s, nil
 }
 
+// AddBearer serves the requests of the client on an enhanced ATT bearer, an LE credit
+// based channel opened on PSM 0x0027 whose ATT_MTU is mtu. It returns the server of
+// the bearer, whose Loop serves the requests until rw is closed. Notifications and
+// indications are still sent on the unenhanced bearer. [Vol 3, Part F, 3.2.11]
+func (s *Server) AddBearer(rw io.ReadWriteCloser, mtu int) (*Server, error) {
+	if mtu < ble.DefaultMTU || mtu > ble.MaxMTU {
+		return nil, fmt.Errorf("invalid MTU")
+	}
+	b := &Server{
+		conn:     s.conn,
+		db:       s.db,
+		bearer:   rw,
+		enhanced: true,
+
+		rxMTU:     mtu,
+		txBuf:     make([]byte, mtu),
+		chNotBuf:  make(chan []byte, 1),
+		chIndBuf:  make(chan []byte, 1),
+		chConfirm: make(chan bool),
+
+		dummyRspWriter: ble.NewResponseWriter(nil),
+		Logger:         s.Logger,
+	}
+	b.chNotBuf <- make([]byte, mtu)
+	b.chIndBuf <- make([]byte, mtu)
+	return b, nil
+}
+
 // notify sends notification to remote central.
 func (s *Server) notify(h uint16, data []byte) (int, error) {
+	// The service of the characteristic may have been removed.
+	if _, ok := s.db.at(h); !ok {
+		return 0, io.ErrClosedPipe
+	}
+
 	// Acquire and reuse notifyBuffer. Release it after usage.
 	nBuf := <-s.chNotBuf
 	defer func() { s.chNotBuf <- nBuf }()
@@ -91,8 +134,31 @@ func (s *Server) notify(h uint16, data []byte) (int, error) {
 	return s.conn.Write(rsp[:3+buf.Len()])
 }
 
+// Indicate sends an indication of the characteristic value h to the client, and waits
+// for its confirmation. The client must have configured indications in this connection,
+// unless it's bonded, as the configuration of bonded clients is kept across connections,
+// e.g. the one of Service Changed. [Vol 3, Part G, 3.3.3.3 & 7.1]
+func (s *Server) Indicate(h uint16, data []byte) error {
+	if !s.conn.Bonded() {
+		// The characteristic declaration is right before its value.
+		s.conn.mu.Lock()
+		ccc := s.conn.cccs[h-1]
+		s.conn.mu.Unlock()
+		if ccc&cccIndicate == 0 {
+			return ErrNotConfigured
+		}
+	}
+	_, err := s.conn.svr.indicate(h, data)
+	return err
+}
+
 // indicate sends indication to remote central.
 func (s *Server) indicate(h uint16, data []byte) (int, error) {
+	// The service of the characteristic may have been removed.
+	if _, ok := s.db.at(h); !ok {
+		return 0, io.ErrClosedPipe
+	}
+
 	// Acquire and reuse indicateBuffer. Release it after usage.
 	iBuf := <-s.chIndBuf
 	defer func() { s.chIndBuf <- iBuf }()
@@ -135,11 +201,11 @@ func (s *Server) Loop() {
 	go func() {
 		b := <-pool
 		for {
-			n, err := s.conn.Read(b.buf)
+			n, err := s.bearer.Read(b.buf)
 			if n == 0 || err != nil {
 				close(seq)
 				close(s.chConfirm)
-				_ = s.conn.Close()
+				_ = s.bearer.Close()
 				return
 			}
 			if b.buf[0] == HandleValueConfirmationCode {
@@ -158,11 +224,18 @@ func (s *Server) Loop() {
 	for req := range seq {
 		if rsp := s.handleRequest(req.buf[:req.len]); rsp != nil {
 			if len(rsp) != 0 {
-				s.conn.Write(rsp)
+				s.bearer.Write(rsp)
 			}
 		}
 		pool <- req
 	}
+
+	// The notifications last as long as the connection, not an enhanced bearer.
+	if s.enhanced {
+		return
+	}
+	s.conn.mu.Lock()
+	defer s.conn.mu.Unlock()
 	for h, ccc := range s.conn.cccs {
 		if ccc != 0 {
 			s.Infof("server: cleanup %v - 0x%02X", ble.ContextKeyCCC, ccc)
@@ -187,6 +260,16 @@ func (s *Server) handleRequest(b []byte) []byte {
 	}
 	s.Debugf("server: req - % X", b)
 
+	if s.db.isOutOfSync(s.conn.Conn, b) {
+		if b[0]&0x40 != 0 {
+			s.Debugf("server: change-unaware client, command ignored")
+			return nil
+		}
+		resp = newErrorResponse(b[0], 0x0000, ble.ErrDBOutOfSync)
+		s.Debugf("server: rsp - % X", resp)
+		return resp
+	}
+
 	switch reqType := b[0]; reqType {
 	case ExchangeMTURequestCode:
 		resp = s.handleExchangeMTURequest(b)
@@ -210,9 +293,12 @@ func (s *Server) handleRequest(b []byte) []byte {
 		resp = s.handlePrepareWriteRequest(b)
 	case ExecuteWriteRequestCode:
 		resp = s.handleExecuteWriteRequest(b)
-	case ReadMultipleRequestCode,
-		SignedWriteCommandCode:
-		fallthrough
+	case SignedWriteCommandCode:
+		s.handleSignedWriteCommand(b)
+	case ReadMultipleRequestCode:
+		resp = s.handleReadMultipleRequest(b)
+	case ReadMultipleVariableRequestCode:
+		resp = s.handleReadMultipleVariableRequest(b)
 	default:
 		resp = newErrorResponse(reqType, 0x0000, ble.ErrReqNotSupp)
 	}
@@ -228,6 +314,9 @@ func (s *Server) handleExchangeMTURequest(r ExchangeMTURequest) []byte {
 		fallthrough
 	case r.ClientRxMTU() < 23:
 		return newErrorResponse(r.AttributeOpcode(), 0x0000, ble.ErrInvalidPDU)
+	case s.enhanced:
+		// The ATT_MTU of an enhanced bearer is the MTU of its channel. [Vol 3, Part F, 3.4.2]
+		return newErrorResponse(r.AttributeOpcode(), 0x0000, ble.ErrReqNotSupp)
 	}
 
 	txMTU := int(r.ClientRxMTU())
@@ -439,6 +528,90 @@ func (s *Server) handleReadRequest(r ReadRequest) []byte {
 	return rsp[:1+buf.Len()]
 }
 
+// handle Read Multiple request. [Vol 3, Part F, 3.4.4.7 & 3.4.4.8]
+func (s *Server) handleReadMultipleRequest(r ReadMultipleRequest) []byte {
+	// Validate the request.
+	switch {
+	case len(r) < 5 || len(r)%2 != 1:
+		return newErrorResponse(r.AttributeOpcode(), 0x0000, ble.ErrInvalidPDU)
+	}
+
+	rsp := ReadMultipleResponse(s.txBuf)
+	rsp.SetAttributeOpcode()
+	buf := bytes.NewBuffer(rsp.SetOfValues())
+	buf.Reset()
+
+	for p := r.SetOfHandles(); len(p) > 0; p = p[2:] {
+		h := binary.LittleEndian.Uint16(p)
+		v, e := s.readValue(r, h)
+		if e != ble.ErrSuccess {
+			return newErrorResponse(r.AttributeOpcode(), h, e)
+		}
+
+		// Values are concatenated, and the result is truncated to the MTU.
+		if n := buf.Cap() - buf.Len(); len(v) > n {
+			v = v[:n]
+		}
+		buf.Write(v)
+	}
+	return rsp[:1+buf.Len()]
+}
+
+// handle Read Multiple Variable request. [Vol 3, Part F, 3.4.4.11 & 3.4.4.12]
+func (s *Server) handleReadMultipleVariableRequest(r ReadMultipleVariableRequest) []byte {
+	// Validate the request.
+	switch {
+	case len(r) < 5 || len(r)%2 != 1:
+		return newErrorResponse(r.AttributeOpcode(), 0x0000, ble.ErrInvalidPDU)
+	}
+
+	rsp := ReadMultipleVariableResponse(s.txBuf)
+	rsp.SetAttributeOpcode()
+	buf := bytes.NewBuffer(rsp.LengthValueTupleList())
+	buf.Reset()
+
+	for p := r.SetOfHandles(); len(p) > 0; p = p[2:] {
+		h := binary.LittleEndian.Uint16(p)
+		v, e := s.readValue(r, h)
+		if e != ble.ErrSuccess {
+			return newErrorResponse(r.AttributeOpcode(), h, e)
+		}
+
+		// Stop once there is no room left for another length field. The
+		// length reports the full value, which may be truncated to fit.
+		n := buf.Cap() - buf.Len() - 2
+		if n < 0 {
+			break
+		}
+		binary.Write(buf, binary.LittleEndian, uint16(len(v)))
+		if len(v) > n {
+			v = v[:n]
+		}
+		buf.Write(v)
+	}
+	return rsp[:1+buf.Len()]
+}
+
+// readValue reads the whole value of the attribute at handle h on behalf of a
+// multiple read request.
+func (s *Server) readValue(r []byte, h uint16) ([]byte, ble.ATTError) {
+	a, ok := s.db.at(h)
+	if !ok {
+		return nil, ble.ErrInvalidHandle
+	}
+
+	// Simple case. Read-only, no-authorization, no-authentication.
+	if a.v != nil {
+		return a.v, ble.ErrSuccess
+	}
+
+	buf := bytes.NewBuffer(make([]byte, 0, len(s.txBuf)-1))
+	if e := handleATT(a, s, r, ble.NewResponseWriter(buf)); e != ble.ErrSuccess {
+		return nil, e
+	}
+	return buf.Bytes(), ble.ErrSuccess
+}
+
 // handle Read Blob request. [Vol 3, Part F, 3.4.4.5 & 3.4.4.6]
 func (s *Server) handleReadBlobRequest(r ReadBlobRequest) []byte {
 	// Validate the request.
@@ -619,6 +792,44 @@ func (s *Server) handleWriteCommand(r WriteCommand) []byte {
 	return nil
 }
 
+// handle Signed Write command. [Vol 3, Part F, 3.4.5.4]
+func (s *Server) handleSignedWriteCommand(r SignedWriteCommand) []byte {
+	// Validate the request.
+	switch {
+	case len(r) < 15:
+		return nil
+	}
+
+	// Only the values of characteristics with the Authenticated Signed Writes property
+	// accept them; the characteristic declaration is right before its value. [Vol 3, Part G, 3.3.1.1]
+	d, ok := s.db.at(r.AttributeHandle() - 1)
+	if !ok || d == nil || !d.typ.Equal(ble.CharacteristicUUID) || len(d.v) < 1 || ble.Property(d.v[0])&ble.CharSignedWrite == 0 {
+		s.Warnf("server: signed write to %04X dropped: not allowed", r.AttributeHandle())
+		return nil
+	}
+
+	sg, ok := s.conn.Conn.(Signer)
+	if !ok {
+		return nil
+	}
+
+	// Commands have no response, so invalid signatures are dropped. [Vol 3, Part C, 10.4.2]
+	if err := sg.VerifySignature(r.signedData(), r.signature()); err != nil {
+		s.Warnf("server: signed write to %04X dropped: %v", r.AttributeHandle(), err)
+		return nil
+	}
+
+	a, ok := s.db.at(r.AttributeHandle())
+	if !ok || a == nil {
+		return nil
+	}
+
+	if e := handleATT(a, s, r, s.dummyRspWriter); e != ble.ErrSuccess {
+		return nil
+	}
+	return nil
+}
+
 func newErrorResponse(op byte, h uint16, s ble.ATTError) []byte {
 	r := ErrorResponse(make([]byte, 5))
 	r.SetAttributeOpcode()
@@ -634,7 +845,7 @@ func handleATT(a *attr, s *Server, req []byte, rsp ble.ResponseWriter) ble.ATTEr
 	var data []byte
 	conn := s.conn
 	switch req[0] {
-	case ReadByTypeRequestCode:
+	case ReadByTypeRequestCode, ReadMultipleRequestCode, ReadMultipleVariableRequestCode:
 		fallthrough
 	case ReadRequestCode:
 		if a.rh == nil {
@@ -675,9 +886,13 @@ func handleATT(a *attr, s *Server, req []byte, rsp ble.ResponseWriter) ble.ATTEr
 		}
 		data = WriteRequest(req).AttributeValue()
 		a.wh.ServeWrite(ble.NewRequest(conn, data, offset), rsp)
-	// case SignedWriteCommandCode:
+	case SignedWriteCommandCode:
+		if a.wh == nil {
+			return ble.ErrWriteNotPerm
+		}
+		data = SignedWriteCommand(req).value()
+		a.wh.ServeWrite(ble.NewRequest(conn, data, offset), rsp)
 	// case ReadByGroupTypeRequestCode:
-	// case ReadMultipleRequestCode:
 	default:
 		return ble.ErrReqNotSupp
 	}
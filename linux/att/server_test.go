@@ -0,0 +1,75 @@
+package att
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/rigado/ble"
+)
+
+// testDB returns a database of a short static value at handle 3, and a long value
+// served by a handler at handle 5.
+func testDB(short, long []byte) *DB {
+	svc := ble.NewService(ble.MustParse("00010000-0001-1000-8000-00805F9B34FB"))
+	svc.NewCharacteristic(ble.MustParse("00010001-0001-1000-8000-00805F9B34FB")).SetValue(short)
+	svc.NewCharacteristic(ble.MustParse("00010002-0001-1000-8000-00805F9B34FB")).HandleRead(
+		ble.ReadHandlerFunc(func(req ble.Request, rsp ble.ResponseWriter) {
+			rsp.Write(long)
+		}))
+	return NewDB([]*ble.Service{svc}, 1, ble.GetLogger())
+}
+
+func testServer(db *DB) *Server {
+	return &Server{conn: &conn{}, db: db, txBuf: make([]byte, ble.DefaultMTU), Logger: ble.GetLogger()}
+}
+
+func TestServerReadMultiple(t *testing.T) {
+	short := []byte("0123456789")
+	long := bytes.Repeat([]byte("abcdefghij"), 2)
+	s := testServer(testDB(short, long))
+
+	// The values are concatenated, and truncated to the ATT_MTU.
+	rsp := s.handleReadMultipleRequest(ReadMultipleRequest{ReadMultipleRequestCode, 3, 0, 5, 0})
+	want := append([]byte{ReadMultipleResponseCode}, short...)
+	want = append(want, long[:ble.DefaultMTU-1-len(short)]...)
+	if !bytes.Equal(rsp, want) {
+		t.Fatalf("response % X, want % X", rsp, want)
+	}
+
+	rsp = s.handleReadMultipleRequest(ReadMultipleRequest{ReadMultipleRequestCode, 3, 0})
+	if want := newErrorResponse(ReadMultipleRequestCode, 0, ble.ErrInvalidPDU); !bytes.Equal(rsp, want) {
+		t.Fatalf("single handle response % X, want % X", rsp, want)
+	}
+	rsp = s.handleReadMultipleRequest(ReadMultipleRequest{ReadMultipleRequestCode, 3, 0, 0x40, 0})
+	if want := newErrorResponse(ReadMultipleRequestCode, 0x40, ble.ErrInvalidHandle); !bytes.Equal(rsp, want) {
+		t.Fatalf("invalid handle response % X, want % X", rsp, want)
+	}
+}
+
+func TestServerReadMultipleVariable(t *testing.T) {
+	short := []byte("0123456789")
+	long := bytes.Repeat([]byte("abcdefghij"), 2)
+	s := testServer(testDB(short, long))
+
+	// The lengths are the ones of the whole values, the last one is truncated
+	// to the ATT_MTU.
+	rsp := s.handleReadMultipleVariableRequest(ReadMultipleVariableRequest{ReadMultipleVariableRequestCode, 3, 0, 5, 0})
+	want := append([]byte{ReadMultipleVariableResponseCode, byte(len(short)), 0}, short...)
+	want = append(want, byte(len(long)), 0)
+	want = append(want, long[:ble.DefaultMTU-len(want)]...)
+	if !bytes.Equal(rsp, want) {
+		t.Fatalf("response % X, want % X", rsp, want)
+	}
+
+	// The values that don't fit are left out.
+	rsp = s.handleReadMultipleVariableRequest(ReadMultipleVariableRequest{ReadMultipleVariableRequestCode, 5, 0, 3, 0})
+	want = append([]byte{ReadMultipleVariableResponseCode, byte(len(long)), 0}, long[:ble.DefaultMTU-3]...)
+	if !bytes.Equal(rsp, want) {
+		t.Fatalf("response % X, want % X", rsp, want)
+	}
+
+	rsp = s.handleReadMultipleVariableRequest(ReadMultipleVariableRequest{ReadMultipleVariableRequestCode, 3, 0, 5})
+	if want := newErrorResponse(ReadMultipleVariableRequestCode, 0, ble.ErrInvalidPDU); !bytes.Equal(rsp, want) {
+		t.Fatalf("odd length response % X, want % X", rsp, want)
+	}
+}
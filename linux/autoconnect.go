@@ -0,0 +1,170 @@
+package linux
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rigado/ble"
+)
+
+// autoConnectRetry is the delay before re-arming a background connection that failed.
+const autoConnectRetry = time.Second
+
+// autoConnectEncryptionTimeout bounds the wait for the encryption of a bonded device.
+const autoConnectEncryptionTimeout = 5 * time.Second
+
+// AutoConnect keeps a connection pending to the devices addrs, using the
+// filter accept list, and passes each connected device to h. Encryption is
+// started on the connections to bonded devices before they are passed to h.
+// Once a device disconnects, it's connected again as soon as it's available.
+//
+// AutoConnect blocks until ctx is done. It replaces the contents of the accept
+// list, and the device can't dial while it runs.
+func (d *Device) AutoConnect(ctx context.Context, addrs []ble.Addr, h ble.AutoConnectHandler) error {
+	if err := d.HCI.ClearAcceptList(); err != nil {
+		return errors.Wrap(err, "can't clear accept list")
+	}
+	defer d.HCI.ClearAcceptList()
+
+	known := make(map[string]ble.Addr)
+	for _, a := range addrs {
+		if err := d.HCI.AddToAcceptList(a); err != nil {
+			return errors.Wrapf(err, "can't add %v to accept list", a)
+		}
+		known[a.String()] = a
+	}
+	pending := len(known)
+
+	disconnected := make(chan ble.Addr, len(known))
+	type result struct {
+		cln ble.Client
+		err error
+	}
+
+	for {
+		if pending == 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case a := <-disconnected:
+				if err := d.HCI.AddToAcceptList(a); err != nil {
+					return errors.Wrapf(err, "can't add %v to accept list", a)
+				}
+				pending++
+			}
+			continue
+		}
+
+		dctx, cancel := context.WithCancel(ctx)
+		ch := make(chan result, 1)
+		go func() {
+			cln, err := d.HCI.ConnectAcceptList(dctx)
+			ch <- result{cln, err}
+		}()
+
+		var r result
+		var rearm []ble.Addr
+	wait:
+		for {
+			select {
+			case r = <-ch:
+				break wait
+			case a := <-disconnected:
+				// The accept list can't change while connecting.
+				rearm = append(rearm, a)
+				cancel()
+			}
+		}
+		cancel()
+
+		if r.err == nil {
+			cln, err := d.client(r.cln, nil)
+			if err != nil {
+				return err
+			}
+			a, ok := known[cln.Addr().String()]
+			switch {
+			case ctx.Err() != nil:
+				cln.CancelConnection()
+			case !ok:
+				d.HCI.Warnf("autoconnect: unexpected connection to %v", cln.Addr())
+				cln.CancelConnection()
+			default:
+				if err := d.HCI.RemoveFromAcceptList(a); err != nil {
+					d.HCI.Warnf("autoconnect: can't remove %v from accept list: %v", a, err)
+				}
+				pending--
+				go d.autoConnected(ctx, a, cln, h, disconnected)
+			}
+		}
+
+		for _, a := range rearm {
+			if err := d.HCI.AddToAcceptList(a); err != nil {
+				return errors.Wrapf(err, "can't add %v to accept list", a)
+			}
+			pending++
+		}
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if r.err != nil && len(rearm) == 0 {
+			d.HCI.Warnf("autoconnect: %v", r.err)
+			select {
+			case <-ctx.Done():
+			case <-time.After(autoConnectRetry):
+			}
+		}
+	}
+}
+
+// autoConnected encrypts the connection to a, if it's bonded, passes it to h,
+// and reports the disconnection.
+func (d *Device) autoConnected(ctx context.Context, a ble.Addr, cln ble.Client, h ble.AutoConnectHandler, disconnected chan<- ble.Addr) {
+	if err := encryptBonded(cln); err != nil {
+		d.HCI.Warnf("autoconnect: %v: %v", a, err)
+		cln.CancelConnection()
+	} else {
+		h(cln)
+	}
+
+	select {
+	case <-cln.Disconnected():
+	case <-ctx.Done():
+		return
+	}
+	select {
+	case disconnected <- a:
+	case <-ctx.Done():
+	}
+}
+
+// encryptBonded starts encryption with the stored bond of the connected device.
+// Connections to devices that aren't bonded are left unencrypted.
+func encryptBonded(cln ble.Client) error {
+	if !cln.Conn().Bonded() {
+		return nil
+	}
+
+	ch := make(chan ble.EncryptionChangedInfo, 1)
+	if err := cln.Conn().StartEncryption(ch); err != nil {
+		return errors.Wrap(err, "can't encrypt")
+	}
+
+	select {
+	case info := <-ch:
+		if !info.Enabled {
+			if info.Err != nil {
+				return errors.Wrap(info.Err, "can't encrypt")
+			}
+			return fmt.Errorf("can't encrypt: status 0x%02X", info.Status)
+		}
+		return nil
+	case <-cln.Disconnected():
+		return fmt.Errorf("disconnected while encrypting")
+	case <-time.After(autoConnectEncryptionTimeout):
+		return fmt.Errorf("encryption timed out")
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"fmt"
 	"github.com/rigado/ble/linux/hci/cmd"
 	"io"
+	"sync"
 
 	smp2 "github.com/rigado/ble/linux/hci/smp"
 
@@ -47,12 +48,24 @@ func NewDeviceWithNameAndHandler(name string, handler ble.NotifyHandler, opts ..
 		return nil, errors.Wrapf(err, "maximum ATT_MTU is %d", ble.MaxMTU)
 	}
 
-	go loop(dev, srv, mtu)
+	// The ATT servers of the connections, to serve their Enhanced ATT bearers.
+	var servers sync.Map
+	// Enhanced ATT bearers are only accepted on encrypted links.
+	if dev.EATTServer() {
+		l, err := dev.ListenL2CAP(ble.PSMEATT, ble.L2CAPOptions{MTU: ble.MaxMTU, Security: ble.L2CAPSecurityEncryption})
+		if err != nil {
+			dev.Close()
+			return nil, errors.Wrap(err, "can't listen for eatt bearers")
+		}
+		go eattLoop(dev, l, &servers)
+	}
+
+	go loop(dev, srv, mtu, &servers)
 
 	return &Device{HCI: dev, Server: srv}, nil
 }
 
-func loop(dev *hci.HCI, s *gatt.Server, mtu int) {
+func loop(dev *hci.HCI, s *gatt.Server, mtu int, servers *sync.Map) {
 	for {
 		l2c, err := dev.Accept()
 		if err != nil {
@@ -81,11 +94,50 @@ func loop(dev *hci.HCI, s *gatt.Server, mtu int) {
 			continue
 		}
 
+		s.Connected(l2c, as)
+		servers.Store(l2c, as)
+		go func() {
+			<-l2c.Disconnected()
+			servers.Delete(l2c)
+		}()
+
 		dev.Infof("starting att server loop")
 		go as.Loop()
 	}
 }
 
+// eattLoop serves the Enhanced ATT bearers opened by the clients of the connections
+// accepted by loop, with the ATT server of the connection.
+func eattLoop(dev *hci.HCI, l ble.L2CAPListener, servers *sync.Map) {
+	for {
+		ch, err := l.Accept()
+		if err != nil {
+			return
+		}
+
+		v, ok := servers.Load(ch.Conn())
+		if !ok {
+			dev.Warnf("eatt: no att server for %v", ch.Conn().RemoteAddr())
+			ch.Close()
+			continue
+		}
+		nc, err := ch.NetConn()
+		if err != nil {
+			dev.Errorf("eatt: %v", err)
+			ch.Close()
+			continue
+		}
+
+		as, err := v.(*att.Server).AddBearer(nc, att.BearerMTU(ch.Info()))
+		if err != nil {
+			dev.Errorf("eatt: %v", err)
+			nc.Close()
+			continue
+		}
+		go as.Loop()
+	}
+}
+
 // Device ...
 type Device struct {
 	HCI    *hci.HCI
@@ -97,6 +149,12 @@ func (d *Device) AddService(svc *ble.Service) error {
 	return d.Server.AddService(svc)
 }
 
+// RemoveService removes a service from database. Connected clients are indicated
+// the services changed.
+func (d *Device) RemoveService(svc *ble.Service) error {
+	return d.Server.RemoveService(svc)
+}
+
 // RemoveAllServices removes all services that are currently in the database.
 func (d *Device) RemoveAllServices() error {
 	return d.Server.RemoveAllServices()
@@ -208,6 +266,17 @@ func (d *Device) StopAdvertising() error {
 	return d.HCI.StopAdvertising()
 }
 
+// StartAdvertisingSet configures and enables an extended advertising set.
+// It requires the device to be created with ble.OptExtendedAdvertising.
+func (d *Device) StartAdvertisingSet(set ble.AdvertisingSet) error {
+	return d.HCI.StartAdvertisingSet(set)
+}
+
+// StopAdvertisingSet disables and removes the advertising set with the given handle.
+func (d *Device) StopAdvertisingSet(handle uint8) error {
+	return d.HCI.StopAdvertisingSet(handle)
+}
+
 func (d *Device) Scan(ctx context.Context, allowDup bool, h ble.AdvHandler) error {
 	if err := d.HCI.SetAdvHandler(h); err != nil {
 		return err
@@ -243,11 +312,29 @@ func (d *Device) StopScan() error {
 	return nil
 }
 
+// SyncPeriodic synchronizes to the periodic advertising of advertising set sid of a device,
+// and passes the periodic advertisements to h until ctx is done.
+// It requires the device to be created with ble.OptExtendedAdvertising, and to be
+// scanning: start a Scan first, the sync can be created once the device is found.
+func (d *Device) SyncPeriodic(ctx context.Context, a ble.Addr, sid uint8, h ble.PeriodicAdvHandler) error {
+	return d.HCI.SyncPeriodic(ctx, a, sid, h)
+}
+
 // Dial ...
 func (d *Device) Dial(ctx context.Context, a ble.Addr) (ble.Client, error) {
 	// d.HCI.Dial is a blocking call, although most of time it should return immediately.
 	// But in case passing wrong device address or the device went non-connectable, it blocks.
 	cln, err := d.HCI.Dial(ctx, a)
+	return d.client(cln, err)
+}
+
+// DialAcceptList connects to the first device on the filter accept list that is available.
+func (d *Device) DialAcceptList(ctx context.Context) (ble.Client, error) {
+	cln, err := d.HCI.DialAcceptList(ctx)
+	return d.client(cln, err)
+}
+
+func (d *Device) client(cln ble.Client, err error) (ble.Client, error) {
 	if err != nil {
 		return nil, errors.Wrap(err, "device")
 	}
@@ -265,6 +352,48 @@ func (d *Device) Dial(ctx context.Context, a ble.Addr) (ble.Client, error) {
 	return cln, errors.Wrap(err, "can't dial")
 }
 
+// AddToAcceptList adds a device to the filter accept list.
+func (d *Device) AddToAcceptList(a ble.Addr) error {
+	return d.HCI.AddToAcceptList(a)
+}
+
+// RemoveFromAcceptList removes a device from the filter accept list.
+func (d *Device) RemoveFromAcceptList(a ble.Addr) error {
+	return d.HCI.RemoveFromAcceptList(a)
+}
+
+// ClearAcceptList removes all devices from the filter accept list.
+func (d *Device) ClearAcceptList() error {
+	return d.HCI.ClearAcceptList()
+}
+
+// AcceptListSize returns the number of devices the filter accept list can hold.
+func (d *Device) AcceptListSize() (int, error) {
+	return d.HCI.AcceptListSize()
+}
+
+// ScanAcceptList scans like Scan, but reports the devices on the filter accept list only.
+func (d *Device) ScanAcceptList(ctx context.Context, allowDup bool, h ble.AdvHandler) error {
+	if err := d.HCI.SetAdvHandler(h); err != nil {
+		return err
+	}
+
+	if err := d.HCI.ScanAcceptList(allowDup); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	if err := d.HCI.StopScanning(); err != nil {
+		return err
+	}
+
+	return ctx.Err()
+}
+
+// ListenL2CAP accepts the LE credit based channels remote devices open on the LE PSM psm.
+func (d *Device) ListenL2CAP(psm uint16, opts ble.L2CAPOptions) (ble.L2CAPListener, error) {
+	return d.HCI.ListenL2CAP(psm, opts)
+}
+
 // Address returns the listener's device address.
 func (d *Device) Address() ble.Addr {
 	return d.HCI.Addr()
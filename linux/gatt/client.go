@@ -1,6 +1,7 @@
 package gatt
 
 import (
+	"bytes"
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
@@ -18,7 +19,10 @@ const (
 
 // A Client is a GATT Client.
 type Client struct {
+	// Reads and writes only take the read lock, and run concurrently on the
+	// Enhanced ATT bearers. The values read are stored under valueMu.
 	sync.RWMutex
+	valueMu sync.Mutex
 
 	profile *ble.Profile
 	name    string
@@ -61,6 +65,29 @@ func ClientWithServer(c *Client, db *att.DB) *Client {
 	return c
 }
 
+// OpenEATT opens n Enhanced ATT bearers to the server. The reads and writes of
+// characteristics and descriptors done concurrently are spread over the bearers.
+// [Vol 3, Part F, 3.2.11]
+func (p *Client) OpenEATT(n int) error {
+	chs, err := p.conn.OpenEnhancedCreditBasedConnections(ble.PSMEATT, n, ble.L2CAPOptions{MTU: ble.MaxMTU})
+	if err != nil {
+		return err
+	}
+	for i, ch := range chs {
+		nc, err := ch.NetConn()
+		if err == nil {
+			err = p.ac.AddBearer(nc, att.BearerMTU(ch.Info()))
+		}
+		if err != nil {
+			for _, ch := range chs[i:] {
+				ch.Close()
+			}
+			return err
+		}
+	}
+	return nil
+}
+
 // Addr returns the address of the client.
 func (p *Client) Addr() ble.Addr {
 	p.RLock()
@@ -87,6 +114,13 @@ func (p *Client) DiscoverProfile(force bool) (*ble.Profile, error) {
 	if p.profile != nil && !force {
 		return p.profile, nil
 	}
+
+	// The services discovered are added to the profile, which is rediscovered
+	// from scratch, as services may have changed.
+	p.Lock()
+	p.profile = nil
+	p.Unlock()
+
 	ss, err := p.DiscoverServices(nil)
 	if err != nil {
 		return nil, fmt.Errorf("can't discover services: %s", err)
@@ -108,22 +142,38 @@ func (p *Client) DiscoverProfile(force bool) (*ble.Profile, error) {
 }
 
 func (p *Client) DiscoverAndCacheProfile(force bool) (*ble.Profile, error) {
+	// The Database Hash changes if the services of the server change.
+	hash, err := p.ReadDatabaseHash()
+	if err != nil {
+		p.Debugf("gatt: no database hash: %v", err)
+	}
+
 	if !force {
+		if profile := p.Profile(); profile != nil && (hash == nil || bytes.Equal(hash, profile.Hash)) {
+			return profile, nil
+		}
+
 		//check cache to see if we have the profile already
 		if p.cache != nil {
 			profile, err := p.cache.Load(p.Addr())
-			if err == nil {
+			if err == nil && (hash == nil || bytes.Equal(hash, profile.Hash)) {
+				p.Lock()
 				p.profile = &profile
+				p.Unlock()
 				return &profile, nil
 			}
 		}
 	}
 
-	profile, err := p.DiscoverProfile(force)
+	profile, err := p.DiscoverProfile(true)
 	if err != nil {
 		return nil, err
 	}
+	profile.Hash = hash
 
+	if p.cache == nil {
+		return profile, nil
+	}
 	err = p.cache.Store(p.Addr(), *profile, true)
 	if err != nil {
 		return profile, err
@@ -132,6 +182,21 @@ func (p *Client) DiscoverAndCacheProfile(force bool) (*ble.Profile, error) {
 	return profile, nil
 }
 
+// ReadDatabaseHash reads the Database Hash of the server. It returns an error if
+// the server has none. [Vol 3, Part G, 7.3]
+func (p *Client) ReadDatabaseHash() ([]byte, error) {
+	p.RLock()
+	defer p.RUnlock()
+	length, b, err := p.ac.ReadByType(0x0001, 0xFFFF, ble.DatabaseHashUUID)
+	if err != nil {
+		return nil, err
+	}
+	if length != 2+16 || len(b) < length {
+		return nil, fmt.Errorf("invalid database hash: % X", b)
+	}
+	return append([]byte(nil), b[2:length]...), nil
+}
+
 // DiscoverServices finds all the primary services on a server. [Vol 3, Part G, 4.4.1]
 // If filter is specified, only filtered services are returned.
 func (p *Client) DiscoverServices(filter []ble.UUID) ([]*ble.Service, error) {
@@ -258,46 +323,133 @@ func (p *Client) DiscoverDescriptors(filter []ble.UUID, c *ble.Characteristic) (
 
 // ReadCharacteristic reads a characteristic value from a server. [Vol 3, Part G, 4.8.1]
 func (p *Client) ReadCharacteristic(c *ble.Characteristic) ([]byte, error) {
-	p.Lock()
-	defer p.Unlock()
+	p.RLock()
+	defer p.RUnlock()
 	val, err := p.ac.Read(c.ValueHandle)
 	if err != nil {
 		return nil, err
 	}
 
+	p.valueMu.Lock()
 	c.Value = val
+	p.valueMu.Unlock()
 	return val, nil
 }
 
 // ReadLongCharacteristic reads a characteristic value which is longer than the MTU. [Vol 3, Part G, 4.8.3]
 func (p *Client) ReadLongCharacteristic(c *ble.Characteristic) ([]byte, error) {
-	p.Lock()
-	defer p.Unlock()
-
-	// The maximum length of an attribute value shall be 512 octects [Vol 3, 3.2.9]
-	buffer := make([]byte, 0, 512)
+	p.RLock()
+	defer p.RUnlock()
 
-	read, err := p.ac.Read(c.ValueHandle)
+	buffer, err := p.ac.ReadLong(c.ValueHandle)
 	if err != nil {
 		return nil, err
 	}
-	buffer = append(buffer, read...)
 
-	for len(read) >= p.conn.TxMTU()-1 {
-		if read, err = p.ac.ReadBlob(c.ValueHandle, uint16(len(buffer))); err != nil {
+	p.valueMu.Lock()
+	c.Value = buffer
+	p.valueMu.Unlock()
+	return buffer, nil
+}
+
+// ReadMultipleCharacteristics reads the values of several characteristics from a server. [Vol 3, Part G, 4.8.5]
+// Servers that don't support Read Multiple Variable Length are read one characteristic at a time.
+func (p *Client) ReadMultipleCharacteristics(cs []*ble.Characteristic) ([][]byte, error) {
+	p.RLock()
+	defer p.RUnlock()
+
+	vals := make([][]byte, 0, len(cs))
+	for len(cs) > 0 {
+		// Read as many handles as fit in a single request.
+		n := (p.conn.TxMTU() - 1) / 2
+		if n > len(cs) {
+			n = len(cs)
+		}
+
+		var vv [][]byte
+		var err error
+		if n > 1 {
+			vv, err = p.readMultipleVariable(cs[:n])
+		}
+		if n == 1 || err == ble.ErrReqNotSupp {
+			vv, err = p.readEach(cs[:n])
+		}
+		if err != nil {
 			return nil, err
 		}
-		buffer = append(buffer, read...)
+		// The values left out of the response are read with the next request.
+		if len(vv) == 0 || len(vv) > n {
+			return nil, att.ErrInvalidResponse
+		}
+		n = len(vv)
+
+		p.valueMu.Lock()
+		for i, c := range cs[:n] {
+			c.Value = vv[i]
+		}
+		p.valueMu.Unlock()
+		vals = append(vals, vv...)
+		cs = cs[n:]
 	}
 
-	c.Value = buffer
-	return buffer, nil
+	return vals, nil
+}
+
+// readMultipleVariable reads the values of cs with a Read Multiple Variable Length
+// Request, and the rest of a truncated value with Read Blob Requests. The values
+// that don't fit in the response are left out.
+func (p *Client) readMultipleVariable(cs []*ble.Characteristic) ([][]byte, error) {
+	handles := make([]uint16, len(cs))
+	for i, c := range cs {
+		handles[i] = c.ValueHandle
+	}
+	vv, lengths, err := p.ac.ReadMultipleVariable(handles)
+	if err != nil {
+		return nil, err
+	}
+
+	for i, v := range vv {
+		for len(v) < lengths[i] {
+			b, err := p.ac.ReadBlob(handles[i], uint16(len(v)))
+			if err != nil {
+				return nil, err
+			}
+			if len(b) == 0 {
+				return nil, att.ErrInvalidResponse
+			}
+			v = append(v[:len(v):len(v)], b...)
+		}
+		vv[i] = v
+	}
+	return vv, nil
+}
+
+func (p *Client) readEach(cs []*ble.Characteristic) ([][]byte, error) {
+	vals := make([][]byte, 0, len(cs))
+	for _, c := range cs {
+		val, err := p.ac.Read(c.ValueHandle)
+		if err != nil {
+			return nil, err
+		}
+		vals = append(vals, val)
+	}
+	return vals, nil
 }
 
 // WriteCharacteristic writes a characteristic value to a server. [Vol 3, Part G, 4.9.3]
 func (p *Client) WriteCharacteristic(c *ble.Characteristic, v []byte, noRsp bool) error {
-	p.Lock()
-	defer p.Unlock()
+	p.RLock()
+	defer p.RUnlock()
+
+	// Characteristics requiring authenticated writes are signed on unencrypted links. [Vol 3, Part G, 4.9.2]
+	signed := c.Property&ble.CharSignedWrite != 0 && (noRsp || c.Property&ble.CharWrite == 0)
+	if signed && p.ac.CanSign() {
+		if err := p.ac.SignAndWrite(c.ValueHandle, v); err != nil {
+			return fmt.Errorf("signed write: %v", err)
+		}
+		return nil
+	}
+
 	if noRsp {
 		return p.ac.WriteCommand(c.ValueHandle, v)
 	}
@@ -306,21 +458,23 @@ func (p *Client) WriteCharacteristic(c *ble.Characteristic, v []byte, noRsp bool
 
 // ReadDescriptor reads a characteristic descriptor from a server. [Vol 3, Part G, 4.12.1]
 func (p *Client) ReadDescriptor(d *ble.Descriptor) ([]byte, error) {
-	p.Lock()
-	defer p.Unlock()
+	p.RLock()
+	defer p.RUnlock()
 	val, err := p.ac.Read(d.Handle)
 	if err != nil {
 		return nil, err
 	}
 
+	p.valueMu.Lock()
 	d.Value = val
+	p.valueMu.Unlock()
 	return val, nil
 }
 
 // WriteDescriptor writes a characteristic descriptor to a server. [Vol 3, Part G, 4.12.3]
 func (p *Client) WriteDescriptor(d *ble.Descriptor, v []byte) error {
-	p.Lock()
-	defer p.Unlock()
+	p.RLock()
+	defer p.RUnlock()
 	return p.ac.Write(d.Handle, v)
 }
 
@@ -340,6 +494,28 @@ func (p *Client) ExchangeMTU(mtu int) (int, error) {
 	return p.ac.ExchangeMTU(mtu)
 }
 
+// SetDataLength requests the maximum payload size and transmission time of the
+// link layer data PDUs sent to the server. [Vol 2, Part E, 7.8.33]
+func (p *Client) SetDataLength(txOctets, txTime uint16) error {
+	p.Lock()
+	defer p.Unlock()
+	return p.conn.SetDataLength(txOctets, txTime)
+}
+
+// SetPHY requests the PHYs used with the server. [Vol 2, Part E, 7.8.49]
+func (p *Client) SetPHY(tx, rx uint8, opts uint16) error {
+	p.Lock()
+	defer p.Unlock()
+	return p.conn.SetPHY(tx, rx, opts)
+}
+
+// PHY returns the PHYs used with the server. [Vol 2, Part E, 7.8.47]
+func (p *Client) PHY() (uint8, uint8, error) {
+	p.Lock()
+	defer p.Unlock()
+	return p.conn.PHY()
+}
+
 // Subscribe subscribes to indication (if ind is set true), or notification of a
 // characteristic value. [Vol 3, Part G, 4.10 & 4.11]
 func (p *Client) Subscribe(c *ble.Characteristic, ind bool, h ble.NotificationHandler) error {
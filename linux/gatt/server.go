@@ -1,13 +1,24 @@
 package gatt
 
 import (
-	"log"
+	"encoding/binary"
+	"fmt"
 	"sync"
 
 	"github.com/rigado/ble"
 	"github.com/rigado/ble/linux/att"
 )
 
+// The GAP and GATT services are the first services of the server, and aren't removed.
+const numDefaultServices = 2
+
+// Client Supported Features [Vol 3, Part G, 7.2]
+const (
+	featRobustCaching = 0x01
+	featEATT          = 0x02
+	featSupported     = featRobustCaching | featEATT
+)
+
 // NewServerWithName creates a new Server with the specified name
 func NewServerWithName(name string) (*Server, error) {
 	return NewServerWithNameAndHandler(name, nil, ble.GetLogger())
@@ -15,12 +26,16 @@ func NewServerWithName(name string) (*Server, error) {
 
 // NewServerWithNameAndHandler allow to specify a custom NotifyHandler
 func NewServerWithNameAndHandler(name string, notifyHandler ble.NotifyHandler, l ble.Logger) (*Server, error) {
-	return &Server{
-		name:   name,
-		svcs:   defaultServicesWithHandler(name, notifyHandler),
-		db:     att.NewDB(defaultServices(name), uint16(1), l),
-		Logger: l,
-	}, nil
+	s := &Server{
+		name:    name,
+		clients: make(map[string]*client),
+		conns:   make(map[string]*att.Server),
+		Logger:  l,
+	}
+	s.svcs = s.defaultServices(notifyHandler)
+	s.db = att.NewDB(s.svcs, uint16(1), l) // ble attrs start at 1
+	s.db.SetOutOfSync(s.outOfSync)
+	return s, nil
 }
 
 // NewServer ...
@@ -35,24 +50,103 @@ type Server struct {
 
 	svcs []*ble.Service
 	db   *att.DB
+
+	// sc is the Service Changed characteristic. The clients that configured its
+	// indications are indicated when services are added or removed, on their
+	// connection if they are connected, or once they reconnect. [Vol 3, Part G, 7.1]
+	// The clients that enabled Robust Caching become change-unaware meanwhile.
+	// The clients are keyed by identity address, and only the state of bonded
+	// clients is kept once they disconnect. [Vol 3, Part G, 2.5.2.1]
+	sc      *ble.Characteristic
+	clients map[string]*client
+	conns   map[string]*att.Server
+
 	ble.Logger
 }
 
-// AddService ...
+// client is a client that configured Service Changed indications, and the range
+// of handles changed since it was last indicated, if pending, or that wrote its
+// Client Supported Features.
+type client struct {
+	indicate   bool
+	pending    bool
+	start, end uint16
+	indicating bool
+
+	// Robust Caching state [Vol 3, Part G, 2.5.2.1]
+	features      byte
+	unaware       bool
+	outOfSyncSent bool
+}
+
+func (c *client) merge(start, end uint16) {
+	if !c.pending || start < c.start {
+		c.start = start
+	}
+	if !c.pending || end > c.end {
+		c.end = end
+	}
+	c.pending = true
+}
+
+// AddService adds a service to the database. The handles of the other services
+// don't change.
 func (s *Server) AddService(svc *ble.Service) error {
 	s.Lock()
 	defer s.Unlock()
+	return s.addService(svc)
+}
+
+func (s *Server) addService(svc *ble.Service) error {
+	start, end, err := s.db.AddService(svc)
+	if err != nil {
+		return err
+	}
 	s.svcs = append(s.svcs, svc)
-	s.db = att.NewDB(s.svcs, uint16(1), s.Logger) // ble attrs start at 1
+	s.changed(start, end)
 	return nil
 }
 
+// RemoveService removes a service from the database. The handles of the other
+// services don't change.
+func (s *Server) RemoveService(svc *ble.Service) error {
+	s.Lock()
+	defer s.Unlock()
+	return s.removeService(svc)
+}
+
+func (s *Server) removeService(svc *ble.Service) error {
+	for i, ss := range s.svcs {
+		if ss != svc {
+			continue
+		}
+		if i < numDefaultServices {
+			return fmt.Errorf("service %v can't be removed", svc.UUID)
+		}
+		start, end, err := s.db.RemoveService(svc)
+		if err != nil {
+			return err
+		}
+		s.svcs = append(s.svcs[:i], s.svcs[i+1:]...)
+		s.changed(start, end)
+		return nil
+	}
+	return fmt.Errorf("service %v not found", svc.UUID)
+}
+
 // RemoveAllServices ...
 func (s *Server) RemoveAllServices() error {
 	s.Lock()
 	defer s.Unlock()
-	s.svcs = defaultServices(s.name)
-	s.db = att.NewDB(s.svcs, uint16(1), s.Logger) // ble attrs start at 1
+	return s.removeAllServices()
+}
+
+func (s *Server) removeAllServices() error {
+	for len(s.svcs) > numDefaultServices {
+		if err := s.removeService(s.svcs[len(s.svcs)-1]); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -60,8 +154,14 @@ func (s *Server) RemoveAllServices() error {
 func (s *Server) SetServices(svcs []*ble.Service) error {
 	s.Lock()
 	defer s.Unlock()
-	s.svcs = append(defaultServices(s.name), svcs...)
-	s.db = att.NewDB(s.svcs, uint16(1), s.Logger) // ble attrs start at 1
+	if err := s.removeAllServices(); err != nil {
+		return err
+	}
+	for _, svc := range svcs {
+		if err := s.addService(svc); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
@@ -70,16 +170,198 @@ func (s *Server) DB() *att.DB {
 	return s.db
 }
 
-func defaultServices(name string) []*ble.Service {
-	return defaultServicesWithHandler(name, nil)
+// Connected registers the ATT server of a new connection, on which the services
+// changed are indicated. The changes made while a bonded client was disconnected
+// are indicated right away.
+func (s *Server) Connected(c ble.Conn, as *att.Server) {
+	addr := clientAddr(c)
+
+	s.Lock()
+	defer s.Unlock()
+	if !c.Bonded() {
+		// The state kept is the one of a former bond, or of another device.
+		delete(s.clients, addr)
+	}
+	s.conns[addr] = as
+	s.indicate(addr)
+
+	go func() {
+		<-c.Disconnected()
+		s.Lock()
+		defer s.Unlock()
+		if s.conns[addr] == as {
+			delete(s.conns, addr)
+			// A client bonding during the connection is known by its identity since.
+			if !c.Bonded() || clientAddr(c) != addr {
+				delete(s.clients, addr)
+			}
+		}
+	}()
+}
+
+// clientAddr returns the address the state of the client c is kept by, its identity
+// address if it uses a resolvable private address.
+func clientAddr(c ble.Conn) string {
+	if a := c.IdentityAddr(); a != nil {
+		return a.String()
+	}
+	return c.RemoteAddr().String()
+}
+
+// changed indicates the handles start to end changed to the clients.
+func (s *Server) changed(start, end uint16) {
+	for addr, c := range s.clients {
+		if c.features&featRobustCaching != 0 {
+			c.unaware, c.outOfSyncSent = true, false
+		}
+		if c.indicate {
+			c.merge(start, end)
+			s.indicate(addr)
+		}
+	}
+}
+
+// indicate indicates the pending changes to the client addr, if it's connected,
+// and not being indicated already. The server must be locked.
+func (s *Server) indicate(addr string) {
+	c, as := s.clients[addr], s.conns[addr]
+	if c == nil || as == nil || !c.indicate || !c.pending || c.indicating {
+		return
+	}
+	start, end := c.start, c.end
+	c.pending, c.indicating = false, true
+
+	go func() {
+		b := make([]byte, 4)
+		binary.LittleEndian.PutUint16(b, start)
+		binary.LittleEndian.PutUint16(b[2:], end)
+		err := as.Indicate(s.sc.ValueHandle, b)
+
+		s.Lock()
+		defer s.Unlock()
+		c.indicating = false
+		if err != nil {
+			// The client is indicated again once it reconnects.
+			s.Warnf("gatt: can't indicate services changed to %v: %v", addr, err)
+			c.merge(start, end)
+			return
+		}
+		// The client confirmed the indication of all the changes.
+		if !c.pending {
+			c.unaware = false
+		}
+		s.indicate(addr)
+	}()
+}
+
+// serveServiceChanged registers the clients that configure Service Changed indications.
+// The bonded clients that disconnect keep being registered, as they are indicated the
+// services changed once they reconnect. The indications are also served by h, if not nil.
+func (s *Server) serveServiceChanged(h ble.NotifyHandler) ble.NotifyHandlerFunc {
+	return func(req ble.Request, n ble.Notifier) {
+		addr := clientAddr(req.Conn())
+		s.Lock()
+		s.client(addr).indicate = true
+		s.Unlock()
+
+		if h != nil {
+			go h.ServeNotify(req, n)
+		}
+		<-n.Context().Done()
+
+		select {
+		case <-req.Conn().Disconnected():
+		default:
+			s.Debugf("gatt: %v unsubscribed from services changed", addr)
+			s.Lock()
+			if c := s.clients[addr]; c != nil {
+				c.indicate, c.pending = false, false
+				if c.features == 0 {
+					delete(s.clients, addr)
+				}
+			}
+			s.Unlock()
+		}
+	}
+}
+
+// client returns the client addr, which is registered if it isn't yet. The server
+// must be locked.
+func (s *Server) client(addr string) *client {
+	c, ok := s.clients[addr]
+	if !ok {
+		c = &client{}
+		s.clients[addr] = c
+	}
+	return c
+}
+
+// readFeatures serves the Client Supported Features of the clients. [Vol 3, Part G, 7.2]
+func (s *Server) readFeatures(req ble.Request, rsp ble.ResponseWriter) {
+	s.Lock()
+	defer s.Unlock()
+	var f byte
+	if c := s.clients[clientAddr(req.Conn())]; c != nil {
+		f = c.features
+	}
+	rsp.Write([]byte{f})
+}
+
+// writeFeatures sets the Client Supported Features of the clients, which can enable
+// features, but not disable them. [Vol 3, Part G, 7.2]
+func (s *Server) writeFeatures(req ble.Request, rsp ble.ResponseWriter) {
+	addr := clientAddr(req.Conn())
+	s.Lock()
+	defer s.Unlock()
+
+	if len(req.Data()) == 0 {
+		rsp.SetStatus(ble.ErrInvalAttrValueLen)
+		return
+	}
+	c := s.client(addr)
+	f := req.Data()[0] & featSupported
+	if c.features&^f != 0 {
+		rsp.SetStatus(ble.ErrValueNotAllowed)
+		return
+	}
+	c.features = f
 }
 
-func defaultServicesWithHandler(name string, handler ble.NotifyHandler) []*ble.Service {
+// outOfSync reports whether the request req of the client c is refused, as the
+// client enabled Robust Caching, and is change-unaware. The client becomes
+// change-aware once it reads the Database Hash, or sends a request after it was
+// told it's out of sync. [Vol 3, Part G, 2.5.2.1]
+func (s *Server) outOfSync(c ble.Conn, req []byte) bool {
+	s.Lock()
+	defer s.Unlock()
+	cl := s.clients[clientAddr(c)]
+	if cl == nil || !cl.unaware {
+		return false
+	}
+
+	switch {
+	case req[0] == att.ExchangeMTURequestCode:
+		return false
+	case req[0] == att.ReadByTypeRequestCode && len(req) == 7 && ble.UUID(req[5:]).Equal(ble.DatabaseHashUUID):
+		cl.unaware = false
+		return false
+	case req[0]&0x40 != 0:
+		// Commands are ignored.
+		return true
+	case cl.outOfSyncSent:
+		cl.unaware = false
+		return false
+	}
+	cl.outOfSyncSent = true
+	return true
+}
+
+func (s *Server) defaultServices(handler ble.NotifyHandler) []*ble.Service {
 	// https://developer.bluetooth.org/gatt/characteristics/Pages/CharacteristicViewer.aspx?u=org.bluetooth.characteristic.ble.appearance.xml
 	var gapCharAppearanceGenericComputer = []byte{0x00, 0x80}
 
 	gapSvc := ble.NewService(ble.GAPUUID)
-	gapSvc.NewCharacteristic(ble.DeviceNameUUID).SetValue([]byte(name))
+	gapSvc.NewCharacteristic(ble.DeviceNameUUID).SetValue([]byte(s.name))
 	gapSvc.NewCharacteristic(ble.AppearanceUUID).SetValue(gapCharAppearanceGenericComputer)
 	gapSvc.NewCharacteristic(ble.PeripheralPrivacyUUID).SetValue([]byte{0x00})
 	gapSvc.NewCharacteristic(ble.ReconnectionAddrUUID).SetValue([]byte{0x00, 0x00, 0x00, 0x00, 0x00, 0x00})
@@ -87,22 +369,20 @@ func defaultServicesWithHandler(name string, handler ble.NotifyHandler) []*ble.S
 	gapSvc.NewCharacteristic(ble.CentralAddressResolutionUUID).SetValue([]byte{0x00})
 
 	gattSvc := ble.NewService(ble.GATTUUID)
-	var indicationHandler ble.NotifyHandlerFunc
-	indicationHandler = defaultHanderFunc
-	if handler != nil {
-		indicationHandler = handler.ServeNotify
-	}
-	gattSvc.NewCharacteristic(ble.ServiceChangedUUID).HandleIndicate(indicationHandler)
-	return []*ble.Service{gapSvc, gattSvc}
-}
-
-func defaultHanderFunc(r ble.Request, n ble.Notifier) {
-	log.Printf("TODO: indicate client when the services are changed")
-	for {
-		select {
-		case <-n.Context().Done():
-			log.Printf("count: Notification unsubscribed")
+	s.sc = gattSvc.NewCharacteristic(ble.ServiceChangedUUID)
+	s.sc.HandleIndicate(s.serveServiceChanged(handler))
+	csf := gattSvc.NewCharacteristic(ble.ClientSupportedFeaturesUUID)
+	csf.HandleRead(ble.ReadHandlerFunc(s.readFeatures))
+	csf.HandleWrite(ble.WriteHandlerFunc(s.writeFeatures))
+	hash := gattSvc.NewCharacteristic(ble.DatabaseHashUUID)
+	hash.HandleRead(ble.ReadHandlerFunc(func(req ble.Request, rsp ble.ResponseWriter) {
+		h, err := s.db.Hash()
+		if err != nil {
+			s.Errorf("gatt: can't compute the database hash: %v", err)
+			rsp.SetStatus(ble.ErrUnlikely)
 			return
 		}
-	}
+		rsp.Write(h)
+	}))
+	return []*ble.Service{gapSvc, gattSvc}
 }
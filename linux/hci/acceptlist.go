@@ -0,0 +1,233 @@
+package hci
+
+import (
+	"bytes"
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rigado/ble"
+	"github.com/rigado/ble/linux/hci/cmd"
+	"github.com/rigado/ble/sliceops"
+)
+
+// Address types of identity addresses resolved by the controller [Vol 2, Part E, 7.7.65.1]
+const (
+	addrTypePublicIdentity = 0x02
+	addrTypeRandomIdentity = 0x03
+)
+
+// AddToAcceptList adds a device to the controller's filter accept list.
+// A bonded device that distributed its identity resolving key is added by its
+// identity address, and the key is loaded to the resolving list, so the device
+// is accepted while using resolvable private addresses as well.
+func (h *HCI) AddToAcceptList(a ble.Addr) error {
+	at, ab, err := peerAddress(a)
+	if err != nil {
+		return err
+	}
+
+	if bi := h.bondedIdentity(ab); bi != nil {
+		at = bi.IdentityAddressType()
+		if err := h.addToResolvingList(bi); err != nil {
+			h.Warnf("accept list: can't add %v to resolving list: %v", a, err)
+		}
+	}
+
+	h.Infof("accept list: add %v, type %v", a, at)
+	return h.Send(&cmd.LEAddDeviceToWhiteList{AddressType: at, Address: ab}, nil)
+}
+
+// RemoveFromAcceptList removes a device from the controller's filter accept list.
+func (h *HCI) RemoveFromAcceptList(a ble.Addr) error {
+	at, ab, err := peerAddress(a)
+	if err != nil {
+		return err
+	}
+
+	if bi := h.bondedIdentity(ab); bi != nil {
+		at = bi.IdentityAddressType()
+	}
+
+	h.Infof("accept list: remove %v, type %v", a, at)
+	return h.Send(&cmd.LERemoveDeviceFromWhiteList{AddressType: at, Address: ab}, nil)
+}
+
+// ClearAcceptList removes all devices from the controller's filter accept list.
+func (h *HCI) ClearAcceptList() error {
+	return h.Send(&cmd.LEClearWhiteList{}, nil)
+}
+
+// AcceptListSize returns the number of devices the controller's filter accept list can hold.
+func (h *HCI) AcceptListSize() (int, error) {
+	rp := cmd.LEReadWhiteListSizeRP{}
+	if err := h.Send(&cmd.LEReadWhiteListSize{}, &rp); err != nil {
+		return 0, err
+	}
+	return int(rp.WhiteListSize), nil
+}
+
+// ScanAcceptList starts scanning, and reports the advertisements of the devices
+// on the filter accept list only.
+func (h *HCI) ScanAcceptList(allowDup bool) error {
+	if err := h.setScanFilterPolicy(FilterPolicyAcceptWhitelist); err != nil {
+		return err
+	}
+	return h.scan(allowDup)
+}
+
+// DialAcceptList connects to the first device on the filter accept list that
+// is available.
+func (h *HCI) DialAcceptList(ctx context.Context) (ble.Client, error) {
+	return h.dialAcceptList(ctx, h.dialerTmo)
+}
+
+// ConnectAcceptList keeps a connection pending to the devices on the filter
+// accept list, until one of them connects or ctx is done. Unlike
+// DialAcceptList, it isn't bound by the dialer timeout.
+func (h *HCI) ConnectAcceptList(ctx context.Context) (ble.Client, error) {
+	return h.dialAcceptList(ctx, 0)
+}
+
+func (h *HCI) dialAcceptList(ctx context.Context, d time.Duration) (ble.Client, error) {
+	h.params.connParams.InitiatorFilterPolicy = FilterPolicyAcceptWhitelist
+	h.params.connParams.PeerAddressType = 0
+	h.params.connParams.PeerAddress = [6]byte{}
+
+	h.Infof("dial: accept list")
+	return h.dial(ctx, d)
+}
+
+// setScanFilterPolicy updates the scanning parameters, if the scanning filter policy changes.
+func (h *HCI) setScanFilterPolicy(policy uint8) error {
+	if h.params.scanParams.ScanningFilterPolicy == policy {
+		return nil
+	}
+	h.params.scanParams.ScanningFilterPolicy = policy
+	if h.extAdv {
+		return h.Send(h.extScanParams(), nil)
+	}
+	return h.Send(&h.params.scanParams, nil)
+}
+
+// LoadResolvingList replaces the controller's resolving list with the identity
+// resolving keys of the bonded devices, and enables address resolution.
+// It does nothing if the controller doesn't support LL privacy, or the bond
+// manager can't list the bonds.
+func (h *HCI) LoadResolvingList() error {
+	l, ok := h.resolver.(IdentityLister)
+	if !ok || h.leFeatures&leFeatureLLPrivacy == 0 {
+		return nil
+	}
+
+	rp := cmd.LEReadResolvingListSizeRP{}
+	if err := h.Send(&cmd.LEReadResolvingListSize{}, &rp); err != nil {
+		return errors.Wrap(err, "can't read resolving list size")
+	}
+
+	// The resolving list can't be changed while address resolution is enabled.
+	if err := h.Send(&cmd.LESetAddressResolutionEnable{AddressResolutionEnable: 0}, nil); err != nil {
+		return errors.Wrap(err, "can't disable address resolution")
+	}
+	if err := h.Send(&cmd.LEClearResolvingList{}, nil); err != nil {
+		return errors.Wrap(err, "can't clear resolving list")
+	}
+
+	h.Lock()
+	h.resolvingList = make(map[[6]byte]bool)
+	h.resolvingListSize = int(rp.ResolvingListSize)
+	h.Unlock()
+
+	n := 0
+	for _, bi := range l.Identities() {
+		if err := h.sendResolvingListEntry(bi); err != nil {
+			h.Warnf("resolving list: %v", err)
+			break
+		}
+		n++
+	}
+
+	h.Infof("resolving list: loaded %v of %v entries", n, rp.ResolvingListSize)
+	return h.Send(&cmd.LESetAddressResolutionEnable{AddressResolutionEnable: 1}, nil)
+}
+
+// addToResolvingList adds the identity resolving key of a bonded device to the
+// resolving list, unless it's already loaded.
+func (h *HCI) addToResolvingList(bi BondInfo) error {
+	h.Lock()
+	var ia [6]byte
+	copy(ia[:], bi.IdentityAddress())
+	loaded := h.resolvingList == nil || h.resolvingList[ia]
+	h.Unlock()
+	if loaded {
+		// Not using the resolving list, or nothing to do.
+		return nil
+	}
+
+	if err := h.Send(&cmd.LESetAddressResolutionEnable{AddressResolutionEnable: 0}, nil); err != nil {
+		return err
+	}
+	err := h.sendResolvingListEntry(bi)
+	if e := h.Send(&cmd.LESetAddressResolutionEnable{AddressResolutionEnable: 1}, nil); err == nil {
+		err = e
+	}
+	return err
+}
+
+// sendResolvingListEntry adds a bonded device to the controller's resolving list.
+// Address resolution must be disabled.
+func (h *HCI) sendResolvingListEntry(bi BondInfo) error {
+	irk, ia := bi.IdentityResolvingKey(), bi.IdentityAddress()
+	if len(irk) != 16 || len(ia) != 6 {
+		return errors.New("invalid identity")
+	}
+
+	h.Lock()
+	full := len(h.resolvingList) >= h.resolvingListSize
+	h.Unlock()
+	if full {
+		return errors.New("resolving list full")
+	}
+
+	// The local device uses its identity address, so its IRK is all zeros.
+	c := cmd.LEAddDeviceToResolvingList{PeerIdentityAddressType: bi.IdentityAddressType()}
+	copy(c.PeerIdentityAddress[:], ia)
+	copy(c.PeerIRK[:], irk)
+	if err := h.Send(&c, nil); err != nil {
+		return errors.Wrapf(err, "can't add %X", ia)
+	}
+
+	h.Lock()
+	h.resolvingList[c.PeerIdentityAddress] = true
+	h.Unlock()
+	return nil
+}
+
+// bondedIdentity returns the bond of the device with the identity address ab, or nil.
+func (h *HCI) bondedIdentity(ab [6]byte) BondInfo {
+	l, ok := h.resolver.(IdentityLister)
+	if !ok {
+		return nil
+	}
+	for _, bi := range l.Identities() {
+		if bytes.Equal(bi.IdentityAddress(), ab[:]) {
+			return bi
+		}
+	}
+	return nil
+}
+
+// peerAddress returns the address type and the little endian address of a.
+func peerAddress(a ble.Addr) (uint8, [6]byte, error) {
+	var b [6]byte
+	ab := a.Bytes()
+	if len(ab) != 6 {
+		return 0, b, ErrInvalidAddr
+	}
+	copy(b[:], sliceops.SwapBuf(ab))
+
+	if _, ok := a.(RandomAddress); ok {
+		return AddressTypeRandom, b, nil
+	}
+	return AddressTypePublic, b, nil
+}
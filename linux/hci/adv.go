@@ -26,6 +26,20 @@ const (
 	evtTypScanRsp       = 0x04 // Scan Response (SCAN_RSP).
 )
 
+// Event type bits of the LE Extended Advertising Report. [Vol 2, Part E, 7.7.65.13]
+const (
+	extEvtTypConnectable    = 0x0001
+	extEvtTypScannable      = 0x0002
+	extEvtTypDirected       = 0x0004
+	extEvtTypScanRsp        = 0x0008
+	extEvtTypLegacy         = 0x0010
+	extEvtTypDataStatus     = 0x0060
+	extEvtTypDataIncomplete = 0x0020 // more data to come
+)
+
+// sidNone is reported for advertisements without an ADI field.
+const sidNone = 0xff
+
 func newAdvertisement(e evt.LEAdvertisingReport, i int) (*Advertisement, error) {
 	ad, err := e.DataWErr(i)
 	if err != nil {
@@ -47,6 +61,35 @@ func newAdvertisement(e evt.LEAdvertisingReport, i int) (*Advertisement, error)
 	return a, nil
 }
 
+func newExtendedAdvertisement(e evt.LEExtendedAdvertisingReport, i int, data []byte) (*Advertisement, error) {
+	p, err := adv.NewRawPacket(data)
+	if err != nil {
+		a, _ := e.AddressWErr(i)
+		return nil, errors.Wrap(err, hex.EncodeToString([]byte{a[5], a[4], a[3], a[2], a[1], a[0]}))
+	}
+
+	ts := int64(time.Now().UnixNano() / 1000)
+	a := &Advertisement{x: e, i: i, xd: data, p: p, ts: ts}
+	return a, nil
+}
+
+// extEventType maps the event type of an extended advertising report to
+// the legacy advertising event types.
+func extEventType(et uint16) uint8 {
+	switch {
+	case et&extEvtTypScanRsp != 0:
+		return evtTypScanRsp
+	case et&extEvtTypDirected != 0 && et&extEvtTypConnectable != 0:
+		return evtTypAdvDirectInd
+	case et&extEvtTypConnectable != 0:
+		return evtTypAdvInd
+	case et&extEvtTypScannable != 0:
+		return evtTypAdvScanInd
+	default:
+		return evtTypAdvNonconnInd
+	}
+}
+
 // Advertisement implements ble.Advertisement and other functions that are only
 // available on Linux.
 type Advertisement struct {
@@ -55,6 +98,14 @@ type Advertisement struct {
 	sr *Advertisement
 	ts int64
 
+	// x and xd are set instead of e for extended advertising reports;
+	// xd holds the data reassembled from all the fragments.
+	x  evt.LEExtendedAdvertisingReport
+	xd []byte
+
+	// identity address resolved from a resolvable private address.
+	identity ble.Addr
+
 	// cached packets.
 	p *adv.Packet
 }
@@ -62,12 +113,12 @@ type Advertisement struct {
 // setScanResponse associate scan response to the existing advertisement.
 func (a *Advertisement) setScanResponse(sr *Advertisement) error {
 
-	ad, err := a.e.DataWErr(a.i)
+	ad, err := a.dataWErr()
 	if err != nil {
 		return err
 	}
 
-	srd, err := sr.e.DataWErr(sr.i)
+	srd, err := sr.dataWErr()
 	if err != nil {
 		return err
 	}
@@ -144,6 +195,12 @@ func (a *Advertisement) Addr() ble.Addr {
 	return v
 }
 
+// IdentityAddr returns the identity address of the remote peripheral,
+// or nil if it is not using a resolvable private address of a bonded device.
+func (a *Advertisement) IdentityAddr() ble.Addr {
+	return a.identity
+}
+
 // EventType returns the event type of Advertisement.
 // This is linux specific.
 func (a *Advertisement) EventType() uint8 {
@@ -183,6 +240,26 @@ func (a *Advertisement) Timestamp() int64 {
 	return a.ts
 }
 
+// PrimaryPHY returns the PHY the advertisement was received on.
+func (a *Advertisement) PrimaryPHY() uint8 {
+	v, _ := a.primaryPHYWErr()
+	return v
+}
+
+// SecondaryPHY returns the PHY of the auxiliary packets of an extended advertisement,
+// or 0 if there are none.
+func (a *Advertisement) SecondaryPHY() uint8 {
+	v, _ := a.secondaryPHYWErr()
+	return v
+}
+
+// SID returns the advertising set ID of an extended advertisement,
+// or 0xFF if there is none.
+func (a *Advertisement) SID() uint8 {
+	v, _ := a.sidWErr()
+	return v
+}
+
 func (a *Advertisement) ToMap() (map[string]interface{}, error) {
 	m := make(map[string]interface{})
 	keys := ble.AdvertisementMapKeys
@@ -199,6 +276,10 @@ func (a *Advertisement) ToMap() (map[string]interface{}, error) {
 	}
 	m[keys.AddressType] = at
 
+	if a.identity != nil {
+		m[keys.IdentityAddress] = strings.Replace(a.identity.String(), ":", "", -1)
+	}
+
 	et, err := a.eventTypeWErr()
 	if err != nil {
 		return nil, errors.Wrap(err, keys.EventType)
@@ -211,6 +292,12 @@ func (a *Advertisement) ToMap() (map[string]interface{}, error) {
 	}
 	m[keys.Connectable] = c
 
+	if a.x != nil {
+		m[keys.PrimaryPHY] = a.PrimaryPHY()
+		m[keys.SecondaryPHY] = a.SecondaryPHY()
+		m[keys.SID] = a.SID()
+	}
+
 	r, err := a.rssiWErr()
 	if err != nil {
 		return nil, errors.Wrap(err, keys.RSSI)
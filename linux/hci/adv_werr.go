@@ -69,37 +69,61 @@ func (a *Advertisement) connectableWErr() (bool, error) {
 }
 
 func (a *Advertisement) rssiWErr() (int, error) {
+	if a.x != nil {
+		r, err := a.x.RSSIWErr(a.i)
+		return int(r), err
+	}
 	r, err := a.e.RSSIWErr(a.i)
 	return int(r), err
 }
 
+func (a *Advertisement) rawAddrWErr() ([6]byte, error) {
+	if a.x != nil {
+		return a.x.AddressWErr(a.i)
+	}
+	return a.e.AddressWErr(a.i)
+}
+
 func (a *Advertisement) addrWErr() (ble.Addr, error) {
-	b, err := a.e.AddressWErr(a.i)
+	b, err := a.rawAddrWErr()
 	if err != nil {
 		return nil, err
 	}
 
 	addr := ble.NewAddr(
 		net.HardwareAddr([]byte{b[5], b[4], b[3], b[2], b[1], b[0]}).String())
-	at, err := a.e.AddressTypeWErr(a.i)
+	at, err := a.addressTypeWErr()
 	if err != nil {
 		return nil, err
 	}
-	if at == 1 {
+	if at == 1 || at == addrTypeRandomIdentity {
 		return RandomAddress{addr}, nil
 	}
 	return addr, nil
 }
 
 func (a *Advertisement) eventTypeWErr() (uint8, error) {
+	if a.x != nil {
+		et, err := a.x.EventTypeWErr(a.i)
+		if err != nil {
+			return 0xff, err
+		}
+		return extEventType(et), nil
+	}
 	return a.e.EventTypeWErr(a.i)
 }
 
 func (a *Advertisement) addressTypeWErr() (uint8, error) {
+	if a.x != nil {
+		return a.x.AddressTypeWErr(a.i)
+	}
 	return a.e.AddressTypeWErr(a.i)
 }
 
 func (a *Advertisement) dataWErr() ([]byte, error) {
+	if a.x != nil {
+		return a.xd, nil
+	}
 	return a.e.DataWErr(a.i)
 }
 
@@ -108,9 +132,33 @@ func (a *Advertisement) srDataWErr() ([]byte, error) {
 	if a.sr == nil {
 		return nil, nil
 	}
+	if a.x != nil {
+		return a.sr.dataWErr()
+	}
 	return a.e.DataWErr(a.sr.i)
 }
 
+func (a *Advertisement) primaryPHYWErr() (uint8, error) {
+	if a.x != nil {
+		return a.x.PrimaryPHYWErr(a.i)
+	}
+	return ble.PHY1M, nil
+}
+
+func (a *Advertisement) secondaryPHYWErr() (uint8, error) {
+	if a.x != nil {
+		return a.x.SecondaryPHYWErr(a.i)
+	}
+	return 0, nil
+}
+
+func (a *Advertisement) sidWErr() (uint8, error) {
+	if a.x != nil {
+		return a.x.AdvertisingSIDWErr(a.i)
+	}
+	return sidNone, nil
+}
+
 func (a *Advertisement) scanResponseWErr() ([]byte, error) {
 	if a.sr == nil {
 		return nil, nil
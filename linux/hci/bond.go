@@ -5,6 +5,18 @@ type bondInfo struct {
 	ediv        uint16
 	randVal     uint64
 	legacy      bool
+
+	authenticated bool
+	peripheralKey bool
+
+	identityResolvingKey []byte
+	identityAddr         []byte
+	identityAddrType     byte
+
+	localSigningKey   []byte
+	remoteSigningKey  []byte
+	localSignCounter  uint32
+	remoteSignCounter uint32
 }
 
 type BondManager interface {
@@ -14,11 +26,39 @@ type BondManager interface {
 	Delete(addr string) error
 }
 
+// IdentityResolver is implemented by bond managers that can resolve a
+// resolvable private address to the bond of the device using it.
+// The address is in little endian order, the same as the bond manager keys.
+type IdentityResolver interface {
+	ResolveIdentity(addr []byte) (BondInfo, bool)
+}
+
+// IdentityLister is implemented by bond managers that can list the bonds of
+// the devices that distributed an identity resolving key.
+type IdentityLister interface {
+	Identities() []BondInfo
+}
+
+// BondLister is implemented by bond managers that can list their bonds, keyed
+// by address, e.g. to show and delete them.
+type BondLister interface {
+	List() (map[string]BondInfo, error)
+}
+
 type BondInfo interface {
 	LongTermKey() []byte
 	EDiv() uint16
 	Random() uint64
 	Legacy() bool
+	Authenticated() bool
+	PeripheralKey() bool
+	IdentityResolvingKey() []byte
+	IdentityAddress() []byte
+	IdentityAddressType() byte
+	LocalSigningKey() []byte
+	RemoteSigningKey() []byte
+	LocalSignCounter() uint32
+	RemoteSignCounter() uint32
 }
 
 func NewBondInfo(longTermKey []byte, ediv uint16, random uint64, legacy bool) BondInfo {
@@ -30,6 +70,62 @@ func NewBondInfo(longTermKey []byte, ediv uint16, random uint64, legacy bool) Bo
 	}
 }
 
+// WithIdentity returns a copy of bi that includes the identity resolving key
+// and identity address distributed by the peer.
+func WithIdentity(bi BondInfo, irk []byte, addr []byte, addrType byte) BondInfo {
+	b := copyBondInfo(bi)
+	b.identityResolvingKey = irk
+	b.identityAddr = addr
+	b.identityAddrType = addrType
+	return b
+}
+
+// WithAuthentication returns a copy of bi that records whether the long term key
+// was generated with MITM protection.
+func WithAuthentication(bi BondInfo, authenticated bool) BondInfo {
+	b := copyBondInfo(bi)
+	b.authenticated = authenticated
+	return b
+}
+
+// WithPeripheralKey returns a copy of bi that records whether the long term key
+// of a legacy bond is the one distributed by the local device, used while it's
+// the peripheral.
+func WithPeripheralKey(bi BondInfo, peripheral bool) BondInfo {
+	b := copyBondInfo(bi)
+	b.peripheralKey = peripheral
+	return b
+}
+
+// WithSigning returns a copy of bi that includes the connection signature
+// resolving keys and sign counters used for signed writes.
+func WithSigning(bi BondInfo, localKey, remoteKey []byte, localCounter, remoteCounter uint32) BondInfo {
+	b := copyBondInfo(bi)
+	b.localSigningKey = localKey
+	b.remoteSigningKey = remoteKey
+	b.localSignCounter = localCounter
+	b.remoteSignCounter = remoteCounter
+	return b
+}
+
+func copyBondInfo(bi BondInfo) *bondInfo {
+	return &bondInfo{
+		longTermKey:          bi.LongTermKey(),
+		ediv:                 bi.EDiv(),
+		randVal:              bi.Random(),
+		legacy:               bi.Legacy(),
+		authenticated:        bi.Authenticated(),
+		peripheralKey:        bi.PeripheralKey(),
+		identityResolvingKey: bi.IdentityResolvingKey(),
+		identityAddr:         bi.IdentityAddress(),
+		identityAddrType:     bi.IdentityAddressType(),
+		localSigningKey:      bi.LocalSigningKey(),
+		remoteSigningKey:     bi.RemoteSigningKey(),
+		localSignCounter:     bi.LocalSignCounter(),
+		remoteSignCounter:    bi.RemoteSignCounter(),
+	}
+}
+
 func (b *bondInfo) LongTermKey() []byte {
 	return b.longTermKey
 }
@@ -45,3 +141,39 @@ func (b *bondInfo) Random() uint64 {
 func (b *bondInfo) Legacy() bool {
 	return b.legacy
 }
+
+func (b *bondInfo) Authenticated() bool {
+	return b.authenticated
+}
+
+func (b *bondInfo) PeripheralKey() bool {
+	return b.peripheralKey
+}
+
+func (b *bondInfo) IdentityResolvingKey() []byte {
+	return b.identityResolvingKey
+}
+
+func (b *bondInfo) IdentityAddress() []byte {
+	return b.identityAddr
+}
+
+func (b *bondInfo) IdentityAddressType() byte {
+	return b.identityAddrType
+}
+
+func (b *bondInfo) LocalSigningKey() []byte {
+	return b.localSigningKey
+}
+
+func (b *bondInfo) RemoteSigningKey() []byte {
+	return b.remoteSigningKey
+}
+
+func (b *bondInfo) LocalSignCounter() uint32 {
+	return b.localSignCounter
+}
+
+func (b *bondInfo) RemoteSignCounter() uint32 {
+	return b.remoteSignCounter
+}
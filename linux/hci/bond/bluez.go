@@ -0,0 +1,319 @@
+package bond
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/rigado/ble/internal/atomicfile"
+	"github.com/rigado/ble/linux/hci"
+)
+
+// BlueZ stores the bonds of an adapter in /var/lib/bluetooth/<adapter>/<device>/info,
+// an INI file per device. The keys are in the byte order of the SMP PDUs, like the
+// bonds of this package, the EDiv and Rand values in decimal.
+const (
+	bluezInfo = "info"
+
+	bluezGeneral    = "General"
+	bluezLTK        = "LongTermKey"
+	bluezPeriphLTK  = "PeripheralLongTermKey"
+	bluezSlaveLTK   = "SlaveLongTermKey" // before BlueZ 5.62
+	bluezIRK        = "IdentityResolvingKey"
+	bluezLocalCSRK  = "LocalSignatureKey"
+	bluezRemoteCSRK = "RemoteSignatureKey"
+
+	// Authenticated of a long term key: bit 0 is set for the keys generated with MITM
+	// protection, bit 1 for the LE Secure Connections keys
+	bluezAuthMITM = 1
+	bluezAuthP256 = 2
+)
+
+// ImportBlueZ reads the LE bonds BlueZ stores for an adapter in the directory dir,
+// e.g. /var/lib/bluetooth/00:11:22:33:44:55. The bonds are keyed by address, like
+// the bonds of a bond manager. The devices without a long term key are skipped.
+func ImportBlueZ(dir string) (map[string]hci.BondInfo, error) {
+	entries, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make(map[string]hci.BondInfo)
+	for _, e := range entries {
+		addr, err := bluezAddr(e.Name())
+		if err != nil || !e.IsDir() {
+			continue
+		}
+		b, err := ioutil.ReadFile(filepath.Join(dir, e.Name(), bluezInfo))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		bd, ok, err := parseBlueZInfo(b, addr)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bluez bond for %s: %s", e.Name(), err)
+		}
+		if !ok {
+			continue
+		}
+		bi, err := createBondInfo(bd)
+		if err != nil {
+			return nil, fmt.Errorf("invalid bluez bond for %s: %s", e.Name(), err)
+		}
+		out[hex.EncodeToString(addr)] = bi
+	}
+	return out, nil
+}
+
+// ExportBlueZ writes the bonds, keyed by address, in the BlueZ directory dir of an
+// adapter. The other settings of the devices BlueZ already knows are kept. The
+// devices without an identity address are written as public devices.
+func ExportBlueZ(dir string, bonds map[string]hci.BondInfo) error {
+	for k, bi := range bonds {
+		addr, err := hex.DecodeString(k)
+		if err != nil || len(addr) != 6 {
+			return fmt.Errorf("invalid address: %s", k)
+		}
+
+		ddir := filepath.Join(dir, bluezDirName(addr))
+		if err := os.MkdirAll(ddir, 0700); err != nil {
+			return err
+		}
+		path := filepath.Join(ddir, bluezInfo)
+		b, err := ioutil.ReadFile(path)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+
+		f := parseINI(b)
+		setBlueZInfo(f, createBondData(bi), bi)
+		if err := atomicfile.WriteFile(path, f.bytes(), 0600); err != nil {
+			return fmt.Errorf("failed to export bond for %s: %s", k, err)
+		}
+	}
+	return nil
+}
+
+// parseBlueZInfo maps the keys of an info file onto a bondData. It reports false if
+// the device has no long term key.
+func parseBlueZInfo(b []byte, addr []byte) (bondData, bool, error) {
+	f := parseINI(b)
+	bd := bondData{}
+
+	ltk := f.section(bluezLTK)
+	for _, s := range []string{bluezPeriphLTK, bluezSlaveLTK} {
+		if ltk == nil {
+			ltk = f.section(s)
+			bd.PeripheralKey = ltk != nil
+		}
+	}
+	if ltk == nil {
+		return bd, false, nil
+	}
+
+	bd.LongTermKey = strings.ToLower(ltk.get("Key"))
+	ediv, err := strconv.ParseUint(ltk.getOr("EDiv", "0"), 10, 16)
+	if err != nil {
+		return bd, false, fmt.Errorf("invalid EDiv: %s", err)
+	}
+	rand, err := strconv.ParseUint(ltk.getOr("Rand", "0"), 10, 64)
+	if err != nil {
+		return bd, false, fmt.Errorf("invalid Rand: %s", err)
+	}
+	bd.EncryptionDiversifier = hex.EncodeToString(binary.LittleEndian.AppendUint16(nil, uint16(ediv)))
+	bd.RandomValue = hex.EncodeToString(binary.LittleEndian.AppendUint64(nil, rand))
+	if auth, err := strconv.Atoi(ltk.get("Authenticated")); err == nil {
+		bd.Legacy = auth&bluezAuthP256 == 0
+		bd.Authenticated = auth&bluezAuthMITM != 0
+	} else {
+		bd.Legacy = ediv != 0 || rand != 0
+	}
+
+	if irk := f.section(bluezIRK); irk != nil {
+		bd.IdentityResolvingKey = strings.ToLower(irk.get("Key"))
+		bd.IdentityAddress = hex.EncodeToString(addr)
+		if g := f.section(bluezGeneral); g != nil && g.get("AddressType") == "static" {
+			bd.IdentityAddressType = 1
+		}
+	}
+
+	local, remote := f.section(bluezLocalCSRK), f.section(bluezRemoteCSRK)
+	if local != nil || remote != nil {
+		if local != nil {
+			bd.LocalSigningKey = strings.ToLower(local.get("Key"))
+			c, _ := strconv.ParseUint(local.getOr("Counter", "0"), 10, 32)
+			bd.LocalSignCounter = uint32(c)
+		}
+		if remote != nil {
+			bd.RemoteSigningKey = strings.ToLower(remote.get("Key"))
+			c, _ := strconv.ParseUint(remote.getOr("Counter", "0"), 10, 32)
+			bd.RemoteSignCounter = uint32(c)
+		}
+	}
+	return bd, true, nil
+}
+
+// setBlueZInfo sets the keys of an info file from a bond.
+func setBlueZInfo(f *iniFile, bd bondData, bi hci.BondInfo) {
+	g := f.addSection(bluezGeneral)
+	addrType := "public"
+	if len(bi.IdentityAddress()) != 0 && bi.IdentityAddressType() != 0 {
+		addrType = "static"
+	}
+	g.set("AddressType", addrType)
+	if g.get("SupportedTechnologies") == "" {
+		g.set("SupportedTechnologies", "LE;")
+	}
+
+	auth := 0
+	if !bi.Legacy() {
+		auth |= bluezAuthP256
+	}
+	if bi.Authenticated() {
+		auth |= bluezAuthMITM
+	}
+	// The key is written to the section of its role, the key of the other role
+	// of a legacy bond BlueZ already knows is kept.
+	name := bluezLTK
+	if bi.Legacy() && bi.PeripheralKey() {
+		name = bluezPeriphLTK
+		if f.section(bluezPeriphLTK) == nil && f.section(bluezSlaveLTK) != nil {
+			name = bluezSlaveLTK
+		}
+	}
+	ltk := f.addSection(name)
+	ltk.set("Key", strings.ToUpper(bd.LongTermKey))
+	ltk.set("Authenticated", strconv.Itoa(auth))
+	ltk.set("EncSize", strconv.Itoa(len(bi.LongTermKey())))
+	ltk.set("EDiv", strconv.FormatUint(uint64(bi.EDiv()), 10))
+	ltk.set("Rand", strconv.FormatUint(bi.Random(), 10))
+
+	if len(bd.IdentityResolvingKey) != 0 {
+		f.addSection(bluezIRK).set("Key", strings.ToUpper(bd.IdentityResolvingKey))
+	}
+	if len(bi.LocalSigningKey()) != 0 {
+		s := f.addSection(bluezLocalCSRK)
+		s.set("Key", strings.ToUpper(bd.LocalSigningKey))
+		s.set("Counter", strconv.FormatUint(uint64(bi.LocalSignCounter()), 10))
+		s.set("Authenticated", "false")
+	}
+	if len(bi.RemoteSigningKey()) != 0 {
+		s := f.addSection(bluezRemoteCSRK)
+		s.set("Key", strings.ToUpper(bd.RemoteSigningKey))
+		s.set("Counter", strconv.FormatUint(uint64(bi.RemoteSignCounter()), 10))
+		s.set("Authenticated", "false")
+	}
+}
+
+// bluezAddr parses the name of a device directory, AA:BB:CC:DD:EE:FF, into a
+// little endian address.
+func bluezAddr(name string) ([]byte, error) {
+	b, err := hex.DecodeString(strings.ReplaceAll(name, ":", ""))
+	if err != nil || len(b) != 6 || len(name) != 17 {
+		return nil, fmt.Errorf("invalid address: %s", name)
+	}
+	for i, j := 0, len(b)-1; i < j; i, j = i+1, j-1 {
+		b[i], b[j] = b[j], b[i]
+	}
+	return b, nil
+}
+
+// bluezDirName formats a little endian address as the name of a device directory.
+func bluezDirName(addr []byte) string {
+	s := make([]string, len(addr))
+	for i, b := range addr {
+		s[len(addr)-1-i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(s, ":")
+}
+
+// iniFile is an INI file whose order of sections and keys is kept.
+type iniFile struct {
+	sections []*iniSection
+}
+
+type iniSection struct {
+	name string
+	keys []string
+	vals map[string]string
+}
+
+func parseINI(b []byte) *iniFile {
+	f := &iniFile{}
+	var s *iniSection
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		switch {
+		case line == "" || line[0] == '#' || line[0] == ';':
+		case line[0] == '[' && line[len(line)-1] == ']':
+			s = f.addSection(line[1 : len(line)-1])
+		case s != nil:
+			if i := strings.IndexByte(line, '='); i > 0 {
+				s.set(strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:]))
+			}
+		}
+	}
+	return f
+}
+
+func (f *iniFile) section(name string) *iniSection {
+	for _, s := range f.sections {
+		if s.name == name {
+			return s
+		}
+	}
+	return nil
+}
+
+// addSection returns the section name, which is added if missing.
+func (f *iniFile) addSection(name string) *iniSection {
+	if s := f.section(name); s != nil {
+		return s
+	}
+	s := &iniSection{name: name, vals: make(map[string]string)}
+	f.sections = append(f.sections, s)
+	return s
+}
+
+func (f *iniFile) bytes() []byte {
+	var b bytes.Buffer
+	for i, s := range f.sections {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		fmt.Fprintf(&b, "[%s]\n", s.name)
+		for _, k := range s.keys {
+			fmt.Fprintf(&b, "%s=%s\n", k, s.vals[k])
+		}
+	}
+	return b.Bytes()
+}
+
+func (s *iniSection) get(key string) string {
+	return s.vals[key]
+}
+
+func (s *iniSection) getOr(key, def string) string {
+	if v, ok := s.vals[key]; ok {
+		return v
+	}
+	return def
+}
+
+func (s *iniSection) set(key, val string) {
+	if _, ok := s.vals[key]; !ok {
+		s.keys = append(s.keys, key)
+	}
+	s.vals[key] = val
+}
@@ -0,0 +1,134 @@
+package bond
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+const testBlueZInfo = `[General]
+Name=sensor
+AddressType=static
+SupportedTechnologies=LE;
+Trusted=false
+
+[IdentityResolvingKey]
+Key=00112233445566778899AABBCCDDEEFF
+
+[LongTermKey]
+Key=0F0E0D0C0B0A09080706050403020100
+Authenticated=1
+EncSize=16
+EDiv=4660
+Rand=1311768467463790320
+
+[PeripheralLongTermKey]
+Key=FFEEDDCCBBAA99887766554433221100
+Authenticated=1
+EncSize=16
+EDiv=22136
+Rand=42
+`
+
+func TestBlueZ(t *testing.T) {
+	dir := t.TempDir()
+	ddir := filepath.Join(dir, "C1:22:33:44:55:66")
+	if err := os.Mkdir(ddir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(ddir, "info"), []byte(testBlueZInfo), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	bonds, err := ImportBlueZ(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bi, ok := bonds["6655443322c1"]
+	if !ok || len(bonds) != 1 {
+		t.Fatalf("bonds %v", bonds)
+	}
+	ltk := []byte{0x0F, 0x0E, 0x0D, 0x0C, 0x0B, 0x0A, 0x09, 0x08, 0x07, 0x06, 0x05, 0x04, 0x03, 0x02, 0x01, 0x00}
+	if !bytes.Equal(bi.LongTermKey(), ltk) || bi.EDiv() != 0x1234 || bi.Random() != 0x123456789ABCDEF0 || !bi.Legacy() || !bi.Authenticated() {
+		t.Fatalf("long term key % X, ediv 0x%X, rand 0x%X, legacy %v, authenticated %v",
+			bi.LongTermKey(), bi.EDiv(), bi.Random(), bi.Legacy(), bi.Authenticated())
+	}
+	if !bytes.Equal(bi.IdentityAddress(), []byte{0x66, 0x55, 0x44, 0x33, 0x22, 0xC1}) || bi.IdentityAddressType() != 1 {
+		t.Fatalf("identity address % X, type %d", bi.IdentityAddress(), bi.IdentityAddressType())
+	}
+
+	// The bonds exported are imported back, the other settings are kept.
+	if err := ExportBlueZ(dir, bonds); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(ddir, "info"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte("Name=sensor")) || !bytes.Contains(b, []byte("[PeripheralLongTermKey]\nKey=FFEEDDCCBBAA99887766554433221100")) {
+		t.Fatalf("settings lost:\n%s", b)
+	}
+	if !bytes.Contains(b, []byte("[LongTermKey]\nKey=0F0E0D0C0B0A09080706050403020100\nAuthenticated=1")) {
+		t.Fatalf("authentication lost:\n%s", b)
+	}
+	exported, err := ImportBlueZ(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(createBondData(exported["6655443322c1"]), createBondData(bi)) {
+		t.Fatalf("exported bond %+v, want %+v", createBondData(exported["6655443322c1"]), createBondData(bi))
+	}
+}
+
+func TestBlueZPeripheralKey(t *testing.T) {
+	dir := t.TempDir()
+	ddir := filepath.Join(dir, "00:11:22:33:44:55")
+	if err := os.Mkdir(ddir, 0700); err != nil {
+		t.Fatal(err)
+	}
+	info := `[General]
+Name=phone
+AddressType=public
+
+[PeripheralLongTermKey]
+Key=FFEEDDCCBBAA99887766554433221100
+Authenticated=0
+EncSize=16
+EDiv=22136
+Rand=42
+`
+	if err := ioutil.WriteFile(filepath.Join(ddir, "info"), []byte(info), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	bonds, err := ImportBlueZ(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bi, ok := bonds["554433221100"]
+	if !ok || !bi.Legacy() || !bi.PeripheralKey() {
+		t.Fatalf("bonds %v", bonds)
+	}
+
+	// The key is written back to the peripheral role section only.
+	if err := ExportBlueZ(dir, bonds); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(filepath.Join(ddir, "info"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte("[PeripheralLongTermKey]\nKey=FFEEDDCCBBAA99887766554433221100")) || bytes.Contains(b, []byte("[LongTermKey]")) {
+		t.Fatalf("key exported in the wrong role:\n%s", b)
+	}
+	exported, err := ImportBlueZ(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(createBondData(exported["554433221100"]), createBondData(bi)) {
+		t.Fatalf("exported bond %+v, want %+v", createBondData(exported["554433221100"]), createBondData(bi))
+	}
+}
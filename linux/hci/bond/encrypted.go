@@ -0,0 +1,164 @@
+package bond
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/rigado/ble/internal/atomicfile"
+	"github.com/rigado/ble/linux/hci"
+)
+
+// encryptedVersion is the version of the encrypted bond file format
+const encryptedVersion = 1
+
+// KeyWrapFunc wraps or unwraps the key encrypting a bond file, e.g. with a key held
+// by a TPM, or the platform keyring. The key is 32 bytes long once unwrapped.
+type KeyWrapFunc func(key []byte) ([]byte, error)
+
+// encryptedFile is the layout of an encrypted bond file; the bonds are sealed with
+// AES-256-GCM by a random key, which is stored wrapped
+type encryptedFile struct {
+	Version    int    `json:"version"`
+	WrappedKey []byte `json:"wrappedKey"`
+	Nonce      []byte `json:"nonce"`
+	Bonds      []byte `json:"bonds"`
+}
+
+// encryptedStore stores the bonds in an encrypted json file
+type encryptedStore struct {
+	path         string
+	wrap, unwrap KeyWrapFunc
+
+	key, wrappedKey []byte //set once loaded, or generated
+}
+
+// NewEncryptedBondManager returns a bond manager storing the bonds in the file
+// bondFilePath, encrypted by a key wrapped with wrap, and unwrapped with unwrap.
+// A plain json file of NewBondManager is encrypted on first use.
+func NewEncryptedBondManager(bondFilePath string, wrap, unwrap KeyWrapFunc) (hci.BondManager, error) {
+	if len(bondFilePath) == 0 {
+		bondFilePath = defaultBondFilename
+	}
+	if wrap == nil || unwrap == nil {
+		return nil, fmt.Errorf("missing key wrapping function")
+	}
+	m := newManager(&encryptedStore{path: bondFilePath, wrap: wrap, unwrap: unwrap})
+
+	//the file is loaded, and migrated, right away so errors show up early
+	m.lock.Lock()
+	defer m.lock.Unlock()
+	if _, err := m.loadBonds(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (s *encryptedStore) load() (map[string]bondData, error) {
+	fileData, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bondData file information: %s", err)
+	}
+
+	if len(fileData) == 0 {
+		return nil, nil
+	}
+
+	//a plain bond file doesn't have a version
+	var ef encryptedFile
+	if err := json.Unmarshal(fileData, &ef); err != nil || ef.Version == 0 {
+		return s.migrate(fileData)
+	}
+	if ef.Version != encryptedVersion {
+		return nil, fmt.Errorf("unsupported bond file version %d", ef.Version)
+	}
+
+	key, err := s.unwrap(ef.WrappedKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to unwrap bond file key: %s", err)
+	}
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	plain, err := aead.Open(nil, ef.Nonce, ef.Bonds, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt bond file: %s", err)
+	}
+	s.key, s.wrappedKey = key, ef.WrappedKey
+
+	return unmarshalBonds(plain)
+}
+
+// migrate encrypts the bonds of a plain json file
+func (s *encryptedStore) migrate(fileData []byte) (map[string]bondData, error) {
+	bonds, err := unmarshalBonds(fileData)
+	if err != nil {
+		return nil, err
+	}
+	if err := s.save(bonds); err != nil {
+		return nil, fmt.Errorf("failed to encrypt bond file: %s", err)
+	}
+	return bonds, nil
+}
+
+func (s *encryptedStore) save(bonds map[string]bondData) error {
+	if s.key == nil {
+		key := make([]byte, 32)
+		if _, err := rand.Read(key); err != nil {
+			return err
+		}
+		wrapped, err := s.wrap(key)
+		if err != nil {
+			return fmt.Errorf("failed to wrap bond file key: %s", err)
+		}
+		s.key, s.wrappedKey = key, wrapped
+	}
+
+	plain, err := json.Marshal(bonds)
+	if err != nil {
+		return fmt.Errorf("failed to marshal bonds to json: %s", err)
+	}
+	aead, err := newAEAD(s.key)
+	if err != nil {
+		return err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return err
+	}
+
+	out, err := json.Marshal(encryptedFile{
+		Version:    encryptedVersion,
+		WrappedKey: s.wrappedKey,
+		Nonce:      nonce,
+		Bonds:      aead.Seal(nil, nonce, plain, nil),
+	})
+	if err != nil {
+		return err
+	}
+
+	err = atomicfile.WriteFile(s.path, out, 0600)
+	if err != nil {
+		return fmt.Errorf("failed to update bondData information: %s", err)
+	}
+	return nil
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != 32 {
+		return nil, fmt.Errorf("invalid bond file key length %d", len(key))
+	}
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(c)
+}
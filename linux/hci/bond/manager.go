@@ -3,20 +3,23 @@ package bond
 import (
 	"encoding/binary"
 	"encoding/hex"
-	"encoding/json"
 	"fmt"
-	"io/ioutil"
-	"os"
 	"sync"
 
 	"github.com/rigado/ble"
 	"github.com/rigado/ble/linux/hci"
+	"github.com/rigado/ble/linux/hci/smp"
 )
 
 type manager struct {
-	filePath string
-	lock     sync.RWMutex
+	store store
+	lock  sync.Mutex
+	bonds map[string]bondData //loaded on first use
 	ble.Logger
+
+	//bonds with an identity resolving key, loaded on demand
+	irkLock sync.Mutex
+	irks    map[string]hci.BondInfo
 }
 
 type bondData struct {
@@ -24,19 +27,46 @@ type bondData struct {
 	EncryptionDiversifier string `json:"encryptionDiversifier"`
 	RandomValue           string `json:"randomValue"`
 	Legacy                bool   `json:"legacy"`
+	Authenticated         bool   `json:"authenticated,omitempty"`
+	PeripheralKey         bool   `json:"peripheralKey,omitempty"`
+
+	IdentityResolvingKey string `json:"identityResolvingKey,omitempty"`
+	IdentityAddress      string `json:"identityAddress,omitempty"`
+	IdentityAddressType  byte   `json:"identityAddressType,omitempty"`
+
+	LocalSigningKey   string `json:"localSigningKey,omitempty"`
+	RemoteSigningKey  string `json:"remoteSigningKey,omitempty"`
+	LocalSignCounter  uint32 `json:"localSignCounter,omitempty"`
+	RemoteSignCounter uint32 `json:"remoteSignCounter,omitempty"`
 }
 
 const (
 	defaultBondFilename = "bonds.json"
 )
 
+//store persists the bonds, keyed by address
+type store interface {
+	load() (map[string]bondData, error)
+	save(bonds map[string]bondData) error
+}
+
+//NewBondManager returns a bond manager storing the bonds in the json file bondFilePath
 func NewBondManager(bondFilePath string) hci.BondManager {
 	if len(bondFilePath) == 0 {
 		bondFilePath = defaultBondFilename
 	}
+	return newManager(&fileStore{path: bondFilePath})
+}
+
+//NewMemoryBondManager returns a bond manager keeping the bonds in memory only, e.g. for tests
+func NewMemoryBondManager() hci.BondManager {
+	return newManager(memStore{})
+}
+
+func newManager(s store) *manager {
 	return &manager{
-		filePath: bondFilePath,
-		Logger:   ble.GetLogger(),
+		store:  s,
+		Logger: ble.GetLogger(),
 	}
 }
 
@@ -46,8 +76,8 @@ func (m *manager) Exists(addr string) bool {
 		return false
 	}
 
-	m.lock.RLock()
-	defer m.lock.RUnlock()
+	m.lock.Lock()
+	defer m.lock.Unlock()
 
 	bonds, err := m.loadBonds()
 	if err != nil {
@@ -55,13 +85,8 @@ func (m *manager) Exists(addr string) bool {
 		return false
 	}
 
-	for k := range bonds {
-		if k == addr {
-			return true
-		}
-	}
-
-	return false
+	_, ok := bonds[addr]
+	return ok
 }
 
 func (m *manager) Find(addr string) (hci.BondInfo, error) {
@@ -69,8 +94,8 @@ func (m *manager) Find(addr string) (hci.BondInfo, error) {
 		return nil, fmt.Errorf("invalid address")
 	}
 
-	m.lock.RLock()
-	defer m.lock.RUnlock()
+	m.lock.Lock()
+	defer m.lock.Unlock()
 
 	bonds, err := m.loadBonds()
 	if err != nil {
@@ -85,6 +110,7 @@ func (m *manager) Find(addr string) (hci.BondInfo, error) {
 	//validate bondData information; if any of it is invalid, delete the bondData
 	bi, bondErr := createBondInfo(bd)
 	if bondErr != nil {
+		bonds := m.copyBonds()
 		delete(bonds, addr)
 		err := m.storeBonds(bonds)
 		if err != nil {
@@ -105,13 +131,16 @@ func (m *manager) Save(addr string, bond hci.BondInfo) error {
 		return fmt.Errorf("empty bondData information")
 	}
 
+	//cleared once the lock is released
+	defer m.clearIdentities()
+
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	bonds, err := m.loadBonds()
-	if err != nil {
+	if _, err := m.loadBonds(); err != nil {
 		return err
 	}
+	bonds := m.copyBonds()
 
 	bd := createBondData(bond)
 
@@ -126,13 +155,16 @@ func (m *manager) Save(addr string, bond hci.BondInfo) error {
 }
 
 func (m *manager) Delete(addr string) error {
+	//cleared once the lock is released
+	defer m.clearIdentities()
+
 	m.lock.Lock()
 	defer m.lock.Unlock()
 
-	bonds, err := m.loadBonds()
-	if err != nil {
+	if _, err := m.loadBonds(); err != nil {
 		return err
 	}
+	bonds := m.copyBonds()
 
 	if _, ok := bonds[addr]; ok {
 		delete(bonds, addr)
@@ -140,7 +172,7 @@ func (m *manager) Delete(addr string) error {
 		return fmt.Errorf("bond for mac %v not found", addr)
 	}
 
-	err = m.storeBonds(bonds)
+	err := m.storeBonds(bonds)
 	if err != nil {
 		return err
 	}
@@ -148,51 +180,131 @@ func (m *manager) Delete(addr string) error {
 	return nil
 }
 
-//this is mutex protected at the public function level
-func (m *manager) loadBonds() (map[string]bondData, error) {
-	//open local file
-	_, err := os.Stat(m.filePath)
-	var f *os.File
-	if os.IsNotExist(err) {
-		f, err = os.Create(m.filePath)
-		if err != nil {
-			return nil, fmt.Errorf("unable to create bondData file: %s", err)
+//ResolveIdentity finds the bond of the device using the resolvable private address addr
+func (m *manager) ResolveIdentity(addr []byte) (hci.BondInfo, bool) {
+	m.irkLock.Lock()
+	defer m.irkLock.Unlock()
+
+	if err := m.loadIdentities(); err != nil {
+		m.Errorf("bondManager: resolve %s", err)
+		return nil, false
+	}
+
+	for _, bi := range m.irks {
+		if smp.ResolvePrivateAddress(bi.IdentityResolvingKey(), addr) {
+			return bi, true
 		}
-		_ = f.Close()
 	}
 
-	fileData, err := ioutil.ReadFile(m.filePath)
+	return nil, false
+}
+
+//List returns the valid bonds, keyed by address
+func (m *manager) List() (map[string]hci.BondInfo, error) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	bonds, err := m.loadBonds()
 	if err != nil {
-		return nil, fmt.Errorf("failed to read bondData file information: %s", err)
+		return nil, err
 	}
 
-	var bonds map[string]bondData
-	if len(fileData) > 0 {
-		err = json.Unmarshal(fileData, &bonds)
+	out := make(map[string]hci.BondInfo, len(bonds))
+	for k, bd := range bonds {
+		bi, err := createBondInfo(bd)
 		if err != nil {
-			return nil, fmt.Errorf("failed to unmarshal current bondData info: %s", err)
+			m.Warnf("bondManager: invalid bond for %s: %s", k, err)
+			continue
 		}
+		out[k] = bi
 	}
+	return out, nil
+}
 
-	if len(bonds) == 0 {
-		bonds = make(map[string]bondData)
+//Identities returns the bonds of the devices that distributed an identity resolving key
+func (m *manager) Identities() []hci.BondInfo {
+	m.irkLock.Lock()
+	defer m.irkLock.Unlock()
+
+	if err := m.loadIdentities(); err != nil {
+		m.Errorf("bondManager: identities %s", err)
+		return nil
 	}
 
-	return bonds, nil
+	out := make([]hci.BondInfo, 0, len(m.irks))
+	for _, bi := range m.irks {
+		out = append(out, bi)
+	}
+	return out
 }
 
-//this is mutex protected at the public function level
-func (m *manager) storeBonds(bonds map[string]bondData) error {
-	out, err := json.Marshal(bonds)
-	if err != nil {
-		return fmt.Errorf("failed to marshal bonds to json: %s", err)
+//loadIdentities loads the identity resolving keys, if not loaded yet; m.irkLock must be held
+func (m *manager) loadIdentities() error {
+	if m.irks != nil {
+		return nil
 	}
 
-	err = ioutil.WriteFile(m.filePath, out, 0644)
+	m.lock.Lock()
+	bonds, err := m.loadBonds()
+	m.lock.Unlock()
 	if err != nil {
-		return fmt.Errorf("failed to update bondData information: %s", err)
+		return err
 	}
 
+	m.irks = make(map[string]hci.BondInfo)
+	for k, bd := range bonds {
+		if len(bd.IdentityResolvingKey) == 0 {
+			continue
+		}
+		bi, err := createBondInfo(bd)
+		if err != nil {
+			continue
+		}
+		m.irks[k] = bi
+	}
+	return nil
+}
+
+//clearIdentities drops the loaded identity resolving keys after the bonds change
+func (m *manager) clearIdentities() {
+	m.irkLock.Lock()
+	m.irks = nil
+	m.irkLock.Unlock()
+}
+
+//loadBonds returns the bonds, which are loaded on first use; they must not be
+//modified, see copyBonds. This is mutex protected at the public function level
+func (m *manager) loadBonds() (map[string]bondData, error) {
+	if m.bonds == nil {
+		bonds, err := m.store.load()
+		if err != nil {
+			return nil, err
+		}
+		if bonds == nil {
+			bonds = make(map[string]bondData)
+		}
+		m.bonds = bonds
+	}
+	return m.bonds, nil
+}
+
+//copyBonds returns a copy of the loaded bonds to modify, so they are only replaced
+//once stored; this is mutex protected at the public function level
+func (m *manager) copyBonds() map[string]bondData {
+	out := make(map[string]bondData, len(m.bonds))
+	for k, bd := range m.bonds {
+		out[k] = bd
+	}
+	return out
+}
+
+//storeBonds replaces the bonds once they are stored;
+//this is mutex protected at the public function level
+func (m *manager) storeBonds(bonds map[string]bondData) error {
+	if err := m.store.save(bonds); err != nil {
+		return err
+	}
+	m.bonds = bonds
 	return nil
 }
 
@@ -211,6 +323,19 @@ func createBondData(bi hci.BondInfo) bondData {
 	b.EncryptionDiversifier = hex.EncodeToString(eDiv)
 	b.RandomValue = hex.EncodeToString(randVal)
 	b.Legacy = bi.Legacy()
+	b.Authenticated = bi.Authenticated()
+	b.PeripheralKey = bi.PeripheralKey()
+
+	if len(bi.IdentityAddress()) != 0 {
+		b.IdentityResolvingKey = hex.EncodeToString(bi.IdentityResolvingKey())
+		b.IdentityAddress = hex.EncodeToString(bi.IdentityAddress())
+		b.IdentityAddressType = bi.IdentityAddressType()
+	}
+
+	b.LocalSigningKey = hex.EncodeToString(bi.LocalSigningKey())
+	b.RemoteSigningKey = hex.EncodeToString(bi.RemoteSigningKey())
+	b.LocalSignCounter = bi.LocalSignCounter()
+	b.RemoteSignCounter = bi.RemoteSignCounter()
 
 	return b
 }
@@ -237,5 +362,40 @@ func createBondInfo(b bondData) (hci.BondInfo, error) {
 	}
 
 	bi := hci.NewBondInfo(ltk, binary.LittleEndian.Uint16(eDiv), binary.LittleEndian.Uint64(randVal), b.Legacy)
+	if b.Authenticated {
+		bi = hci.WithAuthentication(bi, true)
+	}
+	if b.PeripheralKey {
+		bi = hci.WithPeripheralKey(bi, true)
+	}
+
+	if len(b.IdentityAddress) != 0 {
+		irk, err := hex.DecodeString(b.IdentityResolvingKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid identity resolving key in bondData file")
+		}
+
+		ia, err := hex.DecodeString(b.IdentityAddress)
+		if err != nil || len(ia) != 6 {
+			return nil, fmt.Errorf("invalid identity address in bondData file")
+		}
+
+		bi = hci.WithIdentity(bi, irk, ia, b.IdentityAddressType)
+	}
+
+	if len(b.LocalSigningKey) != 0 || len(b.RemoteSigningKey) != 0 {
+		lk, err := hex.DecodeString(b.LocalSigningKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid local signing key in bondData file")
+		}
+
+		rk, err := hex.DecodeString(b.RemoteSigningKey)
+		if err != nil {
+			return nil, fmt.Errorf("invalid remote signing key in bondData file")
+		}
+
+		bi = hci.WithSigning(bi, lk, rk, b.LocalSignCounter, b.RemoteSignCounter)
+	}
+
 	return bi, nil
 }
@@ -0,0 +1,85 @@
+package bond
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/rigado/ble/linux/hci"
+)
+
+// xorWrap stands for a key wrapping function of a keyring.
+func xorWrap(key []byte) ([]byte, error) {
+	out := make([]byte, len(key))
+	for i := range key {
+		out[i] = key[i] ^ 0x5A
+	}
+	return out, nil
+}
+
+func TestEncryptedBondManager(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "bonds.json")
+	ltk := bytes.Repeat([]byte{0x11}, 16)
+	addr := "0a0b0c0d0e0f"
+
+	// A plain bond file is migrated.
+	if err := NewBondManager(path).Save(addr, hci.NewBondInfo(ltk, 0x1234, 0x5678, false)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := NewEncryptedBondManager(path, xorWrap, xorWrap); err != nil {
+		t.Fatal(err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(b, []byte("1111111111")) || bytes.Contains(b, []byte(addr)) {
+		t.Fatalf("bond file not encrypted: %s", b)
+	}
+
+	m, err := NewEncryptedBondManager(path, xorWrap, xorWrap)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bi, err := m.Find(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bi.LongTermKey(), ltk) || bi.EDiv() != 0x1234 || bi.Random() != 0x5678 {
+		t.Fatalf("bond %+v", bi)
+	}
+
+	bonds, err := m.(hci.BondLister).List()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := bonds[addr]; !ok || len(bonds) != 1 {
+		t.Fatalf("bonds %v", bonds)
+	}
+
+	// The key can't be unwrapped.
+	fail := func([]byte) ([]byte, error) { return nil, fmt.Errorf("no key") }
+	if _, err := NewEncryptedBondManager(path, xorWrap, fail); err == nil {
+		t.Fatal("bond file decrypted without key")
+	}
+}
+
+func TestMemoryBondManager(t *testing.T) {
+	m := NewMemoryBondManager()
+	addr := "0a0b0c0d0e0f"
+	if err := m.Save(addr, hci.NewBondInfo(bytes.Repeat([]byte{0x11}, 16), 0, 0, false)); err != nil {
+		t.Fatal(err)
+	}
+	if !m.Exists(addr) {
+		t.Fatal("bond not found")
+	}
+	if err := m.Delete(addr); err != nil {
+		t.Fatal(err)
+	}
+	bonds, err := m.(hci.BondLister).List()
+	if err != nil || len(bonds) != 0 {
+		t.Fatalf("bonds %v: %v", bonds, err)
+	}
+}
@@ -0,0 +1,57 @@
+package bond
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+
+	"github.com/rigado/ble/internal/atomicfile"
+)
+
+// fileStore stores the bonds in a plain json file
+type fileStore struct {
+	path string
+}
+
+func (s *fileStore) load() (map[string]bondData, error) {
+	fileData, err := ioutil.ReadFile(s.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to read bondData file information: %s", err)
+	}
+	return unmarshalBonds(fileData)
+}
+
+func (s *fileStore) save(bonds map[string]bondData) error {
+	out, err := json.Marshal(bonds)
+	if err != nil {
+		return fmt.Errorf("failed to marshal bonds to json: %s", err)
+	}
+
+	err = atomicfile.WriteFile(s.path, out, 0644)
+	if err != nil {
+		return fmt.Errorf("failed to update bondData information: %s", err)
+	}
+	return nil
+}
+
+// memStore keeps the bonds in the manager only
+type memStore struct{}
+
+func (memStore) load() (map[string]bondData, error)   { return nil, nil }
+func (memStore) save(bonds map[string]bondData) error { return nil }
+
+// unmarshalBonds parses the bonds of a plain json file
+func unmarshalBonds(b []byte) (map[string]bondData, error) {
+	var bonds map[string]bondData
+	if len(b) > 0 {
+		err := json.Unmarshal(b, &bonds)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal current bondData info: %s", err)
+		}
+	}
+	return bonds, nil
+}
@@ -0,0 +1,249 @@
+package cmd
+
+import (
+	"encoding/binary"
+	"io"
+)
+
+// The LE Advertising Extensions commands below carry variable length parameters,
+// which can't be expressed in the generated fixed-size structs.
+
+// LESetExtendedAdvertisingData implements LE Set Extended Advertising Data (0x08|0x0037) [Vol 2, Part E, 7.8.54]
+type LESetExtendedAdvertisingData struct {
+	AdvertisingHandle  uint8
+	Operation          uint8
+	FragmentPreference uint8
+	AdvertisingData    []byte
+}
+
+func (c *LESetExtendedAdvertisingData) String() string {
+	return "LE Set Extended Advertising Data (0x08|0x0037)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LESetExtendedAdvertisingData) OpCode() int { return 0x08<<10 | 0x0037 }
+
+// Len returns the length of the command.
+func (c *LESetExtendedAdvertisingData) Len() int { return 4 + len(c.AdvertisingData) }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LESetExtendedAdvertisingData) Marshal(b []byte) error {
+	return marshalData(c, b, c.AdvertisingHandle, c.Operation, c.FragmentPreference, c.AdvertisingData)
+}
+
+// LESetExtendedAdvertisingDataRP returns the return parameter of LE Set Extended Advertising Data
+type LESetExtendedAdvertisingDataRP struct {
+	Status uint8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LESetExtendedAdvertisingDataRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// LESetExtendedScanResponseData implements LE Set Extended Scan Response Data (0x08|0x0038) [Vol 2, Part E, 7.8.55]
+type LESetExtendedScanResponseData struct {
+	AdvertisingHandle  uint8
+	Operation          uint8
+	FragmentPreference uint8
+	ScanResponseData   []byte
+}
+
+func (c *LESetExtendedScanResponseData) String() string {
+	return "LE Set Extended Scan Response Data (0x08|0x0038)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LESetExtendedScanResponseData) OpCode() int { return 0x08<<10 | 0x0038 }
+
+// Len returns the length of the command.
+func (c *LESetExtendedScanResponseData) Len() int { return 4 + len(c.ScanResponseData) }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LESetExtendedScanResponseData) Marshal(b []byte) error {
+	return marshalData(c, b, c.AdvertisingHandle, c.Operation, c.FragmentPreference, c.ScanResponseData)
+}
+
+// LESetExtendedScanResponseDataRP returns the return parameter of LE Set Extended Scan Response Data
+type LESetExtendedScanResponseDataRP struct {
+	Status uint8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LESetExtendedScanResponseDataRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// AdvertisingSetEnable holds the per-set parameters of LE Set Extended Advertising Enable.
+type AdvertisingSetEnable struct {
+	AdvertisingHandle            uint8
+	Duration                     uint16
+	MaxExtendedAdvertisingEvents uint8
+}
+
+// LESetExtendedAdvertisingEnable implements LE Set Extended Advertising Enable (0x08|0x0039) [Vol 2, Part E, 7.8.56]
+type LESetExtendedAdvertisingEnable struct {
+	Enable uint8
+	Sets   []AdvertisingSetEnable
+}
+
+func (c *LESetExtendedAdvertisingEnable) String() string {
+	return "LE Set Extended Advertising Enable (0x08|0x0039)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LESetExtendedAdvertisingEnable) OpCode() int { return 0x08<<10 | 0x0039 }
+
+// Len returns the length of the command.
+func (c *LESetExtendedAdvertisingEnable) Len() int { return 2 + 4*len(c.Sets) }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LESetExtendedAdvertisingEnable) Marshal(b []byte) error {
+	if len(b) < c.Len() {
+		return io.ErrShortBuffer
+	}
+	b[0] = c.Enable
+	b[1] = uint8(len(c.Sets))
+	p := b[2:]
+	for _, s := range c.Sets {
+		p[0] = s.AdvertisingHandle
+		binary.LittleEndian.PutUint16(p[1:], s.Duration)
+		p[3] = s.MaxExtendedAdvertisingEvents
+		p = p[4:]
+	}
+	return nil
+}
+
+// LESetExtendedAdvertisingEnableRP returns the return parameter of LE Set Extended Advertising Enable
+type LESetExtendedAdvertisingEnableRP struct {
+	Status uint8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LESetExtendedAdvertisingEnableRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// ExtendedScanPHY holds the per-PHY parameters of LE Set Extended Scan Parameters.
+type ExtendedScanPHY struct {
+	ScanType     uint8
+	ScanInterval uint16
+	ScanWindow   uint16
+}
+
+// LESetExtendedScanParameters implements LE Set Extended Scan Parameters (0x08|0x0041) [Vol 2, Part E, 7.8.64]
+// Scan holds one entry for each bit set in ScanningPHYs, in order of increasing bit position.
+type LESetExtendedScanParameters struct {
+	OwnAddressType       uint8
+	ScanningFilterPolicy uint8
+	ScanningPHYs         uint8
+	Scan                 []ExtendedScanPHY
+}
+
+func (c *LESetExtendedScanParameters) String() string {
+	return "LE Set Extended Scan Parameters (0x08|0x0041)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LESetExtendedScanParameters) OpCode() int { return 0x08<<10 | 0x0041 }
+
+// Len returns the length of the command.
+func (c *LESetExtendedScanParameters) Len() int { return 3 + 5*len(c.Scan) }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LESetExtendedScanParameters) Marshal(b []byte) error {
+	if len(b) < c.Len() {
+		return io.ErrShortBuffer
+	}
+	b[0] = c.OwnAddressType
+	b[1] = c.ScanningFilterPolicy
+	b[2] = c.ScanningPHYs
+	p := b[3:]
+	for _, s := range c.Scan {
+		p[0] = s.ScanType
+		binary.LittleEndian.PutUint16(p[1:], s.ScanInterval)
+		binary.LittleEndian.PutUint16(p[3:], s.ScanWindow)
+		p = p[5:]
+	}
+	return nil
+}
+
+// LESetExtendedScanParametersRP returns the return parameter of LE Set Extended Scan Parameters
+type LESetExtendedScanParametersRP struct {
+	Status uint8
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (c *LESetExtendedScanParametersRP) Unmarshal(b []byte) error {
+	return unmarshal(c, b)
+}
+
+// ExtendedConnPHY holds the per-PHY parameters of LE Extended Create Connection.
+type ExtendedConnPHY struct {
+	ScanInterval       uint16
+	ScanWindow         uint16
+	ConnIntervalMin    uint16
+	ConnIntervalMax    uint16
+	ConnLatency        uint16
+	SupervisionTimeout uint16
+	MinimumCELength    uint16
+	MaximumCELength    uint16
+}
+
+// LEExtendedCreateConnection implements LE Extended Create Connection (0x08|0x0043) [Vol 2, Part E, 7.8.66]
+// Conn holds one entry for each bit set in InitiatingPHYs, in order of increasing bit position.
+type LEExtendedCreateConnection struct {
+	InitiatorFilterPolicy uint8
+	OwnAddressType        uint8
+	PeerAddressType       uint8
+	PeerAddress           [6]byte
+	InitiatingPHYs        uint8
+	Conn                  []ExtendedConnPHY
+}
+
+func (c *LEExtendedCreateConnection) String() string {
+	return "LE Extended Create Connection (0x08|0x0043)"
+}
+
+// OpCode returns the opcode of the command.
+func (c *LEExtendedCreateConnection) OpCode() int { return 0x08<<10 | 0x0043 }
+
+// Len returns the length of the command.
+func (c *LEExtendedCreateConnection) Len() int { return 10 + 16*len(c.Conn) }
+
+// Marshal serializes the command parameters into binary form.
+func (c *LEExtendedCreateConnection) Marshal(b []byte) error {
+	if len(b) < c.Len() {
+		return io.ErrShortBuffer
+	}
+	b[0] = c.InitiatorFilterPolicy
+	b[1] = c.OwnAddressType
+	b[2] = c.PeerAddressType
+	copy(b[3:9], c.PeerAddress[:])
+	b[9] = c.InitiatingPHYs
+	p := b[10:]
+	for _, s := range c.Conn {
+		binary.LittleEndian.PutUint16(p[0:], s.ScanInterval)
+		binary.LittleEndian.PutUint16(p[2:], s.ScanWindow)
+		binary.LittleEndian.PutUint16(p[4:], s.ConnIntervalMin)
+		binary.LittleEndian.PutUint16(p[6:], s.ConnIntervalMax)
+		binary.LittleEndian.PutUint16(p[8:], s.ConnLatency)
+		binary.LittleEndian.PutUint16(p[10:], s.SupervisionTimeout)
+		binary.LittleEndian.PutUint16(p[12:], s.MinimumCELength)
+		binary.LittleEndian.PutUint16(p[14:], s.MaximumCELength)
+		p = p[16:]
+	}
+	return nil
+}
+
+func marshalData(c command, b []byte, handle, op, frag uint8, data []byte) error {
+	if len(b) < c.Len() {
+		return io.ErrShortBuffer
+	}
+	b[0] = handle
+	b[1] = op
+	b[2] = frag
+	b[3] = uint8(len(data))
+	copy(b[4:], data)
+	return nil
+}
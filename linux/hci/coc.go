@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"encoding/binary"
 	"fmt"
+	"io"
+	"net"
+	"os"
 	"sync"
 	"time"
 
@@ -12,7 +15,7 @@ import (
 
 const (
 	rxChannelSendTimeout = time.Second * 5 //arbitrary
-	txCreditDelay        = time.Millisecond * 500
+	txCreditTimeout      = time.Second * 5 //arbitrary
 	cocRxChannelSize     = 8
 	minDynamicCID        = 0x40
 	maxDynamicCID        = 0xffff
@@ -23,6 +26,22 @@ type cocInfo struct {
 	credits, mtu, mps   uint16
 	rxChan              chan []byte
 	rxTransaction       *cocRxTransaction
+
+	// rxMTU and rxMPS are the local MTU and MPS, and rxCredits the number of credits
+	// given to the remote device when opening the channel.
+	rxMTU, rxMPS, rxCredits uint16
+
+	// sduChan passes the received SDUs to a net.Conn, which returns the credit of
+	// their last K-frame once read.
+	sduChan chan []byte
+
+	// pending are the SDUs received before the channel is subscribed to. Their
+	// credit is returned once they're passed to the subscriber.
+	pending [][]byte
+
+	creditc chan struct{} // signaled when credits are added
+	closed  chan struct{}
+	muTx    *sync.Mutex // serializes the K-frames of SDUs
 }
 
 type cocRxTransaction struct {
@@ -31,6 +50,11 @@ type cocRxTransaction struct {
 	buf    *bytes.Buffer
 }
 
+// cocParams are the MTU, MPS and initial credits of an end of a channel.
+type cocParams struct {
+	mtu, mps, credits uint16
+}
+
 type coc struct {
 	nextSrcCID   uint16 // 0x0040 to 0xFFFF
 	remoteCidLut map[uint16]*cocInfo
@@ -48,21 +72,22 @@ func NewCoc(c *Conn, l ble.Logger) *coc {
 	}
 }
 
+// NextSourceCID returns the next local CID that isn't in use, from the LE dynamic range.
 func (c *coc) NextSourceCID() (uint16, error) {
 	c.Lock()
 	defer c.Unlock()
 
-	switch {
-	case c.nextSrcCID > maxDynamicCID:
-		fallthrough
-	case c.nextSrcCID < minDynamicCID:
-		return 0, fmt.Errorf("invalid cid value %v, must be %v-%v", c.nextSrcCID, minDynamicCID, maxDynamicCID)
+	for n := 0; n <= maxLEDynamicCID-minDynamicCID; n++ {
+		out := c.nextSrcCID
+		c.nextSrcCID++
+		if c.nextSrcCID > maxLEDynamicCID {
+			c.nextSrcCID = minDynamicCID
+		}
+		if _, err := c.unsafeLocalChannel(out); err != nil {
+			return out, nil
+		}
 	}
-
-	out := c.nextSrcCID
-	c.nextSrcCID++
-	return out, nil
-
+	return 0, fmt.Errorf("no cid available, all of %v-%v in use", minDynamicCID, maxLEDynamicCID)
 }
 
 func (c *coc) Open(psm uint16) (ble.LECreditBasedConnection, error) {
@@ -71,14 +96,13 @@ func (c *coc) Open(psm uint16) (ble.LECreditBasedConnection, error) {
 		return nil, err
 	}
 
+	local := cocParams{mtu: 64, mps: 64, credits: 2}
 	out := &LECreditBasedConnectionRequest{
-		SourceCID: localCID,
-		LEPSM:     psm,
-
-		// TODO: all of these we will just ignore for now...
-		MTU:            64,
-		MPS:            64,
-		InitialCredits: 2,
+		SourceCID:      localCID,
+		LEPSM:          psm,
+		MTU:            local.mtu,
+		MPS:            local.mps,
+		InitialCredits: local.credits,
 	}
 
 	in := &LECreditBasedConnectionResponse{}
@@ -90,7 +114,8 @@ func (c *coc) Open(psm uint16) (ble.LECreditBasedConnection, error) {
 		return nil, fmt.Errorf("cocOpen/rsp result code 0x%x", in.Result)
 	}
 
-	conn, err := c.addChannel(localCID, in.DestinationCID, in.InitialCreditsCID, in.MTU, in.MPS)
+	remote := cocParams{mtu: in.MTU, mps: in.MPS, credits: in.InitialCreditsCID}
+	conn, err := c.addChannel(localCID, in.DestinationCID, local, remote)
 	if err != nil {
 		return nil, err
 	}
@@ -100,7 +125,8 @@ func (c *coc) Open(psm uint16) (ble.LECreditBasedConnection, error) {
 	return conn, nil
 }
 
-func (c *coc) addChannel(localCid, remoteCid, remoteCredits, remoteMtu, remoteMps uint16) (ble.LECreditBasedConnection, error) {
+// addChannel adds the channel opened with the remote device, with the local and remote parameters.
+func (c *coc) addChannel(localCid, remoteCid uint16, local, remote cocParams) (*cocWrapper, error) {
 	c.Lock()
 	defer c.Unlock()
 
@@ -111,9 +137,15 @@ func (c *coc) addChannel(localCid, remoteCid, remoteCredits, remoteMtu, remoteMp
 	i := &cocInfo{
 		remoteCID: remoteCid,
 		localCID:  localCid,
-		mtu:       remoteMtu,
-		mps:       remoteMps,
-		credits:   remoteCredits,
+		mtu:       remote.mtu,
+		mps:       remote.mps,
+		credits:   remote.credits,
+		rxMTU:     local.mtu,
+		rxMPS:     local.mps,
+		rxCredits: local.credits,
+		creditc:   make(chan struct{}, 1),
+		closed:    make(chan struct{}),
+		muTx:      &sync.Mutex{},
 	}
 	c.remoteCidLut[remoteCid] = i
 
@@ -129,19 +161,51 @@ func (c *coc) CloseChannel(cid uint16) error {
 		return fmt.Errorf("cid %v not found", cid)
 	}
 
+	c.unsafeClose(i)
+	return nil
+}
+
+// closeAll closes the channels of a disconnected connection.
+func (c *coc) closeAll() {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, i := range c.remoteCidLut {
+		c.unsafeClose(i)
+	}
+}
+
+func (c *coc) unsafeClose(i *cocInfo) {
 	if i.rxChan != nil {
 		close(i.rxChan)
 	}
+	if i.sduChan != nil {
+		close(i.sduChan)
+	}
+	close(i.closed)
 
-	delete(c.remoteCidLut, cid)
-	return nil
+	delete(c.remoteCidLut, i.remoteCID)
 }
 
-func (c *coc) lookupLocalCID(localCid uint16) (*cocInfo, error) {
+// disconnect closes the channel, and disconnects it from the remote device. [Vol 3, Part A, 4.6]
+func (c *coc) disconnect(remoteCid uint16) error {
+	i, err := c.Info(remoteCid)
+	if err != nil {
+		return err
+	}
+	if err := c.CloseChannel(remoteCid); err != nil {
+		return err
+	}
+	return c.Conn.Signal(&DisconnectRequest{
+		DestinationCID: i.remoteCID,
+		SourceCID:      i.localCID,
+	}, &DisconnectResponse{})
+}
+
+func (c *coc) unsafeLocalChannel(localCid uint16) (*cocInfo, error) {
 	for _, v := range c.remoteCidLut {
 		if v.localCID == localCid {
-			out := *v
-			return &out, nil
+			return v, nil
 		}
 	}
 	return nil, fmt.Errorf("%v not found", localCid)
@@ -151,26 +215,68 @@ func (c *coc) Subscribe(localCid uint16) (<-chan []byte, error) {
 	c.Lock()
 	defer c.Unlock()
 
-	i, err := c.lookupLocalCID(localCid)
+	i, err := c.unsafeLocalChannel(localCid)
 	if err != nil {
 		return nil, err
 	}
 
-	if i.rxChan != nil {
+	if i.rxChan != nil || i.sduChan != nil {
 		return nil, fmt.Errorf("cid %v has an existing subscriber", localCid)
 	}
 
-	i.rxChan = make(chan []byte, cocRxChannelSize)
-	c.remoteCidLut[i.remoteCID] = i
+	n := cocRxChannelSize
+	if len(i.pending) > n {
+		n = len(i.pending)
+	}
+	i.rxChan = make(chan []byte, n)
+	for _, sdu := range i.pending {
+		i.rxChan <- sdu
+	}
+	if len(i.pending) != 0 {
+		c.returnCredit(localCid, uint16(len(i.pending)))
+		i.pending = nil
+	}
 
 	return i.rxChan, nil
 }
 
+// subscribeSDU subscribes to the SDUs received on the channel. The credit of their
+// last K-frame is returned to the remote device by the subscriber, with returnCredit.
+func (c *coc) subscribeSDU(localCid uint16) (<-chan []byte, error) {
+	c.Lock()
+	defer c.Unlock()
+
+	i, err := c.unsafeLocalChannel(localCid)
+	if err != nil {
+		return nil, err
+	}
+
+	if i.rxChan != nil || i.sduChan != nil {
+		return nil, fmt.Errorf("cid %v has an existing subscriber", localCid)
+	}
+
+	// The remote device can't complete more SDUs than it has credits.
+	n := int(i.rxCredits)
+	if n < cocRxChannelSize {
+		n = cocRxChannelSize
+	}
+	if n < len(i.pending) {
+		n = len(i.pending)
+	}
+	i.sduChan = make(chan []byte, n)
+	for _, sdu := range i.pending {
+		i.sduChan <- sdu
+	}
+	i.pending = nil
+
+	return i.sduChan, nil
+}
+
 func (c *coc) Unsubscribe(localCid uint16) error {
 	c.Lock()
 	defer c.Unlock()
 
-	i, err := c.lookupLocalCID(localCid)
+	i, err := c.unsafeLocalChannel(localCid)
 	if err != nil {
 		return err
 	}
@@ -179,7 +285,6 @@ func (c *coc) Unsubscribe(localCid uint16) error {
 		close(i.rxChan)
 		i.rxChan = nil
 	}
-	c.remoteCidLut[i.remoteCID] = i
 
 	return nil
 }
@@ -221,6 +326,10 @@ func (c *coc) unsafeModifyCredits(cid, credits uint16, add bool) error {
 			return fmt.Errorf("cid %v would overflow if adding %v credits", cid, credits)
 		}
 		v.credits += credits
+		select {
+		case v.creditc <- struct{}{}:
+		default:
+		}
 	} else {
 		// underflow check
 		if credits > v.credits {
@@ -237,15 +346,15 @@ func (c *coc) recieve(cid uint16, data []byte) error {
 	defer c.Unlock()
 
 	in := data
-	i, err := c.lookupLocalCID(cid)
+	i, err := c.unsafeLocalChannel(cid)
 	if err != nil {
 		return err
 	}
 
-	// todo: maybe this should be at the top?
-	defer c.returnCredit(cid, 1)
-
 	if i.rxTransaction == nil {
+		if len(data) < 2 {
+			return fmt.Errorf("k-frame too short for the sdu length, %v bytes", len(data))
+		}
 		n := int(binary.LittleEndian.Uint16(data))
 		c.Debugf("creating new rx transaction for %v bytes", n)
 		i.rxTransaction = &cocRxTransaction{
@@ -256,9 +365,10 @@ func (c *coc) recieve(cid uint16, data []byte) error {
 
 		in = data[2:] // advance the index past the u16 length
 	}
+	t := i.rxTransaction
 
 	// write the bytes to the buffer
-	b := i.rxTransaction.buf
+	b := t.buf
 	if b == nil {
 		return fmt.Errorf("nil buffer")
 	}
@@ -270,28 +380,47 @@ func (c *coc) recieve(cid uint16, data []byte) error {
 	c.Debugf("rx %v bytes on cid %v [%x]", len(in), cid, in)
 
 	// are we done?
-	if b.Len() >= i.rxTransaction.rxSize {
-		// consider the txn done
-		defer func() { i.rxTransaction = nil }()
-
-		switch {
-		case b.Len() > i.rxTransaction.rxSize:
-			c.Warnf("rx overflow continuing anyways, have %v, want %v bytes", b.Len(), i.rxTransaction.rxSize)
-			fallthrough
-		case i.rxChan != nil:
-			select {
-			case i.rxChan <- b.Bytes():
-				c.Debugf("sent %v bytes to subscriber", b.Len())
-				// ok
-			case <-time.After(rxChannelSendTimeout):
-				return fmt.Errorf("subscriber channel send timeout")
-			}
+	// Credits are returned as soon as K-frames arrive, but the last K-frame of SDUs
+	// read by a net.Conn, whose credit is returned once the SDU is read.
+	if b.Len() < t.rxSize {
+		c.returnCredit(cid, 1)
+		return nil
+	}
+	if i.rxChan != nil {
+		defer c.returnCredit(cid, 1)
+	}
 
+	// consider the txn done
+	i.rxTransaction = nil
+	if b.Len() > t.rxSize {
+		c.Warnf("rx overflow continuing anyways, have %v, want %v bytes", b.Len(), t.rxSize)
+	}
+
+	switch {
+	case i.sduChan != nil:
+		select {
+		case i.sduChan <- b.Bytes():
+			c.Debugf("sent %v bytes to subscriber", b.Len())
 		default:
-			c.Warnf("cid %v has no subscriber, discarding completed rx [%x]", cid, b.Bytes())
-		} // switch
+			// The remote device sent K-frames without credits.
+			c.returnCredit(cid, 1)
+			return fmt.Errorf("cid %v rx queue full, discarding completed rx", cid)
+		}
 
-	} // if
+	case i.rxChan != nil:
+		select {
+		case i.rxChan <- b.Bytes():
+			c.Debugf("sent %v bytes to subscriber", b.Len())
+			// ok
+		case <-time.After(rxChannelSendTimeout):
+			return fmt.Errorf("subscriber channel send timeout")
+		}
+
+	default:
+		// The remote device can't send more SDUs than it has credits.
+		c.Debugf("cid %v has no subscriber yet, keeping completed rx", cid)
+		i.pending = append(i.pending, b.Bytes())
+	}
 
 	return nil
 }
@@ -300,60 +429,63 @@ func (c *coc) returnCredit(localcid, credits uint16) error {
 	// give the credit back to the remote
 	sig := &LEFlowControlCredit{
 		CID:     localcid,
-		Credits: 1,
+		Credits: credits,
 	}
 	return c.Conn.Signal(sig, nil)
 }
 
-func (c *coc) send(cid uint16, data []byte) error {
+// send sends the SDU data on the channel, segmented into K-frames of the remote MPS.
+// It waits for credits until cancel is closed, and returns os.ErrDeadlineExceeded then.
+// A channel can't recover from a partially sent SDU, so it's disconnected if cancel
+// is closed after the first K-frame was sent.
+func (c *coc) send(cid uint16, data []byte, cancel <-chan struct{}) error {
 	i, err := c.Info(cid)
 	if err != nil {
 		return err
 	}
 
-	// slice into mps-2 chunks
+	// The first K-frame carries the SDU length.
 	if i.mps <= 2 {
 		return fmt.Errorf("invalid mps %v for remote cid %v", i.mps, cid)
 	}
+	if len(data) > int(i.mtu) {
+		return fmt.Errorf("sdu of %v bytes exceeds mtu %v of remote cid %v", len(data), i.mtu, cid)
+	}
 
 	c.Debugf("attempting to send %v bytes on cid %v", len(data), cid)
 	c.Debugf("connInfo %+v", i)
 
+	i.muTx.Lock()
+	defer i.muTx.Unlock()
+
 	// Vol 3, Pt A, 3.4.2 L2CAP SDU Length field (2 octets)
 	// The first K-frame of the SDU shall contain the L2CAP SDU Length field that
 	// shall specify the total number of octets in the SDU. The value shall not be
 	// greater than the peer device's MTU for the channel. All subsequent K-frames
 	// that are part of the same SDU shall not contain the L2CAP SDU Length field.
-
-	br := bytes.NewReader(data)
 	sent := 0
-	for br.Len() > 0 {
-		bb := make([]byte, i.mps-2)
-		n, err := br.Read(bb)
-		if err != nil {
-			return err
+	first := true
+	for first || sent < len(data) {
+		n := len(data) - sent
+		hdr := 0
+		if first {
+			hdr = 2
 		}
-
-		// try and get a credit
-		ok := false
-		for i := 0; i < 10; i++ {
-			err := c.DecrementCredits(cid, 1)
-			c.Debugf("decrementCredit: attempt: %v, cid %v, credits %v, err: %v", i, cid, 1, err)
-			if err == nil {
-				ok = true
-				break
-			}
-			// wait and try again
-			time.Sleep(txCreditDelay)
+		if n > int(i.mps)-hdr {
+			n = int(i.mps) - hdr
 		}
 
-		if !ok {
-			return fmt.Errorf("unable to get credit for cid %v", cid)
+		if err := c.takeCredit(i, cancel); err != nil {
+			if !first {
+				c.Warnf("cid %v: disconnecting after a partially sent sdu", cid)
+				go c.disconnect(cid)
+			}
+			return err
 		}
 
-		buf := bytes.NewBuffer(make([]byte, 0))
+		buf := bytes.NewBuffer(make([]byte, 0, 4+hdr+n))
 		// l2cap pdu len
-		if err := binary.Write(buf, binary.LittleEndian, uint16(2+n)); err != nil {
+		if err := binary.Write(buf, binary.LittleEndian, uint16(hdr+n)); err != nil {
 			return err
 		}
 
@@ -363,29 +495,49 @@ func (c *coc) send(cid uint16, data []byte) error {
 		}
 
 		// sdu length (how many payload bytes)
-		if err := binary.Write(buf, binary.LittleEndian, uint16(len(data))); err != nil {
-			return err
+		if first {
+			if err := binary.Write(buf, binary.LittleEndian, uint16(len(data))); err != nil {
+				return err
+			}
 		}
 
 		// information payload
-		if err := binary.Write(buf, binary.LittleEndian, bb[:n]); err != nil {
-			return err
-		}
+		buf.Write(data[sent : sent+n])
 
-		txbb := buf.Bytes()
 		// send it
-		if _, err := c.writePDU(txbb); err != nil {
+		if _, err := c.writePDU(buf.Bytes()); err != nil {
 			return err
 		}
 
 		sent += n
-		c.Debugf("sent [%x], progress %v/%v bytes", sent, len(data))
+		first = false
+		c.Debugf("sent %v/%v bytes", sent, len(data))
 	}
 
 	return nil
 }
 
-func (c *coc) newCocWrapper(i *cocInfo) ble.LECreditBasedConnection {
+// takeCredit takes a credit to send a K-frame, waiting for the remote device to give one.
+func (c *coc) takeCredit(i *cocInfo, cancel <-chan struct{}) error {
+	for {
+		if err := c.DecrementCredits(i.remoteCID, 1); err == nil {
+			return nil
+		}
+		c.Debugf("cid %v: waiting for credits", i.remoteCID)
+
+		select {
+		case <-i.creditc:
+		case <-i.closed:
+			return io.ErrClosedPipe
+		case <-c.Conn.chDone:
+			return io.ErrClosedPipe
+		case <-cancel:
+			return os.ErrDeadlineExceeded
+		}
+	}
+}
+
+func (c *coc) newCocWrapper(i *cocInfo) *cocWrapper {
 	return &cocWrapper{c, i}
 }
 
@@ -395,7 +547,13 @@ type cocWrapper struct {
 }
 
 func (w *cocWrapper) Send(bb []byte) error {
-	return w.coc.send(w.remoteCID, bb)
+	d := newDeadline()
+	d.set(time.Now().Add(txCreditTimeout))
+	err := w.coc.send(w.remoteCID, bb, d.wait())
+	if err == os.ErrDeadlineExceeded {
+		return fmt.Errorf("unable to get credit for cid %v", w.remoteCID)
+	}
+	return err
 }
 
 func (w *cocWrapper) Subscribe() (<-chan []byte, error) {
@@ -406,15 +564,35 @@ func (w *cocWrapper) Unsubscribe() error {
 	return w.coc.Unsubscribe(w.localCID)
 }
 
+// Close closes the channel, and disconnects it from the remote device.
 func (w *cocWrapper) Close() error {
-	return w.coc.CloseChannel(w.remoteCID)
+	return w.coc.disconnect(w.remoteCID)
+}
+
+// Conn returns the connection the channel is opened on.
+func (w *cocWrapper) Conn() ble.Conn {
+	return w.coc.Conn
+}
+
+// NetConn returns the channel as a net.Conn.
+func (w *cocWrapper) NetConn() (net.Conn, error) {
+	rx, err := w.coc.subscribeSDU(w.localCID)
+	if err != nil {
+		return nil, err
+	}
+	return newCocConn(w, rx), nil
 }
 
 func (w *cocWrapper) Info() ble.LECreditBasedConnectionInfo {
+	// The MTU and MPS change if the channel is reconfigured.
+	i, err := w.coc.Info(w.remoteCID)
+	if err != nil {
+		i = w.cocInfo
+	}
 	return ble.LECreditBasedConnectionInfo{
 		RemoteCID: w.remoteCID,
 		LocalCID:  w.localCID,
-		MTU:       w.mtu,
-		MPS:       w.mps,
+		MTU:       i.mtu,
+		MPS:       i.mps,
 	}
 }
@@ -0,0 +1,194 @@
+package hci
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/rigado/ble"
+)
+
+// cocConn is an LE credit based channel used as a net.Conn. Writes are segmented
+// into SDUs of the remote MTU, and the received SDUs are given a credit back once
+// they are read, so the remote device can't send more than the reader consumes.
+type cocConn struct {
+	w  *cocWrapper
+	rx <-chan []byte
+
+	muRead  sync.Mutex
+	buf     []byte // rest of the SDU being read
+	reading bool   // an SDU is being read
+
+	muWrite sync.Mutex
+
+	rd, wd *deadline
+}
+
+func newCocConn(w *cocWrapper, rx <-chan []byte) *cocConn {
+	return &cocConn{
+		w:  w,
+		rx: rx,
+		rd: newDeadline(),
+		wd: newDeadline(),
+	}
+}
+
+// Read reads the received SDUs as a stream. It returns io.EOF once the channel is closed.
+func (c *cocConn) Read(b []byte) (int, error) {
+	c.muRead.Lock()
+	defer c.muRead.Unlock()
+
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	if !c.reading {
+		select {
+		case sdu, ok := <-c.rx:
+			if !ok {
+				return 0, io.EOF
+			}
+			c.buf, c.reading = sdu, true
+		case <-c.rd.wait():
+			return 0, os.ErrDeadlineExceeded
+		}
+	}
+
+	n := copy(b, c.buf)
+	c.buf = c.buf[n:]
+	if len(c.buf) == 0 {
+		// The SDU is read, the remote device can send more.
+		if err := c.w.coc.returnCredit(c.w.localCID, 1); err != nil {
+			c.w.coc.Warnf("cid %v: can't return credit: %v", c.w.localCID, err)
+		}
+		c.reading = false
+	}
+	return n, nil
+}
+
+// Write writes b in SDUs of at most the remote MTU. It blocks while the remote
+// device has no credits.
+func (c *cocConn) Write(b []byte) (int, error) {
+	c.muWrite.Lock()
+	defer c.muWrite.Unlock()
+
+	sent := 0
+	for sent < len(b) {
+		// The MTU changes if the channel is reconfigured.
+		i, err := c.w.coc.Info(c.w.remoteCID)
+		if err != nil {
+			return sent, io.ErrClosedPipe
+		}
+		n := len(b) - sent
+		if n > int(i.mtu) {
+			n = int(i.mtu)
+		}
+		if err := c.w.coc.send(c.w.remoteCID, b[sent:sent+n], c.wd.wait()); err != nil {
+			return sent, err
+		}
+		sent += n
+	}
+	return sent, nil
+}
+
+// Close closes the channel, and disconnects it from the remote device.
+func (c *cocConn) Close() error {
+	return c.w.Close()
+}
+
+// LocalAddr returns the local device address, and the local CID.
+func (c *cocConn) LocalAddr() net.Addr {
+	return cocAddr{c.w.coc.LocalAddr(), c.w.localCID}
+}
+
+// RemoteAddr returns the remote device address, and the remote CID.
+func (c *cocConn) RemoteAddr() net.Addr {
+	return cocAddr{c.w.coc.RemoteAddr(), c.w.remoteCID}
+}
+
+// SetDeadline sets the read and write deadlines.
+func (c *cocConn) SetDeadline(t time.Time) error {
+	c.rd.set(t)
+	c.wd.set(t)
+	return nil
+}
+
+// SetReadDeadline sets the deadline of Read.
+func (c *cocConn) SetReadDeadline(t time.Time) error {
+	c.rd.set(t)
+	return nil
+}
+
+// SetWriteDeadline sets the deadline of Write, which may be waiting for credits.
+func (c *cocConn) SetWriteDeadline(t time.Time) error {
+	c.wd.set(t)
+	return nil
+}
+
+// cocAddr is the address of an end of an LE credit based channel.
+type cocAddr struct {
+	addr ble.Addr
+	cid  uint16
+}
+
+func (a cocAddr) Network() string { return "l2cap" }
+func (a cocAddr) String() string  { return fmt.Sprintf("%v/%d", a.addr, a.cid) }
+
+// deadline is a deadline that can be changed while it's waited for.
+type deadline struct {
+	mu     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{} // closed when the deadline passes
+}
+
+func newDeadline() *deadline {
+	return &deadline{cancel: make(chan struct{})}
+}
+
+// set sets the deadline, the zero time meaning no deadline.
+func (d *deadline) set(t time.Time) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // The timer fired, and closed cancel.
+	}
+	d.timer = nil
+
+	closed := false
+	select {
+	case <-d.cancel:
+		closed = true
+	default:
+	}
+
+	if t.IsZero() {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+
+	if dur := time.Until(t); dur > 0 {
+		if closed {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+
+	if !closed {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel closed when the deadline passes.
+func (d *deadline) wait() <-chan struct{} {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.cancel
+}
@@ -23,6 +23,9 @@ type Conn struct {
 
 	param evt.LEConnectionComplete
 
+	// identity address of a bonded device connecting with a resolvable private address.
+	identity ble.Addr
+
 	// While MTU is the maximum size of payload data that the upper layer (ATT)
 	// can accept, the MPS is the maximum PDU payload size this L2CAP implementation
 	// supports. When segmantation is not used, the MPS should be made to the same
@@ -46,6 +49,25 @@ type Conn struct {
 	sigRxMTU int
 	sigTxMTU int
 
+	// dataLen is the data length of the link layer, which ACL data packets
+	// are fragmented to, so the controller doesn't need to fragment them again.
+	muDataLen sync.RWMutex
+	dataLen   ble.DataLength
+
+	// connParams are the parameters currently used by the connection, and
+	// connUpdated receives the result of the next connection update.
+	muConnParams        sync.RWMutex
+	connParams          ble.ConnParams
+	connUpdated         chan error
+	muRequestConnParams sync.Mutex
+
+	// muSetPHY serializes the PHY updates requested by SetPHY, and muPHY
+	// guards the channel reporting the completion, and the PHY handler.
+	muSetPHY   sync.Mutex
+	muPHY      sync.Mutex
+	phyUpdated chan uint8
+	phyHandler ble.PHYHandler
+
 	sigSent chan []byte
 	// smpSent chan []byte
 
@@ -61,6 +83,7 @@ type Conn struct {
 	// The requesting device sets this field and the responding device uses the
 	// same value in its response. Within each signalling channel a different
 	// Identifier shall be used for each successive command. [Vol 3, Part A, 4]
+	// It's guarded by sigRspChannelsMu.
 	sigID uint8
 
 	// leFrame is set to be true when the LE Credit based flow control is used.
@@ -70,10 +93,19 @@ type Conn struct {
 	// with a success status
 	encryptionEnabled bool
 
+	// keyAuthenticated and keySize are the security of the key the link is
+	// encrypted with: whether it was generated with MITM protection, and its size.
+	keyAuthenticated bool
+	keySize          int
+
 	smp        SmpManager
 	encInfo    ble.EncryptionChangedInfo
 	encChanged chan ble.EncryptionChangedInfo
 
+	// onEncrypted is called once the link is encrypted, guarded by onEncryptedMu.
+	onEncrypted   func()
+	onEncryptedMu sync.Mutex
+
 	coc              *coc
 	sigRspChannels   map[uint8]chan sigCmd
 	sigRspChannelsMu sync.Mutex
@@ -100,6 +132,14 @@ func newConn(h *HCI, param evt.LEConnectionComplete, mac string, handle uint16)
 		sigRxMTU: ble.MaxMTU,
 		sigTxMTU: ble.DefaultMTU,
 
+		dataLen: ble.DefaultDataLength,
+
+		connParams: ble.ConnParams{
+			Interval: param.ConnInterval(),
+			Latency:  param.ConnLatency(),
+			Timeout:  param.SupervisionTimeout(),
+		},
+
 		chInPkt: make(chan packet, 16),
 		chInPDU: make(chan pdu, 16),
 
@@ -113,7 +153,7 @@ func newConn(h *HCI, param evt.LEConnectionComplete, mac string, handle uint16)
 	c.coc = NewCoc(c, c.Logger.ChildLogger(map[string]interface{}{"l2capCoc": mac}))
 
 	if c.hci.smpEnabled {
-		c.smp = c.hci.smp.Create(defaultSmpConfig, c.Logger)
+		c.smp = c.hci.smp.Create(c.hci.smpConfig, c.Logger)
 		c.initPairingContext()
 		c.smp.SetWritePDUFunc(c.writePDU)
 		c.smp.SetEncryptFunc(c.encrypt)
@@ -132,6 +172,7 @@ func newConn(h *HCI, param evt.LEConnectionComplete, mac string, handle uint16)
 						c.Errorf("recombineLoop: cleanup %v", err)
 					}
 				}
+				c.coc.closeAll()
 				close(c.chInPDU)
 				return
 			}
@@ -173,6 +214,10 @@ func (c *Conn) StartEncryption(ch chan ble.EncryptionChangedInfo) error {
 		return ble.ErrEncryptionAlreadyEnabled
 	}
 
+	if c.smp == nil {
+		return fmt.Errorf("smp not enabled")
+	}
+
 	c.encChanged = ch
 	err := c.smp.StartEncryption()
 	if err != nil {
@@ -262,7 +307,8 @@ func (c *Conn) initPairingContext() {
 		lat = 0x01
 	}
 	ra := c.RemoteAddr().Bytes()
-	rat := c.param.PeerAddressType()
+	//identity addresses resolved by the controller are public or random as well
+	rat := c.param.PeerAddressType() & 0x01
 
 	smp.InitContext(la, ra, lat, rat)
 }
@@ -324,6 +370,33 @@ func (c *Conn) stkEncrypt(key []byte) error {
 	return c.hci.Send(&m, nil)
 }
 
+// handleLongTermKeyRequest replies to the controller with the key for the
+// encryption requested by the remote device.
+func (c *Conn) handleLongTermKeyRequest(ediv uint16, rand uint64) {
+	var ltk []byte
+	var err error
+	if c.smp == nil {
+		err = fmt.Errorf("smp not enabled")
+	} else {
+		ltk, err = c.smp.LongTermKeyFor(ediv, rand)
+	}
+
+	if err != nil || len(ltk) != 16 {
+		c.Warnf("longTermKeyRequest: no key, ediv %04X, rand %016X: %v", ediv, rand, err)
+		m := cmd.LELongTermKeyRequestNegativeReply{ConnectionHandle: c.param.ConnectionHandle()}
+		if err := c.hci.Send(&m, nil); err != nil {
+			c.Errorf("longTermKeyRequest: negative reply: %v", err)
+		}
+		return
+	}
+
+	m := cmd.LELongTermKeyRequestReply{ConnectionHandle: c.param.ConnectionHandle()}
+	copy(m.LongTermKey[:], ltk)
+	if err := c.hci.Send(&m, nil); err != nil {
+		c.Errorf("longTermKeyRequest: reply: %v", err)
+	}
+}
+
 // writePDU breaks down a L2CAP PDU into fragments if it's larger than the HCI buffer size. [Vol 3, Part A, 7.2.1]
 func (c *Conn) writePDU(pdu []byte) (int, error) {
 	sent := 0
@@ -344,6 +417,10 @@ func (c *Conn) writePDU(pdu []byte) (int, error) {
 	default:
 	}
 
+	c.muDataLen.RLock()
+	maxTx := int(c.dataLen.MaxTxOctets)
+	c.muDataLen.RUnlock()
+
 	for len(pdu) > 0 {
 		// Get a buffer from our pre-allocated and flow-controlled pool.
 		pkt := c.txBuffer.Get() // ACL pkt
@@ -351,6 +428,9 @@ func (c *Conn) writePDU(pdu []byte) (int, error) {
 		if flen > pkt.Cap()-1-4 {
 			flen = pkt.Cap() - 1 - 4
 		}
+		if flen > maxTx {
+			flen = maxTx
+		}
 
 		// Prepare the Headers
 
@@ -466,6 +546,21 @@ func (c *Conn) handleEncryptionChanged(status uint8, enabled uint8) {
 	}
 
 	c.encryptionEnabled = enabled == 0x01
+	if c.encryptionEnabled {
+		if c.smp != nil {
+			c.keyAuthenticated, c.keySize = c.smp.KeySecurity()
+		}
+		c.encrypted()
+	}
+
+	if c.smp != nil && (err != nil || c.encryptionEnabled) {
+		//key distribution sends on this connection, so don't block the event loop
+		go func(err error) {
+			if err := c.smp.EncryptionChanged(err); err != nil {
+				c.Errorf("encryptionChanged: %v", err)
+			}
+		}(err)
+	}
 
 	c.encInfo = ble.EncryptionChangedInfo{Status: int(status), Err: err, Enabled: c.encryptionEnabled}
 	if c.encChanged != nil {
@@ -505,6 +600,26 @@ func (c *Conn) handleEncryptionKeyRefreshComplete(status uint8) {
 	}
 }
 
+// whenEncrypted calls f on its own goroutine once the link is encrypted.
+func (c *Conn) whenEncrypted(f func()) {
+	c.onEncryptedMu.Lock()
+	defer c.onEncryptedMu.Unlock()
+	if c.encryptionEnabled {
+		go f()
+		return
+	}
+	c.onEncrypted = f
+}
+
+func (c *Conn) encrypted() {
+	c.onEncryptedMu.Lock()
+	defer c.onEncryptedMu.Unlock()
+	if c.onEncrypted != nil {
+		go c.onEncrypted()
+		c.onEncrypted = nil
+	}
+}
+
 // Disconnected returns a receiving channel, which is closed when the connection disconnects.
 func (c *Conn) Disconnected() <-chan struct{} {
 	return c.chDone
@@ -537,6 +652,45 @@ func (c *Conn) RemoteAddr() ble.Addr {
 	return ble.NewAddr(net.HardwareAddr([]byte{a[5], a[4], a[3], a[2], a[1], a[0]}).String())
 }
 
+// IdentityAddr returns the identity address of a bonded remote device using a
+// resolvable private address, or nil if it can't be resolved.
+func (c *Conn) IdentityAddr() ble.Addr {
+	if c.identity != nil {
+		return c.identity
+	}
+
+	//the device may have bonded after the connection was established
+	return c.hci.resolveIdentity(c.param.PeerAddressType(), c.param.PeerAddress())
+}
+
+// Bonded reports whether the local device stores a bond with the remote device.
+func (c *Conn) Bonded() bool {
+	return c.smp != nil && c.smp.Bonded()
+}
+
+// Encrypted reports whether the link is encrypted.
+func (c *Conn) Encrypted() bool {
+	return c.encryptionEnabled
+}
+
+// Sign returns the signature of data for an ATT signed write, using the
+// signing key distributed by the local device during pairing.
+func (c *Conn) Sign(data []byte) ([]byte, error) {
+	if c.smp == nil {
+		return nil, fmt.Errorf("smp not enabled")
+	}
+	return c.smp.Sign(data)
+}
+
+// VerifySignature checks the signature of an ATT signed write, using the
+// signing key distributed by the remote device during pairing.
+func (c *Conn) VerifySignature(data, signature []byte) error {
+	if c.smp == nil {
+		return fmt.Errorf("smp not enabled")
+	}
+	return c.smp.Verify(data, signature)
+}
+
 func (c *Conn) ReadRSSI() (int8, error) {
 	read := &cmd.ReadRSSI{Handle: c.param.ConnectionHandle()}
 	readRsp := cmd.ReadRSSIRP{}
@@ -553,6 +707,40 @@ func (c *Conn) ReadRSSI() (int8, error) {
 	return readRsp.RSSI, nil
 }
 
+// SetDataLength requests the maximum payload size and transmission time of the
+// link layer data PDUs sent on the connection. The controller reports the
+// negotiated values with the LE Data Length Change event. [Vol 2, Part E, 7.8.33]
+func (c *Conn) SetDataLength(txOctets, txTime uint16) error {
+	if txOctets < 27 || txOctets > 251 || txTime < 328 || txTime > 17040 {
+		return fmt.Errorf("invalid data length %d, time %d", txOctets, txTime)
+	}
+
+	rp := cmd.LESetDataLengthRP{}
+	err := c.hci.Send(&cmd.LESetDataLength{
+		ConnectionHandle: c.param.ConnectionHandle(),
+		TxOctets:         txOctets,
+		TxTime:           txTime,
+	}, &rp)
+	if err != nil {
+		return fmt.Errorf("failed to set data length: %v", err)
+	}
+	return nil
+}
+
+// DataLength returns the data length in use on the connection.
+func (c *Conn) DataLength() ble.DataLength {
+	c.muDataLen.RLock()
+	defer c.muDataLen.RUnlock()
+	return c.dataLen
+}
+
+func (c *Conn) handleDataLengthChange(dl ble.DataLength) {
+	c.muDataLen.Lock()
+	c.dataLen = dl
+	c.muDataLen.Unlock()
+	c.Infof("dataLengthChange: tx %v octets %vus, rx %v octets %vus", dl.MaxTxOctets, dl.MaxTxTime, dl.MaxRxOctets, dl.MaxRxTime)
+}
+
 // RxMTU returns the MTU which the upper layer is capable of accepting.
 func (c *Conn) RxMTU() int { return c.rxMTU }
 
@@ -0,0 +1,218 @@
+package hci
+
+import (
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/rigado/ble"
+	"github.com/rigado/ble/linux/hci/cmd"
+	"github.com/rigado/ble/linux/hci/evt"
+)
+
+// leEventRemoteConnectionParameterRequest is the LE event mask bit of LE Remote
+// Connection Parameter Request [Vol 2, Part E, 7.8.1]
+const leEventRemoteConnectionParameterRequest = 1 << 5
+
+// Ranges of the connection parameters [Vol 2, Part E, 7.8.12]
+const (
+	connIntervalMin       = 0x0006
+	connIntervalMax       = 0x0C80
+	connLatencyMax        = 0x01F3
+	supervisionTimeoutMin = 0x000A
+	supervisionTimeoutMax = 0x0C80
+)
+
+// Results of Connection Parameter Update Response [Vol 3, Part A, 4.21]
+const (
+	connParamsAccepted = 0x0000
+	connParamsRejected = 0x0001
+)
+
+// validConnParams reports whether the connection parameters are in range, and
+// the supervision timeout is longer than the effective connection interval.
+func validConnParams(p ble.ConnParamsRequest) bool {
+	switch {
+	case p.IntervalMin < connIntervalMin || p.IntervalMax > connIntervalMax || p.IntervalMin > p.IntervalMax:
+		return false
+	case p.Latency > connLatencyMax:
+		return false
+	case p.Timeout < supervisionTimeoutMin || p.Timeout > supervisionTimeoutMax:
+		return false
+	}
+	// Timeout is in units of 10ms, the interval in units of 1.25ms.
+	return uint32(p.Timeout)*4 > (1+uint32(p.Latency))*uint32(p.IntervalMax)
+}
+
+func (h *HCI) handleLEConnectionParameterRequest(b []byte) error {
+	e := evt.LERemoteConnectionParameterRequest(b)
+	if len(e) < 11 {
+		return fmt.Errorf("connectionParameterRequest: invalid length %d", len(e))
+	}
+
+	c := h.findConnection(e.ConnectionHandle())
+	if c == nil {
+		return fmt.Errorf("connectionParameterRequest: unknown connection handle %04X", e.ConnectionHandle())
+	}
+
+	req := ble.ConnParamsRequest{
+		IntervalMin: e.IntervalMin(),
+		IntervalMax: e.IntervalMax(),
+		Latency:     e.Latency(),
+		Timeout:     e.Timeout(),
+	}
+
+	// The policy may take a while, and the reply can't be sent from the event loop.
+	go c.replyConnParams(req)
+	return nil
+}
+
+func (h *HCI) handleLEConnectionUpdateComplete(b []byte) error {
+	e := evt.LEConnectionUpdateComplete(b)
+	if len(e) < 10 {
+		return fmt.Errorf("connectionUpdateComplete: invalid length %d", len(e))
+	}
+
+	c := h.findConnection(e.ConnectionHandle())
+	if c == nil {
+		return fmt.Errorf("connectionUpdateComplete: unknown connection handle %04X", e.ConnectionHandle())
+	}
+
+	if e.Status() != 0 {
+		err := ErrCommand(e.Status())
+		c.Warnf("connectionUpdateComplete: status %v", err)
+		c.muConnParams.Lock()
+		c.connectionUpdated(err)
+		c.muConnParams.Unlock()
+		return nil
+	}
+
+	p := ble.ConnParams{
+		Interval: e.ConnInterval(),
+		Latency:  e.ConnLatency(),
+		Timeout:  e.SupervisionTimeout(),
+	}
+	c.muConnParams.Lock()
+	c.connParams = p
+	c.connectionUpdated(nil)
+	c.muConnParams.Unlock()
+
+	c.Infof("connectionUpdateComplete: interval %v, latency %v, timeout %v", p.Interval, p.Latency, p.Timeout)
+	return nil
+}
+
+// connectionUpdated passes the result of a connection update to the pending
+// RequestConnectionParameters, if any. It's called with muConnParams held.
+func (c *Conn) connectionUpdated(err error) {
+	if c.connUpdated != nil {
+		c.connUpdated <- err
+		c.connUpdated = nil
+	}
+}
+
+// replyConnParams accepts, rejects, or counter-proposes the connection parameters
+// requested by the remote device, as decided by the connection parameter policy.
+// Without a policy, valid parameters are accepted.
+func (c *Conn) replyConnParams(req ble.ConnParamsRequest) {
+	rsp, ok := c.decideConnParams(req)
+	if !ok {
+		c.Infof("connectionParameterRequest: reject %+v", req)
+		err := c.hci.Send(&cmd.LERemoteConnectionParameterRequestNegativeReply{
+			ConnectionHandle: c.param.ConnectionHandle(),
+			Reason:           uint8(ErrConnParams),
+		}, nil)
+		if err != nil {
+			c.Errorf("connectionParameterRequest: negative reply: %v", err)
+		}
+		return
+	}
+
+	c.Infof("connectionParameterRequest: accept %+v", rsp)
+	err := c.hci.Send(&cmd.LERemoteConnectionParameterRequestReply{
+		ConnectionHandle: c.param.ConnectionHandle(),
+		IntervalMin:      rsp.IntervalMin,
+		IntervalMax:      rsp.IntervalMax,
+		Latency:          rsp.Latency,
+		Timeout:          rsp.Timeout,
+	}, nil)
+	if err != nil {
+		c.Errorf("connectionParameterRequest: reply: %v", err)
+	}
+}
+
+// decideConnParams returns the parameters to apply for the remote device's request,
+// or false to reject it.
+func (c *Conn) decideConnParams(req ble.ConnParamsRequest) (ble.ConnParamsRequest, bool) {
+	p := c.hci.connParamsPolicy
+	if p == nil {
+		return req, validConnParams(req)
+	}
+	rsp, ok := p(c, req)
+	if ok && !validConnParams(rsp) {
+		c.Warnf("connectionParameterRequest: policy replied invalid parameters %+v", rsp)
+		return rsp, false
+	}
+	return rsp, ok
+}
+
+// RequestConnectionParameters asks the central to change the connection parameters,
+// with the L2CAP Connection Parameter Update Request. The interval is in units of
+// 1.25 ms, and the supervision timeout in units of 10 ms. It returns once the central
+// applied new parameters, which are returned by ConnParams, or ctx is done.
+// It returns ble.ErrConnParamsRejected if the central rejected the request, and the
+// status of the connection update if it failed. [Vol 3, Part A, 4.20]
+func (c *Conn) RequestConnectionParameters(ctx context.Context, min, max, latency, timeout uint16) error {
+	if c.param.Role() != roleSlave {
+		return fmt.Errorf("connection parameter update request: not a peripheral")
+	}
+	req := ble.ConnParamsRequest{IntervalMin: min, IntervalMax: max, Latency: latency, Timeout: timeout}
+	if !validConnParams(req) {
+		return fmt.Errorf("invalid connection parameters %+v", req)
+	}
+
+	c.muRequestConnParams.Lock()
+	defer c.muRequestConnParams.Unlock()
+
+	// The central may update the connection before its response arrives.
+	updated := make(chan error, 1)
+	c.muConnParams.Lock()
+	c.connUpdated = updated
+	c.muConnParams.Unlock()
+	defer func() {
+		c.muConnParams.Lock()
+		if c.connUpdated == updated {
+			c.connUpdated = nil
+		}
+		c.muConnParams.Unlock()
+	}()
+
+	rsp := ConnectionParameterUpdateResponse{}
+	err := c.signal(ctx, &ConnectionParameterUpdateRequest{
+		IntervalMin:       min,
+		IntervalMax:       max,
+		SlaveLatency:      latency,
+		TimeoutMultiplier: timeout,
+	}, &rsp)
+	if err != nil {
+		return err
+	}
+	if rsp.Result != connParamsAccepted {
+		return ble.ErrConnParamsRejected
+	}
+
+	select {
+	case err := <-updated:
+		return err
+	case <-c.chDone:
+		return io.ErrClosedPipe
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// ConnParams returns the parameters currently used by the connection.
+func (c *Conn) ConnParams() ble.ConnParams {
+	c.muConnParams.RLock()
+	defer c.muConnParams.RUnlock()
+	return c.connParams
+}
@@ -34,8 +34,8 @@ const (
 )
 
 const (
-	chCmdBufChanSize    = 16 // TODO: decide correct size (comment migrated)
-	chCmdBufElementSize = 64
+	chCmdBufChanSize    = 16      // TODO: decide correct size (comment migrated)
+	chCmdBufElementSize = 4 + 255 // HCI command header and the largest parameter set
 	chCmdBufTimeout     = time.Second * 5
 )
 
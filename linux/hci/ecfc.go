@@ -0,0 +1,321 @@
+package hci
+
+import (
+	"fmt"
+
+	"github.com/rigado/ble"
+)
+
+// Enhanced Credit Based Flow Control Mode [Vol 3, Part A, 3.4.3, 4.25]
+const (
+	ecfcMaxChannels = 5
+	ecfcMinMTU      = 64
+	ecfcMinMPS      = 64
+)
+
+// Results of L2CAP Credit Based Reconfigure Response [Vol 3, Part A, 4.28]
+const (
+	reconfigureSuccess                = 0x0000
+	reconfigureMTUReduced             = 0x0001
+	reconfigureMPSReduced             = 0x0002
+	reconfigureInvalidCID             = 0x0003
+	reconfigureUnacceptableParameters = 0x0004
+)
+
+// ecfcDefaults replaces the zero values of opts by defaults, which are at least
+// the minimum MTU and MPS of the Enhanced Credit Based Flow Control Mode.
+func ecfcDefaults(opts ble.L2CAPOptions) ble.L2CAPOptions {
+	opts = l2capDefaults(opts)
+	if opts.MTU < ecfcMinMTU {
+		opts.MTU = ecfcMinMTU
+	}
+	if opts.MPS < ecfcMinMPS {
+		opts.MPS = ecfcMinMPS
+	}
+	return opts
+}
+
+// OpenEnhanced opens n channels on the SPSM psm, with a single L2CAP Credit Based
+// Connection Request. The remote device may open only some of them; an error is
+// returned if it opened none. [Vol 3, Part A, 4.25]
+func (c *coc) OpenEnhanced(psm uint16, n int, opts ble.L2CAPOptions) ([]ble.LECreditBasedConnection, error) {
+	if n < 1 || n > ecfcMaxChannels {
+		return nil, fmt.Errorf("invalid number of channels %v, must be 1-%v", n, ecfcMaxChannels)
+	}
+	opts = ecfcDefaults(opts)
+
+	out := &L2CAPCreditBasedConnectionRequest{
+		SPSM:           psm,
+		MTU:            opts.MTU,
+		MPS:            opts.MPS,
+		InitialCredits: opts.InitialCredits,
+	}
+	for len(out.SourceCID) < n {
+		cid, err := c.NextSourceCID()
+		if err != nil {
+			return nil, err
+		}
+		out.SourceCID = append(out.SourceCID, cid)
+	}
+
+	in := &L2CAPCreditBasedConnectionResponse{}
+	if err := c.Signal(out, in); err != nil {
+		return nil, err
+	}
+	if len(in.DestinationCID) != n {
+		return nil, fmt.Errorf("ecfcOpen/rsp %v cids, want %v", len(in.DestinationCID), n)
+	}
+
+	local := cocParams{mtu: opts.MTU, mps: opts.MPS, credits: opts.InitialCredits}
+	remote := cocParams{mtu: in.MTU, mps: in.MPS, credits: in.InitialCredits}
+	var chs []ble.LECreditBasedConnection
+	for k, dcid := range in.DestinationCID {
+		if dcid == 0 {
+			continue
+		}
+		ch, err := c.addChannel(out.SourceCID[k], dcid, local, remote)
+		if err != nil {
+			c.Errorf("ecfcOpen: %v", err)
+			continue
+		}
+		chs = append(chs, ch)
+	}
+
+	if len(chs) == 0 {
+		return nil, fmt.Errorf("ecfcOpen/rsp result code 0x%x", in.Result)
+	}
+	c.Infof("ecfcOpen psm 0x%04X, %v/%v channels, result 0x%x", psm, len(chs), n, in.Result)
+	return chs, nil
+}
+
+// channel returns the channel ch of the connection.
+func (c *coc) channel(ch ble.LECreditBasedConnection) (*cocWrapper, error) {
+	w, ok := ch.(*cocWrapper)
+	if !ok || w.coc != c {
+		return nil, fmt.Errorf("not a channel of the connection")
+	}
+	return w, nil
+}
+
+// Reconfigure changes the local MTU and MPS of the channels chs, opened in the Enhanced
+// Credit Based Flow Control Mode. The MTU can't be reduced, nor the MPS of several
+// channels. [Vol 3, Part A, 4.27]
+func (c *coc) Reconfigure(chs []ble.LECreditBasedConnection, mtu, mps uint16) error {
+	if len(chs) < 1 || len(chs) > ecfcMaxChannels {
+		return fmt.Errorf("invalid number of channels %v, must be 1-%v", len(chs), ecfcMaxChannels)
+	}
+	if mtu < ecfcMinMTU || mps < ecfcMinMPS || mps > maxCocMPS {
+		return fmt.Errorf("invalid mtu %v, mps %v", mtu, mps)
+	}
+
+	out := &L2CAPCreditBasedReconfigureRequest{MTU: mtu, MPS: mps}
+	for _, ch := range chs {
+		w, err := c.channel(ch)
+		if err != nil {
+			return err
+		}
+		i, err := c.Info(w.remoteCID)
+		if err != nil {
+			return err
+		}
+		if mtu < i.rxMTU {
+			return fmt.Errorf("cid %v: mtu can't be reduced from %v to %v", i.localCID, i.rxMTU, mtu)
+		}
+		if len(chs) > 1 && mps < i.rxMPS {
+			return fmt.Errorf("cid %v: mps of several channels can't be reduced from %v to %v", i.localCID, i.rxMPS, mps)
+		}
+		out.DestinationCID = append(out.DestinationCID, i.localCID)
+	}
+
+	in := &L2CAPCreditBasedReconfigureResponse{}
+	if err := c.Signal(out, in); err != nil {
+		return err
+	}
+	if in.Result != reconfigureSuccess {
+		return fmt.Errorf("ecfcReconfigure/rsp result code 0x%x", in.Result)
+	}
+
+	c.Lock()
+	defer c.Unlock()
+	for _, cid := range out.DestinationCID {
+		if i, err := c.unsafeLocalChannel(cid); err == nil {
+			i.rxMTU, i.rxMPS = mtu, mps
+		}
+	}
+	return nil
+}
+
+// reconfigureRemote applies the MTU and MPS the remote device reconfigured its channels
+// with, and returns the result of the L2CAP Credit Based Reconfigure Response.
+func (c *coc) reconfigureRemote(req *L2CAPCreditBasedReconfigureRequest) uint16 {
+	if len(req.DestinationCID) < 1 || len(req.DestinationCID) > ecfcMaxChannels {
+		return reconfigureUnacceptableParameters
+	}
+	if req.MTU < ecfcMinMTU || req.MPS < ecfcMinMPS || req.MPS > maxCocMPS {
+		return reconfigureUnacceptableParameters
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	// The CIDs are the remote device's ends of the channels.
+	var chs []*cocInfo
+	for _, cid := range req.DestinationCID {
+		i, ok := c.remoteCidLut[cid]
+		if !ok {
+			return reconfigureInvalidCID
+		}
+		if req.MTU < i.mtu {
+			return reconfigureMTUReduced
+		}
+		if len(req.DestinationCID) > 1 && req.MPS < i.mps {
+			return reconfigureMPSReduced
+		}
+		chs = append(chs, i)
+	}
+	for _, i := range chs {
+		i.mtu, i.mps = req.MTU, req.MPS
+	}
+	return reconfigureSuccess
+}
+
+// acceptEnhanced opens the channels requested by the remote device, which may be refused
+// individually. It returns the L2CAP Credit Based Connection Response, and the opened channels.
+func (l *l2capListener) acceptEnhanced(c *Conn, req *L2CAPCreditBasedConnectionRequest) (*L2CAPCreditBasedConnectionResponse, []*cocWrapper) {
+	opts := ecfcDefaults(l.opts)
+	rsp := &L2CAPCreditBasedConnectionResponse{
+		MTU:            opts.MTU,
+		MPS:            opts.MPS,
+		InitialCredits: opts.InitialCredits,
+		DestinationCID: make([]uint16, len(req.SourceCID)),
+	}
+	refuse := func(result uint16) (*L2CAPCreditBasedConnectionResponse, []*cocWrapper) {
+		return &L2CAPCreditBasedConnectionResponse{
+			Result:         result,
+			DestinationCID: make([]uint16, len(req.SourceCID)),
+		}, nil
+	}
+
+	if len(req.SourceCID) < 1 || len(req.SourceCID) > ecfcMaxChannels {
+		return refuse(cocResultInvalidParameters)
+	}
+	if result := l.checkSecurity(c); result != cocResultSuccess {
+		return refuse(result)
+	}
+	if req.MTU < ecfcMinMTU || req.MPS < ecfcMinMPS || req.MPS > maxCocMPS {
+		return refuse(cocResultUnacceptableParameters)
+	}
+
+	local := cocParams{mtu: opts.MTU, mps: opts.MPS, credits: opts.InitialCredits}
+	remote := cocParams{mtu: req.MTU, mps: req.MPS, credits: req.InitialCredits}
+	var chs []*cocWrapper
+	for k, scid := range req.SourceCID {
+		if scid < minDynamicCID || scid > maxLEDynamicCID {
+			rsp.Result = cocResultInvalidSourceCID
+			continue
+		}
+		if _, err := c.coc.Info(scid); err == nil {
+			rsp.Result = cocResultSourceCIDAllocated
+			continue
+		}
+		if len(l.ch)+len(chs) >= cap(l.ch) {
+			c.Warnf("l2cap: psm 0x%04X backlog full", l.psm)
+			rsp.Result = cocResultNoResources
+			continue
+		}
+		localCID, err := c.coc.NextSourceCID()
+		if err != nil {
+			rsp.Result = cocResultNoResources
+			continue
+		}
+		ch, err := c.coc.addChannel(localCID, scid, local, remote)
+		if err != nil {
+			rsp.Result = cocResultSourceCIDAllocated
+			continue
+		}
+		rsp.DestinationCID[k] = localCID
+		chs = append(chs, ch)
+	}
+	return rsp, chs
+}
+
+// handleCreditBasedConnectionRequest implements L2CAP Credit Based Connection Request (0x17) [Vol 3, Part A, 4.25].
+func (c *Conn) handleCreditBasedConnectionRequest(s sigCmd) {
+	var req L2CAPCreditBasedConnectionRequest
+	if err := req.Unmarshal(s.data()); err != nil {
+		return
+	}
+	c.Debugf("CreditBasedConnectionRequest: spsm 0x%04X, cids %v, mtu %v, mps %v, credits %v",
+		req.SPSM, req.SourceCID, req.MTU, req.MPS, req.InitialCredits)
+
+	l := c.hci.listener(req.SPSM)
+	if l == nil {
+		c.sendResponse(
+			SignalL2CAPCreditBasedConnectionResponse,
+			s.id(),
+			&L2CAPCreditBasedConnectionResponse{
+				Result:         cocResultSPSMNotSupported,
+				DestinationCID: make([]uint16, len(req.SourceCID)),
+			})
+		return
+	}
+
+	rsp, chs := l.acceptEnhanced(c, &req)
+	if _, err := c.sendResponse(SignalL2CAPCreditBasedConnectionResponse, s.id(), rsp); err != nil {
+		c.Errorf("CreditBasedConnectionRequest: %v", err)
+		for _, ch := range chs {
+			c.coc.CloseChannel(ch.remoteCID)
+		}
+		return
+	}
+
+	c.Infof("CreditBasedConnectionRequest: spsm 0x%04X, %v/%v channels opened, result 0x%04X",
+		req.SPSM, len(chs), len(req.SourceCID), rsp.Result)
+	for _, ch := range chs {
+		l.queue(ch)
+	}
+}
+
+// handleCreditBasedReconfigureRequest implements L2CAP Credit Based Reconfigure Request (0x19) [Vol 3, Part A, 4.27].
+func (c *Conn) handleCreditBasedReconfigureRequest(s sigCmd) {
+	var req L2CAPCreditBasedReconfigureRequest
+	if err := req.Unmarshal(s.data()); err != nil {
+		return
+	}
+
+	result := c.coc.reconfigureRemote(&req)
+	c.Debugf("CreditBasedReconfigureRequest: cids %v, mtu %v, mps %v, result 0x%04X", req.DestinationCID, req.MTU, req.MPS, result)
+	c.sendResponse(
+		SignalL2CAPCreditBasedReconfigureResponse,
+		s.id(),
+		&L2CAPCreditBasedReconfigureResponse{
+			Result: result,
+		})
+}
+
+// OpenEnhancedCreditBasedConnections opens n, up to 5, channels in the Enhanced Credit Based
+// Flow Control Mode on the SPSM psm. The remote device may open only some of them.
+func (c *Conn) OpenEnhancedCreditBasedConnections(psm uint16, n int, opts ble.L2CAPOptions) ([]ble.LECreditBasedConnection, error) {
+	return c.coc.OpenEnhanced(psm, n, opts)
+}
+
+// ReconfigureCreditBasedConnections changes the local MTU and MPS of channels opened in the
+// Enhanced Credit Based Flow Control Mode.
+func (c *Conn) ReconfigureCreditBasedConnections(chs []ble.LECreditBasedConnection, mtu, mps uint16) error {
+	return c.coc.Reconfigure(chs, mtu, mps)
+}
+
+// DisconnectCreditBasedConnections closes the channels chs, and disconnects them from the remote device.
+func (c *Conn) DisconnectCreditBasedConnections(chs []ble.LECreditBasedConnection) error {
+	var err error
+	for _, ch := range chs {
+		w, e := c.coc.channel(ch)
+		if e == nil {
+			e = c.coc.disconnect(w.remoteCID)
+		}
+		if e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
@@ -8,6 +8,8 @@ var (
 	ErrBusyAdvertising = errors.New("busy advertising")
 	ErrBusyDialing     = errors.New("busy dialing")
 	ErrBusyListening   = errors.New("busy listening")
+	ErrBusySyncing     = errors.New("busy syncing")
+	ErrNotScanning     = errors.New("not scanning")
 	ErrInvalidAddr     = errors.New("invalid address")
 )
 
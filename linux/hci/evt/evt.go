@@ -77,3 +77,78 @@ func (e LEAdvertisingReport) RSSI(i int) int8 {
 	v, _ := e.RSSIWErr(i)
 	return v
 }
+
+func (e LEExtendedAdvertisingReport) SubeventCode() uint8 {
+	v, _ := e.SubeventCodeWErr()
+	return v
+}
+
+func (e LEExtendedAdvertisingReport) NumReports() uint8 {
+	v, _ := e.NumReportsWErr()
+	return v
+}
+
+func (e LEExtendedAdvertisingReport) EventType(i int) uint16 {
+	v, _ := e.EventTypeWErr(i)
+	return v
+}
+
+func (e LEExtendedAdvertisingReport) AddressType(i int) uint8 {
+	v, _ := e.AddressTypeWErr(i)
+	return v
+}
+
+func (e LEExtendedAdvertisingReport) Address(i int) [6]byte {
+	v, _ := e.AddressWErr(i)
+	return v
+}
+
+func (e LEExtendedAdvertisingReport) PrimaryPHY(i int) uint8 {
+	v, _ := e.PrimaryPHYWErr(i)
+	return v
+}
+
+func (e LEExtendedAdvertisingReport) SecondaryPHY(i int) uint8 {
+	v, _ := e.SecondaryPHYWErr(i)
+	return v
+}
+
+func (e LEExtendedAdvertisingReport) AdvertisingSID(i int) uint8 {
+	v, _ := e.AdvertisingSIDWErr(i)
+	return v
+}
+
+func (e LEExtendedAdvertisingReport) TXPower(i int) int8 {
+	v, _ := e.TXPowerWErr(i)
+	return v
+}
+
+func (e LEExtendedAdvertisingReport) RSSI(i int) int8 {
+	v, _ := e.RSSIWErr(i)
+	return v
+}
+
+func (e LEExtendedAdvertisingReport) PeriodicAdvertisingInterval(i int) uint16 {
+	v, _ := e.PeriodicAdvertisingIntervalWErr(i)
+	return v
+}
+
+func (e LEExtendedAdvertisingReport) DirectAddressType(i int) uint8 {
+	v, _ := e.DirectAddressTypeWErr(i)
+	return v
+}
+
+func (e LEExtendedAdvertisingReport) DirectAddress(i int) [6]byte {
+	v, _ := e.DirectAddressWErr(i)
+	return v
+}
+
+func (e LEExtendedAdvertisingReport) DataLength(i int) uint8 {
+	v, _ := e.DataLengthWErr(i)
+	return v
+}
+
+func (e LEExtendedAdvertisingReport) Data(i int) []byte {
+	v, _ := e.DataWErr(i)
+	return v
+}
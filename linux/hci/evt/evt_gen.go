@@ -219,6 +219,116 @@ func (r LERemoteConnectionParameterRequest) Timeout() uint16 {
 	return binary.LittleEndian.Uint16(r[9:])
 }
 
+const LEDataLengthChangeCode = 0x3E
+
+const LEDataLengthChangeSubCode = 0x07
+
+// LEDataLengthChange implements LE Data Length Change (0x3E:0x07) [Vol 2, Part E, 7.7.65.7].
+type LEDataLengthChange []byte
+
+func (r LEDataLengthChange) SubeventCode() uint8 { return r[0] }
+
+func (r LEDataLengthChange) ConnectionHandle() uint16 { return binary.LittleEndian.Uint16(r[1:]) }
+
+func (r LEDataLengthChange) MaxTxOctets() uint16 { return binary.LittleEndian.Uint16(r[3:]) }
+
+func (r LEDataLengthChange) MaxTxTime() uint16 { return binary.LittleEndian.Uint16(r[5:]) }
+
+func (r LEDataLengthChange) MaxRxOctets() uint16 { return binary.LittleEndian.Uint16(r[7:]) }
+
+func (r LEDataLengthChange) MaxRxTime() uint16 { return binary.LittleEndian.Uint16(r[9:]) }
+
+const LEPHYUpdateCompleteCode = 0x3E
+
+const LEPHYUpdateCompleteSubCode = 0x0C
+
+// LEPHYUpdateComplete implements LE PHY Update Complete (0x3E:0x0C) [Vol 2, Part E, 7.7.65.12].
+type LEPHYUpdateComplete []byte
+
+func (r LEPHYUpdateComplete) SubeventCode() uint8 { return r[0] }
+
+func (r LEPHYUpdateComplete) Status() uint8 { return r[1] }
+
+func (r LEPHYUpdateComplete) ConnectionHandle() uint16 { return binary.LittleEndian.Uint16(r[2:]) }
+
+func (r LEPHYUpdateComplete) TXPHY() uint8 { return r[4] }
+
+func (r LEPHYUpdateComplete) RXPHY() uint8 { return r[5] }
+
+const LEExtendedAdvertisingReportCode = 0x3E
+
+const LEExtendedAdvertisingReportSubCode = 0x0D
+
+// LEExtendedAdvertisingReport implements LE Extended Advertising Report (0x3E:0x0D) [Vol 2, Part E, 7.7.65.13].
+type LEExtendedAdvertisingReport []byte
+
+const LEPeriodicAdvertisingSyncEstablishedCode = 0x3E
+
+const LEPeriodicAdvertisingSyncEstablishedSubCode = 0x0E
+
+// LEPeriodicAdvertisingSyncEstablished implements LE Periodic Advertising Sync Established (0x3E:0x0E) [Vol 2, Part E, 7.7.65.14].
+type LEPeriodicAdvertisingSyncEstablished []byte
+
+func (r LEPeriodicAdvertisingSyncEstablished) SubeventCode() uint8 { return r[0] }
+
+func (r LEPeriodicAdvertisingSyncEstablished) Status() uint8 { return r[1] }
+
+func (r LEPeriodicAdvertisingSyncEstablished) SyncHandle() uint16 {
+	return binary.LittleEndian.Uint16(r[2:])
+}
+
+func (r LEPeriodicAdvertisingSyncEstablished) AdvertisingSID() uint8 { return r[4] }
+
+func (r LEPeriodicAdvertisingSyncEstablished) AdvertiserAddressType() uint8 { return r[5] }
+
+func (r LEPeriodicAdvertisingSyncEstablished) AdvertiserAddress() [6]byte {
+	b := [6]byte{}
+	copy(b[:], r[6:])
+	return b
+}
+
+func (r LEPeriodicAdvertisingSyncEstablished) AdvertiserPHY() uint8 { return r[12] }
+
+func (r LEPeriodicAdvertisingSyncEstablished) PeriodicAdvertisingInterval() uint16 {
+	return binary.LittleEndian.Uint16(r[13:])
+}
+
+func (r LEPeriodicAdvertisingSyncEstablished) AdvertiserClockAccuracy() uint8 { return r[15] }
+
+const LEPeriodicAdvertisingReportCode = 0x3E
+
+const LEPeriodicAdvertisingReportSubCode = 0x0F
+
+// LEPeriodicAdvertisingReport implements LE Periodic Advertising Report (0x3E:0x0F) [Vol 2, Part E, 7.7.65.15].
+type LEPeriodicAdvertisingReport []byte
+
+func (r LEPeriodicAdvertisingReport) SubeventCode() uint8 { return r[0] }
+
+func (r LEPeriodicAdvertisingReport) SyncHandle() uint16 { return binary.LittleEndian.Uint16(r[1:]) }
+
+func (r LEPeriodicAdvertisingReport) TXPower() int8 { return int8(r[3]) }
+
+func (r LEPeriodicAdvertisingReport) RSSI() int8 { return int8(r[4]) }
+
+func (r LEPeriodicAdvertisingReport) CTEType() uint8 { return r[5] }
+
+func (r LEPeriodicAdvertisingReport) DataStatus() uint8 { return r[6] }
+
+func (r LEPeriodicAdvertisingReport) DataLength() uint8 { return r[7] }
+
+func (r LEPeriodicAdvertisingReport) Data() []byte { return r[8:] }
+
+const LEPeriodicAdvertisingSyncLostCode = 0x3E
+
+const LEPeriodicAdvertisingSyncLostSubCode = 0x10
+
+// LEPeriodicAdvertisingSyncLost implements LE Periodic Advertising Sync Lost (0x3E:0x10) [Vol 2, Part E, 7.7.65.16].
+type LEPeriodicAdvertisingSyncLost []byte
+
+func (r LEPeriodicAdvertisingSyncLost) SubeventCode() uint8 { return r[0] }
+
+func (r LEPeriodicAdvertisingSyncLost) SyncHandle() uint16 { return binary.LittleEndian.Uint16(r[1:]) }
+
 const AuthenticatedPayloadTimeoutExpiredCode = 0x57
 
 // AuthenticatedPayloadTimeoutExpired implements Authenticated Payload Timeout Expired (0x57) [Vol 2, Part E, 7.7.75].
@@ -133,6 +133,153 @@ func (e LEAdvertisingReport) RSSIWErr(i int) (int8, error) {
 	return int8(rssi), err
 }
 
+// Reports of the LE Extended Advertising Report are laid out one after the other,
+// unlike the legacy report, with a fixed 24 byte header followed by the data.
+const extAdvReportHeaderLen = 24
+
+func (e LEExtendedAdvertisingReport) SubeventCodeWErr() (uint8, error) {
+	return getByte(e, 0, 0xff)
+}
+
+func (e LEExtendedAdvertisingReport) NumReportsWErr() (uint8, error) {
+	return getByte(e, 1, 0)
+}
+
+// reportWErr returns the bytes of the i-th report.
+func (e LEExtendedAdvertisingReport) reportWErr(i int) ([]byte, error) {
+	nr, err := e.NumReportsWErr()
+	if err != nil {
+		return nil, err
+	}
+	if i < 0 || i >= int(nr) {
+		return nil, fmt.Errorf("index error")
+	}
+
+	si := 2
+	for j := 0; ; j++ {
+		ll, err := getByte(e, si+extAdvReportHeaderLen-1, 0)
+		if err != nil {
+			return nil, err
+		}
+		if j == i {
+			return getBytes(e, si, extAdvReportHeaderLen+int(ll))
+		}
+		si += extAdvReportHeaderLen + int(ll)
+	}
+}
+
+func (e LEExtendedAdvertisingReport) EventTypeWErr(i int) (uint16, error) {
+	r, err := e.reportWErr(i)
+	if err != nil {
+		return 0xffff, err
+	}
+	return getUint16LE(r, 0, 0xffff)
+}
+
+func (e LEExtendedAdvertisingReport) AddressTypeWErr(i int) (uint8, error) {
+	r, err := e.reportWErr(i)
+	if err != nil {
+		return 0xff, err
+	}
+	return getByte(r, 2, 0xff)
+}
+
+func (e LEExtendedAdvertisingReport) AddressWErr(i int) ([6]byte, error) {
+	r, err := e.reportWErr(i)
+	if err != nil {
+		return [6]byte{}, err
+	}
+
+	out := [6]byte{}
+	copy(out[:], r[3:9])
+	return out, nil
+}
+
+func (e LEExtendedAdvertisingReport) PrimaryPHYWErr(i int) (uint8, error) {
+	r, err := e.reportWErr(i)
+	if err != nil {
+		return 0, err
+	}
+	return getByte(r, 9, 0)
+}
+
+func (e LEExtendedAdvertisingReport) SecondaryPHYWErr(i int) (uint8, error) {
+	r, err := e.reportWErr(i)
+	if err != nil {
+		return 0, err
+	}
+	return getByte(r, 10, 0)
+}
+
+func (e LEExtendedAdvertisingReport) AdvertisingSIDWErr(i int) (uint8, error) {
+	r, err := e.reportWErr(i)
+	if err != nil {
+		return 0xff, err
+	}
+	return getByte(r, 11, 0xff)
+}
+
+func (e LEExtendedAdvertisingReport) TXPowerWErr(i int) (int8, error) {
+	r, err := e.reportWErr(i)
+	if err != nil {
+		return 127, err
+	}
+	v, err := getByte(r, 12, 127)
+	return int8(v), err
+}
+
+func (e LEExtendedAdvertisingReport) RSSIWErr(i int) (int8, error) {
+	r, err := e.reportWErr(i)
+	if err != nil {
+		return 0, err
+	}
+	v, err := getByte(r, 13, 0)
+	return int8(v), err
+}
+
+func (e LEExtendedAdvertisingReport) PeriodicAdvertisingIntervalWErr(i int) (uint16, error) {
+	r, err := e.reportWErr(i)
+	if err != nil {
+		return 0, err
+	}
+	return getUint16LE(r, 14, 0)
+}
+
+func (e LEExtendedAdvertisingReport) DirectAddressTypeWErr(i int) (uint8, error) {
+	r, err := e.reportWErr(i)
+	if err != nil {
+		return 0xff, err
+	}
+	return getByte(r, 16, 0xff)
+}
+
+func (e LEExtendedAdvertisingReport) DirectAddressWErr(i int) ([6]byte, error) {
+	r, err := e.reportWErr(i)
+	if err != nil {
+		return [6]byte{}, err
+	}
+
+	out := [6]byte{}
+	copy(out[:], r[17:23])
+	return out, nil
+}
+
+func (e LEExtendedAdvertisingReport) DataLengthWErr(i int) (uint8, error) {
+	r, err := e.reportWErr(i)
+	if err != nil {
+		return 0, err
+	}
+	return getByte(r, 23, 0)
+}
+
+func (e LEExtendedAdvertisingReport) DataWErr(i int) ([]byte, error) {
+	r, err := e.reportWErr(i)
+	if err != nil {
+		return nil, err
+	}
+	return r[extAdvReportHeaderLen:], nil
+}
+
 //get or default
 func getByte(b []byte, i int, def byte) (byte, error) {
 	bb, err := getBytes(b, i, 1)
@@ -10,6 +10,7 @@ import (
 	"github.com/rigado/ble"
 	"github.com/rigado/ble/linux/adv"
 	"github.com/rigado/ble/linux/gatt"
+	"github.com/rigado/ble/linux/hci/cmd"
 	"github.com/rigado/ble/sliceops"
 )
 
@@ -19,6 +20,13 @@ func (h *HCI) Bytes() []byte {
 	return ble.NewAddr(h.addr.String()).Bytes()
 }
 
+// Connections returns the number of open connections, in either role.
+func (h *HCI) Connections() int {
+	h.muConns.Lock()
+	defer h.muConns.Unlock()
+	return len(h.conns)
+}
+
 // SetAdvHandler ...
 func (h *HCI) SetAdvHandler(ah ble.AdvHandler) error {
 	h.advHandler = ah
@@ -27,19 +35,40 @@ func (h *HCI) SetAdvHandler(ah ble.AdvHandler) error {
 
 // Scan starts scanning.
 func (h *HCI) Scan(allowDup bool) error {
+	if err := h.setScanFilterPolicy(h.scanFilterPolicy); err != nil {
+		return err
+	}
+	return h.scan(allowDup)
+}
+
+func (h *HCI) scan(allowDup bool) error {
 	h.params.scanEnable.FilterDuplicates = 1
 	if allowDup {
 		h.params.scanEnable.FilterDuplicates = 0
 	}
+	h.Lock()
 	h.params.scanEnable.LEScanEnable = 1
+	h.Unlock()
 	h.adHist = make([]*Advertisement, 128)
 	h.adLast = 0
+	if h.extAdv {
+		h.adFrags = make(map[string]adFrag)
+		return h.Send(&cmd.LESetExtendedScanEnable{
+			Enable:           1,
+			FilterDuplicates: h.params.scanEnable.FilterDuplicates,
+		}, nil)
+	}
 	return h.Send(&h.params.scanEnable, nil)
 }
 
 // StopScanning stops scanning.
 func (h *HCI) StopScanning() error {
+	h.Lock()
 	h.params.scanEnable.LEScanEnable = 0
+	h.Unlock()
+	if h.extAdv {
+		return h.Send(&cmd.LESetExtendedScanEnable{Enable: 0}, nil)
+	}
 	return h.Send(&h.params.scanEnable, nil)
 }
 
@@ -177,6 +206,9 @@ func (h *HCI) AdvertiseIBeacon(u ble.UUID, major, minor uint16, pwr int8) error
 // StopAdvertising stops advertising.
 func (h *HCI) StopAdvertising() error {
 	h.params.advEnable.AdvertisingEnable = 0
+	if h.extAdv {
+		return h.enableAdvertisingSet(legacyAdvHandle, false)
+	}
 	return h.Send(&h.params.advEnable, nil)
 }
 
@@ -216,29 +248,42 @@ func (h *HCI) Dial(ctx context.Context, a ble.Addr) (ble.Client, error) {
 
 	ab = sliceops.SwapBuf(ab)
 	copy(h.params.connParams.PeerAddress[:], ab)
+	h.params.connParams.InitiatorFilterPolicy = FilterPolicyAcceptAll
 
 	h.Infof("dial: addr %v, type %v", a.String(), h.params.connParams.PeerAddressType)
+	return h.dial(ctx, h.dialerTmo)
+}
 
-	if err = h.Send(&h.params.connParams, nil); err != nil {
+// dial creates a connection with the current connection parameters.
+// The pending connection is cancelled after d, unless d is 0.
+func (h *HCI) dial(ctx context.Context, d time.Duration) (ble.Client, error) {
+	// Drop the failure of a previous connection.
+	select {
+	case <-h.chDialErr:
+	default:
+	}
+	if err := h.createConnection(); err != nil {
 		return nil, err
 	}
 	var tmo <-chan time.Time
-	if h.dialerTmo != time.Duration(0) {
-		tmo = time.After(h.dialerTmo)
+	if d != time.Duration(0) {
+		tmo = time.After(d)
 	}
 
 	select {
 	case <-ctx.Done():
 		return h.cancelDial(ctx.Err())
 	case <-tmo:
-		return h.cancelDial(fmt.Errorf("dialer timeout (%s)", h.dialerTmo))
+		return h.cancelDial(fmt.Errorf("dialer timeout (%s)", d))
 	case <-h.done:
 		return nil, h.err
 	case c, ok := <-h.chMasterConn:
 		if !ok {
 			return nil, fmt.Errorf("chMasterConn closed")
 		}
-		return gatt.NewClient(c, h.cache, h.done, h.Logger)
+		return h.newClient(c)
+	case err := <-h.chDialErr:
+		return nil, errors.Wrap(err, "connection failed")
 	}
 }
 
@@ -256,7 +301,7 @@ func (h *HCI) cancelDial(passthrough error) (ble.Client, error) {
 		select {
 		case c := <-h.chMasterConn:
 			h.Debug("cancelDial: got connection complete after disallowed")
-			return gatt.NewClient(c, h.cache, h.done, h.Logger)
+			return h.newClient(c)
 		case <-time.After(50 * time.Millisecond):
 			h.Debug("cancelDial: connection req timed out after a connection was made")
 			return nil, errors.Wrap(passthrough, "cancel connection failed - connection req timed out after a connection was made")
@@ -267,8 +312,35 @@ func (h *HCI) cancelDial(passthrough error) (ble.Client, error) {
 	return nil, errors.Wrapf(passthrough, "cancel connection failed - %s", err.Error())
 }
 
+// newClient returns a GATT client of the master connection c, after exchanging
+// the ATT_MTU, if configured. The Enhanced ATT bearers are opened once the link
+// is encrypted.
+func (h *HCI) newClient(c *Conn) (ble.Client, error) {
+	cln, err := gatt.NewClient(c, h.cache, h.done, h.Logger)
+	if err != nil {
+		return nil, err
+	}
+	if h.connectMTU != 0 {
+		if _, err := cln.ExchangeMTU(h.connectMTU); err != nil {
+			h.Warnf("dial: can't exchange mtu: %v", err)
+		}
+	}
+	if h.eattBearers != 0 {
+		c.whenEncrypted(func() {
+			if err := cln.OpenEATT(h.eattBearers); err != nil {
+				h.Warnf("dial: can't open eatt bearers: %v", err)
+			}
+		})
+	}
+	return cln, nil
+}
+
 // Advertise starts advertising.
 func (h *HCI) Advertise() error {
+	if h.extAdv {
+		return h.enableAdvertisingSet(legacyAdvHandle, true)
+	}
+
 	//send the current advertising parameters first
 	if err := h.Send(&h.params.advParams, nil); err != nil {
 		return err
@@ -284,6 +356,10 @@ func (h *HCI) SetAdvertisement(ad []byte, sr []byte) error {
 		return ble.ErrEIRPacketTooLong
 	}
 
+	if h.extAdv {
+		return h.setLegacyAdvertisingSet(ad, sr)
+	}
+
 	h.params.advData.AdvertisingDataLength = uint8(len(ad))
 	copy(h.params.advData.AdvertisingData[:], ad)
 	if err := h.Send(&h.params.advData, nil); err != nil {
@@ -297,3 +373,22 @@ func (h *HCI) SetAdvertisement(ad []byte, sr []byte) error {
 	}
 	return nil
 }
+
+// setLegacyAdvertisingSet configures the advertising set used by the legacy advertising
+// functions with the current advertising parameters, and sets its data and scanResp.
+func (h *HCI) setLegacyAdvertisingSet(ad []byte, sr []byte) error {
+	c, err := h.legacyAdvertisingSet()
+	if err != nil {
+		return err
+	}
+	if err := h.configureAdvertisingSet(c); err != nil {
+		return err
+	}
+	if err := h.setExtAdvertisingData(legacyAdvHandle, ad, false); err != nil {
+		return err
+	}
+	if c.AdvertisingEventProperties&ble.AdvPropScannable == 0 {
+		return nil
+	}
+	return h.setExtAdvertisingData(legacyAdvHandle, sr, true)
+}
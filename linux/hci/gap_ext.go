@@ -0,0 +1,395 @@
+package hci
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/rigado/ble"
+	"github.com/rigado/ble/linux/adv"
+	"github.com/rigado/ble/linux/hci/cmd"
+	"github.com/rigado/ble/linux/hci/evt"
+)
+
+// LE features [Vol 6, Part B, 4.6]
+const (
+	leFeatureDataLengthExtension = 1 << 5
+	leFeatureLLPrivacy           = 1 << 6
+	leFeature2MPHY               = 1 << 8
+	leFeatureCodedPHY            = 1 << 11
+	leFeatureExtendedAdvertising = 1 << 12
+)
+
+// LE event mask bits [Vol 2, Part E, 7.8.1]
+const (
+	leEventDataLengthChange          = 1 << 6
+	leEventExtendedAdvertisingReport = 1 << 12
+)
+
+// Operations of LE Set Extended Advertising Data [Vol 2, Part E, 7.8.54]
+const (
+	advDataOpIntermediate = 0x00
+	advDataOpFirst        = 0x01
+	advDataOpLast         = 0x02
+	advDataOpComplete     = 0x03
+
+	// advDataFragmentPreference lets the controller fragment the data as it sees fit.
+	advDataFragmentPreference = 0x01
+
+	// maxAdvDataFragment is the most data a single command can carry.
+	maxAdvDataFragment = 251
+)
+
+// advTxPowerNoPreference lets the controller choose the tx power of an advertising set.
+const advTxPowerNoPreference = 127
+
+// adFragTimeout is how long the data of an incomplete advertisement is kept
+// waiting for the next report; the fragments of an advertisement are sent
+// within a few milliseconds of each other.
+const adFragTimeout = time.Second
+
+// adFrag is the data of an incomplete advertisement, received at t.
+type adFrag struct {
+	data []byte
+	t    time.Time
+}
+
+// legacyAdvHandle is the advertising set used by the legacy advertising
+// functions when extended advertising is enabled.
+const legacyAdvHandle = 0x00
+
+// legacyAdvProperties maps the legacy advertising types to the event properties
+// of the equivalent legacy PDUs. [Vol 2, Part E, 7.8.53]
+var legacyAdvProperties = map[uint8]uint16{
+	0x00: ble.AdvPropLegacy | ble.AdvPropConnectable | ble.AdvPropScannable,                           // ADV_IND
+	0x01: ble.AdvPropLegacy | ble.AdvPropConnectable | ble.AdvPropDirected | ble.AdvPropHighDutyCycle, // ADV_DIRECT_IND (high duty cycle)
+	0x02: ble.AdvPropLegacy | ble.AdvPropScannable,                                                    // ADV_SCAN_IND
+	0x03: ble.AdvPropLegacy,                                                                           // ADV_NONCONN_IND
+	0x04: ble.AdvPropLegacy | ble.AdvPropConnectable | ble.AdvPropDirected,                            // ADV_DIRECT_IND (low duty cycle)
+}
+
+// ErrExtendedAdvertising is returned when an extended advertising function is
+// used without extended advertising being enabled.
+var ErrExtendedAdvertising = errors.New("extended advertising not enabled")
+
+// initiatingPHYs returns the PHYs, as a bitmask, to scan and initiate connections on.
+func (h *HCI) initiatingPHYs() (uint8, int) {
+	if h.leFeatures&leFeatureCodedPHY != 0 {
+		return 0x05, 2 // LE 1M and LE Coded
+	}
+	return 0x01, 1 // LE 1M
+}
+
+// extScanParams derives the extended scanning parameters from the legacy ones.
+func (h *HCI) extScanParams() *cmd.LESetExtendedScanParameters {
+	p := h.params.scanParams
+	phys, n := h.initiatingPHYs()
+	c := &cmd.LESetExtendedScanParameters{
+		OwnAddressType:       p.OwnAddressType,
+		ScanningFilterPolicy: p.ScanningFilterPolicy,
+		ScanningPHYs:         phys,
+	}
+	for i := 0; i < n; i++ {
+		c.Scan = append(c.Scan, cmd.ExtendedScanPHY{
+			ScanType:     p.LEScanType,
+			ScanInterval: p.LEScanInterval,
+			ScanWindow:   p.LEScanWindow,
+		})
+	}
+	return c
+}
+
+// extConnParams derives the extended connection parameters from the legacy ones.
+func (h *HCI) extConnParams() *cmd.LEExtendedCreateConnection {
+	p := h.params.connParams
+	phys, n := h.initiatingPHYs()
+	c := &cmd.LEExtendedCreateConnection{
+		InitiatorFilterPolicy: p.InitiatorFilterPolicy,
+		OwnAddressType:        p.OwnAddressType,
+		PeerAddressType:       p.PeerAddressType,
+		PeerAddress:           p.PeerAddress,
+		InitiatingPHYs:        phys,
+	}
+	for i := 0; i < n; i++ {
+		c.Conn = append(c.Conn, cmd.ExtendedConnPHY{
+			ScanInterval:       p.LEScanInterval,
+			ScanWindow:         p.LEScanWindow,
+			ConnIntervalMin:    p.ConnIntervalMin,
+			ConnIntervalMax:    p.ConnIntervalMax,
+			ConnLatency:        p.ConnLatency,
+			SupervisionTimeout: p.SupervisionTimeout,
+			MinimumCELength:    p.MinimumCELength,
+			MaximumCELength:    p.MaximumCELength,
+		})
+	}
+	return c
+}
+
+// createConnection starts connecting with the current connection parameters.
+func (h *HCI) createConnection() error {
+	if h.extAdv {
+		return h.Send(h.extConnParams(), nil)
+	}
+	return h.Send(&h.params.connParams, nil)
+}
+
+// legacyAdvertisingSet describes the legacy advertising parameters as an advertising set.
+func (h *HCI) legacyAdvertisingSet() (*cmd.LESetExtendedAdvertisingParameters, error) {
+	p := h.params.advParams
+	props, ok := legacyAdvProperties[p.AdvertisingType]
+	if !ok {
+		return nil, fmt.Errorf("invalid AdvertisingType %v", p.AdvertisingType)
+	}
+
+	c := &cmd.LESetExtendedAdvertisingParameters{
+		AdvertisingHandle:            legacyAdvHandle,
+		AdvertisingEventProperties:   props,
+		PrimaryAdvertisingChannelMap: p.AdvertisingChannelMap,
+		OwnAddressType:               p.OwnAddressType,
+		PeerAddressType:              p.DirectAddressType,
+		PeerAddress:                  p.DirectAddress,
+		AdvertisingFilterPolicy:      p.AdvertisingFilterPolicy,
+		AdvertisingTXPower:           advTxPowerNoPreference,
+		PrimaryAdvertisingPHY:        ble.PHY1M,
+		SecondaryAdvertisingPHY:      ble.PHY1M,
+	}
+	putUint24(c.PrimaryAdvertisingIntervalMin[:], uint32(p.AdvertisingIntervalMin))
+	putUint24(c.PrimaryAdvertisingIntervalMax[:], uint32(p.AdvertisingIntervalMax))
+	return c, nil
+}
+
+// setExtAdvertisingData sets the advertising data, or the scan response, of an advertising set.
+// Data longer than a single command can carry is sent in several fragments.
+func (h *HCI) setExtAdvertisingData(handle uint8, data []byte, scanResp bool) error {
+	var op uint8
+	for first := true; first || len(data) > 0; first = false {
+		n := len(data)
+		if n > maxAdvDataFragment {
+			n = maxAdvDataFragment
+		}
+
+		last := n == len(data)
+		switch {
+		case first && last:
+			op = advDataOpComplete
+		case first:
+			op = advDataOpFirst
+		case last:
+			op = advDataOpLast
+		default:
+			op = advDataOpIntermediate
+		}
+
+		var c Command
+		if scanResp {
+			c = &cmd.LESetExtendedScanResponseData{
+				AdvertisingHandle:  handle,
+				Operation:          op,
+				FragmentPreference: advDataFragmentPreference,
+				ScanResponseData:   data[:n],
+			}
+		} else {
+			c = &cmd.LESetExtendedAdvertisingData{
+				AdvertisingHandle:  handle,
+				Operation:          op,
+				FragmentPreference: advDataFragmentPreference,
+				AdvertisingData:    data[:n],
+			}
+		}
+		if err := h.Send(c, nil); err != nil {
+			return err
+		}
+		data = data[n:]
+	}
+	return nil
+}
+
+// enableAdvertisingSet enables or disables an advertising set.
+func (h *HCI) enableAdvertisingSet(handle uint8, enable bool) error {
+	c := &cmd.LESetExtendedAdvertisingEnable{
+		Sets: []cmd.AdvertisingSetEnable{{AdvertisingHandle: handle}},
+	}
+	if enable {
+		c.Enable = 1
+	}
+	if err := h.Send(c, nil); err != nil {
+		return err
+	}
+
+	h.Lock()
+	h.advSets[handle] = enable
+	h.Unlock()
+	return nil
+}
+
+// configureAdvertisingSet sets the parameters of an advertising set, disabling it first if needed.
+func (h *HCI) configureAdvertisingSet(c *cmd.LESetExtendedAdvertisingParameters) error {
+	h.Lock()
+	enabled := h.advSets[c.AdvertisingHandle]
+	h.Unlock()
+
+	if enabled {
+		if err := h.enableAdvertisingSet(c.AdvertisingHandle, false); err != nil {
+			return err
+		}
+	}
+
+	if err := h.Send(c, nil); err != nil {
+		return err
+	}
+
+	h.Lock()
+	h.advSets[c.AdvertisingHandle] = false
+	h.Unlock()
+	return nil
+}
+
+// StartAdvertisingSet configures and enables an extended advertising set.
+// Several sets, identified by their handle, can be advertised at once.
+func (h *HCI) StartAdvertisingSet(s ble.AdvertisingSet) error {
+	if !h.extAdv {
+		return ErrExtendedAdvertising
+	}
+
+	if s.Properties&ble.AdvPropLegacy != 0 &&
+		(len(s.Data) > adv.MaxEIRPacketLength || len(s.ScanResponse) > adv.MaxEIRPacketLength) {
+		return ble.ErrEIRPacketTooLong
+	}
+
+	primary := s.PrimaryPHY
+	if primary == 0 {
+		primary = ble.PHY1M
+	}
+	secondary := s.SecondaryPHY
+	if secondary == 0 {
+		secondary = ble.PHY1M
+	}
+	txPower := int8(advTxPowerNoPreference)
+	if s.TxPower != nil {
+		txPower = *s.TxPower
+	}
+
+	c := &cmd.LESetExtendedAdvertisingParameters{
+		AdvertisingHandle:            s.Handle,
+		AdvertisingEventProperties:   s.Properties,
+		PrimaryAdvertisingChannelMap: 0x07,
+		OwnAddressType:               h.params.advParams.OwnAddressType,
+		AdvertisingFilterPolicy:      h.params.advParams.AdvertisingFilterPolicy,
+		AdvertisingTXPower:           txPower,
+		PrimaryAdvertisingPHY:        primary,
+		SecondaryAdvertisingPHY:      secondary,
+		AdvertisingSID:               s.SID,
+	}
+	putUint24(c.PrimaryAdvertisingIntervalMin[:], s.IntervalMin)
+	putUint24(c.PrimaryAdvertisingIntervalMax[:], s.IntervalMax)
+
+	if err := h.configureAdvertisingSet(c); err != nil {
+		return errors.Wrap(err, "set parameters")
+	}
+
+	if len(s.Data) > 0 {
+		if err := h.setExtAdvertisingData(s.Handle, s.Data, false); err != nil {
+			return errors.Wrap(err, "set data")
+		}
+	}
+	if len(s.ScanResponse) > 0 {
+		if err := h.setExtAdvertisingData(s.Handle, s.ScanResponse, true); err != nil {
+			return errors.Wrap(err, "set scan response")
+		}
+	}
+
+	return h.enableAdvertisingSet(s.Handle, true)
+}
+
+// StopAdvertisingSet disables and removes the advertising set with the given handle.
+func (h *HCI) StopAdvertisingSet(handle uint8) error {
+	if !h.extAdv {
+		return ErrExtendedAdvertising
+	}
+
+	if err := h.enableAdvertisingSet(handle, false); err != nil {
+		return err
+	}
+	if err := h.Send(&cmd.LERemoveAdvertisingSet{AdvertisingHandle: handle}, nil); err != nil {
+		return err
+	}
+
+	h.Lock()
+	delete(h.advSets, handle)
+	h.Unlock()
+	return nil
+}
+
+func (h *HCI) handleLEExtendedAdvertisingReport(b []byte) error {
+	if h.advHandler == nil {
+		return nil
+	}
+
+	e := evt.LEExtendedAdvertisingReport(b)
+
+	nr, err := e.NumReportsWErr()
+	if err != nil {
+		return h.makeAdvError(errors.Wrap(err, "extAdvRep numReports"), e, true)
+	}
+
+	for i := 0; i < int(nr); i++ {
+		et, err := e.EventTypeWErr(i)
+		if err != nil {
+			h.makeAdvError(errors.Wrap(err, "extAdvRep eventType"), e, true)
+			continue
+		}
+
+		data, err := e.DataWErr(i)
+		if err != nil {
+			h.makeAdvError(errors.Wrap(err, "extAdvRep data"), e, true)
+			continue
+		}
+
+		// Reassemble the data of advertisements delivered in several reports.
+		// Truncated data is delivered as is, there won't be any more of it.
+		addr, _ := e.AddressWErr(i)
+		sid, _ := e.AdvertisingSIDWErr(i)
+		key := fmt.Sprintf("%x/%v/%v", addr, sid, et&extEvtTypScanRsp)
+		now := time.Now()
+		if f, ok := h.adFrags[key]; ok && now.Sub(f.t) < adFragTimeout {
+			data = append(f.data, data...)
+		}
+		if et&extEvtTypDataStatus == extEvtTypDataIncomplete && h.adFrags != nil {
+			h.dropStaleAdFrags(now)
+			h.adFrags[key] = adFrag{data: data, t: now}
+			continue
+		}
+		delete(h.adFrags, key)
+
+		a, err := newExtendedAdvertisement(e, i, data)
+		if err != nil {
+			h.makeAdvError(errors.Wrap(err, fmt.Sprintf("newExtAdv (typ %v)", et)), e, true)
+			continue
+		}
+
+		a, err = h.trackAdvertisement(extEventType(et), a, e)
+		if err != nil {
+			continue
+		}
+
+		h.dispatchAdvertisement(a)
+	}
+
+	return nil
+}
+
+// dropStaleAdFrags drops the data of the advertisements whose next report didn't
+// arrive in time, e.g. because the controller missed it.
+func (h *HCI) dropStaleAdFrags(now time.Time) {
+	for key, f := range h.adFrags {
+		if now.Sub(f.t) >= adFragTimeout {
+			delete(h.adFrags, key)
+		}
+	}
+}
+
+func putUint24(b []byte, v uint32) {
+	b[0] = byte(v)
+	b[1] = byte(v >> 8)
+	b[2] = byte(v >> 16)
+}
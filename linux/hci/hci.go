@@ -50,7 +50,11 @@ func NewHCI(smp SmpManagerFactory, opts ...ble.Option) (*HCI, error) {
 		muConns:      sync.Mutex{},
 		conns:        make(map[uint16]*Conn),
 		chMasterConn: make(chan *Conn, 1),
+		chDialErr:    make(chan error, 1),
 		chSlaveConn:  make(chan *Conn),
+		advSets:      make(map[uint8]bool),
+		syncs:        make(map[uint16]*periodicSync),
+		listeners:    make(map[uint16]*l2capListener),
 
 		muClose:   sync.Mutex{},
 		done:      make(chan bool),
@@ -61,6 +65,7 @@ func NewHCI(smp SmpManagerFactory, opts ...ble.Option) (*HCI, error) {
 		Logger:     ble.GetLogger(),
 	}
 	h.params.init()
+	h.smpConfig = defaultSmpConfig
 	if err := h.Option(opts...); err != nil {
 		return nil, errors.Wrap(err, "can't set options")
 	}
@@ -76,6 +81,8 @@ type HCI struct {
 
 	smp        SmpManagerFactory
 	smpEnabled bool
+	smpConfig  SmpConfig
+	resolver   IdentityResolver
 
 	transport transport
 	skt       io.ReadWriteCloser
@@ -94,9 +101,30 @@ type HCI struct {
 	bufSize int
 	bufCnt  int
 
+	// scanFilterPolicy is the configured scanning filter policy.
+	scanFilterPolicy uint8
+
+	// Identity addresses of the devices on the resolving list, nil if the
+	// controller doesn't resolve addresses.
+	resolvingList     map[[6]byte]bool
+	resolvingListSize int
+
 	// Device information or status.
-	addr    net.HardwareAddr
-	txPwrLv int
+	addr       net.HardwareAddr
+	txPwrLv    int
+	leFeatures uint64
+
+	// extAdv is set when scanning, advertising and connecting use the LE
+	// Advertising Extensions commands. The controller doesn't allow mixing
+	// them with the legacy commands. [Vol 2, Part E, 3.1.1]
+	extAdvRequested bool
+	extAdv          bool
+	advSets         map[uint8]bool // configured advertising sets, and whether they are enabled
+	adFrags         map[string]adFrag
+
+	// Periodic advertising syncs; only one can be pending at a time.
+	pendingSync *periodicSync
+	syncs       map[uint16]*periodicSync
 
 	// adHist and adLast track the history of past scannable advertising packets.
 	// Controller delivers AD(Advertising Data) and SR(Scan Response) separately
@@ -118,11 +146,30 @@ type HCI struct {
 	muConns      sync.Mutex
 	conns        map[uint16]*Conn
 	chMasterConn chan *Conn // Dial returns master connections.
+	chDialErr    chan error // Dial returns the failure of its connection.
 	chSlaveConn  chan *Conn // Peripheral accept slave connections.
 
 	dialerTmo   time.Duration
 	listenerTmo time.Duration
 
+	// defaultPHY is the PHY preference of new connections, or nil.
+	defaultPHY *cmd.LESetDefaultPHY
+
+	// connParamsPolicy decides on the connection parameter requests of remote devices, or nil.
+	connParamsPolicy ble.ConnParamsPolicy
+
+	// listeners accept the LE credit based channels opened on their LE PSMs.
+	muListeners sync.Mutex
+	listeners   map[uint16]*l2capListener
+
+	// connectMTU is the ATT_MTU exchanged right after connecting as a central, or 0.
+	connectMTU int
+
+	// eattBearers is the number of Enhanced ATT bearers opened as a central once the
+	// link is encrypted, or 0. eattServer accepts the ones opened by remote clients.
+	eattBearers int
+	eattServer  bool
+
 	//error handler
 	errorHandler func(error)
 	err          error
@@ -151,10 +198,16 @@ func (h *HCI) Init() error {
 	h.evth[evt.EncryptionChangeCode] = h.handleEncryptionChange
 
 	h.subh[evt.LEAdvertisingReportSubCode] = h.handleLEAdvertisingReport
+	h.subh[evt.LEExtendedAdvertisingReportSubCode] = h.handleLEExtendedAdvertisingReport
+	h.subh[evt.LEPeriodicAdvertisingSyncEstablishedSubCode] = h.handleLEPeriodicAdvertisingSyncEstablished
+	h.subh[evt.LEPeriodicAdvertisingReportSubCode] = h.handleLEPeriodicAdvertisingReport
+	h.subh[evt.LEPeriodicAdvertisingSyncLostSubCode] = h.handleLEPeriodicAdvertisingSyncLost
 	h.subh[evt.LEConnectionCompleteSubCode] = h.handleLEConnectionComplete
 	h.subh[evt.LEConnectionUpdateCompleteSubCode] = h.handleLEConnectionUpdateComplete
 	h.subh[evt.LELongTermKeyRequestSubCode] = h.handleLELongTermKeyRequest
 	h.subh[evt.LERemoteConnectionParameterRequestSubCode] = h.handleLEConnectionParameterRequest
+	h.subh[evt.LEDataLengthChangeSubCode] = h.handleLEDataLengthChange
+	h.subh[evt.LEPHYUpdateCompleteSubCode] = h.handleLEPHYUpdateComplete
 	// evt.ReadRemoteVersionInformationCompleteCode: todo),
 	// evt.HardwareErrorCode:                        todo),
 	// evt.DataBufferOverflowCode:                   todo),
@@ -187,8 +240,17 @@ func (h *HCI) Init() error {
 	if err != nil {
 		return err
 	}
-	h.Send(&p.advParams, nil)
-	h.Send(&p.scanParams, nil)
+	h.scanFilterPolicy = p.scanParams.ScanningFilterPolicy
+	if h.extAdv {
+		h.Send(h.extScanParams(), nil)
+	} else {
+		h.Send(&p.advParams, nil)
+		h.Send(&p.scanParams, nil)
+	}
+
+	if err := h.LoadResolvingList(); err != nil {
+		h.Warnf("can't load resolving list: %v", err)
+	}
 	return nil
 }
 
@@ -251,6 +313,16 @@ func (h *HCI) Option(opts ...ble.Option) error {
 	return err
 }
 
+// LocalOOBData generates the LE Secure Connections out of band data of the device,
+// to be passed to the remote devices, e.g. over NFC. The data is used by the
+// following pairings, until LocalOOBData is called again.
+func (h *HCI) LocalOOBData() (ble.OOBData, error) {
+	if h.smp == nil {
+		return ble.OOBData{}, fmt.Errorf("smp not supported")
+	}
+	return h.smp.LocalOOBData()
+}
+
 func (h *HCI) isOpen() bool {
 	select {
 	case <-h.done:
@@ -288,13 +360,35 @@ func (h *HCI) init() error {
 		h.bufSize = int(LEReadBufferSizeRP.HCLEDataPacketLength)
 	}
 
-	LEReadAdvertisingChannelTxPowerRP := cmd.LEReadAdvertisingChannelTxPowerRP{}
-	h.Send(&cmd.LEReadAdvertisingChannelTxPower{}, &LEReadAdvertisingChannelTxPowerRP)
+	LEReadLocalSupportedFeaturesRP := cmd.LEReadLocalSupportedFeaturesRP{}
+	h.Send(&cmd.LEReadLocalSupportedFeatures{}, &LEReadLocalSupportedFeaturesRP)
+
+	h.leFeatures = LEReadLocalSupportedFeaturesRP.LEFeatures
+	h.extAdv = h.extAdvRequested && h.leFeatures&leFeatureExtendedAdvertising != 0
+	if h.extAdvRequested && !h.extAdv {
+		h.Warnf("extended advertising not supported by the controller, using legacy advertising")
+	}
 
-	h.txPwrLv = int(LEReadAdvertisingChannelTxPowerRP.TransmitPowerLevel)
+	if !h.extAdv {
+		// Only the legacy commands return the advertising channel tx power.
+		LEReadAdvertisingChannelTxPowerRP := cmd.LEReadAdvertisingChannelTxPowerRP{}
+		h.Send(&cmd.LEReadAdvertisingChannelTxPower{}, &LEReadAdvertisingChannelTxPowerRP)
 
+		h.txPwrLv = int(LEReadAdvertisingChannelTxPowerRP.TransmitPowerLevel)
+	}
+
+	leEventMask := uint64(0x000000000000001F) | leEventRemoteConnectionParameterRequest
+	if h.extAdv {
+		leEventMask |= leEventExtendedAdvertisingReport | leEventPeriodicAdvertising
+	}
+	if h.leFeatures&leFeatureDataLengthExtension != 0 {
+		leEventMask |= leEventDataLengthChange
+	}
+	if h.leFeatures&(leFeature2MPHY|leFeatureCodedPHY) != 0 {
+		leEventMask |= leEventPHYUpdateComplete
+	}
 	LESetEventMaskRP := cmd.LESetEventMaskRP{}
-	h.Send(&cmd.LESetEventMask{LEEventMask: 0x000000000000001F}, &LESetEventMaskRP)
+	h.Send(&cmd.LESetEventMask{LEEventMask: leEventMask}, &LESetEventMaskRP)
 
 	SetEventMaskRP := cmd.SetEventMaskRP{}
 	h.Send(&cmd.SetEventMask{EventMask: 0x3dbff807fffbffff}, &SetEventMaskRP)
@@ -305,6 +399,10 @@ func (h *HCI) init() error {
 	WriteDefaultDataLengthRP := cmd.LEWriteSuggestedDefaultDataLengthRP{}
 	h.Send(&cmd.LEWriteSuggestedDefaultDataLength{SuggestedMaxTxOctets: 251, SuggestedMaxTxTime: 2120}, &WriteDefaultDataLengthRP)
 
+	if err := h.setDefaultPHY(); err != nil {
+		h.Warnf("can't set default phy: %v", err)
+	}
+
 	return h.err
 }
 
@@ -636,104 +734,118 @@ func (h *HCI) handleLEAdvertisingReport(b []byte) error {
 			continue
 		}
 
-		switch et {
-		case evtTypAdvInd: //0x00
-			fallthrough
-		case evtTypAdvScanInd: //0x02
-			a, err = newAdvertisement(e, i)
-			if err != nil {
-				h.makeAdvError(errors.Wrap(err, fmt.Sprintf("newAdv (typ %v)", et)), e, true)
-				continue
-			}
-			h.adHist[h.adLast] = a
-			h.adLast++
-			if h.adLast == len(h.adHist) {
-				h.adLast = 0
-			}
+		if et > evtTypScanRsp {
+			h.makeAdvError(fmt.Errorf("invalid eventType %v", et), e, true)
+			continue
+		}
 
-			//advInd, advScanInd
+		a, err = newAdvertisement(e, i)
+		if err != nil {
+			h.makeAdvError(errors.Wrap(err, fmt.Sprintf("newAdv (typ %v)", et)), e, true)
+			continue
+		}
 
-		case evtTypScanRsp: //0x04
-			sr, err := newAdvertisement(e, i)
-			if err != nil {
-				h.makeAdvError(errors.Wrap(err, fmt.Sprintf("newAdv (typ %v)", et)), e, true)
-				continue
-			}
+		a, err = h.trackAdvertisement(et, a, e)
+		if err != nil {
+			return err
+		}
 
-			for idx := h.adLast - 1; idx != h.adLast; idx-- {
-				if idx == -1 {
-					idx = len(h.adHist) - 1
-					if idx == h.adLast {
-						break
-					}
-				}
-				if h.adHist[idx] == nil {
-					break
-				}
+		if a == nil {
+			h.makeAdvError(fmt.Errorf("nil advertisement (i %v, typ %v)", i, et), e, true)
+			continue
+		}
 
-				//bad addr?
-				addrh, err := h.adHist[idx].addrWErr()
-				if err != nil {
-					h.makeAdvError(errors.Wrap(err, fmt.Sprintf("adHist addr (typ %v)", et)), e, true)
-					break
-				}
+		h.dispatchAdvertisement(a)
+	} //for
 
-				//bad addr?
-				addrsr, err := sr.addrWErr()
-				if err != nil {
-					h.makeAdvError(errors.Wrap(err, fmt.Sprintf("srAddr (typ %v)", et)), e, true)
-					break
-				}
+	return nil
+}
 
-				//set the scan response here
-				if addrh.String() == addrsr.String() {
-					//this will leave everything alone if there is an error when we attach the scanresp
-					err = h.adHist[idx].setScanResponse(sr)
-					if err != nil {
-						h.makeAdvError(errors.Wrap(err, fmt.Sprintf("setScanResp (typ %v)", et)), e, true)
-						break
-					}
-					a = h.adHist[idx]
+// trackAdvertisement keeps the history of scannable advertisements, and
+// associates a scan response with the advertisement it belongs to.
+// It returns the advertisement to pass to the advHandler.
+func (h *HCI) trackAdvertisement(et uint8, a *Advertisement, e []byte) (*Advertisement, error) {
+	switch et {
+	case evtTypAdvInd: //0x00
+		fallthrough
+	case evtTypAdvScanInd: //0x02
+		h.adHist[h.adLast] = a
+		h.adLast++
+		if h.adLast == len(h.adHist) {
+			h.adLast = 0
+		}
+
+		//advInd, advScanInd
+		return a, nil
+
+	case evtTypScanRsp: //0x04
+		sr := a
+		a = nil
+
+		for idx := h.adLast - 1; idx != h.adLast; idx-- {
+			if idx == -1 {
+				idx = len(h.adHist) - 1
+				if idx == h.adLast {
 					break
 				}
-			} //for
+			}
+			if h.adHist[idx] == nil {
+				break
+			}
 
-			// Got a SR without having received an associated AD before?
-			if a == nil {
-				ee := h.makeAdvError(errors.Wrap(err, fmt.Sprintf("scanRsp (typ %v) w/o associated advData, srAddr %v", et, sr.Addr())), e, true)
-				return ee
+			//bad addr?
+			addrh, err := h.adHist[idx].addrWErr()
+			if err != nil {
+				h.makeAdvError(errors.Wrap(err, fmt.Sprintf("adHist addr (typ %v)", et)), e, true)
+				break
 			}
-			// sr
 
-		case evtTypAdvDirectInd: //0x01
-			fallthrough
-		case evtTypAdvNonconnInd: //0x03
-			a, err = newAdvertisement(e, i)
+			//bad addr?
+			addrsr, err := sr.addrWErr()
 			if err != nil {
-				h.makeAdvError(errors.Wrap(err, fmt.Sprintf("newAdv (typ %v)", et)), e, true)
-				continue
+				h.makeAdvError(errors.Wrap(err, fmt.Sprintf("srAddr (typ %v)", et)), e, true)
+				break
 			}
 
-		default:
-			h.makeAdvError(fmt.Errorf("invalid eventType %v", et), e, true)
-			continue
-		} // switch
+			//set the scan response here
+			if addrh.String() == addrsr.String() {
+				//this will leave everything alone if there is an error when we attach the scanresp
+				err = h.adHist[idx].setScanResponse(sr)
+				if err != nil {
+					h.makeAdvError(errors.Wrap(err, fmt.Sprintf("setScanResp (typ %v)", et)), e, true)
+					break
+				}
+				a = h.adHist[idx]
+				break
+			}
+		} //for
 
+		// Got a SR without having received an associated AD before?
 		if a == nil {
-			h.makeAdvError(fmt.Errorf("nil advertisement (i %v, typ %v)", i, et), e, true)
-			continue
+			ee := h.makeAdvError(fmt.Errorf("scanRsp (typ %v) w/o associated advData, srAddr %v", et, sr.Addr()), e, true)
+			return nil, ee
 		}
+		// sr
+		return a, nil
 
-		//dispatch
-		if h.advHandlerSync {
-			h.advHandler(a)
-		} else {
-			go h.advHandler(a)
-		}
+	default:
+		//advDirectInd, advNonconnInd
+		return a, nil
+	}
+}
 
-	} //for
+// dispatchAdvertisement passes an advertisement to the advHandler.
+func (h *HCI) dispatchAdvertisement(a *Advertisement) {
+	if a.identity == nil {
+		a.identity = h.resolveAdvIdentity(a)
+	}
 
-	return nil
+	//dispatch
+	if h.advHandlerSync {
+		h.advHandler(a)
+	} else {
+		go h.advHandler(a)
+	}
 }
 
 func (h *HCI) handleCommandComplete(b []byte) error {
@@ -792,12 +904,20 @@ func (h *HCI) handleLEConnectionComplete(b []byte) error {
 
 	if status := e.Status(); status != 0 {
 		h.Warnf("connectionComplete: connection failed with status %X", status)
+		if e.Role() == roleMaster && ErrCommand(status) != ErrConnID {
+			// Not a cancelled dial, e.g. the controller ran out of connections.
+			select {
+			case h.chDialErr <- ErrCommand(status):
+			default:
+			}
+		}
 		return nil
 	}
 
 	pa := e.PeerAddress()
 	addr := hex.EncodeToString(sliceops.SwapBuf(pa[:]))
 	c := newConn(h, e, addr, e.ConnectionHandle())
+	c.identity = h.resolveIdentity(e.PeerAddressType(), pa)
 	h.muConns.Lock()
 	h.Debugf("connectionComplete: handle %04x, addr %v, lecc evt %X", e.ConnectionHandle(), addr, b)
 	h.conns[e.ConnectionHandle()] = c
@@ -838,13 +958,23 @@ func (h *HCI) handleLEConnectionComplete(b []byte) error {
 	return nil
 }
 
-func (h *HCI) handleLEConnectionParameterRequest(b []byte) error {
-	h.Warn("LEConnectionParameterRequest: ignored")
-	return nil
-}
+func (h *HCI) handleLEDataLengthChange(b []byte) error {
+	e := evt.LEDataLengthChange(b)
+	if len(e) < 11 {
+		return fmt.Errorf("dataLengthChange: invalid length %d", len(e))
+	}
 
-func (h *HCI) handleLEConnectionUpdateComplete(b []byte) error {
-	h.Warn("LEConnectionUpdateComplete: ignored")
+	c := h.findConnection(e.ConnectionHandle())
+	if c == nil {
+		return fmt.Errorf("dataLengthChange: unknown connection handle %04X", e.ConnectionHandle())
+	}
+
+	c.handleDataLengthChange(ble.DataLength{
+		MaxTxOctets: e.MaxTxOctets(),
+		MaxTxTime:   e.MaxTxTime(),
+		MaxRxOctets: e.MaxRxOctets(),
+		MaxRxTime:   e.MaxRxTime(),
+	})
 	return nil
 }
 
@@ -954,10 +1084,16 @@ func (h *HCI) handleNumberOfCompletedPackets(b []byte) error {
 }
 
 func (h *HCI) handleLELongTermKeyRequest(b []byte) error {
-	//todo: probably need to support this
 	e := evt.LELongTermKeyRequest(b)
-	h.Logger.Errorf("LELongTermKeyRequest: not supported - pkt %X", e)
-	return fmt.Errorf("not supported")
+
+	c := h.findConnection(e.ConnectionHandle())
+	if c == nil {
+		return fmt.Errorf("longTermKeyRequest: unknown connection handle %04X", e.ConnectionHandle())
+	}
+
+	//the reply waits on a command complete, so don't block the event loop
+	go c.handleLongTermKeyRequest(e.EncryptionDiversifier(), e.RandomNumber())
+	return nil
 }
 
 func (h *HCI) setAllowedCommands(n int) {
@@ -1018,6 +1154,55 @@ func (h *HCI) dispatchError(e error) {
 	}
 }
 
+// resolveIdentity returns the identity address of a bonded device using the
+// resolvable private address addr, or nil if it can't be resolved.
+func (h *HCI) resolveIdentity(addrType uint8, addr [6]byte) ble.Addr {
+	switch addrType {
+	case addrTypePublicIdentity, addrTypeRandomIdentity:
+		//already resolved by the controller
+		ida := ble.NewAddr(net.HardwareAddr(sliceops.SwapBuf(addr[:])).String())
+		if addrType == addrTypeRandomIdentity {
+			return RandomAddress{ida}
+		}
+		return ida
+	}
+
+	//only random addresses can be resolvable private addresses
+	if h.resolver == nil || addrType != 0x01 {
+		return nil
+	}
+
+	bi, ok := h.resolver.ResolveIdentity(addr[:])
+	if !ok {
+		return nil
+	}
+
+	ia := bi.IdentityAddress()
+	if len(ia) != 6 {
+		return nil
+	}
+
+	ida := ble.NewAddr(net.HardwareAddr(sliceops.SwapBuf(ia)).String())
+	if bi.IdentityAddressType() == 0x01 {
+		return RandomAddress{ida}
+	}
+	return ida
+}
+
+func (h *HCI) resolveAdvIdentity(a *Advertisement) ble.Addr {
+	at, err := a.addressTypeWErr()
+	if err != nil {
+		return nil
+	}
+
+	addr, err := a.rawAddrWErr()
+	if err != nil {
+		return nil
+	}
+
+	return h.resolveIdentity(at, addr)
+}
+
 func (h *HCI) findConnection(handle uint16) *Conn {
 	h.muConns.Lock()
 	defer h.muConns.Unlock()
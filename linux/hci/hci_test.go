@@ -1,6 +1,7 @@
 package hci
 
 import (
+	"context"
 	"reflect"
 	"testing"
 
@@ -145,3 +146,150 @@ func TestAdvDecode(t *testing.T) {
 		t.Fatal("mfgData mismatch")
 	}
 }
+
+func extAdvReport(et uint16, data []byte) evt.LEExtendedAdvertisingReport {
+	e := evt.LEExtendedAdvertisingReport{0x0D, 1,
+		byte(et), byte(et >> 8), // event type
+		1,                   // addr type: random
+		1, 2, 3, 4, 5, 0xc6, // addr
+		ble.PHYCoded, ble.PHY2M, // primary, secondary phy
+		5,    // sid
+		0x7f, // tx power
+		0xc0, // rssi
+		0, 0, // periodic adv interval
+		0, 0, 0, 0, 0, 0, 0, // direct addr
+		byte(len(data))}
+	return append(e, data...)
+}
+
+func TestExtendedAdvReassembly(t *testing.T) {
+	var got []ble.Advertisement
+	h := &HCI{
+		Logger:         ble.GetLogger(),
+		advHandlerSync: true,
+		advHandler:     func(a ble.Advertisement) { got = append(got, a) },
+		adHist:         make([]*Advertisement, 128),
+		adFrags:        make(map[string]adFrag),
+	}
+
+	md := make([]byte, 200)
+	for i := range md {
+		md[i] = byte(i)
+	}
+	ad := append([]byte{byte(len(md) + 1), 0xff}, md...)
+
+	if err := h.handleLEExtendedAdvertisingReport(extAdvReport(extEvtTypDataIncomplete, ad[:120])); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Fatal("advertisement dispatched before the last fragment")
+	}
+
+	if err := h.handleLEExtendedAdvertisingReport(extAdvReport(0, ad[120:])); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("expected 1 advertisement, got %v", len(got))
+	}
+
+	a := got[0]
+	if !reflect.DeepEqual(a.ManufacturerData(), md) {
+		t.Fatal("mfgData mismatch")
+	}
+	if a.PrimaryPHY() != ble.PHYCoded || a.SecondaryPHY() != ble.PHY2M || a.SID() != 5 {
+		t.Fatalf("phy/sid mismatch: %v %v %v", a.PrimaryPHY(), a.SecondaryPHY(), a.SID())
+	}
+	if a.RSSI() != -64 || a.Connectable() {
+		t.Fatal("rssi/connectable mismatch")
+	}
+	if len(h.adFrags) != 0 {
+		t.Fatal("fragments not released")
+	}
+
+	// a fragment older than the timeout isn't completed by the next report
+	if err := h.handleLEExtendedAdvertisingReport(extAdvReport(extEvtTypDataIncomplete, ad[:120])); err != nil {
+		t.Fatal(err)
+	}
+	for k, f := range h.adFrags {
+		f.t = f.t.Add(-adFragTimeout)
+		h.adFrags[k] = f
+	}
+	if err := h.handleLEExtendedAdvertisingReport(extAdvReport(0, []byte{0x02, 0x01, 0x06})); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || len(got[1].ManufacturerData()) != 0 {
+		t.Fatal("stale fragment reassembled")
+	}
+	if len(h.adFrags) != 0 {
+		t.Fatal("stale fragment not released")
+	}
+}
+
+func TestSyncPeriodicNotScanning(t *testing.T) {
+	h := &HCI{Logger: ble.GetLogger(), extAdv: true}
+	err := h.SyncPeriodic(context.Background(), ble.NewAddr("c6:05:04:03:02:01"), 5, func(ble.PeriodicAdvertisement) {})
+	if err != ErrNotScanning {
+		t.Fatalf("expected %v, got %v", ErrNotScanning, err)
+	}
+	if h.pendingSync != nil {
+		t.Fatal("sync pending")
+	}
+}
+
+func TestPeriodicAdvReassembly(t *testing.T) {
+	var got []ble.PeriodicAdvertisement
+	s := &periodicSync{
+		addr:    ble.NewAddr("c6:05:04:03:02:01"),
+		sid:     5,
+		handler: func(a ble.PeriodicAdvertisement) { got = append(got, a) },
+		lost:    make(chan struct{}),
+		handle:  0x0042,
+	}
+	h := &HCI{
+		Logger:         ble.GetLogger(),
+		advHandlerSync: true,
+		syncs:          map[uint16]*periodicSync{s.handle: s},
+	}
+
+	report := func(status byte, data []byte) []byte {
+		b := []byte{0x0F, 0x42, 0x00, 0x7f, 0xc0, 0xff, status, byte(len(data))}
+		return append(b, data...)
+	}
+
+	md := make([]byte, 100)
+	for i := range md {
+		md[i] = byte(i)
+	}
+	ad := append([]byte{byte(len(md) + 1), 0xff}, md...)
+
+	if err := h.handleLEPeriodicAdvertisingReport(report(periodicDataIncomplete, ad[:60])); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 0 {
+		t.Fatal("periodic advertisement dispatched before the last fragment")
+	}
+	if err := h.handleLEPeriodicAdvertisingReport(report(0, ad[60:])); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("expected 1 periodic advertisement, got %v", len(got))
+	}
+	if !reflect.DeepEqual(got[0].Fields[ble.AdvertisementMapKeys.MFG], md) {
+		t.Fatal("mfgData mismatch", got[0].Fields)
+	}
+	if got[0].RSSI != -64 || got[0].SID != 5 {
+		t.Fatal("rssi/sid mismatch")
+	}
+
+	if err := h.handleLEPeriodicAdvertisingSyncLost([]byte{0x10, 0x42, 0x00}); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-s.lost:
+	default:
+		t.Fatal("sync lost not reported")
+	}
+	if len(h.syncs) != 0 {
+		t.Fatal("sync not released")
+	}
+}
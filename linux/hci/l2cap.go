@@ -0,0 +1,218 @@
+package hci
+
+import (
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/rigado/ble"
+)
+
+// Results of LE Credit Based Connection Response [Vol 3, Part A, 4.23]
+const (
+	cocResultSuccess                    = 0x0000
+	cocResultSPSMNotSupported           = 0x0002
+	cocResultNoResources                = 0x0004
+	cocResultInsufficientAuthentication = 0x0005
+	cocResultInsufficientAuthorization  = 0x0006
+	cocResultInsufficientKeySize        = 0x0007
+	cocResultInsufficientEncryption     = 0x0008
+	cocResultInvalidSourceCID           = 0x0009
+	cocResultSourceCIDAllocated         = 0x000A
+	cocResultUnacceptableParameters     = 0x000B
+	cocResultInvalidParameters          = 0x000C
+)
+
+// Ranges of LE credit based channels [Vol 3, Part A, 2.1, 4.22]
+const (
+	minLEPSM          = 0x0001
+	maxLEPSM          = 0x00FF
+	maxLEDynamicCID   = 0x007F
+	minCocMTU         = 23
+	minCocMPS         = 23
+	maxCocMPS         = 65533
+	defaultCocMTU     = 256
+	defaultCocMPS     = 247 // The largest PDU fitting 251 octets LL payloads.
+	defaultCocCredits = 10
+	defaultCocBacklog = 8
+)
+
+// l2capListener accepts the LE credit based channels opened on an LE PSM.
+type l2capListener struct {
+	hci  *HCI
+	psm  uint16
+	opts ble.L2CAPOptions
+
+	ch     chan ble.LECreditBasedConnection
+	once   sync.Once
+	closed chan struct{}
+}
+
+// ListenL2CAP accepts the LE credit based channels remote devices open on the LE PSM psm.
+// Only one listener can be registered on a PSM.
+func (h *HCI) ListenL2CAP(psm uint16, opts ble.L2CAPOptions) (ble.L2CAPListener, error) {
+	if psm < minLEPSM || psm > maxLEPSM {
+		return nil, fmt.Errorf("invalid le psm 0x%04X, must be 0x%04X-0x%04X", psm, minLEPSM, maxLEPSM)
+	}
+	opts = l2capDefaults(opts)
+	if opts.MTU < minCocMTU || opts.MPS < minCocMPS || opts.MPS > maxCocMPS {
+		return nil, fmt.Errorf("invalid mtu %v, mps %v", opts.MTU, opts.MPS)
+	}
+
+	h.muListeners.Lock()
+	defer h.muListeners.Unlock()
+	if _, ok := h.listeners[psm]; ok {
+		return nil, fmt.Errorf("le psm 0x%04X already in use", psm)
+	}
+	l := &l2capListener{
+		hci:    h,
+		psm:    psm,
+		opts:   opts,
+		ch:     make(chan ble.LECreditBasedConnection, opts.Backlog),
+		closed: make(chan struct{}),
+	}
+	h.listeners[psm] = l
+	return l, nil
+}
+
+// l2capDefaults replaces the zero values of opts by defaults.
+func l2capDefaults(opts ble.L2CAPOptions) ble.L2CAPOptions {
+	if opts.MTU == 0 {
+		opts.MTU = defaultCocMTU
+	}
+	if opts.MPS == 0 {
+		opts.MPS = defaultCocMPS
+	}
+	if opts.InitialCredits == 0 {
+		opts.InitialCredits = defaultCocCredits
+	}
+	if opts.Backlog <= 0 {
+		opts.Backlog = defaultCocBacklog
+	}
+	return opts
+}
+
+func (h *HCI) listener(psm uint16) *l2capListener {
+	h.muListeners.Lock()
+	defer h.muListeners.Unlock()
+	return h.listeners[psm]
+}
+
+// Accept waits for and returns the next channel opened on the PSM.
+func (l *l2capListener) Accept() (ble.LECreditBasedConnection, error) {
+	select {
+	case c := <-l.ch:
+		return c, nil
+	case <-l.closed:
+		return nil, io.ErrClosedPipe
+	case <-l.hci.done:
+		return nil, io.ErrClosedPipe
+	}
+}
+
+// Close stops listening, and closes the channels that weren't accepted.
+func (l *l2capListener) Close() error {
+	l.once.Do(func() {
+		l.hci.muListeners.Lock()
+		delete(l.hci.listeners, l.psm)
+		l.hci.muListeners.Unlock()
+		close(l.closed)
+	})
+
+	for {
+		select {
+		case c := <-l.ch:
+			c.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// PSM returns the LE PSM the listener accepts channels on.
+func (l *l2capListener) PSM() uint16 {
+	return l.psm
+}
+
+// accept opens the channel requested by the remote device. It returns the LE Credit
+// Based Connection Response, whose result is cocResultSuccess if the channel is opened.
+func (l *l2capListener) accept(c *Conn, req *LECreditBasedConnectionRequest) (*LECreditBasedConnectionResponse, ble.LECreditBasedConnection) {
+	refuse := func(result uint16) (*LECreditBasedConnectionResponse, ble.LECreditBasedConnection) {
+		return &LECreditBasedConnectionResponse{Result: result}, nil
+	}
+
+	if result := l.checkSecurity(c); result != cocResultSuccess {
+		return refuse(result)
+	}
+	if req.SourceCID < minDynamicCID || req.SourceCID > maxLEDynamicCID {
+		return refuse(cocResultInvalidSourceCID)
+	}
+	if _, err := c.coc.Info(req.SourceCID); err == nil {
+		return refuse(cocResultSourceCIDAllocated)
+	}
+	if req.MTU < minCocMTU || req.MPS < minCocMPS || req.MPS > maxCocMPS {
+		return refuse(cocResultUnacceptableParameters)
+	}
+	if len(l.ch) == cap(l.ch) {
+		c.Warnf("l2cap: psm 0x%04X backlog full", l.psm)
+		return refuse(cocResultNoResources)
+	}
+
+	localCID, err := c.coc.NextSourceCID()
+	if err != nil {
+		return refuse(cocResultNoResources)
+	}
+	ch, err := c.coc.addChannel(localCID, req.SourceCID,
+		cocParams{mtu: l.opts.MTU, mps: l.opts.MPS, credits: l.opts.InitialCredits},
+		cocParams{mtu: req.MTU, mps: req.MPS, credits: req.InitialCredits})
+	if err != nil {
+		return refuse(cocResultSourceCIDAllocated)
+	}
+
+	return &LECreditBasedConnectionResponse{
+		DestinationCID:    localCID,
+		MTU:               l.opts.MTU,
+		MPS:               l.opts.MPS,
+		InitialCreditsCID: l.opts.InitialCredits,
+		Result:            cocResultSuccess,
+	}, ch
+}
+
+// checkSecurity returns the result refusing a channel on c if the link doesn't
+// meet the security requirements of the listener, cocResultSuccess otherwise.
+func (l *l2capListener) checkSecurity(c *Conn) uint16 {
+	if l.opts.Security >= ble.L2CAPSecurityEncryption || l.opts.MinKeySize != 0 {
+		if !c.Encrypted() {
+			// A device without a bond has no key to encrypt the link with, it has to pair.
+			if !c.Bonded() {
+				return cocResultInsufficientAuthentication
+			}
+			return cocResultInsufficientEncryption
+		}
+		if l.opts.Security >= ble.L2CAPSecurityAuthentication && !c.keyAuthenticated {
+			return cocResultInsufficientAuthentication
+		}
+		if c.keySize < int(l.opts.MinKeySize) {
+			return cocResultInsufficientKeySize
+		}
+	}
+	if l.opts.Authorize != nil && !l.opts.Authorize(c) {
+		return cocResultInsufficientAuthorization
+	}
+	return cocResultSuccess
+}
+
+// queue passes an opened channel to Accept. The channel is closed if the listener
+// was closed, or its backlog filled up, meanwhile.
+func (l *l2capListener) queue(ch ble.LECreditBasedConnection) {
+	select {
+	case <-l.closed:
+	default:
+		select {
+		case l.ch <- ch:
+			return
+		default:
+		}
+	}
+	go ch.Close()
+}
@@ -0,0 +1,66 @@
+package hci
+
+import (
+	"testing"
+
+	"github.com/rigado/ble"
+)
+
+// bondedSmp is a security manager with a bond for the remote device.
+type bondedSmp struct {
+	SmpManager
+}
+
+func (bondedSmp) Bonded() bool { return true }
+
+func TestL2CAPRefusal(t *testing.T) {
+	open := &l2capListener{psm: 0x0080}
+	secure := &l2capListener{psm: 0x0081, opts: ble.L2CAPOptions{Security: ble.L2CAPSecurityEncryption}}
+	authenticated := &l2capListener{psm: 0x0082, opts: ble.L2CAPOptions{Security: ble.L2CAPSecurityAuthentication}}
+	longKey := &l2capListener{psm: 0x0083, opts: ble.L2CAPOptions{MinKeySize: 16}}
+	authorized := &l2capListener{psm: 0x0084, opts: ble.L2CAPOptions{Authorize: func(ble.Conn) bool { return false }}}
+	c := &Conn{}
+	bonded := &Conn{smp: bondedSmp{}}
+	encrypted := &Conn{smp: bondedSmp{}, encryptionEnabled: true, keySize: 7}
+
+	for _, tc := range []struct {
+		name   string
+		l      *l2capListener
+		c      *Conn
+		req    LECreditBasedConnectionRequest
+		result uint16
+	}{
+		{"not paired", secure, c, LECreditBasedConnectionRequest{SourceCID: 0x0040, MTU: 23, MPS: 23}, cocResultInsufficientAuthentication},
+		{"not encrypted", secure, bonded, LECreditBasedConnectionRequest{SourceCID: 0x0040, MTU: 23, MPS: 23}, cocResultInsufficientEncryption},
+		{"not authenticated", authenticated, encrypted, LECreditBasedConnectionRequest{SourceCID: 0x0040, MTU: 23, MPS: 23}, cocResultInsufficientAuthentication},
+		{"short key", longKey, encrypted, LECreditBasedConnectionRequest{SourceCID: 0x0040, MTU: 23, MPS: 23}, cocResultInsufficientKeySize},
+		{"not authorized", authorized, c, LECreditBasedConnectionRequest{SourceCID: 0x0040, MTU: 23, MPS: 23}, cocResultInsufficientAuthorization},
+		{"invalid cid", open, c, LECreditBasedConnectionRequest{SourceCID: 0x0004, MTU: 23, MPS: 23}, cocResultInvalidSourceCID},
+	} {
+		rsp, ch := tc.l.accept(tc.c, &tc.req)
+		if ch != nil || rsp.Result != tc.result {
+			t.Errorf("%s: result 0x%04X, want 0x%04X", tc.name, rsp.Result, tc.result)
+		}
+	}
+
+	for _, tc := range []struct {
+		name   string
+		l      *l2capListener
+		c      *Conn
+		req    L2CAPCreditBasedConnectionRequest
+		result uint16
+	}{
+		{"not paired", secure, c, L2CAPCreditBasedConnectionRequest{SourceCID: []uint16{0x0040}, MTU: 64, MPS: 64}, cocResultInsufficientAuthentication},
+		{"not encrypted", secure, bonded, L2CAPCreditBasedConnectionRequest{SourceCID: []uint16{0x0040}, MTU: 64, MPS: 64}, cocResultInsufficientEncryption},
+		{"not authenticated", authenticated, encrypted, L2CAPCreditBasedConnectionRequest{SourceCID: []uint16{0x0040}, MTU: 64, MPS: 64}, cocResultInsufficientAuthentication},
+		{"short key", longKey, encrypted, L2CAPCreditBasedConnectionRequest{SourceCID: []uint16{0x0040}, MTU: 64, MPS: 64}, cocResultInsufficientKeySize},
+		{"not authorized", authorized, c, L2CAPCreditBasedConnectionRequest{SourceCID: []uint16{0x0040}, MTU: 64, MPS: 64}, cocResultInsufficientAuthorization},
+		{"no channels", open, c, L2CAPCreditBasedConnectionRequest{MTU: 64, MPS: 64}, cocResultInvalidParameters},
+		{"small mtu", open, c, L2CAPCreditBasedConnectionRequest{SourceCID: []uint16{0x0040}, MTU: 23, MPS: 64}, cocResultUnacceptableParameters},
+	} {
+		rsp, chs := tc.l.acceptEnhanced(tc.c, &tc.req)
+		if chs != nil || rsp.Result != tc.result || len(rsp.DestinationCID) != len(tc.req.SourceCID) {
+			t.Errorf("%s: result 0x%04X, %d cids, want 0x%04X", tc.name, rsp.Result, len(rsp.DestinationCID), tc.result)
+		}
+	}
+}
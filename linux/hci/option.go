@@ -3,8 +3,10 @@ package hci
 import (
 	"errors"
 	"fmt"
+	"io"
 	"time"
 
+	"github.com/rigado/ble"
 	"github.com/rigado/ble/cache"
 
 	"github.com/rigado/ble/linux/hci/cmd"
@@ -22,6 +24,53 @@ func (h *HCI) SetListenerTimeout(d time.Duration) error {
 	return nil
 }
 
+// SetConnectMTU sets the ATT_MTU exchanged right after connecting as a central.
+func (h *HCI) SetConnectMTU(mtu int) error {
+	if mtu != 0 && (mtu < ble.DefaultMTU || mtu > ble.MaxMTU) {
+		return fmt.Errorf("invalid mtu %d", mtu)
+	}
+	h.connectMTU = mtu
+	return nil
+}
+
+// SetEATT sets the number of Enhanced ATT bearers opened as a central, once the
+// link is encrypted.
+func (h *HCI) SetEATT(bearers int) error {
+	if bearers < 0 || bearers > ecfcMaxChannels {
+		return fmt.Errorf("invalid number of eatt bearers %d, must be 0-%d", bearers, ecfcMaxChannels)
+	}
+	h.eattBearers = bearers
+	return nil
+}
+
+// SetEATTServer accepts the Enhanced ATT bearers opened by remote clients.
+func (h *HCI) SetEATTServer(enable bool) error {
+	h.eattServer = enable
+	return nil
+}
+
+// EATTServer reports whether the Enhanced ATT bearers opened by remote clients
+// are accepted.
+func (h *HCI) EATTServer() bool {
+	return h.eattServer
+}
+
+// SetDefaultPHY sets the PHY preferences of new connections.
+func (h *HCI) SetDefaultPHY(tx, rx uint8) error {
+	all, txPHYs, rxPHYs, err := phyPreferences(tx, rx)
+	if err != nil {
+		return err
+	}
+	h.defaultPHY = &cmd.LESetDefaultPHY{AllPHYs: all, TXPHYs: txPHYs, RXPHYs: rxPHYs}
+	return nil
+}
+
+// SetConnParamsPolicy sets the policy deciding on the connection parameter requests of remote devices.
+func (h *HCI) SetConnParamsPolicy(p ble.ConnParamsPolicy) error {
+	h.connParamsPolicy = p
+	return nil
+}
+
 // SetConnParams overrides default connection parameters.
 func (h *HCI) SetConnParams(param cmd.LECreateConnection) error {
 	h.params.connParams = param
@@ -34,6 +83,9 @@ func (h *HCI) EnableSecurity(bm interface{}) error {
 		return fmt.Errorf("unknown bond manager type")
 	}
 	h.smpEnabled = true
+	if r, ok := bm.(IdentityResolver); ok {
+		h.resolver = r
+	}
 	if h.smp != nil {
 		h.smp.SetBondManager(bondManager)
 	}
@@ -100,6 +152,68 @@ func (h *HCI) SetTransportH4Uart(path string, baud int) error {
 	return nil
 }
 
+// SetTransportVirtual sets an in-process transport
+func (h *HCI) SetTransportVirtual(rwc io.ReadWriteCloser) error {
+	h.transport = transport{
+		virtual: rwc,
+	}
+	return nil
+}
+
+// SetExtendedAdvertising uses the LE Advertising Extensions commands, if the controller supports them.
+func (h *HCI) SetExtendedAdvertising(enable bool) error {
+	h.extAdvRequested = enable
+	return nil
+}
+
+// SetPairingAgent sets the agent interacting with the user during pairing.
+func (h *HCI) SetPairingAgent(a ble.PairingAgent) error {
+	h.smpConfig.Agent = a
+	return nil
+}
+
+// SetIOCapability sets the IO capability sent when pairing.
+func (h *HCI) SetIOCapability(c ble.IOCapability) error {
+	if c >= IoCapsReservedStart {
+		return fmt.Errorf("invalid io capability 0x%02X", byte(c))
+	}
+	h.smpConfig.IoCap = byte(c)
+	return nil
+}
+
+// SetMITMProtection requires authenticated pairing.
+func (h *HCI) SetMITMProtection(enable bool) error {
+	h.smpConfig.AuthReq = setFlag(h.smpConfig.AuthReq, AuthReqMITM, enable)
+	return nil
+}
+
+// SetBonding sets whether the keys distributed when pairing are stored.
+func (h *HCI) SetBonding(enable bool) error {
+	h.smpConfig.AuthReq = setFlag(h.smpConfig.AuthReq, AuthReqBonding, enable)
+	h.smpConfig.InitKeyDist, h.smpConfig.RespKeyDist = 0, 0
+	if enable {
+		h.smpConfig.InitKeyDist, h.smpConfig.RespKeyDist = defaultSmpConfig.InitKeyDist, defaultSmpConfig.RespKeyDist
+	}
+	return nil
+}
+
+// SetSecureConnectionsOnly refuses legacy pairing.
+func (h *HCI) SetSecureConnectionsOnly(enable bool) error {
+	h.smpConfig.SecureConnectionsOnly = enable
+	return nil
+}
+
+func setFlag(b, flag byte, set bool) byte {
+	if set {
+		return b | flag
+	}
+	return b &^ flag
+}
+
 func (h *HCI) SetGattCacheFile(filename string) {
 	h.cache = cache.New(filename)
 }
+
+func (h *HCI) SetGattCache(c ble.GattCache) {
+	h.cache = c
+}
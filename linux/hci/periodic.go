@@ -0,0 +1,245 @@
+package hci
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/rigado/ble"
+	"github.com/rigado/ble/linux/hci/cmd"
+	"github.com/rigado/ble/linux/hci/evt"
+	"github.com/rigado/ble/parser"
+	"github.com/rigado/ble/sliceops"
+)
+
+// LE event mask bits of the periodic advertising sync events [Vol 2, Part E, 7.8.1]
+const leEventPeriodicAdvertising = 1<<13 | 1<<14 | 1<<15
+
+// Data status of the LE Periodic Advertising Report [Vol 2, Part E, 7.7.65.15]
+const periodicDataIncomplete = 0x01
+
+// defaultSyncTimeout is the time the controller waits for a periodic advertising
+// packet before reporting the sync lost.
+const defaultSyncTimeout = 1000 // N * 10 msec
+
+// periodicSync tracks the synchronization to a periodic advertising train.
+type periodicSync struct {
+	addr    ble.Addr
+	sid     uint8
+	handler ble.PeriodicAdvHandler
+
+	established chan uint8 // status of LE Periodic Advertising Sync Established
+	lost        chan struct{}
+
+	handle uint16
+	buf    []byte
+}
+
+// SyncPeriodic synchronizes to the periodic advertising of advertising set sid of a device,
+// and passes the periodic advertisements to ph until ctx is done.
+// The controller synchronizes to a train found by the extended scan, which must
+// be running; ErrNotScanning is returned otherwise.
+// It returns ble.ErrSyncLost if the synchronization is lost.
+func (h *HCI) SyncPeriodic(ctx context.Context, a ble.Addr, sid uint8, ph ble.PeriodicAdvHandler) error {
+	if !h.extAdv {
+		return ErrExtendedAdvertising
+	}
+
+	ab := a.Bytes()
+	if len(ab) != 6 {
+		return ErrInvalidAddr
+	}
+
+	c := cmd.LEPeriodicAdvertisingCreateSync{
+		AdvertisingSID: sid,
+		SyncTimeout:    defaultSyncTimeout,
+	}
+	if _, ok := a.(RandomAddress); ok {
+		c.AdvertiserAddressType = 1
+	}
+	copy(c.AdvertiserAddress[:], sliceops.SwapBuf(ab))
+
+	s := &periodicSync{
+		addr:        a,
+		sid:         sid,
+		handler:     ph,
+		established: make(chan uint8, 1),
+		lost:        make(chan struct{}),
+	}
+
+	h.Lock()
+	if h.params.scanEnable.LEScanEnable == 0 {
+		h.Unlock()
+		return ErrNotScanning
+	}
+	if h.pendingSync != nil {
+		h.Unlock()
+		return ErrBusySyncing
+	}
+	h.pendingSync = s
+	h.Unlock()
+
+	h.Infof("sync periodic: addr %v, sid %v", a.String(), sid)
+	if err := h.Send(&c, nil); err != nil {
+		h.Lock()
+		h.pendingSync = nil
+		h.Unlock()
+		return err
+	}
+
+	select {
+	case status := <-s.established:
+		if status != 0 {
+			return ErrCommand(status)
+		}
+	case <-ctx.Done():
+		h.cancelSync(s)
+		return ctx.Err()
+	case <-h.done:
+		return h.err
+	}
+
+	select {
+	case <-ctx.Done():
+		h.terminateSync(s)
+		return ctx.Err()
+	case <-s.lost:
+		return ble.ErrSyncLost
+	case <-h.done:
+		return h.err
+	}
+}
+
+// cancelSync cancels a pending sync.
+func (h *HCI) cancelSync(s *periodicSync) {
+	h.Lock()
+	pending := h.pendingSync == s
+	if pending {
+		h.pendingSync = nil
+	}
+	h.Unlock()
+
+	if pending {
+		// A sync established from now on isn't wanted anymore, and is terminated
+		// by the event handler.
+		err := h.Send(&cmd.LEPeriodicAdvertisingCreateSyncCancel{}, nil)
+		if err != nil && !errors.Is(err, ErrDisallowed) {
+			h.Warnf("sync periodic: cancel failed: %v", err)
+		}
+		return
+	}
+
+	// The sync was established in the meantime.
+	if status := <-s.established; status == 0 {
+		h.terminateSync(s)
+	}
+}
+
+// terminateSync stops the synchronization to a periodic advertising train.
+func (h *HCI) terminateSync(s *periodicSync) {
+	h.Lock()
+	delete(h.syncs, s.handle)
+	h.Unlock()
+
+	if err := h.Send(&cmd.LEPeriodicAdvertisingTerminateSync{SyncHandle: s.handle}, nil); err != nil {
+		h.Warnf("sync periodic: terminate failed: %v", err)
+	}
+}
+
+func (h *HCI) handleLEPeriodicAdvertisingSyncEstablished(b []byte) error {
+	e := evt.LEPeriodicAdvertisingSyncEstablished(b)
+	if len(e) < 16 {
+		return fmt.Errorf("invalid periodic advertising sync established: % X", b)
+	}
+
+	h.Lock()
+	s := h.pendingSync
+	h.pendingSync = nil
+	if s != nil && e.Status() == 0 {
+		s.handle = e.SyncHandle()
+		h.syncs[s.handle] = s
+	}
+	h.Unlock()
+
+	if s == nil {
+		// The sync was cancelled, but got established anyway.
+		if e.Status() == 0 {
+			go h.Send(&cmd.LEPeriodicAdvertisingTerminateSync{SyncHandle: e.SyncHandle()}, nil)
+		}
+		return nil
+	}
+
+	s.established <- e.Status()
+	return nil
+}
+
+func (h *HCI) handleLEPeriodicAdvertisingReport(b []byte) error {
+	e := evt.LEPeriodicAdvertisingReport(b)
+	if len(e) < 8 || len(e.Data()) < int(e.DataLength()) {
+		return fmt.Errorf("invalid periodic advertising report: % X", b)
+	}
+
+	h.Lock()
+	s := h.syncs[e.SyncHandle()]
+	h.Unlock()
+	if s == nil {
+		return nil
+	}
+
+	// Reassemble the data delivered in several reports.
+	// Truncated data is delivered as is, there won't be any more of it.
+	s.buf = append(s.buf, e.Data()[:e.DataLength()]...)
+	if e.DataStatus() == periodicDataIncomplete {
+		return nil
+	}
+	data := s.buf
+	s.buf = nil
+
+	pa := ble.PeriodicAdvertisement{
+		Addr:      s.addr,
+		SID:       s.sid,
+		TxPower:   e.TXPower(),
+		RSSI:      e.RSSI(),
+		Timestamp: time.Now().UnixNano() / 1000,
+		Data:      data,
+	}
+
+	m, err := parser.Parse(data)
+	switch {
+	case err == nil:
+	case errors.Is(err, parser.EmptyOrNilPdu):
+		m = map[string]interface{}{}
+	case len(m) > 0:
+		// some of the data was ok, append the error
+		m[ble.AdvertisementMapKeys.AdvertisementError] = err.Error()
+	default:
+		h.dispatchError(fmt.Errorf("periodic adv decode: %v, bytes %v", err, data))
+	}
+	pa.Fields = m
+
+	if h.advHandlerSync {
+		s.handler(pa)
+	} else {
+		go s.handler(pa)
+	}
+	return nil
+}
+
+func (h *HCI) handleLEPeriodicAdvertisingSyncLost(b []byte) error {
+	e := evt.LEPeriodicAdvertisingSyncLost(b)
+	if len(e) < 3 {
+		return fmt.Errorf("invalid periodic advertising sync lost: % X", b)
+	}
+
+	h.Lock()
+	s := h.syncs[e.SyncHandle()]
+	delete(h.syncs, e.SyncHandle())
+	h.Unlock()
+
+	if s != nil {
+		h.Infof("sync periodic: sync lost, addr %v, sid %v", s.addr.String(), s.sid)
+		close(s.lost)
+	}
+	return nil
+}
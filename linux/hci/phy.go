@@ -0,0 +1,154 @@
+package hci
+
+import (
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/rigado/ble"
+	"github.com/rigado/ble/linux/hci/cmd"
+	"github.com/rigado/ble/linux/hci/evt"
+)
+
+// leEventPHYUpdateComplete is the LE event mask bit of LE PHY Update Complete [Vol 2, Part E, 7.8.1]
+const leEventPHYUpdateComplete = 1 << 11
+
+// phyUpdateTimeout bounds the wait for the PHY update procedure started by SetPHY.
+const phyUpdateTimeout = 10 * time.Second
+
+// Bits of All PHYs of LE Set PHY and LE Set Default PHY [Vol 2, Part E, 7.8.49]
+const (
+	allPHYsNoTxPreference = 1 << 0
+	allPHYsNoRxPreference = 1 << 1
+)
+
+// phyPreferences returns the parameters of LE Set PHY, or LE Set Default PHY, for the
+// PHY preferences tx and rx, where 0 means no preference.
+func phyPreferences(tx, rx uint8) (all, txPHYs, rxPHYs uint8, err error) {
+	const phys = ble.PHYMask1M | ble.PHYMask2M | ble.PHYMaskCoded
+	if tx&^phys != 0 || rx&^phys != 0 {
+		return 0, 0, 0, fmt.Errorf("invalid phys tx 0x%02X, rx 0x%02X", tx, rx)
+	}
+	if tx == 0 {
+		all |= allPHYsNoTxPreference
+	}
+	if rx == 0 {
+		all |= allPHYsNoRxPreference
+	}
+	return all, tx, rx, nil
+}
+
+// setDefaultPHY sets the PHY preferences of new connections.
+func (h *HCI) setDefaultPHY() error {
+	if h.defaultPHY == nil {
+		return nil
+	}
+	if h.leFeatures&(leFeature2MPHY|leFeatureCodedPHY) == 0 {
+		h.Warnf("default phy: only LE 1M supported by the controller")
+		return nil
+	}
+	return h.Send(h.defaultPHY, nil)
+}
+
+func (h *HCI) handleLEPHYUpdateComplete(b []byte) error {
+	e := evt.LEPHYUpdateComplete(b)
+	if len(e) < 6 {
+		return fmt.Errorf("phyUpdateComplete: invalid length %d", len(e))
+	}
+
+	c := h.findConnection(e.ConnectionHandle())
+	if c == nil {
+		return fmt.Errorf("phyUpdateComplete: unknown connection handle %04X", e.ConnectionHandle())
+	}
+
+	c.handlePHYUpdateComplete(e.Status(), e.TXPHY(), e.RXPHY())
+	return nil
+}
+
+// SetPHY requests the PHYs the connection transmits and receives on, as
+// bitmasks of ble.PHYMask1M, ble.PHYMask2M and ble.PHYMaskCoded; 0 means
+// no preference. opts selects the coding used on the LE Coded PHY.
+// It returns once the controller completed the PHY update procedure. [Vol 2, Part E, 7.8.49]
+func (c *Conn) SetPHY(tx, rx uint8, opts uint16) error {
+	all, txPHYs, rxPHYs, err := phyPreferences(tx, rx)
+	if err != nil {
+		return err
+	}
+
+	// The controller reports one PHY update at a time.
+	c.muSetPHY.Lock()
+	defer c.muSetPHY.Unlock()
+
+	ch := make(chan uint8, 1)
+	c.muPHY.Lock()
+	c.phyUpdated = ch
+	c.muPHY.Unlock()
+	defer func() {
+		c.muPHY.Lock()
+		c.phyUpdated = nil
+		c.muPHY.Unlock()
+	}()
+
+	err = c.hci.Send(&cmd.LESetPHY{
+		ConnectionHandle: c.param.ConnectionHandle(),
+		AllPHYs:          all,
+		TXPHYs:           txPHYs,
+		RXPHYs:           rxPHYs,
+		PHYOptions:       opts,
+	}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to set phy: %v", err)
+	}
+
+	select {
+	case status := <-ch:
+		if status != 0 {
+			return fmt.Errorf("phy update failed: %v", ErrCommand(status))
+		}
+		return nil
+	case <-c.chDone:
+		return io.ErrClosedPipe
+	case <-time.After(phyUpdateTimeout):
+		return fmt.Errorf("phy update timed out")
+	}
+}
+
+// PHY returns the PHYs the connection transmits and receives on. [Vol 2, Part E, 7.8.47]
+func (c *Conn) PHY() (uint8, uint8, error) {
+	rp := cmd.LEReadPHYRP{}
+	if err := c.hci.Send(&cmd.LEReadPHY{ConnectionHandle: c.param.ConnectionHandle()}, &rp); err != nil {
+		return 0, 0, fmt.Errorf("failed to read phy: %v", err)
+	}
+	return rp.TXPHY, rp.RXPHY, nil
+}
+
+// SetPHYHandler sets the handler called whenever the PHYs of the connection change,
+// whether the local or the remote device started the update.
+func (c *Conn) SetPHYHandler(h ble.PHYHandler) {
+	c.muPHY.Lock()
+	defer c.muPHY.Unlock()
+	c.phyHandler = h
+}
+
+func (c *Conn) handlePHYUpdateComplete(status, tx, rx uint8) {
+	c.muPHY.Lock()
+	ch, h := c.phyUpdated, c.phyHandler
+	c.muPHY.Unlock()
+
+	if ch != nil {
+		select {
+		case ch <- status:
+		default:
+		}
+	}
+
+	if status != 0 {
+		c.Warnf("phyUpdateComplete: status %v", ErrCommand(status))
+		return
+	}
+	c.Infof("phyUpdateComplete: tx %v, rx %v", tx, rx)
+	if h != nil {
+		// Event handlers can't block, nor send commands.
+		go h(tx, rx)
+	}
+}
@@ -2,6 +2,7 @@ package hci
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -25,13 +26,27 @@ func (s sigCmd) id() uint8    { return s[1] }
 func (s sigCmd) len() int     { return int(binary.LittleEndian.Uint16(s[2:4])) }
 func (s sigCmd) data() []byte { return s[4 : 4+s.len()] }
 
+// sigRspTimeout bounds the wait for signaling responses sent by Signal.
+// TODO: Find the proper timed out defined in spec, if any.
+const sigRspTimeout = 2 * time.Second
+
 // Signal ...
 func (c *Conn) Signal(req, rsp Signal) error {
+	ctx, cancel := context.WithTimeout(context.Background(), sigRspTimeout)
+	defer cancel()
+	return c.signal(ctx, req, rsp)
+}
 
+// signal sends a signaling request, and waits for the response until ctx is done.
+func (c *Conn) signal(ctx context.Context, req, rsp Signal) error {
+	// Requests are signaled concurrently, e.g. to return credits of channels.
+	c.sigRspChannelsMu.Lock()
 	c.sigID++
 	if c.sigID == 0 {
 		c.sigID = 1
 	}
+	id := c.sigID
+	c.sigRspChannelsMu.Unlock()
 
 	data := req.Marshal()
 
@@ -47,7 +62,7 @@ func (c *Conn) Signal(req, rsp Signal) error {
 	if err := binary.Write(buf, binary.LittleEndian, uint8(req.Code())); err != nil {
 		return err
 	}
-	if err := binary.Write(buf, binary.LittleEndian, uint8(c.sigID)); err != nil {
+	if err := binary.Write(buf, binary.LittleEndian, id); err != nil {
 		return err
 	}
 	if err := binary.Write(buf, binary.LittleEndian, uint16(len(data))); err != nil {
@@ -63,7 +78,7 @@ func (c *Conn) Signal(req, rsp Signal) error {
 	if rsp != nil {
 		rspc = make(chan sigCmd, 1)
 		c.sigRspChannelsMu.Lock()
-		c.sigRspChannels[c.sigID] = rspc
+		c.sigRspChannels[id] = rspc
 		c.sigRspChannelsMu.Unlock()
 
 		// cleanup
@@ -71,7 +86,7 @@ func (c *Conn) Signal(req, rsp Signal) error {
 			c.sigRspChannelsMu.Lock()
 			delete(c.sigRspChannels, sigId)
 			c.sigRspChannelsMu.Unlock()
-		}(c.sigID)
+		}(id)
 	}
 
 	if _, err := c.writePDU(buf.Bytes()); err != nil {
@@ -88,16 +103,18 @@ func (c *Conn) Signal(req, rsp Signal) error {
 	select {
 	case s = <-rspc:
 		// ok
-	case <-time.After(time.Second * 2):
-		// TODO: Find the proper timed out defined in spec, if any.
-		return errors.New("signaling request timed out")
+	case <-ctx.Done():
+		if ctx.Err() == context.DeadlineExceeded {
+			return errors.New("signaling request timed out")
+		}
+		return ctx.Err()
 	}
 
 	if s.code() != rsp.Code() {
 		return fmt.Errorf("unexpected signaling response, have %v, want %v", s.code(), req.Code())
 	}
-	if s.id() != c.sigID {
-		return fmt.Errorf("unexpected signaling id, have %v, want %v", s.id(), c.sigID)
+	if s.id() != id {
+		return fmt.Errorf("unexpected signaling id, have %v, want %v", s.id(), id)
 	}
 
 	return rsp.Unmarshal(s.data())
@@ -169,6 +186,10 @@ func (c *Conn) handleSignal(p pdu) error {
 			c.LECreditBasedConnectionRequest(s)
 		case SignalLEFlowControlCredit:
 			c.LEFlowControlCredit(s)
+		case SignalL2CAPCreditBasedConnectionRequest:
+			c.handleCreditBasedConnectionRequest(s)
+		case SignalL2CAPCreditBasedReconfigureRequest:
+			c.handleCreditBasedReconfigureRequest(s)
 		default:
 
 			c.sigRspChannelsMu.Lock()
@@ -202,11 +223,17 @@ func (c *Conn) handleDisconnectRequest(s sigCmd) {
 		return
 	}
 
+	// LE credit based channels are closed by either device.
+	if req.DestinationCID >= minDynamicCID {
+		c.disconnectCoc(s.id(), req)
+		return
+	}
+
 	// Send Command Reject when the DCID is unrecognized.
 	if req.DestinationCID != cidLEAtt {
 		endpoints := make([]byte, 4)
 		binary.LittleEndian.PutUint16(endpoints, req.SourceCID)
-		binary.LittleEndian.PutUint16(endpoints, req.DestinationCID)
+		binary.LittleEndian.PutUint16(endpoints[2:], req.DestinationCID)
 		c.sendResponse(
 			SignalCommandReject,
 			s.id(),
@@ -231,6 +258,33 @@ func (c *Conn) handleDisconnectRequest(s sigCmd) {
 		})
 }
 
+// disconnectCoc closes the LE credit based channel the remote device disconnects.
+func (c *Conn) disconnectCoc(id uint8, req DisconnectRequest) {
+	i, err := c.coc.Info(req.SourceCID)
+	if err != nil || i.localCID != req.DestinationCID {
+		endpoints := make([]byte, 4)
+		binary.LittleEndian.PutUint16(endpoints, req.SourceCID)
+		binary.LittleEndian.PutUint16(endpoints[2:], req.DestinationCID)
+		c.sendResponse(
+			SignalCommandReject,
+			id,
+			&CommandReject{
+				Reason: 0x0002, // Invalid CID in request
+				Data:   endpoints,
+			})
+		return
+	}
+
+	c.coc.CloseChannel(req.SourceCID)
+	c.sendResponse(
+		SignalDisconnectResponse,
+		id,
+		&DisconnectResponse{
+			DestinationCID: req.DestinationCID,
+			SourceCID:      req.SourceCID,
+		})
+}
+
 // ConnectionParameterUpdateRequest implements Connection Parameter Update Request (0x12) [Vol 3, Part A, 4.20].
 func (c *Conn) handleConnectionParameterUpdateRequest(s sigCmd) {
 	// This command shall only be sent from the LE slave device to the LE master
@@ -255,34 +309,91 @@ func (c *Conn) handleConnectionParameterUpdateRequest(s sigCmd) {
 		return
 	}
 
-	// LE Connection Update (0x08|0x0013) [Vol 2, Part E, 7.8.18]
-	c.hci.Send(&cmd.LEConnectionUpdate{
-		ConnectionHandle:   c.param.ConnectionHandle(),
-		ConnIntervalMin:    req.IntervalMin,
-		ConnIntervalMax:    req.IntervalMax,
-		ConnLatency:        req.SlaveLatency,
-		SupervisionTimeout: req.TimeoutMultiplier,
-		MinimumCELength:    0, // Informational, and spec doesn't specify the use.
-		MaximumCELength:    0, // Informational, and spec doesn't specify the use.
-	}, nil)
+	// The connection parameter policy decides, as for the requests of the
+	// Connection Parameters Request Link Layer Control Procedure. The response
+	// has no parameters, so a counter-proposal is rejected.
+	r := ble.ConnParamsRequest{
+		IntervalMin: req.IntervalMin,
+		IntervalMax: req.IntervalMax,
+		Latency:     req.SlaveLatency,
+		Timeout:     req.TimeoutMultiplier,
+	}
+	p, ok := c.decideConnParams(r)
+	if ok && p != r {
+		c.Infof("connectionParameterUpdateRequest: reject %+v, policy counter-proposed %+v", r, p)
+		ok = false
+	}
+	if !ok {
+		c.sendResponse(
+			SignalConnectionParameterUpdateResponse,
+			s.id(),
+			&ConnectionParameterUpdateResponse{
+				Result: connParamsRejected,
+			})
+		return
+	}
 
-	// Currently, we (as a slave host) accept all the parameters and forward
-	// it to the controller. The controller might update all, partial or even
-	// none (ignore) of the parameters. The slave(remote) host will be indicated
-	// by its controller if the update actually happens.
-	// TODO: allow users to implement what parameters to accept.
 	c.sendResponse(
 		SignalConnectionParameterUpdateResponse,
 		s.id(),
 		&ConnectionParameterUpdateResponse{
-			Result: 0, // Accept.
+			Result: connParamsAccepted,
 		})
+
+	// LE Connection Update (0x08|0x0013) [Vol 2, Part E, 7.8.18]
+	// The controller might update all, partial or even none (ignore) of the
+	// parameters. The slave(remote) host will be indicated by its controller
+	// if the update actually happens.
+	err := c.hci.Send(&cmd.LEConnectionUpdate{
+		ConnectionHandle:   c.param.ConnectionHandle(),
+		ConnIntervalMin:    p.IntervalMin,
+		ConnIntervalMax:    p.IntervalMax,
+		ConnLatency:        p.Latency,
+		SupervisionTimeout: p.Timeout,
+		MinimumCELength:    0, // Informational, and spec doesn't specify the use.
+		MaximumCELength:    0, // Informational, and spec doesn't specify the use.
+	}, nil)
+	if err != nil {
+		c.Errorf("connectionParameterUpdateRequest: %v", err)
+	}
 }
 
-// LECreditBasedConnectionRequest ...
+// LECreditBasedConnectionRequest implements LE Credit Based Connection Request (0x14) [Vol 3, Part A, 4.22].
+// The channel is opened if a listener is registered on the LE PSM, and its requirements are met.
 func (c *Conn) LECreditBasedConnectionRequest(s sigCmd) {
-	c.Debugf("LECreditBasedConnectionRequest")
-	// TODO:
+	var req LECreditBasedConnectionRequest
+	if err := req.Unmarshal(s.data()); err != nil {
+		return
+	}
+	c.Debugf("LECreditBasedConnectionRequest: psm 0x%04X, cid %v, mtu %v, mps %v, credits %v",
+		req.LEPSM, req.SourceCID, req.MTU, req.MPS, req.InitialCredits)
+
+	l := c.hci.listener(req.LEPSM)
+	if l == nil {
+		c.sendResponse(
+			SignalLECreditBasedConnectionResponse,
+			s.id(),
+			&LECreditBasedConnectionResponse{
+				Result: cocResultSPSMNotSupported,
+			})
+		return
+	}
+
+	rsp, ch := l.accept(c, &req)
+	if _, err := c.sendResponse(SignalLECreditBasedConnectionResponse, s.id(), rsp); err != nil {
+		c.Errorf("LECreditBasedConnectionRequest: %v", err)
+		if ch != nil {
+			c.coc.CloseChannel(req.SourceCID)
+		}
+		return
+	}
+	if ch == nil {
+		c.Infof("LECreditBasedConnectionRequest: psm 0x%04X refused, result 0x%04X", req.LEPSM, rsp.Result)
+		return
+	}
+
+	c.Infof("LECreditBasedConnectionRequest: psm 0x%04X, localCID %v, remoteCID %v opened", req.LEPSM, rsp.DestinationCID, req.SourceCID)
+	l.queue(ch)
 }
 
 // LEFlowControlCredit ...
@@ -20,13 +20,22 @@ func (s CommandReject) Code() int { return 0x01 }
 // Marshal serializes the command parameters into binary form.
 func (s *CommandReject) Marshal() []byte {
 	buf := bytes.NewBuffer(make([]byte, 0))
-	binary.Write(buf, binary.LittleEndian, s)
+	binary.Write(buf, binary.LittleEndian, s.Reason)
+	binary.Write(buf, binary.LittleEndian, s.Data)
 	return buf.Bytes()
 }
 
 // Unmarshal de-serializes the binary data and stores the result in the receiver.
 func (s *CommandReject) Unmarshal(b []byte) error {
-	return binary.Read(bytes.NewBuffer(b), binary.LittleEndian, s)
+	buf := bytes.NewBuffer(b)
+	if err := binary.Read(buf, binary.LittleEndian, &s.Reason); err != nil {
+		return err
+	}
+	s.Data = make([]byte, buf.Len())
+	if err := binary.Read(buf, binary.LittleEndian, s.Data); err != nil {
+		return err
+	}
+	return nil
 }
 
 // SignalL2CAPConnectionRequest is the code of L2CAP Connection Request signaling packet.
@@ -264,7 +273,7 @@ type L2CAPCreditBasedConnectionRequest struct {
 	MTU            uint16
 	MPS            uint16
 	InitialCredits uint16
-	SourceCID      uint16
+	SourceCID      []uint16
 }
 
 // Code returns the event code of the command.
@@ -273,13 +282,34 @@ func (s L2CAPCreditBasedConnectionRequest) Code() int { return 0x17 }
 // Marshal serializes the command parameters into binary form.
 func (s *L2CAPCreditBasedConnectionRequest) Marshal() []byte {
 	buf := bytes.NewBuffer(make([]byte, 0))
-	binary.Write(buf, binary.LittleEndian, s)
+	binary.Write(buf, binary.LittleEndian, s.SPSM)
+	binary.Write(buf, binary.LittleEndian, s.MTU)
+	binary.Write(buf, binary.LittleEndian, s.MPS)
+	binary.Write(buf, binary.LittleEndian, s.InitialCredits)
+	binary.Write(buf, binary.LittleEndian, s.SourceCID)
 	return buf.Bytes()
 }
 
 // Unmarshal de-serializes the binary data and stores the result in the receiver.
 func (s *L2CAPCreditBasedConnectionRequest) Unmarshal(b []byte) error {
-	return binary.Read(bytes.NewBuffer(b), binary.LittleEndian, s)
+	buf := bytes.NewBuffer(b)
+	if err := binary.Read(buf, binary.LittleEndian, &s.SPSM); err != nil {
+		return err
+	}
+	if err := binary.Read(buf, binary.LittleEndian, &s.MTU); err != nil {
+		return err
+	}
+	if err := binary.Read(buf, binary.LittleEndian, &s.MPS); err != nil {
+		return err
+	}
+	if err := binary.Read(buf, binary.LittleEndian, &s.InitialCredits); err != nil {
+		return err
+	}
+	s.SourceCID = make([]uint16, buf.Len()/2)
+	if err := binary.Read(buf, binary.LittleEndian, s.SourceCID); err != nil {
+		return err
+	}
+	return nil
 }
 
 // SignalL2CAPCreditBasedConnectionResponse is the code of L2CAP Credit Based Connection Response signaling packet.
@@ -287,11 +317,11 @@ const SignalL2CAPCreditBasedConnectionResponse = 0x18
 
 // L2CAPCreditBasedConnectionResponse implements L2CAP Credit Based Connection Response (0x18) [Vol 3, Part A, 4.26].
 type L2CAPCreditBasedConnectionResponse struct {
-	MTU               uint16
-	MPS               uint16
-	InitialCreditsCID uint16
-	Result            uint16
-	DestinationCID    uint16
+	MTU            uint16
+	MPS            uint16
+	InitialCredits uint16
+	Result         uint16
+	DestinationCID []uint16
 }
 
 // Code returns the event code of the command.
@@ -300,11 +330,93 @@ func (s L2CAPCreditBasedConnectionResponse) Code() int { return 0x18 }
 // Marshal serializes the command parameters into binary form.
 func (s *L2CAPCreditBasedConnectionResponse) Marshal() []byte {
 	buf := bytes.NewBuffer(make([]byte, 0))
-	binary.Write(buf, binary.LittleEndian, s)
+	binary.Write(buf, binary.LittleEndian, s.MTU)
+	binary.Write(buf, binary.LittleEndian, s.MPS)
+	binary.Write(buf, binary.LittleEndian, s.InitialCredits)
+	binary.Write(buf, binary.LittleEndian, s.Result)
+	binary.Write(buf, binary.LittleEndian, s.DestinationCID)
 	return buf.Bytes()
 }
 
 // Unmarshal de-serializes the binary data and stores the result in the receiver.
 func (s *L2CAPCreditBasedConnectionResponse) Unmarshal(b []byte) error {
+	buf := bytes.NewBuffer(b)
+	if err := binary.Read(buf, binary.LittleEndian, &s.MTU); err != nil {
+		return err
+	}
+	if err := binary.Read(buf, binary.LittleEndian, &s.MPS); err != nil {
+		return err
+	}
+	if err := binary.Read(buf, binary.LittleEndian, &s.InitialCredits); err != nil {
+		return err
+	}
+	if err := binary.Read(buf, binary.LittleEndian, &s.Result); err != nil {
+		return err
+	}
+	s.DestinationCID = make([]uint16, buf.Len()/2)
+	if err := binary.Read(buf, binary.LittleEndian, s.DestinationCID); err != nil {
+		return err
+	}
+	return nil
+}
+
+// SignalL2CAPCreditBasedReconfigureRequest is the code of L2CAP Credit Based Reconfigure Request signaling packet.
+const SignalL2CAPCreditBasedReconfigureRequest = 0x19
+
+// L2CAPCreditBasedReconfigureRequest implements L2CAP Credit Based Reconfigure Request (0x19) [Vol 3, Part A, 4.27].
+type L2CAPCreditBasedReconfigureRequest struct {
+	MTU            uint16
+	MPS            uint16
+	DestinationCID []uint16
+}
+
+// Code returns the event code of the command.
+func (s L2CAPCreditBasedReconfigureRequest) Code() int { return 0x19 }
+
+// Marshal serializes the command parameters into binary form.
+func (s *L2CAPCreditBasedReconfigureRequest) Marshal() []byte {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	binary.Write(buf, binary.LittleEndian, s.MTU)
+	binary.Write(buf, binary.LittleEndian, s.MPS)
+	binary.Write(buf, binary.LittleEndian, s.DestinationCID)
+	return buf.Bytes()
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (s *L2CAPCreditBasedReconfigureRequest) Unmarshal(b []byte) error {
+	buf := bytes.NewBuffer(b)
+	if err := binary.Read(buf, binary.LittleEndian, &s.MTU); err != nil {
+		return err
+	}
+	if err := binary.Read(buf, binary.LittleEndian, &s.MPS); err != nil {
+		return err
+	}
+	s.DestinationCID = make([]uint16, buf.Len()/2)
+	if err := binary.Read(buf, binary.LittleEndian, s.DestinationCID); err != nil {
+		return err
+	}
+	return nil
+}
+
+// SignalL2CAPCreditBasedReconfigureResponse is the code of L2CAP Credit Based Reconfigure Response signaling packet.
+const SignalL2CAPCreditBasedReconfigureResponse = 0x1A
+
+// L2CAPCreditBasedReconfigureResponse implements L2CAP Credit Based Reconfigure Response (0x1A) [Vol 3, Part A, 4.28].
+type L2CAPCreditBasedReconfigureResponse struct {
+	Result uint16
+}
+
+// Code returns the event code of the command.
+func (s L2CAPCreditBasedReconfigureResponse) Code() int { return 0x1A }
+
+// Marshal serializes the command parameters into binary form.
+func (s *L2CAPCreditBasedReconfigureResponse) Marshal() []byte {
+	buf := bytes.NewBuffer(make([]byte, 0))
+	binary.Write(buf, binary.LittleEndian, s)
+	return buf.Bytes()
+}
+
+// Unmarshal de-serializes the binary data and stores the result in the receiver.
+func (s *L2CAPCreditBasedReconfigureResponse) Unmarshal(b []byte) error {
 	return binary.Read(bytes.NewBuffer(b), binary.LittleEndian, s)
 }
@@ -20,6 +20,14 @@ const (
 	IoCapsReservedStart   = 0x05
 )
 
+// AuthReq flags of the pairing request and response [Vol 3, Part H, 3.5.1]
+const (
+	AuthReqBonding  = 0x01
+	AuthReqMITM     = 0x04
+	AuthReqSC       = 0x08
+	AuthReqKeypress = 0x10
+)
+
 type OobDataFlag byte
 
 const (
@@ -30,6 +38,7 @@ const (
 type SmpManagerFactory interface {
 	Create(SmpConfig, ble.Logger) SmpManager
 	SetBondManager(BondManager)
+	LocalOOBData() (ble.OOBData, error)
 }
 
 type SmpManager interface {
@@ -38,18 +47,35 @@ type SmpManager interface {
 	Handle(data []byte) error
 	Pair(authData ble.AuthData, to time.Duration) error
 	BondInfoFor(addr string) BondInfo
+	Bonded() bool
 	DeleteBondInfo() error
 	StartEncryption() error
 	SetWritePDUFunc(func([]byte) (int, error))
 	SetEncryptFunc(func(BondInfo) error)
 	LegacyPairingInfo() (bool, []byte)
+	LongTermKeyFor(ediv uint16, rand uint64) ([]byte, error)
+	EncryptionChanged(err error) error
+	Sign(data []byte) ([]byte, error)
+	Verify(data, signature []byte) error
+	KeySecurity() (authenticated bool, keySize int)
 }
 
 type SmpConfig struct {
 	IoCap, OobFlag, AuthReq, MaxKeySize, InitKeyDist, RespKeyDist byte
+
+	// SecureConnectionsOnly refuses legacy pairing.
+	SecureConnectionsOnly bool
+
+	// Agent interacts with the user, if not nil.
+	Agent ble.PairingAgent
 }
 
-//todo: make these configurable
+// defaultSmpConfig is the pairing configuration, unless changed by the pairing options.
 var defaultSmpConfig = SmpConfig{
-	IoCapsKeyboardDisplay, byte(OobNotPresent), 0x09, 16, 0x00, 0x01,
+	IoCap:       IoCapsKeyboardDisplay,
+	OobFlag:     byte(OobNotPresent),
+	AuthReq:     AuthReqBonding | AuthReqSC,
+	MaxKeySize:  16,
+	InitKeyDist: 0x06,
+	RespKeyDist: 0x07,
 }
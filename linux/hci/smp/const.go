@@ -24,4 +24,25 @@ const (
 	authReqBondMask = byte(0x03)
 	authReqBond     = byte(0x01)
 	authReqNoBond   = byte(0x00)
+
+	minKeySize = 7
+
+	keyDistEncKey  = byte(0x01)
+	keyDistIdKey   = byte(0x02)
+	keyDistSignKey = byte(0x04)
+)
+
+//Core spec v5.0, Vol 3, Part H, 3.5.5, Table 3.7
+const (
+	reasonPasskeyEntryFailed  = 0x01
+	reasonOobNotAvailable     = 0x02
+	reasonAuthRequirements    = 0x03
+	reasonConfirmValueFailed  = 0x04
+	reasonPairingNotSupported = 0x05
+	reasonEncryptionKeySize   = 0x06
+	reasonCommandNotSupported = 0x07
+	reasonUnspecified         = 0x08
+	reasonInvalidParameters   = 0x0a
+	reasonDHKeyCheckFailed    = 0x0b
+	reasonNumericComparison   = 0x0c
 )
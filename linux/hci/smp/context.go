@@ -7,6 +7,7 @@ import (
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
+	"strings"
 
 	"github.com/rigado/ble"
 	"github.com/rigado/ble/linux/hci"
@@ -35,10 +36,16 @@ type pairingContext struct {
 	remoteRandom   []byte
 	remoteConfirm  []byte
 
+	remoteIRK              []byte
+	remoteIdentityAddr     []byte
+	remoteIdentityAddrType byte
+	remoteCSRK             []byte
+
 	localAddr     []byte
 	localAddrType byte
 	localRandom   []byte
 	localConfirm  []byte
+	localCSRK     []byte
 
 	scECDHKeys         *ECDHKeys
 	scMacKey           []byte
@@ -46,9 +53,22 @@ type pairingContext struct {
 	scDHKey            []byte
 	scRemoteDHKeyCheck []byte
 
+	//out of band data of secure connections pairing, the random values are 0
+	//unless exchanged
+	localOOB         *oobSource
+	localOOBRandom   []byte
+	remoteOOBRandom  []byte
+	remoteOOBConfirm []byte
+
 	legacy       bool
 	shortTermKey []byte
 
+	// responder is set when the remote device initiated pairing
+	responder bool
+
+	// expectedKeys holds the key distribution bits not yet received from the remote device
+	expectedKeys byte
+
 	passKeyIteration int
 
 	pairingType int
@@ -56,6 +76,10 @@ type pairingContext struct {
 	authData    ble.AuthData
 	bond        hci.BondInfo
 
+	//agent interacts with the user, if set
+	agent  ble.PairingAgent
+	scOnly bool
+
 	ble.Logger
 }
 
@@ -151,6 +175,11 @@ func (p *pairingContext) calcMacLtk() error {
 	na := p.localRandom
 	nb := p.remoteRandom
 
+	if p.responder {
+		la, ra = ra, la
+		na, nb = nb, na
+	}
+
 	mk, ltk, err := smpF5(p.scDHKey, na, nb, la, ra)
 	if err != nil {
 		return err
@@ -171,7 +200,8 @@ func (p *pairingContext) checkDHKeyCheck() error {
 	na := p.localRandom
 	nb := p.remoteRandom
 
-	ioCap := sliceops.SwapBuf([]byte{p.response.AuthReq, p.response.OobFlag, p.response.IoCap})
+	rc := p.remoteConfig()
+	ioCap := sliceops.SwapBuf([]byte{rc.AuthReq, rc.OobFlag, rc.IoCap})
 
 	ra := make([]byte, 16)
 	if p.pairingType == Passkey {
@@ -185,8 +215,7 @@ func (p *pairingContext) checkDHKeyCheck() error {
 		//swap to little endian
 		ra = sliceops.SwapBuf(ra)
 	} else if p.pairingType == Oob {
-		ra = p.authData.OOBData
-		//todo: does this need to be swapped?
+		ra = p.localOOBRandom
 	}
 
 	dhKeyCheck, err := smpF6(p.scMacKey, nb, na, ra, ioCap, rAddr, la)
@@ -222,22 +251,7 @@ func (p *pairingContext) generateDHKey() error {
 }
 
 func (p *pairingContext) checkLegacyConfirm() error {
-	preq := buildPairingReq(p.request)
-	pres := buildPairingRsp(p.response)
-	la := p.localAddr
-	ra := p.remoteAddr
-	sRand := p.remoteRandom
-
-	k := make([]byte, 16)
-	if p.pairingType == Passkey {
-		k = getLegacyParingTK(p.authData.Passkey)
-	}
-	c1, err := smpC1(k, sRand, preq, pres,
-		p.localAddrType,
-		p.remoteAddrType,
-		la,
-		ra,
-	)
+	c1, err := p.legacyConfirm(p.remoteRandom)
 	if err != nil {
 		return err
 	}
@@ -251,3 +265,139 @@ func (p *pairingContext) checkLegacyConfirm() error {
 
 	return nil
 }
+
+//legacyConfirm calculates the legacy confirm value for the random value r
+//Core spec v5.0, Vol 3, Part H, 2.3.5.5
+func (p *pairingContext) legacyConfirm(r []byte) ([]byte, error) {
+	preq := buildPairingReq(p.request)
+	pres := buildPairingRsp(p.response)
+	iat, ia := p.initiatorAddr()
+	rat, ra := p.responderAddr()
+
+	k := make([]byte, 16)
+	if p.pairingType == Passkey {
+		k = getLegacyParingTK(p.authData.Passkey)
+	}
+
+	return smpC1(k, r, preq, pres, iat, rat, ia, ra)
+}
+
+func (p *pairingContext) initiatorAddr() (byte, []byte) {
+	if p.responder {
+		return p.remoteAddrType, p.remoteAddr
+	}
+	return p.localAddrType, p.localAddr
+}
+
+func (p *pairingContext) responderAddr() (byte, []byte) {
+	if p.responder {
+		return p.localAddrType, p.localAddr
+	}
+	return p.remoteAddrType, p.remoteAddr
+}
+
+//localConfig returns the pairing parameters sent by the local device
+func (p *pairingContext) localConfig() hci.SmpConfig {
+	if p.responder {
+		return p.response
+	}
+	return p.request
+}
+
+//remoteConfig returns the pairing parameters sent by the remote device
+func (p *pairingContext) remoteConfig() hci.SmpConfig {
+	if p.responder {
+		return p.request
+	}
+	return p.response
+}
+
+//bonding reports whether the keys generated during pairing should be stored
+func (p *pairingContext) bonding() bool {
+	if p.request.AuthReq&authReqBondMask != authReqBond {
+		return false
+	}
+
+	//as the responder, bonding is only done if both sides agreed to it
+	return !p.responder || p.response.AuthReq&authReqBondMask == authReqBond
+}
+
+//localKeyDist returns the keys to be distributed by the local device
+func (p *pairingContext) localKeyDist() byte {
+	if p.responder {
+		return p.keyDist(p.response.RespKeyDist)
+	}
+	return p.keyDist(p.response.InitKeyDist)
+}
+
+//remoteKeyDist returns the keys to be distributed by the remote device
+func (p *pairingContext) remoteKeyDist() byte {
+	if p.responder {
+		return p.keyDist(p.response.InitKeyDist)
+	}
+	return p.keyDist(p.response.RespKeyDist)
+}
+
+func (p *pairingContext) keyDist(kd byte) byte {
+	//the LTK is generated during secure connections pairing
+	if !p.legacy {
+		kd &^= keyDistEncKey
+	}
+
+	return kd
+}
+
+//passkeyDisplayed reports whether the local device displays the passkey the
+//user enters on the remote device, rather than the user entering it
+//Core spec v5.0, Vol 3, Part H, 2.3.5.1, Table 2.8
+func (p *pairingContext) passkeyDisplayed() bool {
+	switch p.localConfig().IoCap {
+	case hci.IoCapsDisplayOnly, hci.IoCapsDisplayYesNo:
+		return true
+	case hci.IoCapsKeyboardDisplay:
+		switch p.remoteConfig().IoCap {
+		case hci.IoCapsKeyboardOnly:
+			return true
+		case hci.IoCapsKeyboardDisplay:
+			//the initiator displays, the responder inputs
+			return !p.responder
+		}
+	}
+	return false
+}
+
+//numericComparisonValue returns the value both devices display for the user to
+//compare, g2(PKax, PKbx, Na, Nb)
+//Core spec v5.0, Vol 3, Part H, 2.3.5.6.2
+func (p *pairingContext) numericComparisonValue() (uint32, error) {
+	pka := MarshalPublicKeyX(p.scECDHKeys.public)
+	pkb := MarshalPublicKeyX(p.scRemotePubKey)
+	na := append([]byte{}, p.localRandom...)
+	nb := append([]byte{}, p.remoteRandom...)
+
+	if p.responder {
+		pka, pkb = pkb, pka
+		na, nb = nb, na
+	}
+
+	return smpG2(pka, pkb, na, nb)
+}
+
+//remoteDevice returns the address of the remote device, for the agent
+func (p *pairingContext) remoteDevice() ble.Addr {
+	a := sliceops.SwapBuf(p.remoteAddr)
+	s := make([]string, len(a))
+	for i, b := range a {
+		s[i] = hex.EncodeToString([]byte{b})
+	}
+	return ble.NewAddr(strings.Join(s, ":"))
+}
+
+//bondKey returns the bond manager key for the remote device, which is its
+//identity address when the device uses resolvable private addresses
+func (p *pairingContext) bondKey() string {
+	if len(p.remoteIdentityAddr) != 0 {
+		return hex.EncodeToString(p.remoteIdentityAddr)
+	}
+	return hex.EncodeToString(p.remoteAddr)
+}
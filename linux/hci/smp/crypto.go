@@ -1,6 +1,7 @@
 package smp
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 
@@ -172,3 +173,67 @@ func smpS1(k, r1, r2 []byte) ([]byte, error) {
 
 	return out, nil
 }
+
+//smpAh: From Bluetooth Core Spec 5.0: Part H, Section 2, 2.2.2
+func smpAh(k, r []byte) ([]byte, error) {
+	switch {
+	case len(k) != 16:
+		return nil, fmt.Errorf("ah: invalid length for k: %d", len(k))
+	case len(r) != 3:
+		return nil, fmt.Errorf("ah: invalid length for r: %d", len(r))
+	}
+
+	//r' = padding || r
+	rp := make([]byte, 16)
+	copy(rp, r)
+
+	out, err := smpE(k, rp)
+	if err != nil {
+		return nil, fmt.Errorf("failed to encrypt r in ah: %s", err)
+	}
+
+	return out[:3], nil
+}
+
+//smpSign: From Bluetooth Core Spec 5.0: Part H, Section 2, 2.4.5
+//returns the signature, SignCounter || MAC
+func smpSign(csrk, m []byte, counter uint32) ([]byte, error) {
+	if len(csrk) != 16 {
+		return nil, fmt.Errorf("sign: invalid length for csrk: %d", len(csrk))
+	}
+
+	//the sign counter is appended to the message
+	msg := make([]byte, len(m), len(m)+4)
+	copy(msg, m)
+	msg = binary.LittleEndian.AppendUint32(msg, counter)
+
+	mac, err := aesCMAC(csrk, msg)
+	if err != nil {
+		return nil, err
+	}
+
+	//the MAC is the 64 most significant bits of the CMAC output
+	sig := binary.LittleEndian.AppendUint32(make([]byte, 0, 12), counter)
+	return append(sig, mac[8:]...), nil
+}
+
+//ResolvePrivateAddress reports whether addr is a resolvable private address
+//generated with irk. Both are in little endian order.
+//Core spec v5.0, Vol 6, Part B, 1.3.2.3
+func ResolvePrivateAddress(irk, addr []byte) bool {
+	if len(irk) != 16 || len(addr) != 6 {
+		return false
+	}
+
+	//the two most significant bits of a resolvable private address are 0b01
+	if addr[5]&0xc0 != 0x40 {
+		return false
+	}
+
+	hash, err := smpAh(irk, addr[3:])
+	if err != nil {
+		return false
+	}
+
+	return bytes.Equal(hash, addr[:3])
+}
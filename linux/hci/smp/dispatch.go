@@ -1,20 +1,20 @@
 package smp
 
 var dispatcher = map[byte]smpDispatcher{
-	//pairingRequest:        {"pairing request", smpOnPairingRequest},
+	pairingRequest:          {"pairing request", smpOnPairingRequest},
 	pairingResponse:         {"pairing response", smpOnPairingResponse},
 	pairingConfirm:          {"pairing confirm", smpOnPairingConfirm},
 	pairingRandom:           {"pairing random", smpOnPairingRandom},
 	pairingFailed:           {"pairing failed", smpOnPairingFailed},
 	encryptionInformation:   {"encryption info", smpOnEncryptionInformation},
 	masterIdentification:    {"master id", smpOnMasterIdentification},
-	identityInformation:     {"id info", nil},
-	identityAddrInformation: {"id addr info", nil},
-	signingInformation:      {"signing info", nil},
+	identityInformation:     {"id info", smpOnIdentityInformation},
+	identityAddrInformation: {"id addr info", smpOnIdentityAddrInformation},
+	signingInformation:      {"signing info", smpOnSigningInformation},
 	securityRequest:         {"security req", smpOnSecurityRequest},
 	pairingPublicKey:        {"pairing pub key", smpOnPairingPublicKey},
 	pairingDHKeyCheck:       {"pairing dhkey check", smpOnDHKeyCheck},
-	pairingKeypress:         {"pairing keypress", nil},
+	pairingKeypress:         {"pairing keypress", smpOnPairingKeypress},
 }
 
 //Core spec v5.0, Vol 3, Part H, 3.5.5, Table 3.7
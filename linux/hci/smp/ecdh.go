@@ -4,6 +4,7 @@ import (
 	"crypto"
 	"crypto/elliptic"
 	"crypto/rand"
+	"fmt"
 
 	"github.com/rigado/ble/sliceops"
 	"github.com/wsddn/go-ecdh"
@@ -67,6 +68,15 @@ func MarshalPublicKeyX(k crypto.PublicKey) []byte {
 func GenerateSecret(prv crypto.PrivateKey, pub crypto.PublicKey) ([]byte, error) {
 	e := ecdh.NewEllipticECDH(elliptic.P256())
 	b, err := e.GenerateSharedSecret(prv, pub)
-	b = sliceops.SwapBuf(b)
-	return b, err
+	if err != nil {
+		return nil, err
+	}
+	if len(b) > 32 {
+		return nil, fmt.Errorf("invalid dhkey length %v", len(b))
+	}
+
+	//the secret comes without its leading zeros, the dhkey is 32 bytes long
+	s := make([]byte, 32)
+	copy(s[32-len(b):], b)
+	return sliceops.SwapBuf(s), nil
 }
@@ -0,0 +1,49 @@
+package smp
+
+import (
+	"bytes"
+	"crypto/elliptic"
+	"testing"
+
+	"github.com/rigado/ble/sliceops"
+	"github.com/wsddn/go-ecdh"
+)
+
+func TestGenerateSecretPadding(t *testing.T) {
+	//about 1 in 256 secrets has a leading zero byte
+	e := ecdh.NewEllipticECDH(elliptic.P256())
+	for i := 0; i < 10000; i++ {
+		a, err := GenerateKeys()
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := GenerateKeys()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		raw, err := e.GenerateSharedSecret(a.private, b.public)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(raw) == 32 {
+			continue
+		}
+
+		s, err := GenerateSecret(a.private, b.public)
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := append(make([]byte, 32-len(raw)), raw...)
+		if !bytes.Equal(s, sliceops.SwapBuf(want)) {
+			t.Fatalf("dhkey %x, want %x", s, sliceops.SwapBuf(want))
+		}
+
+		//f5 takes the short secret too
+		if _, _, err := smpF5(s, make([]byte, 16), make([]byte, 16), make([]byte, 7), make([]byte, 7)); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	t.Fatal("no short secret generated")
+}
@@ -6,17 +6,25 @@ import (
 )
 
 type factory struct {
-	bm hci.BondManager
+	bm  hci.BondManager
+	oob *oobSource
 }
 
 func NewSmpFactory(bm hci.BondManager) *factory {
-	return &factory{bm}
+	return &factory{bm: bm, oob: &oobSource{}}
 }
 
 func (f *factory) Create(config hci.SmpConfig, l ble.Logger) hci.SmpManager {
-	return NewSmpManager(config, f.bm, l)
+	m := NewSmpManager(config, f.bm, l)
+	m.pairing.localOOB = f.oob
+	return m
 }
 
 func (f *factory) SetBondManager(bm hci.BondManager) {
 	f.bm = bm
 }
+
+// LocalOOBData generates the out of band data used by the following pairings
+func (f *factory) LocalOOBData() (ble.OOBData, error) {
+	return f.oob.generate()
+}
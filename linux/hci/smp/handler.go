@@ -2,28 +2,108 @@ package smp
 
 import (
 	"bytes"
+	"crypto/rand"
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 
+	"github.com/rigado/ble"
 	"github.com/rigado/ble/linux/hci"
 )
 
-//func smpOnPairingRequest(c *Conn, in pdu) ([]byte, error) {
-//	if len(in) < 6 {
-//		return nil, fmt.Errorf("%v, invalid length %v", hex.EncodeToString(in), len(in))
-//	}
-//
-//	rx := smpConfig{}
-//	rx.ioCap = in[0]
-//	rx.oobFlag = in[1]
-//	rx.authReq = in[2]
-//	rx.maxKeySz = in[3]
-//	rx.initKeyDist = in[4]
-//	rx.respKeyDist = in[5]
-//
-//	return nil, nil
-//}
+func smpOnPairingRequest(t *transport, in pdu) ([]byte, error) {
+	if len(in) < 6 {
+		return nil, fmt.Errorf("%v, invalid length %v", hex.EncodeToString(in), len(in))
+	}
+
+	rx := hci.SmpConfig{}
+	rx.IoCap = in[0]
+	rx.OobFlag = in[1]
+	rx.AuthReq = in[2]
+	rx.MaxKeySize = in[3]
+	rx.InitKeyDist = in[4]
+	rx.RespKeyDist = in[5]
+
+	//until the remote initiates pairing, the request holds the local config
+	local := t.pairing.request
+
+	rsp := hci.SmpConfig{}
+	rsp.IoCap = local.IoCap
+	rsp.OobFlag = local.OobFlag
+	rsp.AuthReq = local.AuthReq
+	rsp.MaxKeySize = local.MaxKeySize
+	rsp.InitKeyDist = rx.InitKeyDist & local.InitKeyDist
+	rsp.RespKeyDist = rx.RespKeyDist & local.RespKeyDist
+
+	//only bond if the initiator asked for it
+	if rx.AuthReq&authReqBondMask != authReqBond {
+		rsp.AuthReq &^= authReqBondMask
+		rsp.InitKeyDist = 0
+		rsp.RespKeyDist = 0
+	}
+
+	t.pairing.responder = true
+	t.pairing.request = rx
+	t.pairing.response = rsp
+	t.pairing.localRandom = nil
+	t.pairing.passKeyIteration = 0
+
+	//shortened keys are not supported
+	if rx.MaxKeySize < minKeySize || rx.MaxKeySize < local.MaxKeySize {
+		t.pairing.state = Error
+		t.sendPairingFailed(reasonEncryptionKeySize)
+		return nil, fmt.Errorf("unsupported max key size %v", rx.MaxKeySize)
+	}
+
+	t.pairing.legacy = isLegacy(rx.AuthReq) || isLegacy(rsp.AuthReq)
+	t.pairing.pairingType = determinePairingType(t)
+	t.pairing.expectedKeys = t.pairing.remoteKeyDist()
+
+	pts, ok := pairingTypeStrings[t.pairing.pairingType]
+	if !ok {
+		return nil, fmt.Errorf("invalid pairing type %v", t.pairing.pairingType)
+	}
+	t.Infof("smpOnPairingRequest: detected pairing type '%v'", pts)
+
+	if t.pairing.legacy && t.pairing.pairingType == Oob &&
+		len(t.pairing.authData.OOBData) == 0 {
+		t.pairing.state = Error
+		t.sendPairingFailed(reasonOobNotAvailable)
+		return nil, fmt.Errorf("pairing requires OOB data but OOB data not specified")
+	}
+
+	if err := t.checkRequirements(); err != nil {
+		t.pairing.state = Error
+		return nil, err
+	}
+
+	if !t.pairing.legacy {
+		keys, err := GenerateKeys()
+		if err != nil {
+			return nil, err
+		}
+		t.pairing.scECDHKeys = keys
+	}
+
+	if err := t.pairing.setupOOB(); err != nil {
+		t.pairing.state = Error
+		t.sendPairingFailed(reasonOobNotAvailable)
+		return nil, err
+	}
+
+	if err := t.sendPairingResponse(); err != nil {
+		return nil, err
+	}
+
+	if t.pairing.legacy {
+		t.pairing.state = WaitConfirm
+	} else {
+		t.pairing.state = WaitPublicKey
+	}
+
+	//the passkey is set once the initiator got the response, and may display its own
+	return nil, t.setupPasskey(func() error { return nil })
+}
 
 func smpOnPairingResponse(t *transport, in pdu) ([]byte, error) {
 	if len(in) < 6 {
@@ -44,6 +124,7 @@ func smpOnPairingResponse(t *transport, in pdu) ([]byte, error) {
 
 	t.pairing.legacy = isLegacy(rx.AuthReq)
 	t.pairing.pairingType = determinePairingType(t)
+	t.pairing.expectedKeys = t.pairing.remoteKeyDist()
 
 	pts, ok := pairingTypeStrings[t.pairing.pairingType]
 	if !ok {
@@ -51,17 +132,29 @@ func smpOnPairingResponse(t *transport, in pdu) ([]byte, error) {
 	}
 	t.Infof("smpOnPairingResponse: detected pairing type '%v'", pts)
 
-	if t.pairing.pairingType == Oob &&
+	if t.pairing.legacy && t.pairing.pairingType == Oob &&
 		len(t.pairing.authData.OOBData) == 0 {
 		t.pairing.state = Error
 		return nil, fmt.Errorf("pairing requires OOB data but OOB data not specified")
 	}
 
-	if t.pairing.legacy {
-		return nil, t.sendMConfirm()
+	if err := t.pairing.setupOOB(); err != nil {
+		t.pairing.state = Error
+		t.sendPairingFailed(reasonOobNotAvailable)
+		return nil, err
 	}
 
-	return nil, t.sendPublicKey()
+	if err := t.checkRequirements(); err != nil {
+		return nil, err
+	}
+
+	return nil, t.setupPasskey(func() error {
+		if t.pairing.legacy {
+			return t.sendMConfirm()
+		}
+
+		return t.sendPublicKey()
+	})
 }
 
 func smpOnPairingConfirm(t *transport, in pdu) ([]byte, error) {
@@ -75,6 +168,10 @@ func smpOnPairingConfirm(t *transport, in pdu) ([]byte, error) {
 
 	t.pairing.remoteConfirm = in
 
+	if t.pairing.responder {
+		return nil, onResponderConfirm(t)
+	}
+
 	err := t.sendPairingRandom()
 	if err != nil {
 		return nil, err
@@ -94,6 +191,10 @@ func smpOnPairingRandom(t *transport, in pdu) ([]byte, error) {
 
 	t.pairing.remoteRandom = in
 
+	if t.pairing.responder {
+		return nil, onResponderRandom(t)
+	}
+
 	//conf check
 	if t.pairing.legacy {
 		return onLegacyRandom(t)
@@ -112,7 +213,8 @@ func onSecureRandom(t *transport) ([]byte, error) {
 		if more {
 			return nil, nil
 		}
-	} else {
+	} else if t.pairing.pairingType != Oob {
+		//out of band data has no confirm value, it is checked with the public key
 		err := t.pairing.checkConfirm()
 		if err != nil {
 			t.Errorf("smpOnSecureRandom: checkConfirm - %v", err)
@@ -120,23 +222,23 @@ func onSecureRandom(t *transport) ([]byte, error) {
 		}
 	}
 
-	// TODO
-	// here we would do the compare from g2(...) but this is just works only for now
-	// move on to auth stage 2 (2.3.5.6.5) calc mackey, ltk
-	err := t.pairing.calcMacLtk()
-	if err != nil {
-		t.Errorf("smpOnSecureRandom: calcMacLtk - %v", err)
-		return nil, err
-	}
+	return nil, t.confirmNumericComparison(func() error {
+		// move on to auth stage 2 (2.3.5.6.5) calc mackey, ltk
+		err := t.pairing.calcMacLtk()
+		if err != nil {
+			t.Errorf("smpOnSecureRandom: calcMacLtk - %v", err)
+			return err
+		}
 
-	//send dhkey check
-	err = t.sendDHKeyCheck()
-	if err != nil {
-		t.Errorf("smpOnSecureRandom: sendDHKeyCheck - %v", err)
-		return nil, err
-	}
+		//send dhkey check
+		err = t.sendDHKeyCheck()
+		if err != nil {
+			t.Errorf("smpOnSecureRandom: sendDHKeyCheck - %v", err)
+			return err
+		}
 
-	return nil, nil
+		return nil
+	})
 }
 
 func onLegacyRandom(t *transport) ([]byte, error) {
@@ -161,15 +263,87 @@ func onLegacyRandom(t *transport) ([]byte, error) {
 		return nil, err
 	}
 	t.pairing.shortTermKey = stk
-
-	if t.pairing.request.AuthReq&authReqBondMask == authReqNoBond {
-		t.pairing.state = Finished
-	}
+	t.pairing.state = WaitEncryption
 
 	err = t.encrypter.Encrypt()
 	return nil, err
 }
 
+func onResponderConfirm(t *transport) error {
+	if t.pairing.legacy {
+		return t.sendSConfirm()
+	}
+
+	if t.pairing.pairingType == Passkey {
+		continuePassKeyPairing(t)
+		t.pairing.state = WaitRandom
+		return nil
+	}
+
+	return fmt.Errorf("unexpected pairing confirm")
+}
+
+func onResponderRandom(t *transport) error {
+	if t.pairing.legacy {
+		err := t.pairing.checkLegacyConfirm()
+		if err != nil {
+			t.sendPairingFailed(reasonConfirmValueFailed)
+			return err
+		}
+
+		//calculate STK
+		k := getLegacyParingTK(0)
+		if t.pairing.pairingType == Passkey {
+			k = getLegacyParingTK(t.pairing.authData.Passkey)
+		}
+
+		stk, err := smpS1(k, t.pairing.localRandom, t.pairing.remoteRandom)
+		if err != nil {
+			return err
+		}
+		t.pairing.shortTermKey = stk
+
+		//the initiator starts encryption with the STK once it has our random
+		t.pairing.state = WaitEncryption
+		return t.send(append([]byte{pairingRandom}, t.pairing.localRandom...))
+	}
+
+	if t.pairing.pairingType == Passkey {
+		err := t.pairing.checkPasskeyConfirm()
+		if err != nil {
+			t.sendPairingFailed(reasonConfirmValueFailed)
+			return err
+		}
+
+		err = t.sendPairingRandom()
+		if err != nil {
+			return err
+		}
+
+		t.pairing.passKeyIteration++
+		if t.pairing.passKeyIteration < passkeyIterationCount {
+			t.pairing.state = WaitConfirm
+			return nil
+		}
+	} else {
+		err := t.sendPairingRandom()
+		if err != nil {
+			return err
+		}
+	}
+
+	return t.confirmNumericComparison(func() error {
+		err := t.pairing.calcMacLtk()
+		if err != nil {
+			t.Errorf("onResponderRandom: calcMacLtk - %v", err)
+			return err
+		}
+
+		t.pairing.state = WaitDhKeyCheck
+		return nil
+	})
+}
+
 func smpOnPairingPublicKey(t *transport, in pdu) ([]byte, error) {
 	if t.pairing == nil {
 		return nil, fmt.Errorf("no pairing context")
@@ -194,12 +368,48 @@ func smpOnPairingPublicKey(t *transport, in pdu) ([]byte, error) {
 
 	t.pairing.scRemotePubKey = pubk
 
-	if t.pairing.pairingType == Passkey {
+	if t.pairing.pairingType == Oob {
+		err := t.pairing.checkOOBConfirm()
+		if err != nil {
+			t.pairing.state = Error
+			t.sendPairingFailed(reasonConfirmValueFailed)
+			return nil, err
+		}
+	}
+
+	if t.pairing.responder {
+		return nil, onResponderPublicKey(t)
+	}
+
+	switch t.pairing.pairingType {
+	case Passkey:
 		startPassKeyPairing(t)
+	case Oob:
+		//the initiator sends the first random value
+		return nil, t.sendPairingRandom()
 	}
 	return nil, nil
 }
 
+func onResponderPublicKey(t *transport) error {
+	err := t.sendPublicKey()
+	if err != nil {
+		return err
+	}
+
+	switch t.pairing.pairingType {
+	case Passkey:
+		//the initiator sends the first confirm value
+		t.pairing.state = WaitConfirm
+		return nil
+	case Oob:
+		t.pairing.state = WaitRandom
+		return nil
+	}
+
+	return t.sendSecureConfirm()
+}
+
 func smpOnDHKeyCheck(t *transport, in pdu) ([]byte, error) {
 	if t.pairing == nil {
 		return nil, fmt.Errorf("no pairing context")
@@ -209,17 +419,20 @@ func smpOnDHKeyCheck(t *transport, in pdu) ([]byte, error) {
 	err := t.pairing.checkDHKeyCheck()
 	if err != nil {
 		//dhkeycheck failed!
+		if t.pairing.responder {
+			t.sendPairingFailed(reasonDHKeyCheckFailed)
+		}
 		return nil, err
 	}
 
 	t.Debugf("dhKeyCheck: OK")
-	err = t.saveBondInfo()
-	if err != nil {
-		return nil, err
+
+	if t.pairing.responder {
+		return nil, t.sendDHKeyCheck()
 	}
 
-	//at this point, the pairing is complete
-	t.pairing.state = Finished
+	//pairing completes after key distribution on the encrypted link
+	t.pairing.state = WaitEncryption
 
 	//todo: separate this out
 	return nil, t.encrypter.Encrypt()
@@ -235,6 +448,20 @@ func smpOnPairingFailed(t *transport, in pdu) ([]byte, error) {
 	return nil, fmt.Errorf("pairing failed: %s", reason)
 }
 
+//smpOnPairingKeypress notifies the agent of the keys pressed on the remote
+//device during passkey entry
+func smpOnPairingKeypress(t *transport, in pdu) ([]byte, error) {
+	if len(in) != 1 {
+		return nil, fmt.Errorf("%v, invalid length %v", hex.EncodeToString(in), len(in))
+	}
+
+	if t.pairing.agent != nil {
+		t.pairing.agent.Keypress(t.pairing.remoteDevice(), ble.KeypressType(in[0]))
+	}
+
+	return nil, nil
+}
+
 func smpOnSecurityRequest(t *transport, in pdu) ([]byte, error) {
 	if len(in) < 1 {
 		return nil, fmt.Errorf("%v, invalid length %v", hex.EncodeToString(in), len(in))
@@ -245,8 +472,7 @@ func smpOnSecurityRequest(t *transport, in pdu) ([]byte, error) {
 	rx.AuthReq = in[0]
 
 	if (rx.AuthReq & authReqBondMask) == authReqBond {
-		ra := hex.EncodeToString(t.pairing.remoteAddr)
-		bi, err := t.bondManager.Find(ra)
+		bi, err := t.bondManager.Find(t.pairing.bondKey())
 		if err == nil {
 			t.pairing.bond = bi
 			return nil, t.encrypter.Encrypt()
@@ -262,6 +488,10 @@ func smpOnSecurityRequest(t *transport, in pdu) ([]byte, error) {
 }
 
 func smpOnEncryptionInformation(t *transport, in pdu) ([]byte, error) {
+	if len(in) != 16 {
+		return nil, fmt.Errorf("%v, invalid length %v", hex.EncodeToString(in), len(in))
+	}
+
 	//need to save the ltk, ediv, and rand to a file
 	t.pairing.bond = hci.NewBondInfo(in, 0, 0, true)
 
@@ -269,6 +499,10 @@ func smpOnEncryptionInformation(t *transport, in pdu) ([]byte, error) {
 }
 
 func smpOnMasterIdentification(t *transport, in pdu) ([]byte, error) {
+	if len(in) != 10 || t.pairing.bond == nil {
+		return nil, fmt.Errorf("%v, invalid master identification", hex.EncodeToString(in))
+	}
+
 	data := []byte(in)
 	ediv := binary.LittleEndian.Uint16(data[:2])
 	randVal := binary.LittleEndian.Uint64(data[2:])
@@ -276,14 +510,131 @@ func smpOnMasterIdentification(t *transport, in pdu) ([]byte, error) {
 	ltk := t.pairing.bond.LongTermKey()
 	t.pairing.bond = hci.NewBondInfo(ltk, ediv, randVal, true)
 
-	if err := t.saveBondInfo(); err != nil {
-		return nil, err
+	return nil, t.keyReceived(keyDistEncKey)
+}
+
+func smpOnIdentityInformation(t *transport, in pdu) ([]byte, error) {
+	if len(in) != 16 {
+		return nil, fmt.Errorf("%v, invalid length %v", hex.EncodeToString(in), len(in))
 	}
 
-	t.pairing.state = Finished
+	t.pairing.remoteIRK = append([]byte{}, in...)
+
 	return nil, nil
 }
 
+func smpOnIdentityAddrInformation(t *transport, in pdu) ([]byte, error) {
+	if len(in) != 7 {
+		return nil, fmt.Errorf("%v, invalid length %v", hex.EncodeToString(in), len(in))
+	}
+
+	t.pairing.remoteIdentityAddrType = in[0]
+	t.pairing.remoteIdentityAddr = append([]byte{}, in[1:]...)
+
+	return nil, t.keyReceived(keyDistIdKey)
+}
+
+func smpOnSigningInformation(t *transport, in pdu) ([]byte, error) {
+	if len(in) != 16 {
+		return nil, fmt.Errorf("%v, invalid length %v", hex.EncodeToString(in), len(in))
+	}
+
+	t.pairing.remoteCSRK = append([]byte{}, in...)
+
+	return nil, t.keyReceived(keyDistSignKey)
+}
+
+//checkRequirements fails pairing if the pairing method doesn't meet the local
+//MITM protection or secure connections only requirements
+func (t *transport) checkRequirements() error {
+	p := t.pairing
+	var err error
+	switch {
+	case p.scOnly && p.legacy:
+		err = fmt.Errorf("legacy pairing refused, secure connections only")
+	case p.localConfig().AuthReq&hci.AuthReqMITM != 0 && p.pairingType == JustWorks:
+		err = fmt.Errorf("just works pairing refused, mitm protection required")
+	}
+
+	if err != nil {
+		t.sendPairingFailed(reasonAuthRequirements)
+	}
+	return err
+}
+
+//setupPasskey sets the passkey of passkey entry pairing with the agent, if any,
+//then continues with next; the passkey is either generated and displayed, or
+//entered by the user
+func (t *transport) setupPasskey(next func() error) error {
+	p := t.pairing
+	if p.pairingType != Passkey || p.agent == nil {
+		return next()
+	}
+
+	addr := p.remoteDevice()
+	if p.passkeyDisplayed() {
+		b := make([]byte, 4)
+		if _, err := rand.Read(b); err != nil {
+			return err
+		}
+		passkey := binary.LittleEndian.Uint32(b) % 1000000
+		p.authData.Passkey = int(passkey)
+		p.agent.DisplayPasskey(addr, passkey)
+		return next()
+	}
+
+	var passkey uint32
+	return t.askAgent(func() (err error) {
+		passkey, err = p.agent.RequestPasskey(addr)
+		return err
+	}, func(err error) error {
+		if err == nil && passkey > 999999 {
+			err = fmt.Errorf("invalid passkey %v", passkey)
+		}
+		if err != nil {
+			t.sendPairingFailed(reasonPasskeyEntryFailed)
+			return fmt.Errorf("passkey entry failed: %v", err)
+		}
+		p.authData.Passkey = int(passkey)
+		return next()
+	})
+}
+
+//confirmNumericComparison has the user confirm both devices display the same
+//value, then continues with next; pairing fails if there is no agent
+func (t *transport) confirmNumericComparison(next func() error) error {
+	p := t.pairing
+	if p.pairingType != NumericComp {
+		return next()
+	}
+
+	if p.agent == nil {
+		t.sendPairingFailed(reasonNumericComparison)
+		return fmt.Errorf("numeric comparison failed: no pairing agent")
+	}
+
+	v, err := p.numericComparisonValue()
+	if err != nil {
+		return err
+	}
+
+	addr := p.remoteDevice()
+	var ok bool
+	return t.askAgent(func() (err error) {
+		ok, err = p.agent.ConfirmNumericComparison(addr, v)
+		return err
+	}, func(err error) error {
+		if err == nil && !ok {
+			err = fmt.Errorf("rejected by the user")
+		}
+		if err != nil {
+			t.sendPairingFailed(reasonNumericComparison)
+			return fmt.Errorf("numeric comparison failed: %v", err)
+		}
+		return next()
+	})
+}
+
 func handlePassKeyRandom(t *transport) (bool, error) {
 	err := t.pairing.checkPasskeyConfirm()
 	if err != nil {
@@ -338,11 +689,14 @@ func determinePairingType(t *transport) int {
 	req := t.pairing.request
 	rsp := t.pairing.response
 
-	if req.OobFlag == 0x01 && rsp.OobFlag == 0x01 && t.pairing.legacy {
-		return Oob
-	}
-
-	if req.OobFlag == 0x01 || rsp.OobFlag == 0x01 {
+	//legacy pairing needs the data of both devices, secure connections the data
+	//of either
+	//Core spec v5.0, Vol 3, Part H, 2.3.5.1
+	if t.pairing.legacy {
+		if req.OobFlag == 0x01 && rsp.OobFlag == 0x01 {
+			return Oob
+		}
+	} else if req.OobFlag == 0x01 || rsp.OobFlag == 0x01 {
 		return Oob
 	}
 
@@ -1,8 +1,10 @@
 package smp
 
 import (
-	"encoding/hex"
+	"crypto/subtle"
+	"encoding/binary"
 	"fmt"
+	"sync"
 	"time"
 
 	"github.com/rigado/ble"
@@ -19,6 +21,8 @@ const (
 	WaitConfirm
 	WaitRandom
 	WaitDhKeyCheck
+	WaitEncryption
+	WaitKeyDistribution
 	Finished
 	Error
 )
@@ -30,21 +34,41 @@ type manager struct {
 	bondManager hci.BondManager
 	encrypt     func(info hci.BondInfo) error
 	result      chan error
+	mu          sync.Mutex
+
+	//the pdus received while the agent waits for the user are queued
+	waitingAgent bool
+	agentSeq     int
+	queued       [][]byte
+
 	ble.Logger
 }
 
 //todo: need to have on instance per connection which requires a mutex in the bond manager
 //todo: remove bond manager from input parameters?
 func NewSmpManager(config hci.SmpConfig, bm hci.BondManager, l ble.Logger) *manager {
-	p := &pairingContext{request: config, state: Init, Logger: l}
-	m := &manager{config: config, pairing: p, bondManager: bm, result: make(chan error), Logger: l}
+	p := &pairingContext{request: config, state: Init, agent: config.Agent, scOnly: config.SecureConnectionsOnly, Logger: l}
+	m := &manager{config: config, pairing: p, bondManager: bm, result: make(chan error, 1), Logger: l}
+	p.request.IoCap = m.ioCap(ble.AuthData{})
 	t := NewSmpTransport(p, bm, m, nil, nil, l)
+	t.runAgent = m.runAgent
 	m.t = t
 	return m
 }
 
+//ioCap returns the io capability sent when pairing; without an agent, the device
+//can neither display nor input anything, unless the passkey is given to Pair
+func (m *manager) ioCap(authData ble.AuthData) byte {
+	if m.config.Agent == nil && authData.Passkey == 0 {
+		return hci.IoCapsNone
+	}
+	return m.config.IoCap
+}
+
 func (m *manager) SetConfig(config hci.SmpConfig) {
 	m.config = config
+	m.pairing.agent = config.Agent
+	m.pairing.scOnly = config.SecureConnectionsOnly
 }
 
 func (m *manager) SetWritePDUFunc(w func([]byte) (int, error)) {
@@ -71,9 +95,24 @@ func (m *manager) InitContext(localAddr, remoteAddr []byte,
 	m.pairing.remoteAddrType = remoteAddrType
 
 	m.t.pairing = m.pairing
+
+	//bonds of devices using resolvable private addresses are stored by identity address
+	if r, ok := m.bondManager.(hci.IdentityResolver); ok {
+		if bi, found := r.ResolveIdentity(m.pairing.remoteAddr); found {
+			m.pairing.remoteIdentityAddr = bi.IdentityAddress()
+			m.pairing.remoteIdentityAddrType = bi.IdentityAddressType()
+			m.pairing.remoteIRK = bi.IdentityResolvingKey()
+		}
+	}
 }
 
 func (m *manager) Handle(in []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.handle(in)
+}
+
+func (m *manager) handle(in []byte) error {
 	p := pdu(in)
 	payload := p.payload()
 	code := payload[0]
@@ -86,31 +125,107 @@ func (m *manager) Handle(in []byte) error {
 		return m.t.send([]byte{pairingFailed, 0x05})
 	}
 
+	if m.waitingAgent {
+		if code != pairingFailed {
+			m.queued = append(m.queued, in)
+			return nil
+		}
+		//the answer of the agent is dropped
+		m.agentSeq++
+		m.waitingAgent = false
+		m.queued = nil
+	}
+
+	if code == pairingRequest {
+		//start over with the local configuration
+		m.t.pairing = m.pairing
+		m.t.pairing.request = m.config
+		m.t.pairing.request.IoCap = m.ioCap(ble.AuthData{})
+	}
+
 	_, err := v.handler(m.t, data)
+	m.done(err)
+	return err
+}
+
+//done ends the pairing if it failed, and reports the outcome
+func (m *manager) done(err error) {
 	if err != nil {
 		m.t.pairing.state = Error
-		m.result <- err
-		return err
 	}
 
-	if m.t.pairing.state == Finished {
+	m.pairingResult(err)
+}
+
+//runAgent runs ask, which waits for the user, on its own goroutine so the link
+//isn't blocked meanwhile; then is called with its error once it returns, with the
+//lock held, and the pdus received until then are handled.
+func (m *manager) runAgent(ask func() error, then func(error) error) {
+	m.agentSeq++
+	seq := m.agentSeq
+	m.waitingAgent = true
+
+	go func() {
+		err := ask()
+
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if seq != m.agentSeq {
+			//pairing failed meanwhile
+			return
+		}
+		m.waitingAgent = false
+
+		m.done(then(err))
+
+		queued := m.queued
+		m.queued = nil
+		for _, in := range queued {
+			m.handle(in)
+		}
+	}()
+}
+
+//pairingResult reports the outcome of the pairing to Pair once it is known
+func (m *manager) pairingResult(err error) {
+	p := m.t.pairing
+	if p.responder {
+		//nothing is waiting on the result of a remote initiated pairing
+		if err != nil {
+			m.Errorf("smp: pairing failed: %v", err)
+		} else if p.state == Finished {
+			m.Infof("smp: pairing complete")
+		}
+		return
+	}
+
+	if err != nil {
+		select {
+		case m.result <- err:
+		default:
+		}
+		return
+	}
+
+	if p.state == Finished {
 		select {
 		case <-m.result:
 		default:
 			close(m.result)
 		}
 	}
-
-	return nil
 }
 
 func (m *manager) Pair(authData ble.AuthData, to time.Duration) error {
+	m.mu.Lock()
 	if m.t.pairing.state != Init {
+		m.mu.Unlock()
 		return fmt.Errorf("Pairing already in progress")
 	}
 
 	//todo: can this be made less bad??
 	m.t.pairing = m.pairing
+	m.t.pairing.responder = false
 	m.t.pairing.authData = authData
 
 	//set a default timeout
@@ -118,11 +233,14 @@ func (m *manager) Pair(authData ble.AuthData, to time.Duration) error {
 		to = time.Minute
 	}
 
-	if len(authData.OOBData) > 0 {
+	m.t.pairing.request.IoCap = m.ioCap(authData)
+	m.t.pairing.request.OobFlag = m.config.OobFlag
+	if len(authData.OOBData) > 0 || authData.RemoteOOB != nil {
 		m.t.pairing.request.OobFlag = byte(hci.OobPreset)
 	}
 
 	err := m.t.StartPairing(to)
+	m.mu.Unlock()
 	if err != nil {
 		return err
 	}
@@ -140,7 +258,7 @@ func (m *manager) waitResult(to time.Duration) error {
 }
 
 func (m *manager) StartEncryption() error {
-	bi, err := m.bondManager.Find(hex.EncodeToString(m.pairing.remoteAddr))
+	bi, err := m.bondManager.Find(m.pairing.bondKey())
 	if err != nil {
 		return err
 	}
@@ -158,8 +276,169 @@ func (m *manager) BondInfoFor(addr string) hci.BondInfo {
 	return bi
 }
 
+//Bonded reports whether the bond manager stores a bond for the remote device
+func (m *manager) Bonded() bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.bondManager != nil && m.bondManager.Exists(m.pairing.bondKey())
+}
+
 func (m *manager) DeleteBondInfo() error {
-	return m.bondManager.Delete(hex.EncodeToString(m.pairing.remoteAddr))
+	return m.bondManager.Delete(m.pairing.bondKey())
+}
+
+//LongTermKeyFor returns the key requested by the controller when the remote
+//device starts encryption.
+func (m *manager) LongTermKeyFor(ediv uint16, rand uint64) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := m.t.pairing
+	if p.responder && ediv == 0 && rand == 0 {
+		switch {
+		case p.state == WaitEncryption && p.legacy:
+			return p.shortTermKey, nil
+		case p.state == WaitEncryption && p.bond != nil:
+			return p.bond.LongTermKey(), nil
+		}
+	}
+
+	bi, err := m.bondManager.Find(m.pairing.bondKey())
+	if err != nil {
+		return nil, err
+	}
+
+	if bi.EDiv() != ediv || bi.Random() != rand {
+		return nil, fmt.Errorf("no key for ediv %x, rand %x", ediv, rand)
+	}
+
+	return bi.LongTermKey(), nil
+}
+
+//EncryptionChanged continues pairing with key distribution once the link
+//has been encrypted with the key generated during pairing.
+func (m *manager) EncryptionChanged(err error) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := m.t.pairing
+	if p.state != WaitEncryption {
+		return nil
+	}
+
+	if err == nil {
+		p.state = WaitKeyDistribution
+
+		//the responder distributes its keys first
+		if p.responder {
+			err = m.t.distributeKeys()
+		}
+		if err == nil {
+			err = m.t.finishKeyDistribution()
+		}
+	}
+
+	if err != nil {
+		p.state = Error
+	}
+
+	m.pairingResult(err)
+	return err
+}
+
+//Sign returns the signature of data for a signed write using the local
+//CSRK, and increments the local sign counter.
+func (m *manager) Sign(data []byte) ([]byte, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	key := m.pairing.bondKey()
+	bi, err := m.bondManager.Find(key)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(bi.LocalSigningKey()) == 0 {
+		return nil, fmt.Errorf("no signing key")
+	}
+
+	counter := bi.LocalSignCounter()
+	sig, err := smpSign(bi.LocalSigningKey(), data, counter)
+	if err != nil {
+		return nil, err
+	}
+
+	//store the counter before the signature is used so it is never reused
+	bi = hci.WithSigning(bi, bi.LocalSigningKey(), bi.RemoteSigningKey(), counter+1, bi.RemoteSignCounter())
+	if err := m.bondManager.Save(key, bi); err != nil {
+		return nil, err
+	}
+
+	return sig, nil
+}
+
+//Verify checks the signature of data received in a signed write against
+//the remote CSRK, rejecting sign counters that have already been used.
+func (m *manager) Verify(data, signature []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if len(signature) != 12 {
+		return fmt.Errorf("invalid signature length %v", len(signature))
+	}
+
+	key := m.pairing.bondKey()
+	bi, err := m.bondManager.Find(key)
+	if err != nil {
+		return err
+	}
+
+	if len(bi.RemoteSigningKey()) == 0 {
+		return fmt.Errorf("no signing key")
+	}
+
+	counter := binary.LittleEndian.Uint32(signature)
+	if counter < bi.RemoteSignCounter() {
+		return fmt.Errorf("sign counter replayed: %v, expected at least %v", counter, bi.RemoteSignCounter())
+	}
+
+	sig, err := smpSign(bi.RemoteSigningKey(), data, counter)
+	if err != nil {
+		return err
+	}
+
+	if subtle.ConstantTimeCompare(sig, signature) != 1 {
+		return fmt.Errorf("signature mismatch")
+	}
+
+	bi = hci.WithSigning(bi, bi.LocalSigningKey(), bi.RemoteSigningKey(), bi.LocalSignCounter(), counter+1)
+	return m.bondManager.Save(key, bi)
+}
+
+//KeySecurity reports whether the key encrypting the link was generated with
+//MITM protection, and its size in octets: the key of the pairing waiting for
+//the encryption, or the long term key of the bond otherwise.
+func (m *manager) KeySecurity() (bool, int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	p := m.t.pairing
+	if p.state == WaitEncryption {
+		size := p.request.MaxKeySize
+		if p.response.MaxKeySize < size {
+			size = p.response.MaxKeySize
+		}
+		return p.pairingType != JustWorks, int(size)
+	}
+
+	if m.bondManager == nil {
+		return false, 0
+	}
+	bi, err := m.bondManager.Find(m.pairing.bondKey())
+	if err != nil {
+		return false, 0
+	}
+	return bi.Authenticated(), len(bi.LongTermKey())
 }
 
 func (m *manager) LegacyPairingInfo() (bool, []byte) {
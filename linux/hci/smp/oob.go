@@ -0,0 +1,118 @@
+package smp
+
+import (
+	"bytes"
+	"crypto/rand"
+	"fmt"
+	"sync"
+
+	"github.com/rigado/ble"
+	"github.com/rigado/ble/linux/hci"
+)
+
+// localOOB is the out of band data of the local device, with the keys its
+// confirm value was computed with
+type localOOB struct {
+	keys    *ECDHKeys
+	random  []byte
+	confirm []byte
+}
+
+// oobSource holds the local out of band data, shared by the connections of a device
+type oobSource struct {
+	mu  sync.Mutex
+	oob *localOOB
+}
+
+// generate replaces the local out of band data
+// Core spec v5.0, Vol 3, Part H, 2.3.5.6.4
+func (s *oobSource) generate() (ble.OOBData, error) {
+	keys, err := GenerateKeys()
+	if err != nil {
+		return ble.OOBData{}, err
+	}
+
+	r := make([]byte, 16)
+	if _, err := rand.Read(r); err != nil {
+		return ble.OOBData{}, err
+	}
+
+	//Ca = f4(PKax, PKax, ra, 0)
+	pkx := MarshalPublicKeyX(keys.public)
+	c, err := smpF4(pkx, pkx, r, 0)
+	if err != nil {
+		return ble.OOBData{}, err
+	}
+
+	s.mu.Lock()
+	s.oob = &localOOB{keys: keys, random: r, confirm: c}
+	s.mu.Unlock()
+
+	return ble.OOBData{
+		Confirm: append([]byte{}, c...),
+		Random:  append([]byte{}, r...),
+	}, nil
+}
+
+func (s *oobSource) get() *localOOB {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.oob
+}
+
+// setupOOB sets the keys and the random values of LE Secure Connections out of
+// band pairing. The remote device has our data if its oob flag is set, we have
+// its data if ours is; the random value of a device is 0 otherwise.
+// Core spec v5.0, Vol 3, Part H, 2.3.5.6.4
+func (p *pairingContext) setupOOB() error {
+	if p.legacy || p.pairingType != Oob {
+		return nil
+	}
+
+	p.localOOBRandom = make([]byte, 16)
+	p.remoteOOBRandom = make([]byte, 16)
+	p.remoteOOBConfirm = nil
+
+	if p.remoteConfig().OobFlag == byte(hci.OobPreset) {
+		local := p.localOOB.get()
+		if local == nil {
+			return fmt.Errorf("no local oob data")
+		}
+		p.scECDHKeys = local.keys
+		p.localOOBRandom = local.random
+	}
+
+	if p.localConfig().OobFlag == byte(hci.OobPreset) {
+		remote := p.authData.RemoteOOB
+		if remote == nil || len(remote.Random) != 16 || len(remote.Confirm) != 16 {
+			return fmt.Errorf("no remote oob data")
+		}
+		p.remoteOOBRandom = remote.Random
+		p.remoteOOBConfirm = remote.Confirm
+	}
+
+	return nil
+}
+
+// checkOOBConfirm checks the public key of the remote device is the one of its
+// out of band data, Cb = f4(PKbx, PKbx, rb, 0)
+func (p *pairingContext) checkOOBConfirm() error {
+	if p.remoteOOBConfirm == nil {
+		return nil
+	}
+
+	pkbx := MarshalPublicKeyX(p.scRemotePubKey)
+	c, err := smpF4(pkbx, pkbx, p.remoteOOBRandom, 0)
+	if err != nil {
+		return err
+	}
+
+	if !bytes.Equal(c, p.remoteOOBConfirm) {
+		return fmt.Errorf("oob confirm mismatch, exp %x got %x", p.remoteOOBConfirm, c)
+	}
+
+	return nil
+}
@@ -0,0 +1,443 @@
+package smp
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/rigado/ble"
+	"github.com/rigado/ble/linux/hci"
+	"github.com/rigado/ble/sliceops"
+)
+
+type testBondManager struct {
+	bonds map[string]hci.BondInfo
+}
+
+func (b *testBondManager) Find(addr string) (hci.BondInfo, error) {
+	bi, ok := b.bonds[addr]
+	if !ok {
+		return nil, fmt.Errorf("bond not found for %v", addr)
+	}
+	return bi, nil
+}
+
+func (b *testBondManager) Save(addr string, bi hci.BondInfo) error {
+	b.bonds[addr] = bi
+	return nil
+}
+
+func (b *testBondManager) Exists(addr string) bool {
+	_, ok := b.bonds[addr]
+	return ok
+}
+
+func (b *testBondManager) Delete(addr string) error {
+	delete(b.bonds, addr)
+	return nil
+}
+
+var (
+	testInitiatorAddr = []byte{0x11, 0x22, 0x33, 0x44, 0x55, 0x66}
+	testResponderAddr = []byte{0xc1, 0xc2, 0xc3, 0xc4, 0xc5, 0xc6}
+)
+
+//link runs everything received by a manager on a single goroutine, until closed
+type link struct {
+	fs   chan func()
+	done chan struct{}
+}
+
+func newLink() *link {
+	l := &link{fs: make(chan func(), 16), done: make(chan struct{})}
+	go func() {
+		for {
+			select {
+			case f := <-l.fs:
+				f()
+			case <-l.done:
+				return
+			}
+		}
+	}()
+	return l
+}
+
+//send drops f once the link is closed, the pdus of a failed pairing may still be in flight
+func (l *link) send(f func()) {
+	select {
+	case l.fs <- f:
+	case <-l.done:
+	}
+}
+
+func (l *link) close() {
+	close(l.done)
+}
+
+//connect routes the pdus written by one manager to the other
+func connect(src, dst *manager, l *link) {
+	src.SetWritePDUFunc(func(b []byte) (int, error) {
+		b = append([]byte{}, b...)
+		l.send(func() { dst.Handle(b) })
+		return len(b), nil
+	})
+}
+
+func testPairing(t *testing.T, config hci.SmpConfig) (hci.BondInfo, hci.BondInfo) {
+	ibi, rbi, err := pairDevices(t, config, config, ble.AuthData{}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ibi, rbi
+}
+
+//pairDevices pairs an initiator, with auth data ad, and a responder, with the out
+//of band data of roob, and returns their bonds
+func pairDevices(t *testing.T, iconfig, rconfig hci.SmpConfig, ad ble.AuthData, roob *oobSource) (hci.BondInfo, hci.BondInfo, error) {
+	l := ble.GetLogger()
+	ibm := &testBondManager{map[string]hci.BondInfo{}}
+	rbm := &testBondManager{map[string]hci.BondInfo{}}
+
+	init := NewSmpManager(iconfig, ibm, l)
+	init.InitContext(testInitiatorAddr, testResponderAddr, 0, 1)
+	resp := NewSmpManager(rconfig, rbm, l)
+	resp.InitContext(testResponderAddr, testInitiatorAddr, 1, 0)
+	resp.pairing.localOOB = roob
+
+	il, rl := newLink(), newLink()
+	defer il.close()
+	defer rl.close()
+
+	connect(init, resp, rl)
+	connect(resp, init, il)
+
+	//stand in for the controllers starting encryption
+	encErr := make(chan error, 1)
+	init.SetEncryptFunc(func(bi hci.BondInfo) error {
+		key := bi
+		if legacy, stk := init.LegacyPairingInfo(); legacy {
+			key = hci.NewBondInfo(stk, 0, 0, true)
+		}
+
+		rl.send(func() {
+			ltk, err := resp.LongTermKeyFor(key.EDiv(), key.Random())
+			if err == nil && !bytes.Equal(ltk, key.LongTermKey()) {
+				err = fmt.Errorf("key mismatch: initiator %x, responder %x", key.LongTermKey(), ltk)
+			}
+			encErr <- err
+			resp.EncryptionChanged(nil)
+			il.send(func() { init.EncryptionChanged(nil) })
+		})
+		return nil
+	})
+
+	err := init.Pair(ad, 5*time.Second)
+	if err != nil {
+		return nil, nil, fmt.Errorf("pairing failed: %v", err)
+	}
+
+	if err := <-encErr; err != nil {
+		return nil, nil, err
+	}
+
+	//wait for the responder to process the initiator's keys
+	done := make(chan struct{})
+	rl.send(func() { close(done) })
+	<-done
+
+	ibi, err := ibm.Find(hex.EncodeToString(sliceops.SwapBuf(testResponderAddr)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("initiator: %v", err)
+	}
+
+	rbi, err := rbm.Find(hex.EncodeToString(sliceops.SwapBuf(testInitiatorAddr)))
+	if err != nil {
+		return nil, nil, fmt.Errorf("responder: %v", err)
+	}
+
+	return ibi, rbi, nil
+}
+
+func TestResponderLegacyPairing(t *testing.T) {
+	config := hci.SmpConfig{
+		IoCap:       hci.IoCapsNone,
+		AuthReq:     authReqBond,
+		MaxKeySize:  16,
+		InitKeyDist: keyDistIdKey | keyDistSignKey,
+		RespKeyDist: keyDistEncKey | keyDistIdKey | keyDistSignKey,
+	}
+
+	ibi, rbi := testPairing(t, config)
+	if len(ibi.LocalSigningKey()) != 16 ||
+		!bytes.Equal(ibi.LocalSigningKey(), rbi.RemoteSigningKey()) ||
+		!bytes.Equal(ibi.RemoteSigningKey(), rbi.LocalSigningKey()) {
+		t.Fatalf("signing key mismatch")
+	}
+
+	if !bytes.Equal(ibi.IdentityAddress(), sliceops.SwapBuf(testResponderAddr)) ||
+		!bytes.Equal(rbi.IdentityAddress(), sliceops.SwapBuf(testInitiatorAddr)) {
+		t.Fatalf("identity address mismatch")
+	}
+
+	if !bytes.Equal(ibi.LongTermKey(), rbi.LongTermKey()) ||
+		ibi.EDiv() != rbi.EDiv() || ibi.Random() != rbi.Random() {
+		t.Fatalf("bond mismatch")
+	}
+}
+
+func TestResponderSecurePairing(t *testing.T) {
+	config := hci.SmpConfig{
+		IoCap:       hci.IoCapsNone,
+		AuthReq:     0x09,
+		MaxKeySize:  16,
+		RespKeyDist: keyDistEncKey,
+	}
+
+	ibi, rbi := testPairing(t, config)
+	if !bytes.Equal(ibi.LongTermKey(), rbi.LongTermKey()) {
+		t.Fatalf("ltk mismatch: initiator %x, responder %x", ibi.LongTermKey(), rbi.LongTermKey())
+	}
+}
+
+//testAgent passes the passkey displayed by one device to the other, and
+//records the numeric comparison values
+type testAgent struct {
+	passkeys chan uint32
+	values   chan uint32
+	accept   bool
+}
+
+func (a *testAgent) DisplayPasskey(addr ble.Addr, passkey uint32) {
+	a.passkeys <- passkey
+}
+
+func (a *testAgent) RequestPasskey(addr ble.Addr) (uint32, error) {
+	select {
+	case p := <-a.passkeys:
+		return p, nil
+	case <-time.After(time.Second):
+		return 0, fmt.Errorf("no passkey displayed")
+	}
+}
+
+func (a *testAgent) ConfirmNumericComparison(addr ble.Addr, value uint32) (bool, error) {
+	a.values <- value
+	return a.accept, nil
+}
+
+func (a *testAgent) Keypress(addr ble.Addr, kind ble.KeypressType) {}
+
+func TestPairingAgent(t *testing.T) {
+	config := func(ioCap, authReq byte, agent ble.PairingAgent) hci.SmpConfig {
+		return hci.SmpConfig{
+			IoCap:       ioCap,
+			AuthReq:     authReq,
+			MaxKeySize:  16,
+			RespKeyDist: keyDistEncKey,
+			Agent:       agent,
+		}
+	}
+	const (
+		sc     = hci.AuthReqBonding | hci.AuthReqMITM | hci.AuthReqSC
+		legacy = hci.AuthReqBonding | hci.AuthReqMITM
+	)
+
+	for _, tc := range []struct {
+		name           string
+		iIoCap, rIoCap byte
+		authReq        byte
+		reject         bool
+	}{
+		{"numeric comparison", hci.IoCapsDisplayYesNo, hci.IoCapsKeyboardDisplay, sc, false},
+		{"numeric comparison rejected", hci.IoCapsDisplayYesNo, hci.IoCapsDisplayYesNo, sc, true},
+		{"passkey entry", hci.IoCapsKeyboardOnly, hci.IoCapsDisplayOnly, sc, false},
+		{"passkey displayed", hci.IoCapsKeyboardDisplay, hci.IoCapsKeyboardDisplay, legacy, false},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			passkeys := make(chan uint32, 1)
+			ia := &testAgent{passkeys, make(chan uint32, 1), true}
+			ra := &testAgent{passkeys, make(chan uint32, 1), !tc.reject}
+
+			_, _, err := pairDevices(t, config(tc.iIoCap, tc.authReq, ia), config(tc.rIoCap, tc.authReq, ra), ble.AuthData{}, nil)
+			if tc.reject {
+				if err == nil {
+					t.Fatal("pairing succeeded, the comparison was rejected")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(ia.values) != 0 || len(ra.values) != 0 {
+				iv, rv := <-ia.values, <-ra.values
+				if iv != rv || iv > 999999 {
+					t.Fatalf("compared values %06d, %06d", iv, rv)
+				}
+			}
+		})
+	}
+}
+
+func TestPairingRequirements(t *testing.T) {
+	config := func(ioCap, authReq byte, scOnly bool) hci.SmpConfig {
+		return hci.SmpConfig{
+			IoCap:                 ioCap,
+			AuthReq:               authReq,
+			MaxKeySize:            16,
+			RespKeyDist:           keyDistEncKey,
+			SecureConnectionsOnly: scOnly,
+		}
+	}
+
+	//legacy pairing is refused by a secure connections only responder
+	_, _, err := pairDevices(t, config(hci.IoCapsNone, hci.AuthReqBonding, false),
+		config(hci.IoCapsNone, hci.AuthReqBonding|hci.AuthReqSC, true), ble.AuthData{}, nil)
+	if err == nil {
+		t.Fatal("legacy pairing succeeded, secure connections only")
+	}
+
+	//just works pairing is refused if mitm protection is required
+	_, _, err = pairDevices(t, config(hci.IoCapsNone, hci.AuthReqBonding|hci.AuthReqMITM|hci.AuthReqSC, false),
+		config(hci.IoCapsNone, hci.AuthReqBonding|hci.AuthReqSC, false), ble.AuthData{}, nil)
+	if err == nil {
+		t.Fatal("just works pairing succeeded, mitm protection required")
+	}
+}
+
+func TestSecureOOBPairing(t *testing.T) {
+	config := hci.SmpConfig{
+		IoCap:       hci.IoCapsNone,
+		AuthReq:     hci.AuthReqBonding | hci.AuthReqMITM | hci.AuthReqSC,
+		MaxKeySize:  16,
+		RespKeyDist: keyDistEncKey,
+	}
+
+	//the initiator read the out of band data of the responder, e.g. over nfc
+	roob := &oobSource{}
+	od, err := roob.generate()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ibi, rbi, err := pairDevices(t, config, config, ble.AuthData{RemoteOOB: &od}, roob)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ibi.Legacy() || !bytes.Equal(ibi.LongTermKey(), rbi.LongTermKey()) {
+		t.Fatalf("ltk mismatch: initiator %x, responder %x", ibi.LongTermKey(), rbi.LongTermKey())
+	}
+
+	//the data doesn't match the public key of the responder
+	bad := ble.OOBData{Confirm: append([]byte{}, od.Confirm...), Random: od.Random}
+	bad.Confirm[0] ^= 0xff
+	if _, _, err := pairDevices(t, config, config, ble.AuthData{RemoteOOB: &bad}, roob); err == nil {
+		t.Fatal("pairing succeeded, the oob confirm value is wrong")
+	}
+
+	//the responder has no out of band data
+	if _, _, err := pairDevices(t, config, config, ble.AuthData{RemoteOOB: &od}, nil); err == nil {
+		t.Fatal("pairing succeeded, the responder has no oob data")
+	}
+}
+
+//blockingAgent waits for the passkey to be released
+type blockingAgent struct {
+	testAgent
+	asked   chan struct{}
+	passkey chan uint32
+}
+
+func (a *blockingAgent) RequestPasskey(addr ble.Addr) (uint32, error) {
+	close(a.asked)
+	return <-a.passkey, nil
+}
+
+//smpPDU wraps an smp command in an l2cap header
+func smpPDU(code byte, data ...byte) []byte {
+	b := []byte{byte(len(data) + 1), 0, byte(hci.CidSMP), byte(hci.CidSMP >> 8), code}
+	return append(b, data...)
+}
+
+func TestPairingAgentBlocking(t *testing.T) {
+	a := &blockingAgent{asked: make(chan struct{}), passkey: make(chan uint32)}
+	resp := NewSmpManager(hci.SmpConfig{
+		IoCap:       hci.IoCapsKeyboardOnly,
+		AuthReq:     hci.AuthReqBonding | hci.AuthReqMITM,
+		MaxKeySize:  16,
+		RespKeyDist: keyDistEncKey,
+		Agent:       a,
+	}, &testBondManager{map[string]hci.BondInfo{}}, ble.GetLogger())
+	resp.InitContext(testResponderAddr, testInitiatorAddr, 1, 0)
+
+	sent := make(chan []byte, 16)
+	resp.SetWritePDUFunc(func(b []byte) (int, error) {
+		sent <- pdu(append([]byte{}, b...)).payload()
+		return len(b), nil
+	})
+
+	handled := make(chan error, 1)
+	handle := func(b []byte) {
+		go func() { handled <- resp.Handle(b) }()
+		select {
+		case err := <-handled:
+			if err != nil {
+				t.Fatal(err)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("the link is blocked by the agent")
+		}
+	}
+
+	//legacy passkey entry, the initiator displays the passkey
+	handle(smpPDU(pairingRequest, hci.IoCapsDisplayOnly, 0, hci.AuthReqBonding|hci.AuthReqMITM, 16, 0, keyDistEncKey))
+	if b := <-sent; b[0] != pairingResponse {
+		t.Fatalf("sent % X, want pairing response", b)
+	}
+	<-a.asked
+
+	//the confirm value of the initiator waits for the passkey
+	handle(smpPDU(pairingConfirm, make([]byte, 16)...))
+	select {
+	case b := <-sent:
+		t.Fatalf("sent % X before the passkey was entered", b)
+	default:
+	}
+
+	a.passkey <- 123456
+	select {
+	case b := <-sent:
+		if b[0] != pairingConfirm {
+			t.Fatalf("sent % X, want pairing confirm", b)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no pairing confirm sent once the passkey was entered")
+	}
+}
+
+func TestPairingWithoutAgent(t *testing.T) {
+	//a device without agent can't display or input anything
+	resp := NewSmpManager(hci.SmpConfig{
+		IoCap:       hci.IoCapsKeyboardDisplay,
+		AuthReq:     hci.AuthReqBonding | hci.AuthReqSC,
+		MaxKeySize:  16,
+		RespKeyDist: keyDistEncKey,
+	}, &testBondManager{map[string]hci.BondInfo{}}, ble.GetLogger())
+	resp.InitContext(testResponderAddr, testInitiatorAddr, 1, 0)
+
+	var rsp []byte
+	resp.SetWritePDUFunc(func(b []byte) (int, error) {
+		rsp = pdu(append([]byte{}, b...)).payload()
+		return len(b), nil
+	})
+	err := resp.Handle(smpPDU(pairingRequest, hci.IoCapsDisplayYesNo, 0, hci.AuthReqBonding|hci.AuthReqSC, 16, 0, keyDistEncKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rsp[0] != pairingResponse || rsp[1] != hci.IoCapsNone {
+		t.Fatalf("sent % X, want pairing response with io capability NoInputNoOutput", rsp)
+	}
+}
@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"crypto/rand"
 	"encoding/binary"
-	"encoding/hex"
 	"fmt"
 	"time"
 
@@ -30,12 +29,25 @@ type transport struct {
 
 	nopFunc func() error //workaround stuff
 
+	//runAgent runs the user interactions of the agent, see manager.runAgent
+	runAgent func(ask func() error, then func(error) error)
+
 	result chan error
 	ble.Logger
 }
 
 func NewSmpTransport(ctx *pairingContext, bm hci.BondManager, e hci.Encrypter, writePDU func([]byte) (int, error), nopFunc func() error, l ble.Logger) *transport {
-	return &transport{ctx, writePDU, bm, e, nopFunc, make(chan error), l}
+	return &transport{pairing: ctx, writePDU: writePDU, bondManager: bm, encrypter: e, nopFunc: nopFunc, result: make(chan error), Logger: l}
+}
+
+// askAgent asks the agent with ask, and calls then with its error; then runs
+// later if the agent is run on its own goroutine
+func (t *transport) askAgent(ask func() error, then func(error) error) error {
+	if t.runAgent == nil {
+		return then(ask())
+	}
+	t.runAgent(ask, then)
+	return nil
 }
 
 func (t *transport) SetContext(ctx *pairingContext) {
@@ -54,11 +66,34 @@ func (t *transport) StartPairing(to time.Duration) error {
 }
 
 func (t *transport) saveBondInfo() error {
-	if t.pairing.request.AuthReq&authReqBondMask != authReqBond {
+	if !t.pairing.bonding() {
 		return nil
 	}
-	addr := hex.EncodeToString(t.pairing.remoteAddr)
-	return t.bondManager.Save(addr, t.pairing.bond)
+
+	bi := t.pairing.bond
+	if bi == nil {
+		return fmt.Errorf("no bond information")
+	}
+
+	if t.pairing.pairingType != JustWorks {
+		bi = hci.WithAuthentication(bi, true)
+	}
+
+	// The responder of a legacy pairing keeps the key it distributed.
+	if bi.Legacy() && t.pairing.responder {
+		bi = hci.WithPeripheralKey(bi, true)
+	}
+
+	if len(t.pairing.remoteIdentityAddr) != 0 {
+		bi = hci.WithIdentity(bi, t.pairing.remoteIRK,
+			t.pairing.remoteIdentityAddr, t.pairing.remoteIdentityAddrType)
+	}
+
+	if len(t.pairing.localCSRK) != 0 || len(t.pairing.remoteCSRK) != 0 {
+		bi = hci.WithSigning(bi, t.pairing.localCSRK, t.pairing.remoteCSRK, 0, 0)
+	}
+
+	return t.bondManager.Save(t.pairing.bondKey(), bi)
 }
 
 func (t *transport) send(pdu []byte) error {
@@ -148,7 +183,8 @@ func (t *transport) sendDHKeyCheck() error {
 	na := p.localRandom
 	nb := p.remoteRandom
 
-	ioCap := sliceops.SwapBuf([]byte{t.pairing.request.AuthReq, t.pairing.request.OobFlag, t.pairing.request.IoCap})
+	lc := t.pairing.localConfig()
+	ioCap := sliceops.SwapBuf([]byte{lc.AuthReq, lc.OobFlag, lc.IoCap})
 
 	rb := make([]byte, 16)
 	if t.pairing.pairingType == Passkey {
@@ -162,8 +198,7 @@ func (t *transport) sendDHKeyCheck() error {
 		//swap to little endian
 		rb = sliceops.SwapBuf(rb)
 	} else if t.pairing.pairingType == Oob {
-		rb = t.pairing.authData.OOBData
-		//todo: does this need to be swapped?
+		rb = t.pairing.remoteOOBRandom
 	}
 
 	ea, err := smpF6(t.pairing.scMacKey, na, nb, rb, ioCap, la, ra)
@@ -172,6 +207,10 @@ func (t *transport) sendDHKeyCheck() error {
 	}
 
 	t.pairing.state = WaitDhKeyCheck
+	if t.pairing.responder {
+		//the initiator starts encryption once it has our check
+		t.pairing.state = WaitEncryption
+	}
 	out := append([]byte{pairingDHKeyCheck}, ea...)
 	return t.send(out)
 }
@@ -181,9 +220,6 @@ func (t *transport) sendMConfirm() error {
 		return fmt.Errorf("no pairing context")
 	}
 
-	preq := buildPairingReq(t.pairing.request)
-	pres := buildPairingRsp(t.pairing.response)
-
 	r := make([]byte, 16)
 	_, err := rand.Read(r)
 	if err != nil {
@@ -191,24 +227,162 @@ func (t *transport) sendMConfirm() error {
 	}
 	t.pairing.localRandom = r
 
-	la := t.pairing.localAddr
-	lat := t.pairing.localAddrType
-	ra := t.pairing.remoteAddr
-	rat := t.pairing.remoteAddrType
+	c1, err := t.pairing.legacyConfirm(r)
+	if err != nil {
+		return err
+	}
 
-	k := make([]byte, 16)
-	if t.pairing.pairingType == Passkey {
-		k = getLegacyParingTK(t.pairing.authData.Passkey)
+	t.pairing.state = WaitConfirm
+	out := append([]byte{pairingConfirm}, c1...)
+	return t.send(out)
+}
+
+func (t *transport) sendPairingResponse() error {
+	cmd := buildPairingRsp(t.pairing.response)
+	return t.send(cmd)
+}
+
+func (t *transport) sendPairingFailed(reason byte) error {
+	return t.send([]byte{pairingFailed, reason})
+}
+
+// sendSConfirm sends the responder's legacy confirm value
+func (t *transport) sendSConfirm() error {
+	if t.pairing == nil {
+		return fmt.Errorf("no pairing context")
 	}
 
-	c1, err := smpC1(k, r, preq, pres,
-		lat, rat, la, ra,
-	)
+	r := make([]byte, 16)
+	_, err := rand.Read(r)
 	if err != nil {
 		return err
 	}
+	t.pairing.localRandom = r
 
-	t.pairing.state = WaitConfirm
+	c1, err := t.pairing.legacyConfirm(r)
+	if err != nil {
+		return err
+	}
+
+	t.pairing.state = WaitRandom
 	out := append([]byte{pairingConfirm}, c1...)
 	return t.send(out)
 }
+
+// sendSecureConfirm sends the responder's confirm value for
+// just works and numeric comparison pairing
+func (t *transport) sendSecureConfirm() error {
+	if t.pairing == nil {
+		return fmt.Errorf("no pairing context")
+	}
+
+	nb := make([]byte, 16)
+	_, err := rand.Read(nb)
+	if err != nil {
+		return err
+	}
+	t.pairing.localRandom = nb
+
+	//Cb = f4(PKbx, PKax, Nb, 0)
+	kbx := MarshalPublicKeyX(t.pairing.scECDHKeys.public)
+	kax := MarshalPublicKeyX(t.pairing.scRemotePubKey)
+	cb, err := smpF4(kbx, kax, nb, 0)
+	if err != nil {
+		return err
+	}
+
+	t.pairing.state = WaitRandom
+	out := append([]byte{pairingConfirm}, cb...)
+	return t.send(out)
+}
+
+// distributeKeys sends the keys requested by the remote device.
+// Core spec v5.0, Vol 3, Part H, 3.6.1
+func (t *transport) distributeKeys() error {
+	kd := t.pairing.localKeyDist()
+
+	//only the responder's LTK is used, so it is the only one distributed
+	if kd&keyDistEncKey != 0 && t.pairing.responder {
+		ltk := make([]byte, 16)
+		if _, err := rand.Read(ltk); err != nil {
+			return err
+		}
+
+		ids := make([]byte, 10)
+		if _, err := rand.Read(ids); err != nil {
+			return err
+		}
+		ediv := binary.LittleEndian.Uint16(ids[:2])
+		randVal := binary.LittleEndian.Uint64(ids[2:])
+		t.pairing.bond = hci.NewBondInfo(ltk, ediv, randVal, true)
+
+		if err := t.send(append([]byte{encryptionInformation}, ltk...)); err != nil {
+			return err
+		}
+
+		if err := t.send(append([]byte{masterIdentification}, ids...)); err != nil {
+			return err
+		}
+	}
+
+	if kd&keyDistIdKey != 0 {
+		//an all zero IRK indicates that resolvable private addresses are not used
+		irk := make([]byte, 16)
+		if err := t.send(append([]byte{identityInformation}, irk...)); err != nil {
+			return err
+		}
+
+		out := []byte{identityAddrInformation, t.pairing.localAddrType}
+		out = append(out, t.pairing.localAddr...)
+		if err := t.send(out); err != nil {
+			return err
+		}
+	}
+
+	if kd&keyDistSignKey != 0 {
+		csrk := make([]byte, 16)
+		if _, err := rand.Read(csrk); err != nil {
+			return err
+		}
+		t.pairing.localCSRK = csrk
+
+		if err := t.send(append([]byte{signingInformation}, csrk...)); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// finishKeyDistribution completes pairing once the link is encrypted and
+// all keys expected from the remote device have been received
+func (t *transport) finishKeyDistribution() error {
+	p := t.pairing
+	if p.state != WaitKeyDistribution || p.expectedKeys != 0 {
+		return nil
+	}
+
+	//the initiator distributes its keys after the responder
+	if !p.responder {
+		if err := t.distributeKeys(); err != nil {
+			return err
+		}
+	}
+
+	if err := t.saveBondInfo(); err != nil {
+		return err
+	}
+
+	p.state = Finished
+	return nil
+}
+
+// keyReceived marks a key from the remote device as received
+func (t *transport) keyReceived(key byte) error {
+	if t.pairing.expectedKeys&key == 0 {
+		return fmt.Errorf("unexpected key distribution %x", key)
+	}
+
+	t.pairing.expectedKeys &^= key
+	return t.finishKeyDistribution()
+}
@@ -2,7 +2,12 @@ package smp
 
 import (
 	"bytes"
+	"encoding/hex"
 	"testing"
+
+	"github.com/rigado/ble"
+	"github.com/rigado/ble/linux/hci"
+	"github.com/rigado/ble/sliceops"
 )
 
 func TestAesCMAC(t *testing.T) {
@@ -19,3 +24,68 @@ func TestAesCMAC(t *testing.T) {
 	}
 
 }
+
+func TestResolvePrivateAddress(t *testing.T) {
+	//Core spec v5.0, Vol 3, Part H, Appendix D.7, in little endian order
+	irk := []byte{0x9b, 0x7d, 0x39, 0x0a, 0xa6, 0x10, 0x10, 0x34,
+		0x05, 0xad, 0xc8, 0x57, 0xa3, 0x34, 0x02, 0xec}
+	prand := []byte{0x94, 0x81, 0x70}
+	hash := []byte{0xaa, 0xfb, 0x0d}
+
+	r, err := smpAh(irk, prand)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(r, hash) {
+		t.Fatalf("hash mismatch: exp %x got %x", hash, r)
+	}
+
+	addr := append(hash, prand...)
+	if !ResolvePrivateAddress(irk, addr) {
+		t.Fatal("failed to resolve address")
+	}
+
+	addr[0] ^= 0x01
+	if ResolvePrivateAddress(irk, addr) {
+		t.Fatal("resolved address with invalid hash")
+	}
+}
+
+func TestSignVerify(t *testing.T) {
+	csrk := []byte{0x3c, 0x4f, 0xb1, 0x22, 0x05, 0x9a, 0x1e, 0x4a,
+		0x2b, 0xbb, 0x4d, 0xd8, 0x11, 0xf7, 0x70, 0xc2}
+	bm := &testBondManager{map[string]hci.BondInfo{}}
+	key := hex.EncodeToString(sliceops.SwapBuf(testResponderAddr))
+	bi := hci.WithSigning(hci.NewBondInfo(make([]byte, 16), 0, 0, false), csrk, csrk, 0, 0)
+	bm.Save(key, bi)
+
+	m := NewSmpManager(hci.SmpConfig{}, bm, ble.GetLogger())
+	m.InitContext(testInitiatorAddr, testResponderAddr, 0, 0)
+
+	data := []byte{0xd2, 0x03, 0x00, 0x01, 0x02}
+	sig, err := m.Sign(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := m.Verify(data, sig); err != nil {
+		t.Fatalf("failed to verify signature: %v", err)
+	}
+
+	if err := m.Verify(data, sig); err == nil {
+		t.Fatal("replayed signature accepted")
+	}
+
+	next, err := m.Sign(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(sig, next) {
+		t.Fatal("sign counter not incremented")
+	}
+
+	next[len(next)-1] ^= 0x01
+	if err := m.Verify(data, next); err == nil {
+		t.Fatal("invalid signature accepted")
+	}
+}
@@ -27,6 +27,7 @@ type transport struct {
 	hci      *transportHci
 	h4uart   *transportH4Uart
 	h4socket *transportH4Socket
+	virtual  io.ReadWriteCloser
 }
 
 func getTransport(t transport) (io.ReadWriteCloser, error) {
@@ -45,6 +46,9 @@ func getTransport(t transport) (io.ReadWriteCloser, error) {
 		}
 		return h4.NewSerial(so)
 
+	case t.virtual != nil:
+		return t.virtual, nil
+
 	default:
 		return nil, fmt.Errorf("no valid transport found")
 	}
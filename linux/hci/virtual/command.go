@@ -0,0 +1,714 @@
+package virtual
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/rigado/ble/linux/hci/cmd"
+)
+
+// Event codes [Vol 2, Part E, 7.7]
+const (
+	evtDisconnectionComplete    = 0x05
+	evtEncryptionChange         = 0x08
+	evtCommandComplete          = 0x0E
+	evtCommandStatus            = 0x0F
+	evtNumberOfCompletedPackets = 0x13
+	evtLEMeta                   = 0x3E
+
+	subLEConnectionComplete       = 0x01
+	subLEAdvertisingReport        = 0x02
+	subLEConnectionUpdateComplete = 0x03
+	subLELongTermKeyRequest       = 0x05
+	subLERemoteConnParamRequest   = 0x06
+	subLEDataLengthChange         = 0x07
+	subLEPHYUpdateComplete        = 0x0C
+)
+
+// Error codes [Vol 2, Part D, 1.3]
+const (
+	errUnknownCommand = 0x01
+	errUnknownConnID  = 0x02
+	errKeyMissing     = 0x06
+	errMemoryCapacity = 0x07
+	errConnTimeout    = 0x08
+	errConnLimit      = 0x09
+	errDisallowed     = 0x0C
+	errInvalidParams  = 0x12
+	errLocalHost      = 0x16
+	errMICFailure     = 0x3D
+)
+
+// Advertising types of LE Set Advertising Parameters, and event types of LE Advertising Report.
+const (
+	advInd            = 0x00
+	advDirectInd      = 0x01
+	advScanInd        = 0x02
+	advNonconnInd     = 0x03
+	scanRsp           = 0x04
+	advDirectIndLowDC = 0x04
+)
+
+const (
+	roleCentral    = 0x00
+	rolePeripheral = 0x01
+)
+
+// rssi is reported for all advertisements and connections.
+const rssi = int8(-50)
+
+// minAdvInterval is the shortest advertising interval allowed for connectable advertising.
+const minAdvInterval = 20 * time.Millisecond
+
+// leFeatures reported by LE Read Local Supported Features; LE Encryption,
+// LE Data Packet Length Extension, LE 2M PHY and LE Coded PHY.
+const leFeatures = uint64(0x01 | 0x20 | 0x100 | 0x800)
+
+// PHYs [Vol 2, Part E, 7.8.47]
+const (
+	phy1M    = 0x01
+	phy2M    = 0x02
+	phyCoded = 0x03
+)
+
+// Initial and maximum data length of the connections [Vol 6, Part B, 4.5.10]
+const (
+	minTxOctets = 27
+	minTxTime   = 328
+	maxTxOctets = 251
+	maxTxTime   = 2120
+)
+
+var (
+	opReset                             = (&cmd.Reset{}).OpCode()
+	opSetEventMask                      = (&cmd.SetEventMask{}).OpCode()
+	opWriteLEHostSupport                = (&cmd.WriteLEHostSupport{}).OpCode()
+	opReadBufferSize                    = (&cmd.ReadBufferSize{}).OpCode()
+	opReadBDADDR                        = (&cmd.ReadBDADDR{}).OpCode()
+	opReadRSSI                          = (&cmd.ReadRSSI{}).OpCode()
+	opDisconnect                        = (&cmd.Disconnect{}).OpCode()
+	opLESetEventMask                    = (&cmd.LESetEventMask{}).OpCode()
+	opLEReadBufferSize                  = (&cmd.LEReadBufferSize{}).OpCode()
+	opLEReadLocalSupportedFeatures      = (&cmd.LEReadLocalSupportedFeatures{}).OpCode()
+	opLESetRandomAddress                = (&cmd.LESetRandomAddress{}).OpCode()
+	opLESetAdvertisingParameters        = (&cmd.LESetAdvertisingParameters{}).OpCode()
+	opLEReadAdvertisingChannelTxPower   = (&cmd.LEReadAdvertisingChannelTxPower{}).OpCode()
+	opLESetAdvertisingData              = (&cmd.LESetAdvertisingData{}).OpCode()
+	opLESetScanResponseData             = (&cmd.LESetScanResponseData{}).OpCode()
+	opLESetAdvertiseEnable              = (&cmd.LESetAdvertiseEnable{}).OpCode()
+	opLESetScanParameters               = (&cmd.LESetScanParameters{}).OpCode()
+	opLESetScanEnable                   = (&cmd.LESetScanEnable{}).OpCode()
+	opLECreateConnection                = (&cmd.LECreateConnection{}).OpCode()
+	opLECreateConnectionCancel          = (&cmd.LECreateConnectionCancel{}).OpCode()
+	opLEConnectionUpdate                = (&cmd.LEConnectionUpdate{}).OpCode()
+	opLEStartEncryption                 = (&cmd.LEStartEncryption{}).OpCode()
+	opLERemoteConnParamRequestReply     = (&cmd.LERemoteConnectionParameterRequestReply{}).OpCode()
+	opLERemoteConnParamRequestNegReply  = (&cmd.LERemoteConnectionParameterRequestNegativeReply{}).OpCode()
+	opLELongTermKeyRequestReply         = (&cmd.LELongTermKeyRequestReply{}).OpCode()
+	opLELongTermKeyRequestNegativeReply = (&cmd.LELongTermKeyRequestNegativeReply{}).OpCode()
+	opLEWriteSuggestedDefaultDataLength = (&cmd.LEWriteSuggestedDefaultDataLength{}).OpCode()
+	opLESetDataLength                   = (&cmd.LESetDataLength{}).OpCode()
+	opLEReadPHY                         = (&cmd.LEReadPHY{}).OpCode()
+	opLESetDefaultPHY                   = (&cmd.LESetDefaultPHY{}).OpCode()
+	opLESetPHY                          = (&cmd.LESetPHY{}).OpCode()
+	opLEReadWhiteListSize               = (&cmd.LEReadWhiteListSize{}).OpCode()
+	opLEClearWhiteList                  = (&cmd.LEClearWhiteList{}).OpCode()
+	opLEAddDeviceToWhiteList            = (&cmd.LEAddDeviceToWhiteList{}).OpCode()
+	opLERemoveDeviceFromWhiteList       = (&cmd.LERemoveDeviceFromWhiteList{}).OpCode()
+)
+
+// Filter policies of scanning and initiating
+const (
+	filterPolicyAcceptAll  = 0x00
+	filterPolicyAcceptList = 0x01
+)
+
+// command executes a command from the host, and queues its events.
+func (c *Controller) command(op int, b []byte) {
+	c.air.Lock()
+	defer c.air.Unlock()
+
+	switch op {
+	case opReset:
+		c.reset()
+		c.complete(op, uint8(0))
+
+	case opSetEventMask, opLESetEventMask, opWriteLEHostSupport,
+		opLESetRandomAddress, opLEWriteSuggestedDefaultDataLength, opLESetDefaultPHY:
+		c.complete(op, uint8(0))
+
+	case opReadBDADDR:
+		c.complete(op, cmd.ReadBDADDRRP{BDADDR: c.addr})
+
+	case opReadBufferSize:
+		// LE only, the host uses the LE buffers.
+		c.complete(op, cmd.ReadBufferSizeRP{})
+
+	case opLEReadBufferSize:
+		c.complete(op, cmd.LEReadBufferSizeRP{
+			HCLEDataPacketLength:    aclDataPacketLength,
+			HCTotalNumLEDataPackets: numACLDataPackets,
+		})
+
+	case opLEReadLocalSupportedFeatures:
+		c.complete(op, cmd.LEReadLocalSupportedFeaturesRP{LEFeatures: leFeatures})
+
+	case opLEReadAdvertisingChannelTxPower:
+		c.complete(op, cmd.LEReadAdvertisingChannelTxPowerRP{})
+
+	case opLESetAdvertisingParameters:
+		var p cmd.LESetAdvertisingParameters
+		if err := decode(b, &p); err != nil || p.AdvertisingType > advDirectIndLowDC {
+			c.complete(op, uint8(errInvalidParams))
+			return
+		}
+		c.advParams = p
+		c.complete(op, uint8(0))
+
+	case opLESetAdvertisingData:
+		var p cmd.LESetAdvertisingData
+		if err := decode(b, &p); err != nil || int(p.AdvertisingDataLength) > len(p.AdvertisingData) {
+			c.complete(op, uint8(errInvalidParams))
+			return
+		}
+		c.advData = append([]byte(nil), p.AdvertisingData[:p.AdvertisingDataLength]...)
+		c.complete(op, uint8(0))
+
+	case opLESetScanResponseData:
+		var p cmd.LESetScanResponseData
+		if err := decode(b, &p); err != nil || int(p.ScanResponseDataLength) > len(p.ScanResponseData) {
+			c.complete(op, uint8(errInvalidParams))
+			return
+		}
+		c.scanRsp = append([]byte(nil), p.ScanResponseData[:p.ScanResponseDataLength]...)
+		c.complete(op, uint8(0))
+
+	case opLESetAdvertiseEnable:
+		var p cmd.LESetAdvertiseEnable
+		if err := decode(b, &p); err != nil {
+			c.complete(op, uint8(errInvalidParams))
+			return
+		}
+		c.complete(op, uint8(0))
+		if p.AdvertisingEnable == 1 {
+			c.startAdvertising()
+		} else {
+			c.stopAdvertising()
+		}
+
+	case opLESetScanParameters:
+		var p cmd.LESetScanParameters
+		if err := decode(b, &p); err != nil {
+			c.complete(op, uint8(errInvalidParams))
+			return
+		}
+		c.scanParams = p
+		c.complete(op, uint8(0))
+
+	case opLESetScanEnable:
+		var p cmd.LESetScanEnable
+		if err := decode(b, &p); err != nil {
+			c.complete(op, uint8(errInvalidParams))
+			return
+		}
+		c.scanning = p.LEScanEnable == 1
+		c.filterDup = p.FilterDuplicates == 1
+		c.seen = make(map[string]bool)
+		c.complete(op, uint8(0))
+
+	case opLECreateConnection:
+		var p cmd.LECreateConnection
+		if err := decode(b, &p); err != nil {
+			c.status(op, errInvalidParams)
+			return
+		}
+		if c.initiating != nil {
+			c.status(op, errDisallowed)
+			return
+		}
+		c.initiating = &p
+		c.status(op, 0)
+		c.air.connectPending()
+
+	case opLEReadWhiteListSize:
+		c.complete(op, cmd.LEReadWhiteListSizeRP{WhiteListSize: acceptListSize})
+
+	case opLEClearWhiteList:
+		if c.acceptListInUse() {
+			c.complete(op, uint8(errDisallowed))
+			return
+		}
+		c.acceptList = make(map[acceptListEntry]bool)
+		c.complete(op, uint8(0))
+
+	case opLEAddDeviceToWhiteList:
+		var p cmd.LEAddDeviceToWhiteList
+		if err := decode(b, &p); err != nil {
+			c.complete(op, uint8(errInvalidParams))
+			return
+		}
+		e := acceptListEntry{p.AddressType, p.Address}
+		switch {
+		case c.acceptListInUse():
+			c.complete(op, uint8(errDisallowed))
+		case !c.acceptList[e] && len(c.acceptList) >= acceptListSize:
+			c.complete(op, uint8(errMemoryCapacity))
+		default:
+			c.acceptList[e] = true
+			c.complete(op, uint8(0))
+		}
+
+	case opLERemoveDeviceFromWhiteList:
+		var p cmd.LERemoveDeviceFromWhiteList
+		if err := decode(b, &p); err != nil {
+			c.complete(op, uint8(errInvalidParams))
+			return
+		}
+		if c.acceptListInUse() {
+			c.complete(op, uint8(errDisallowed))
+			return
+		}
+		delete(c.acceptList, acceptListEntry{p.AddressType, p.Address})
+		c.complete(op, uint8(0))
+
+	case opLECreateConnectionCancel:
+		if c.initiating == nil {
+			c.complete(op, uint8(errDisallowed))
+			return
+		}
+		c.initiating = nil
+		c.complete(op, uint8(0))
+		c.connectionComplete(errUnknownConnID, &link{}, [6]byte{})
+
+	case opDisconnect:
+		var p cmd.Disconnect
+		if err := decode(b, &p); err != nil {
+			c.status(op, errInvalidParams)
+			return
+		}
+		l := c.links[p.ConnectionHandle]
+		if l == nil {
+			c.status(op, errUnknownConnID)
+			return
+		}
+		c.status(op, 0)
+		c.disconnect(l, errLocalHost, p.Reason)
+
+	case opReadRSSI:
+		var p cmd.ReadRSSI
+		if err := decode(b, &p); err != nil || c.links[p.Handle] == nil {
+			c.complete(op, cmd.ReadRSSIRP{Status: errUnknownConnID, ConnectionHandle: p.Handle})
+			return
+		}
+		c.complete(op, cmd.ReadRSSIRP{ConnectionHandle: p.Handle, RSSI: rssi})
+
+	case opLEConnectionUpdate:
+		var p cmd.LEConnectionUpdate
+		if err := decode(b, &p); err != nil {
+			c.status(op, errInvalidParams)
+			return
+		}
+		l := c.links[p.ConnectionHandle]
+		if l == nil {
+			c.status(op, errUnknownConnID)
+			return
+		}
+		c.status(op, 0)
+		if l.role == rolePeripheral {
+			// The central's host decides on the parameters requested by the peripheral.
+			l.remote.paramsRequested = true
+			l.peer.event(evtLEMeta, uint8(subLERemoteConnParamRequest), l.remote.handle,
+				p.ConnIntervalMin, p.ConnIntervalMax, p.ConnLatency, p.SupervisionTimeout)
+			return
+		}
+		c.updateConnParams(l, connParams{p.ConnIntervalMin, p.ConnLatency, p.SupervisionTimeout})
+
+	case opLERemoteConnParamRequestReply:
+		var p cmd.LERemoteConnectionParameterRequestReply
+		if err := decode(b, &p); err != nil {
+			c.complete(op, cmd.LERemoteConnectionParameterRequestReplyRP{Status: errInvalidParams})
+			return
+		}
+		l := c.links[p.ConnectionHandle]
+		if l == nil || !l.paramsRequested {
+			c.complete(op, cmd.LERemoteConnectionParameterRequestReplyRP{Status: errUnknownConnID, ConnectionHandle: p.ConnectionHandle})
+			return
+		}
+		l.paramsRequested = false
+		c.complete(op, cmd.LERemoteConnectionParameterRequestReplyRP{ConnectionHandle: p.ConnectionHandle})
+		c.updateConnParams(l, connParams{p.IntervalMin, p.Latency, p.Timeout})
+
+	case opLERemoteConnParamRequestNegReply:
+		var p cmd.LERemoteConnectionParameterRequestNegativeReply
+		if err := decode(b, &p); err != nil {
+			c.complete(op, cmd.LERemoteConnectionParameterRequestNegativeReplyRP{Status: errInvalidParams})
+			return
+		}
+		l := c.links[p.ConnectionHandle]
+		if l == nil || !l.paramsRequested {
+			c.complete(op, cmd.LERemoteConnectionParameterRequestNegativeReplyRP{Status: errUnknownConnID, ConnectionHandle: p.ConnectionHandle})
+			return
+		}
+		l.paramsRequested = false
+		c.complete(op, cmd.LERemoteConnectionParameterRequestNegativeReplyRP{ConnectionHandle: p.ConnectionHandle})
+		l.peer.connectionUpdateComplete(p.Reason, l.remote)
+
+	case opLESetDataLength:
+		var p cmd.LESetDataLength
+		if err := decode(b, &p); err != nil {
+			c.complete(op, cmd.LESetDataLengthRP{Status: errInvalidParams})
+			return
+		}
+		l := c.links[p.ConnectionHandle]
+		if l == nil {
+			c.complete(op, cmd.LESetDataLengthRP{Status: errUnknownConnID, ConnectionHandle: p.ConnectionHandle})
+			return
+		}
+		c.complete(op, cmd.LESetDataLengthRP{ConnectionHandle: p.ConnectionHandle})
+		octets, tm := clamp(p.TxOctets, minTxOctets, maxTxOctets), clamp(p.TxTime, minTxTime, maxTxTime)
+		if octets == l.txOctets && tm == l.txTime {
+			return
+		}
+		l.txOctets, l.txTime = octets, tm
+		c.dataLengthChange(l)
+		l.peer.dataLengthChange(l.remote)
+
+	case opLEReadPHY:
+		var p cmd.LEReadPHY
+		if err := decode(b, &p); err != nil || c.links[p.ConnectionHandle] == nil {
+			c.complete(op, cmd.LEReadPHYRP{Status: errUnknownConnID, ConnectionHandle: p.ConnectionHandle})
+			return
+		}
+		l := c.links[p.ConnectionHandle]
+		c.complete(op, cmd.LEReadPHYRP{ConnectionHandle: p.ConnectionHandle, TXPHY: l.txPHY, RXPHY: l.remote.txPHY})
+
+	case opLESetPHY:
+		var p cmd.LESetPHY
+		if err := decode(b, &p); err != nil {
+			c.status(op, errInvalidParams)
+			return
+		}
+		l := c.links[p.ConnectionHandle]
+		if l == nil {
+			c.status(op, errUnknownConnID)
+			return
+		}
+		c.status(op, 0)
+		if p.AllPHYs&0x01 == 0 {
+			l.txPHY = preferredPHY(p.TXPHYs)
+		}
+		if p.AllPHYs&0x02 == 0 {
+			l.remote.txPHY = preferredPHY(p.RXPHYs)
+		}
+		c.phyUpdateComplete(l)
+		l.peer.phyUpdateComplete(l.remote)
+
+	case opLEStartEncryption:
+		var p cmd.LEStartEncryption
+		if err := decode(b, &p); err != nil {
+			c.status(op, errInvalidParams)
+			return
+		}
+		l := c.links[p.ConnectionHandle]
+		switch {
+		case l == nil:
+			c.status(op, errUnknownConnID)
+		case l.role != roleCentral || l.ltk != nil:
+			c.status(op, errDisallowed)
+		default:
+			c.status(op, 0)
+			ltk := p.LongTermKey
+			l.ltk = &ltk
+			l.peer.event(evtLEMeta, uint8(subLELongTermKeyRequest), l.remote.handle, p.RandomNumber, p.EncryptedDiversifier)
+		}
+
+	case opLELongTermKeyRequestReply:
+		var p cmd.LELongTermKeyRequestReply
+		if err := decode(b, &p); err != nil {
+			c.complete(op, uint8(errInvalidParams))
+			return
+		}
+		l := c.links[p.ConnectionHandle]
+		if l == nil || l.remote.ltk == nil {
+			c.complete(op, cmd.LELongTermKeyRequestReplyRP{Status: errDisallowed, ConnectionHandle: p.ConnectionHandle})
+			return
+		}
+		c.complete(op, cmd.LELongTermKeyRequestReplyRP{ConnectionHandle: p.ConnectionHandle})
+		ltk := l.remote.ltk
+		l.remote.ltk = nil
+		if *ltk != p.LongTermKey {
+			// The central can't decrypt the peripheral's packets.
+			c.disconnect(l, errMICFailure, errMICFailure)
+			return
+		}
+		c.event(evtEncryptionChange, uint8(0), l.handle, uint8(1))
+		l.peer.event(evtEncryptionChange, uint8(0), l.remote.handle, uint8(1))
+
+	case opLELongTermKeyRequestNegativeReply:
+		var p cmd.LELongTermKeyRequestNegativeReply
+		if err := decode(b, &p); err != nil {
+			c.complete(op, uint8(errInvalidParams))
+			return
+		}
+		l := c.links[p.ConnectionHandle]
+		if l == nil || l.remote.ltk == nil {
+			c.complete(op, cmd.LELongTermKeyRequestNegativeReplyRP{Status: errDisallowed, ConnectionHandle: p.ConnectionHandle})
+			return
+		}
+		c.complete(op, cmd.LELongTermKeyRequestNegativeReplyRP{ConnectionHandle: p.ConnectionHandle})
+		l.remote.ltk = nil
+		l.peer.event(evtEncryptionChange, uint8(errKeyMissing), l.remote.handle, uint8(0))
+
+	default:
+		c.complete(op, uint8(errUnknownCommand))
+	}
+}
+
+// complete queues a Command Complete event with the return parameters rp.
+func (c *Controller) complete(op int, rp interface{}) {
+	c.event(evtCommandComplete, uint8(1), uint16(op), rp)
+}
+
+// status queues a Command Status event.
+func (c *Controller) status(op int, status uint8) {
+	c.event(evtCommandStatus, status, uint8(1), uint16(op))
+}
+
+// reset stops all activities of the controller. The connections are dropped
+// without notifying the host, their peers see them time out.
+func (c *Controller) reset() {
+	c.scanning = false
+	c.stopAdvertising()
+	c.initiating = nil
+	for _, l := range c.links {
+		delete(c.links, l.handle)
+		delete(l.peer.links, l.remote.handle)
+		l.peer.disconnectionComplete(l.remote, errConnTimeout)
+	}
+}
+
+func (c *Controller) startAdvertising() {
+	if c.advertising {
+		return
+	}
+	c.advertising = true
+	c.advStop = make(chan struct{})
+
+	interval := time.Duration(c.advParams.AdvertisingIntervalMin) * 625 * time.Microsecond
+	if interval < minAdvInterval {
+		interval = minAdvInterval
+	}
+	go c.advertise(c.advStop, interval)
+
+	close(c.air.advStarted)
+	c.air.advStarted = make(chan struct{})
+	c.air.connectPending()
+}
+
+func (c *Controller) stopAdvertising() {
+	if !c.advertising {
+		return
+	}
+	c.advertising = false
+	close(c.advStop)
+}
+
+// advertise sends an advertisement to all scanners every interval, until stop is closed.
+func (c *Controller) advertise(stop chan struct{}, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		c.air.Lock()
+		select {
+		case <-stop:
+			c.air.Unlock()
+			return
+		default:
+		}
+		for _, s := range c.air.ctrls {
+			if s != c && s.scanning && s.accepts(s.scanParams.ScanningFilterPolicy, c) {
+				s.receive(c)
+			}
+		}
+		c.air.Unlock()
+
+		select {
+		case <-t.C:
+		case <-stop:
+			return
+		}
+	}
+}
+
+// receive reports an advertisement of adv, and its scan response if scanning actively.
+func (c *Controller) receive(adv *Controller) {
+	switch adv.advParams.AdvertisingType {
+	case advInd, advScanInd:
+		c.advertisingReport(adv.advParams.AdvertisingType, adv.addr, adv.advData)
+		if c.scanParams.LEScanType == 1 {
+			c.advertisingReport(scanRsp, adv.addr, adv.scanRsp)
+		}
+	case advNonconnInd:
+		c.advertisingReport(advNonconnInd, adv.addr, adv.advData)
+	case advDirectInd, advDirectIndLowDC:
+		if adv.advParams.DirectAddress == c.addr {
+			c.advertisingReport(advDirectInd, adv.addr, nil)
+		}
+	}
+}
+
+func (c *Controller) advertisingReport(et uint8, addr [6]byte, data []byte) {
+	if c.filterDup {
+		k := fmt.Sprintf("%X/%d", addr, et)
+		if c.seen[k] {
+			return
+		}
+		c.seen[k] = true
+	}
+	c.event(evtLEMeta, uint8(subLEAdvertisingReport), uint8(1), et, uint8(0), addr, uint8(len(data)), data, rssi)
+}
+
+// accepts reports whether the filter policy lets c receive the packets of peer.
+// The virtual controllers use public addresses only.
+func (c *Controller) accepts(policy uint8, peer *Controller) bool {
+	return policy == filterPolicyAcceptAll || c.acceptList[acceptListEntry{0, peer.addr}]
+}
+
+// initiatesTo reports whether the pending connection of c is to peer.
+func (c *Controller) initiatesTo(peer *Controller) bool {
+	if c.initiating.InitiatorFilterPolicy == filterPolicyAcceptList {
+		return c.accepts(filterPolicyAcceptList, peer)
+	}
+	return c.initiating.PeerAddress == peer.addr
+}
+
+// acceptListInUse reports whether the filter accept list is used by scanning
+// or initiating, and can't be changed.
+func (c *Controller) acceptListInUse() bool {
+	return (c.scanning && c.scanParams.ScanningFilterPolicy == filterPolicyAcceptList) ||
+		(c.initiating != nil && c.initiating.InitiatorFilterPolicy == filterPolicyAcceptList)
+}
+
+// connectable reports whether c accepts a connection from the central.
+func (c *Controller) connectable(central *Controller) bool {
+	if !c.advertising {
+		return false
+	}
+	switch c.advParams.AdvertisingType {
+	case advInd:
+		return true
+	case advDirectInd, advDirectIndLowDC:
+		return c.advParams.DirectAddress == central.addr
+	}
+	return false
+}
+
+// connectPending establishes the pending connections to devices that are advertising.
+func (a *Air) connectPending() {
+	for _, c := range a.ctrls {
+		if c.initiating == nil {
+			continue
+		}
+		for _, p := range a.ctrls {
+			if p != c && c.initiatesTo(p) && p.connectable(c) {
+				a.connect(c, p)
+				break
+			}
+		}
+	}
+}
+
+// connect establishes a connection from central to peripheral.
+func (a *Air) connect(central, peripheral *Controller) {
+	p := central.initiating
+	central.initiating = nil
+	if central.maxConns > 0 && len(central.links) >= central.maxConns {
+		central.connectionComplete(errConnLimit, &link{role: roleCentral}, peripheral.addr)
+		return
+	}
+	peripheral.stopAdvertising()
+
+	cp := connParams{p.ConnIntervalMin, p.ConnLatency, p.SupervisionTimeout}
+	cl := &link{handle: central.newHandle(), role: roleCentral, peer: peripheral, connParams: cp,
+		txOctets: minTxOctets, txTime: minTxTime, txPHY: phy1M}
+	central.links[cl.handle] = cl
+	pl := &link{handle: peripheral.newHandle(), role: rolePeripheral, peer: central, connParams: cp,
+		txOctets: minTxOctets, txTime: minTxTime, txPHY: phy1M}
+	peripheral.links[pl.handle] = pl
+	cl.remote, pl.remote = pl, cl
+
+	central.connectionComplete(0, cl, peripheral.addr)
+	peripheral.connectionComplete(0, pl, central.addr)
+}
+
+// newHandle returns an unused connection handle.
+func (c *Controller) newHandle() uint16 {
+	for {
+		c.nextHandle = c.nextHandle%0x0EFF + 1
+		if _, used := c.links[c.nextHandle]; !used {
+			return c.nextHandle
+		}
+	}
+}
+
+// disconnect terminates a connection, and notifies both ends.
+func (c *Controller) disconnect(l *link, localReason, remoteReason uint8) {
+	delete(c.links, l.handle)
+	delete(l.peer.links, l.remote.handle)
+	c.disconnectionComplete(l, localReason)
+	l.peer.disconnectionComplete(l.remote, remoteReason)
+}
+
+func (c *Controller) connectionComplete(status uint8, l *link, peer [6]byte) {
+	cp := l.connParams
+	c.event(evtLEMeta, uint8(subLEConnectionComplete), status, l.handle, l.role,
+		uint8(0), peer, cp.interval, cp.latency, cp.timeout, uint8(0))
+}
+
+// updateConnParams changes the parameters of a connection, and notifies both ends.
+func (c *Controller) updateConnParams(l *link, cp connParams) {
+	l.connParams, l.remote.connParams = cp, cp
+	c.connectionUpdateComplete(0, l)
+	l.peer.connectionUpdateComplete(0, l.remote)
+}
+
+func (c *Controller) connectionUpdateComplete(status uint8, l *link) {
+	cp := l.connParams
+	c.event(evtLEMeta, uint8(subLEConnectionUpdateComplete), status, l.handle, cp.interval, cp.latency, cp.timeout)
+}
+
+func (c *Controller) dataLengthChange(l *link) {
+	c.event(evtLEMeta, uint8(subLEDataLengthChange), l.handle, l.txOctets, l.txTime, l.remote.txOctets, l.remote.txTime)
+}
+
+func (c *Controller) phyUpdateComplete(l *link) {
+	c.event(evtLEMeta, uint8(subLEPHYUpdateComplete), uint8(0), l.handle, l.txPHY, l.remote.txPHY)
+}
+
+func (c *Controller) disconnectionComplete(l *link, reason uint8) {
+	c.event(evtDisconnectionComplete, uint8(0), l.handle, reason)
+}
+
+// clamp limits v to the range [min, max].
+func clamp(v, min, max uint16) uint16 {
+	switch {
+	case v < min:
+		return min
+	case v > max:
+		return max
+	}
+	return v
+}
+
+// preferredPHY returns the fastest of the PHYs in the preference bitmask phys.
+func preferredPHY(phys uint8) uint8 {
+	switch {
+	case phys&0x02 != 0:
+		return phy2M
+	case phys&0x01 != 0:
+		return phy1M
+	case phys&0x04 != 0:
+		return phyCoded
+	}
+	return phy1M
+}
@@ -0,0 +1,330 @@
+// Package virtual implements an emulated LE controller, which lets HCI
+// instances scan, advertise and connect to each other in-process, without
+// any radio hardware. It is mostly useful for tests.
+//
+// Each Controller is an HCI transport: the host writes commands and ACL
+// data packets, and reads events and ACL data packets, all prefixed with
+// the H4 packet type. Controllers attached to the same Air see each
+// other's advertisements, and can connect to each other.
+package virtual
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+
+	"github.com/rigado/ble/linux/hci/cmd"
+)
+
+// HCI packet types [Vol 4, Part A, 2]
+const (
+	pktTypeCommand = 0x01
+	pktTypeACLData = 0x02
+	pktTypeEvent   = 0x04
+)
+
+// ACL packet boundary flags [Vol 2, Part E, 5.4.2]
+const (
+	pbfHostToControllerStart = 0x00
+	pbfContinuing            = 0x01
+	pbfControllerToHostStart = 0x02
+)
+
+// Buffers reported to the host by LE Read Buffer Size.
+const (
+	aclDataPacketLength = 251
+	numACLDataPackets   = 8
+)
+
+// acceptListSize is the number of devices the filter accept list can hold.
+const acceptListSize = 8
+
+// Air is the medium shared by virtual controllers.
+type Air struct {
+	// All controller state is guarded by the air, as most of the
+	// operations involve two controllers.
+	sync.Mutex
+
+	ctrls []*Controller
+
+	// advStarted is closed, and replaced, each time a controller starts advertising.
+	advStarted chan struct{}
+}
+
+// NewAir returns an empty medium.
+func NewAir() *Air {
+	return &Air{advStarted: make(chan struct{})}
+}
+
+// NewController attaches a controller with the public device address addr,
+// e.g. "00:00:00:00:00:01", to the air.
+func (a *Air) NewController(addr string) (*Controller, error) {
+	mac, err := net.ParseMAC(addr)
+	if err != nil || len(mac) != 6 {
+		return nil, fmt.Errorf("invalid address %q", addr)
+	}
+
+	c := &Controller{
+		air:        a,
+		ready:      make(chan struct{}, 1),
+		done:       make(chan struct{}),
+		acceptList: make(map[acceptListEntry]bool),
+		links:      make(map[uint16]*link),
+	}
+	// HCI carries addresses little endian.
+	for i := range c.addr {
+		c.addr[i] = mac[5-i]
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	for _, o := range a.ctrls {
+		if o.addr == c.addr {
+			return nil, fmt.Errorf("address %v already in use", addr)
+		}
+	}
+	a.ctrls = append(a.ctrls, c)
+	return c, nil
+}
+
+// WaitAdvertising blocks until the controller with the address addr is
+// advertising, or ctx is done.
+func (a *Air) WaitAdvertising(ctx context.Context, addr string) error {
+	mac, err := net.ParseMAC(addr)
+	if err != nil || len(mac) != 6 {
+		return fmt.Errorf("invalid address %q", addr)
+	}
+	var ha [6]byte
+	for i := range ha {
+		ha[i] = mac[5-i]
+	}
+
+	for {
+		a.Lock()
+		advertising := false
+		for _, c := range a.ctrls {
+			if c.addr == ha {
+				advertising = c.advertising
+				break
+			}
+		}
+		started := a.advStarted
+		a.Unlock()
+
+		if advertising {
+			return nil
+		}
+		select {
+		case <-started:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Controller is an emulated LE controller. It implements io.ReadWriteCloser,
+// and is passed to the HCI with ble.OptTransportVirtual.
+type Controller struct {
+	air  *Air
+	addr [6]byte
+
+	// Packets to the host.
+	qmu   sync.Mutex
+	queue [][]byte
+	ready chan struct{}
+
+	done      chan struct{}
+	closeOnce sync.Once
+
+	// Guarded by air.
+	scanParams  cmd.LESetScanParameters
+	scanning    bool
+	filterDup   bool
+	seen        map[string]bool
+	advParams   cmd.LESetAdvertisingParameters
+	advData     []byte
+	scanRsp     []byte
+	advertising bool
+	advStop     chan struct{}
+	initiating  *cmd.LECreateConnection
+	acceptList  map[acceptListEntry]bool
+	links       map[uint16]*link
+	nextHandle  uint16
+	maxConns    int
+}
+
+type acceptListEntry struct {
+	addrType uint8
+	addr     [6]byte
+}
+
+// link is one end of a connection between two controllers.
+type link struct {
+	handle uint16
+	role   uint8
+	peer   *Controller
+	remote *link
+
+	connParams connParams
+
+	// paramsRequested is set while the peripheral's request for new connection
+	// parameters awaits the reply of the central's host.
+	paramsRequested bool
+
+	// Data length and PHY of the PDUs sent on the link.
+	txOctets uint16
+	txTime   uint16
+	txPHY    uint8
+
+	// Long term key of an encryption started by the central, awaiting the
+	// reply of the peripheral's host.
+	ltk *[16]byte
+}
+
+type connParams struct {
+	interval uint16
+	latency  uint16
+	timeout  uint16
+}
+
+// Read returns the next packet for the host.
+// It blocks until a packet is available, and returns io.EOF once the controller is closed.
+func (c *Controller) Read(b []byte) (int, error) {
+	for {
+		c.qmu.Lock()
+		if len(c.queue) > 0 {
+			p := c.queue[0]
+			c.queue = c.queue[1:]
+			c.qmu.Unlock()
+			if len(b) < len(p) {
+				return 0, io.ErrShortBuffer
+			}
+			return copy(b, p), nil
+		}
+		c.qmu.Unlock()
+
+		select {
+		case <-c.ready:
+		case <-c.done:
+			return 0, io.EOF
+		}
+	}
+}
+
+// Write processes a command or ACL data packet from the host.
+func (c *Controller) Write(b []byte) (int, error) {
+	select {
+	case <-c.done:
+		return 0, io.ErrClosedPipe
+	default:
+	}
+
+	if len(b) < 1 {
+		return 0, fmt.Errorf("virtual: empty packet")
+	}
+	switch b[0] {
+	case pktTypeCommand:
+		if len(b) < 4 || len(b) != 4+int(b[3]) {
+			return 0, fmt.Errorf("virtual: invalid command packet: % X", b)
+		}
+		c.command(int(binary.LittleEndian.Uint16(b[1:])), b[4:])
+	case pktTypeACLData:
+		if len(b) < 5 || len(b) != 5+int(binary.LittleEndian.Uint16(b[3:])) {
+			return 0, fmt.Errorf("virtual: invalid acl packet: % X", b)
+		}
+		c.acl(b[1:])
+	default:
+		return 0, fmt.Errorf("virtual: unsupported packet type 0x%02X", b[0])
+	}
+	return len(b), nil
+}
+
+// SetMaxConnections limits the number of connections of the controller.
+// Connections beyond the limit fail with Connection Limit Exceeded.
+// A value of 0, the default, doesn't limit them.
+func (c *Controller) SetMaxConnections(n int) {
+	c.air.Lock()
+	defer c.air.Unlock()
+	c.maxConns = n
+}
+
+// Close detaches the controller from the air. Its peers see their
+// connections to it time out.
+func (c *Controller) Close() error {
+	c.closeOnce.Do(func() {
+		c.air.Lock()
+		c.reset()
+		for i, o := range c.air.ctrls {
+			if o == c {
+				c.air.ctrls = append(c.air.ctrls[:i], c.air.ctrls[i+1:]...)
+				break
+			}
+		}
+		c.air.Unlock()
+		close(c.done)
+	})
+	return nil
+}
+
+// emit queues a packet for the host. It never blocks, so it can be called
+// with the air locked.
+func (c *Controller) emit(p []byte) {
+	c.qmu.Lock()
+	c.queue = append(c.queue, p)
+	c.qmu.Unlock()
+
+	select {
+	case c.ready <- struct{}{}:
+	default:
+	}
+}
+
+// acl forwards an ACL data packet to the peer, and reports the packet as completed.
+func (c *Controller) acl(b []byte) {
+	hdr := binary.LittleEndian.Uint16(b)
+	handle, pbf := hdr&0x0fff, (hdr>>12)&0x3
+
+	c.air.Lock()
+	defer c.air.Unlock()
+
+	l := c.links[handle]
+	if l == nil {
+		return
+	}
+
+	if pbf == pbfHostToControllerStart {
+		pbf = pbfControllerToHostStart
+	}
+	p := make([]byte, 1+len(b))
+	p[0] = pktTypeACLData
+	binary.LittleEndian.PutUint16(p[1:], l.remote.handle|pbf<<12)
+	copy(p[3:], b[2:])
+	l.peer.emit(p)
+
+	c.event(evtNumberOfCompletedPackets, uint8(1), handle, uint16(1))
+}
+
+// event queues an event with the parameters serialized in order.
+func (c *Controller) event(code uint8, params ...interface{}) {
+	buf := &bytes.Buffer{}
+	for _, p := range params {
+		if b, ok := p.([]byte); ok {
+			buf.Write(b)
+			continue
+		}
+		binary.Write(buf, binary.LittleEndian, p)
+	}
+	c.emit(append([]byte{pktTypeEvent, code, uint8(buf.Len())}, buf.Bytes()...))
+}
+
+// decode de-serializes command parameters into a command struct.
+func decode(b []byte, c interface{}) error {
+	if len(b) != binary.Size(c) {
+		return fmt.Errorf("invalid length %d", len(b))
+	}
+	return binary.Read(bytes.NewReader(b), binary.LittleEndian, c)
+}
@@ -0,0 +1,1130 @@
+package virtual_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/rigado/ble"
+	"github.com/rigado/ble/linux"
+	"github.com/rigado/ble/linux/hci/bond"
+	"github.com/rigado/ble/linux/hci/cmd"
+	"github.com/rigado/ble/linux/hci/virtual"
+)
+
+func newDevice(t *testing.T, air *virtual.Air, addr string, opts ...ble.Option) *linux.Device {
+	c, err := air.NewController(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts = append([]ble.Option{ble.OptTransportVirtual(c), ble.OptDialerTimeout(time.Second), ble.OptAdvHandlerSync(true)}, opts...)
+	d, err := linux.NewDevice(opts...)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d
+}
+
+// waitAdvertising waits for the device to advertise.
+func waitAdvertising(t *testing.T, air *virtual.Air, d *linux.Device) {
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := air.WaitAdvertising(ctx, d.Address().String()); err != nil {
+		t.Fatalf("%v not advertising: %v", d.Address(), err)
+	}
+}
+
+// pairOptions configures the devices of connectPair.
+type pairOptions struct {
+	central    []ble.Option
+	peripheral []ble.Option
+	services   []*ble.Service
+}
+
+type pairOption func(*pairOptions)
+
+// centralOpts passes options to the central.
+func centralOpts(opts ...ble.Option) pairOption {
+	return func(o *pairOptions) { o.central = append(o.central, opts...) }
+}
+
+// peripheralOpts passes options to the peripheral.
+func peripheralOpts(opts ...ble.Option) pairOption {
+	return func(o *pairOptions) { o.peripheral = append(o.peripheral, opts...) }
+}
+
+// withServices adds services to the peripheral before it advertises.
+func withServices(svcs ...*ble.Service) pairOption {
+	return func(o *pairOptions) { o.services = append(o.services, svcs...) }
+}
+
+// connectPair connects a central to an advertising peripheral, on an air of
+// their own. The connection is canceled, and the devices are stopped, when the
+// test ends.
+func connectPair(t *testing.T, opts ...pairOption) (central, peripheral *linux.Device, cln ble.Client) {
+	var o pairOptions
+	for _, opt := range opts {
+		opt(&o)
+	}
+
+	air := virtual.NewAir()
+	central = newDevice(t, air, "00:00:00:00:00:01", o.central...)
+	t.Cleanup(func() { central.Stop() })
+	peripheral = newDevice(t, air, "00:00:00:00:00:02", o.peripheral...)
+	t.Cleanup(func() { peripheral.Stop() })
+	for _, svc := range o.services {
+		if err := peripheral.AddService(svc); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+	go peripheral.AdvertiseNameAndServices(ctx, "virtual")
+	waitAdvertising(t, air, peripheral)
+
+	cln, err := central.Dial(context.Background(), peripheral.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { cln.CancelConnection() })
+	return central, peripheral, cln
+}
+
+func TestCentralPeripheral(t *testing.T) {
+	air := virtual.NewAir()
+	central := newDevice(t, air, "00:00:00:00:00:01")
+	defer central.Stop()
+	peripheral := newDevice(t, air, "00:00:00:00:00:02")
+	defer peripheral.Stop()
+
+	value := []byte("hello, central")
+	su := ble.MustParse("00010000-0001-1000-8000-00805F9B34FB")
+	cu := ble.MustParse("00010001-0001-1000-8000-00805F9B34FB")
+	svc := ble.NewService(su)
+	svc.NewCharacteristic(cu).HandleRead(ble.ReadHandlerFunc(func(req ble.Request, rsp ble.ResponseWriter) {
+		rsp.Write(value)
+	}))
+	if err := peripheral.AddService(svc); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go peripheral.AdvertiseNameAndServices(ctx, "virtual", su)
+
+	found := make(chan ble.Advertisement, 1)
+	sctx, scancel := context.WithTimeout(context.Background(), time.Second)
+	defer scancel()
+	scanned := make(chan struct{})
+	go func() {
+		central.Scan(sctx, false, func(a ble.Advertisement) {
+			if a.LocalName() == "virtual" {
+				select {
+				case found <- a:
+				default:
+				}
+			}
+		})
+		close(scanned)
+	}()
+
+	var a ble.Advertisement
+	select {
+	case a = <-found:
+		scancel()
+	case <-sctx.Done():
+		t.Fatal("peripheral not found")
+	}
+	if a.Addr().String() != peripheral.Address().String() {
+		t.Fatalf("advertisement from %v, want %v", a.Addr(), peripheral.Address())
+	}
+
+	// Let the scan stop before dialing.
+	<-scanned
+
+	cln, err := central.Dial(context.Background(), a.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cln.CancelConnection()
+
+	p, err := cln.DiscoverProfile(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := p.FindCharacteristic(ble.NewCharacteristic(cu))
+	if c == nil {
+		t.Fatal("characteristic not discovered")
+	}
+	b, err := cln.ReadCharacteristic(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, value) {
+		t.Fatalf("read %q, want %q", b, value)
+	}
+}
+
+func TestAcceptList(t *testing.T) {
+	air := virtual.NewAir()
+	central := newDevice(t, air, "00:00:00:00:00:01")
+	defer central.Stop()
+	other := newDevice(t, air, "00:00:00:00:00:02")
+	defer other.Stop()
+	listed := newDevice(t, air, "00:00:00:00:00:03")
+	defer listed.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go other.AdvertiseNameAndServices(ctx, "other")
+	go listed.AdvertiseNameAndServices(ctx, "listed")
+
+	if err := central.AddToAcceptList(listed.Address()); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := central.AcceptListSize(); err != nil || n == 0 {
+		t.Fatalf("accept list size %v, err %v", n, err)
+	}
+
+	names := make(chan string, 16)
+	sctx, scancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer scancel()
+	central.ScanAcceptList(sctx, true, func(a ble.Advertisement) {
+		select {
+		case names <- a.LocalName():
+		default:
+		}
+	})
+	close(names)
+
+	n := 0
+	for name := range names {
+		if name != "listed" {
+			t.Fatalf("advertisement from %q, not on the accept list", name)
+		}
+		n++
+	}
+	if n == 0 {
+		t.Fatal("no advertisement from the accept list")
+	}
+
+	dctx, dcancel := context.WithTimeout(context.Background(), time.Second)
+	defer dcancel()
+	cln, err := central.DialAcceptList(dctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cln.CancelConnection()
+	if cln.Addr().String() != listed.Address().String() {
+		t.Fatalf("connected to %v, want %v", cln.Addr(), listed.Address())
+	}
+}
+
+func TestAutoConnect(t *testing.T) {
+	air := virtual.NewAir()
+	central := newDevice(t, air, "00:00:00:00:00:01")
+	defer central.Stop()
+	peripheral := newDevice(t, air, "00:00:00:00:00:02")
+	defer peripheral.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go peripheral.AdvertiseNameAndServices(ctx, "peripheral")
+
+	clients := make(chan ble.Client, 2)
+	actx, acancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer acancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- central.AutoConnect(actx, []ble.Addr{peripheral.Address()}, func(c ble.Client) {
+			clients <- c
+		})
+	}()
+
+	for i := 0; i < 2; i++ {
+		select {
+		case c := <-clients:
+			if c.Addr().String() != peripheral.Address().String() {
+				t.Fatalf("connected to %v, want %v", c.Addr(), peripheral.Address())
+			}
+			if i > 0 {
+				break
+			}
+			// Disconnect, and let the peripheral advertise again.
+			c.CancelConnection()
+			<-c.Disconnected()
+			if err := peripheral.HCI.Advertise(); err != nil {
+				t.Fatal(err)
+			}
+		case err := <-done:
+			t.Fatalf("autoconnect returned: %v", err)
+		}
+	}
+
+	acancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("autoconnect returned %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestAutoConnectBonded(t *testing.T) {
+	air := virtual.NewAir()
+	central := newDevice(t, air, "00:00:00:00:00:01", ble.OptEnableSecurity(bond.NewMemoryBondManager()))
+	defer central.Stop()
+	peripheral := newDevice(t, air, "00:00:00:00:00:02", ble.OptEnableSecurity(bond.NewMemoryBondManager()))
+	defer peripheral.Stop()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go peripheral.AdvertiseNameAndServices(ctx, "peripheral")
+
+	clients := make(chan ble.Client, 2)
+	actx, acancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer acancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- central.AutoConnect(actx, []ble.Addr{peripheral.Address()}, func(c ble.Client) {
+			clients <- c
+		})
+	}()
+
+	encrypted := func(c ble.Client) bool {
+		return c.Conn().(interface{ Encrypted() bool }).Encrypted()
+	}
+	for i := 0; i < 2; i++ {
+		select {
+		case c := <-clients:
+			if i > 0 {
+				// The reconnection is encrypted with the bond before it's handled.
+				if !c.Conn().Bonded() || !encrypted(c) {
+					t.Fatalf("reconnection bonded %v, encrypted %v", c.Conn().Bonded(), encrypted(c))
+				}
+				break
+			}
+			if c.Conn().Bonded() || encrypted(c) {
+				t.Fatal("connection encrypted before pairing")
+			}
+			if err := c.Pair(ble.AuthData{}, time.Second); err != nil {
+				t.Fatal(err)
+			}
+			c.CancelConnection()
+			<-c.Disconnected()
+			if err := peripheral.HCI.Advertise(); err != nil {
+				t.Fatal(err)
+			}
+		case err := <-done:
+			t.Fatalf("autoconnect returned: %v", err)
+		}
+	}
+
+	acancel()
+	if err := <-done; err != context.Canceled {
+		t.Fatalf("autoconnect returned %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestDataLength(t *testing.T) {
+	value := bytes.Repeat([]byte("0123456789"), 40)
+	su := ble.MustParse("00010000-0001-1000-8000-00805F9B34FB")
+	cu := ble.MustParse("00010001-0001-1000-8000-00805F9B34FB")
+	svc := ble.NewService(su)
+	svc.NewCharacteristic(cu).HandleRead(ble.ReadHandlerFunc(func(req ble.Request, rsp ble.ResponseWriter) {
+		rsp.Write(value)
+	}))
+	_, _, cln := connectPair(t, centralOpts(ble.OptConnectMTU(ble.MaxMTU)), withServices(svc))
+
+	if mtu := cln.Conn().TxMTU(); mtu <= ble.DefaultMTU {
+		t.Fatalf("mtu %v not exchanged", mtu)
+	}
+	if dl := cln.Conn().DataLength(); dl != ble.DefaultDataLength {
+		t.Fatalf("initial data length %+v, want %+v", dl, ble.DefaultDataLength)
+	}
+
+	if err := cln.SetDataLength(251, 2120); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; cln.Conn().DataLength().MaxTxOctets != 251; i++ {
+		if i == 100 {
+			t.Fatalf("data length %+v not changed", cln.Conn().DataLength())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	p, err := cln.DiscoverProfile(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := p.FindCharacteristic(ble.NewCharacteristic(cu))
+	if c == nil {
+		t.Fatal("characteristic not discovered")
+	}
+	b, err := cln.ReadCharacteristic(c)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, value) {
+		t.Fatalf("read %d bytes, want %d", len(b), len(value))
+	}
+}
+
+func TestPHY(t *testing.T) {
+	_, _, cln := connectPair(t, centralOpts(ble.OptDefaultPHY(ble.PHYMask1M|ble.PHYMask2M, 0)))
+
+	if tx, rx, err := cln.PHY(); err != nil || tx != ble.PHY1M || rx != ble.PHY1M {
+		t.Fatalf("initial phy tx %v, rx %v, err %v", tx, rx, err)
+	}
+
+	updated := make(chan [2]uint8, 1)
+	cln.Conn().SetPHYHandler(func(tx, rx uint8) {
+		updated <- [2]uint8{tx, rx}
+	})
+	if err := cln.SetPHY(ble.PHYMask2M, ble.PHYMaskCoded, ble.CodedPHYS8); err != nil {
+		t.Fatal(err)
+	}
+	if tx, rx, err := cln.PHY(); err != nil || tx != ble.PHY2M || rx != ble.PHYCoded {
+		t.Fatalf("phy tx %v, rx %v, err %v", tx, rx, err)
+	}
+	select {
+	case u := <-updated:
+		if u != [2]uint8{ble.PHY2M, ble.PHYCoded} {
+			t.Fatalf("phy handler called with %v", u)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("phy handler not called")
+	}
+}
+
+func TestConnParamsPolicy(t *testing.T) {
+	counter := ble.ConnParamsRequest{IntervalMin: 24, IntervalMax: 40, Latency: 0, Timeout: 400}
+	requests := make(chan ble.ConnParamsRequest, 2)
+	policy := func(c ble.Conn, req ble.ConnParamsRequest) (ble.ConnParamsRequest, bool) {
+		requests <- req
+		return counter, req.Latency == 0
+	}
+
+	_, peripheral, cln := connectPair(t, centralOpts(ble.OptConnParamsPolicy(policy)))
+	initial := cln.Conn().ConnParams()
+
+	// The peripheral's controller numbers its connections from 1.
+	update := func(latency uint16) {
+		err := peripheral.HCI.Send(&cmd.LEConnectionUpdate{
+			ConnectionHandle:   1,
+			ConnIntervalMin:    6,
+			ConnIntervalMax:    8,
+			ConnLatency:        latency,
+			SupervisionTimeout: 100,
+		}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case req := <-requests:
+			if req.IntervalMin != 6 || req.IntervalMax != 8 || req.Latency != latency || req.Timeout != 100 {
+				t.Fatalf("policy called with %+v", req)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("policy not called")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+
+	update(4)
+	if p := cln.Conn().ConnParams(); p != initial {
+		t.Fatalf("rejected parameters applied: %+v", p)
+	}
+
+	update(0)
+	want := ble.ConnParams{Interval: counter.IntervalMin, Latency: counter.Latency, Timeout: counter.Timeout}
+	if p := cln.Conn().ConnParams(); p != want {
+		t.Fatalf("parameters %+v, want %+v", p, want)
+	}
+}
+
+func TestRequestConnectionParameters(t *testing.T) {
+	policy := func(c ble.Conn, req ble.ConnParamsRequest) (ble.ConnParamsRequest, bool) {
+		switch req.Latency {
+		case 0:
+			return req, true
+		case 2:
+			req.Latency = 0
+			return req, true
+		}
+		return req, false
+	}
+
+	// The peripheral gets its end of the connection from a request.
+	conns := make(chan ble.Conn, 1)
+	su := ble.MustParse("00010000-0001-1000-8000-00805F9B34FB")
+	cu := ble.MustParse("00010001-0001-1000-8000-00805F9B34FB")
+	svc := ble.NewService(su)
+	svc.NewCharacteristic(cu).HandleRead(ble.ReadHandlerFunc(func(req ble.Request, rsp ble.ResponseWriter) {
+		select {
+		case conns <- req.Conn():
+		default:
+		}
+	}))
+	_, _, cln := connectPair(t, centralOpts(ble.OptConnParamsPolicy(policy)), withServices(svc))
+
+	p, err := cln.DiscoverProfile(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cln.ReadCharacteristic(p.FindCharacteristic(ble.NewCharacteristic(cu))); err != nil {
+		t.Fatal(err)
+	}
+	conn := <-conns
+
+	rctx, rcancel := context.WithTimeout(context.Background(), time.Second)
+	defer rcancel()
+	if err := conn.RequestConnectionParameters(rctx, 80, 100, 4, 600); err != ble.ErrConnParamsRejected {
+		t.Fatalf("rejected request returned %v", err)
+	}
+	if err := conn.RequestConnectionParameters(rctx, 80, 100, 2, 600); err != ble.ErrConnParamsRejected {
+		t.Fatalf("counter-proposed request returned %v", err)
+	}
+	if err := conn.RequestConnectionParameters(rctx, 80, 100, 0, 600); err != nil {
+		t.Fatal(err)
+	}
+	want := ble.ConnParams{Interval: 80, Latency: 0, Timeout: 600}
+	if p := conn.ConnParams(); p != want {
+		t.Fatalf("peripheral parameters %+v, want %+v", p, want)
+	}
+	if p := cln.Conn().ConnParams(); p != want {
+		t.Fatalf("central parameters %+v, want %+v", p, want)
+	}
+	if err := cln.Conn().RequestConnectionParameters(rctx, 80, 100, 0, 600); err == nil {
+		t.Fatal("central requested connection parameters")
+	}
+}
+
+func TestListenL2CAP(t *testing.T) {
+	_, peripheral, cln := connectPair(t)
+
+	l, err := peripheral.ListenL2CAP(0x0080, ble.L2CAPOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	if _, err := peripheral.ListenL2CAP(0x0080, ble.L2CAPOptions{}); err == nil {
+		t.Fatal("listened twice on a psm")
+	}
+	sl, err := peripheral.ListenL2CAP(0x0081, ble.L2CAPOptions{Security: ble.L2CAPSecurityEncryption})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sl.Close()
+
+	if _, err := cln.Conn().OpenLECreditBasedConnection(0x0082); err == nil {
+		t.Fatal("opened a channel on an unknown psm")
+	}
+	if _, err := cln.Conn().OpenLECreditBasedConnection(0x0081); err == nil {
+		t.Fatal("opened a channel requiring encryption")
+	}
+
+	cc, err := cln.Conn().OpenLECreditBasedConnection(0x0080)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ci, pi := cc.Info(), pc.Info(); ci.LocalCID != pi.RemoteCID || ci.RemoteCID != pi.LocalCID {
+		t.Fatalf("central channel %+v, peripheral channel %+v", ci, pi)
+	}
+
+	// The data sent before the channel is subscribed to is kept.
+	if err := cc.Send([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	rx, err := pc.Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case b := <-rx:
+		if string(b) != "hello" {
+			t.Fatalf("received %q", b)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no data received")
+	}
+
+	if err := cc.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case _, ok := <-rx:
+		if ok {
+			t.Fatal("data received after close")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("channel not closed by the central")
+	}
+
+	l.Close()
+	if _, err := l.Accept(); err == nil {
+		t.Fatal("accepted on a closed listener")
+	}
+}
+
+func TestL2CAPSecurity(t *testing.T) {
+	_, peripheral, cln := connectPair(t,
+		centralOpts(ble.OptEnableSecurity(bond.NewMemoryBondManager())),
+		peripheralOpts(ble.OptEnableSecurity(bond.NewMemoryBondManager())))
+
+	el, err := peripheral.ListenL2CAP(0x0080, ble.L2CAPOptions{Security: ble.L2CAPSecurityEncryption, MinKeySize: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer el.Close()
+	al, err := peripheral.ListenL2CAP(0x0081, ble.L2CAPOptions{Security: ble.L2CAPSecurityAuthentication})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer al.Close()
+
+	if _, err := cln.Conn().OpenLECreditBasedConnection(0x0080); err == nil {
+		t.Fatal("opened a channel requiring encryption before pairing")
+	}
+	if err := cln.Pair(ble.AuthData{}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// Just Works pairing encrypts the link with a full size key, without MITM protection.
+	if _, err := cln.Conn().OpenLECreditBasedConnection(0x0080); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cln.Conn().OpenLECreditBasedConnection(0x0081); err == nil {
+		t.Fatal("opened a channel requiring authentication after just works pairing")
+	}
+}
+
+func TestCocNetConn(t *testing.T) {
+	_, peripheral, cln := connectPair(t)
+
+	// Few credits and small PDUs, so writes wait for the reader.
+	l, err := peripheral.ListenL2CAP(0x0080, ble.L2CAPOptions{MTU: 100, MPS: 23, InitialCredits: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	cc, err := cln.Conn().OpenLECreditBasedConnection(0x0080)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pc, err := l.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cn, err := cc.NetConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	pn, err := pc.NetConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pc.Subscribe(); err == nil {
+		t.Fatal("subscribed to a net.Conn channel")
+	}
+
+	pn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := pn.Read(make([]byte, 1)); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("read returned %v, want deadline exceeded", err)
+	}
+	pn.SetReadDeadline(time.Time{})
+
+	data := make([]byte, 1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	written := make(chan error, 1)
+	go func() {
+		_, err := cn.Write(data)
+		written <- err
+	}()
+	select {
+	case err := <-written:
+		t.Fatalf("write of 1000 bytes with 2 credits returned %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(pn, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatal("received data differs")
+	}
+	if err := <-written; err != nil {
+		t.Fatal(err)
+	}
+
+	// The central's MTU is 64.
+	if _, err := pn.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	b := make([]byte, 64)
+	n, err := cn.Read(b)
+	if err != nil || string(b[:n]) != "hello" {
+		t.Fatalf("read %q, %v", b[:n], err)
+	}
+
+	if err := pn.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := cn.Read(b); err != io.EOF {
+		t.Fatalf("read returned %v after close, want EOF", err)
+	}
+}
+
+func TestEnhancedCreditBasedConnections(t *testing.T) {
+	_, peripheral, cln := connectPair(t)
+
+	l, err := peripheral.ListenL2CAP(0x0080, ble.L2CAPOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if _, err := cln.Conn().OpenEnhancedCreditBasedConnections(0x0081, 2, ble.L2CAPOptions{}); err == nil {
+		t.Fatal("opened channels on an unknown psm")
+	}
+
+	ccs, err := cln.Conn().OpenEnhancedCreditBasedConnections(0x0080, 3, ble.L2CAPOptions{MTU: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ccs) != 3 {
+		t.Fatalf("opened %v channels, want 3", len(ccs))
+	}
+	var pcs []ble.LECreditBasedConnection
+	for range ccs {
+		pc, err := l.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if pc.Info().MTU != 100 {
+			t.Fatalf("peripheral channel %+v, want mtu 100", pc.Info())
+		}
+		pcs = append(pcs, pc)
+	}
+
+	rx, err := pcs[2].Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ccs[2].Send([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case b := <-rx:
+		if string(b) != "hello" {
+			t.Fatalf("received %q", b)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no data received")
+	}
+
+	if err := cln.Conn().ReconfigureCreditBasedConnections(ccs, 300, 250); err != nil {
+		t.Fatal(err)
+	}
+	for _, pc := range pcs {
+		if i := pc.Info(); i.MTU != 300 || i.MPS != 250 {
+			t.Fatalf("reconfigured peripheral channel %+v", i)
+		}
+	}
+	if err := cln.Conn().ReconfigureCreditBasedConnections(ccs, 200, 250); err == nil {
+		t.Fatal("reduced the mtu")
+	}
+
+	if err := cln.Conn().DisconnectCreditBasedConnections(ccs[2:]); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case _, ok := <-rx:
+		if ok {
+			t.Fatal("data received after disconnection")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("channel not disconnected")
+	}
+}
+
+func TestEATT(t *testing.T) {
+	// The reads are served slowly, to see how many are served at once.
+	var mu sync.Mutex
+	reading, maxReading := 0, 0
+	su := ble.MustParse("00010000-0001-1000-8000-00805F9B34FB")
+	svc := ble.NewService(su)
+	var cus []ble.UUID
+	for i := 0; i < 4; i++ {
+		cu := ble.MustParse(fmt.Sprintf("0001000%d-0001-1000-8000-00805F9B34FB", i+1))
+		cus = append(cus, cu)
+		svc.NewCharacteristic(cu).HandleRead(ble.ReadHandlerFunc(func(req ble.Request, rsp ble.ResponseWriter) {
+			mu.Lock()
+			reading++
+			if reading > maxReading {
+				maxReading = reading
+			}
+			mu.Unlock()
+
+			time.Sleep(100 * time.Millisecond)
+			rsp.Write(cu[12:])
+
+			mu.Lock()
+			reading--
+			mu.Unlock()
+		}))
+	}
+	_, _, cln := connectPair(t,
+		centralOpts(ble.OptEATT(3), ble.OptEnableSecurity(bond.NewMemoryBondManager())),
+		peripheralOpts(ble.OptEATTServer(true), ble.OptEnableSecurity(bond.NewMemoryBondManager())),
+		withServices(svc))
+
+	p, err := cln.DiscoverProfile(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cs []*ble.Characteristic
+	for _, cu := range cus {
+		c := p.FindCharacteristic(ble.NewCharacteristic(cu))
+		if c == nil {
+			t.Fatalf("characteristic %v not discovered", cu)
+		}
+		cs = append(cs, c)
+	}
+
+	// readAll reads the characteristics at once, and returns how many reads
+	// were served at once.
+	readAll := func() int {
+		mu.Lock()
+		maxReading = 0
+		mu.Unlock()
+
+		var wg sync.WaitGroup
+		errc := make(chan error, len(cs))
+		for _, c := range cs {
+			wg.Add(1)
+			go func(c *ble.Characteristic) {
+				defer wg.Done()
+				b, err := cln.ReadCharacteristic(c)
+				if err == nil && !bytes.Equal(b, c.UUID[12:]) {
+					err = fmt.Errorf("read %q from %v", b, c.UUID)
+				}
+				errc <- err
+			}(c)
+		}
+		wg.Wait()
+		close(errc)
+		for err := range errc {
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		return maxReading
+	}
+
+	// The bearers are only opened on an encrypted link.
+	if n := readAll(); n != 1 {
+		t.Fatalf("%v reads served at once before pairing, want 1", n)
+	}
+
+	if err := cln.Pair(ble.AuthData{}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	// The bearers are opened in the background once the link is encrypted.
+	deadline := time.Now().Add(time.Second)
+	for {
+		n := readAll()
+		if n == len(cs) {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%v reads served at once, want %v", n, len(cs))
+		}
+	}
+}
+
+func TestReadMultipleCharacteristics(t *testing.T) {
+	values := [][]byte{
+		[]byte("short"),
+		bytes.Repeat([]byte("0123456789"), 2),
+		[]byte("left out"),
+	}
+	svc := ble.NewService(ble.MustParse("00010000-0001-1000-8000-00805F9B34FB"))
+	for i, v := range values {
+		v := v
+		c := svc.NewCharacteristic(ble.MustParse(fmt.Sprintf("0001000%d-0001-1000-8000-00805F9B34FB", i+1)))
+		c.HandleRead(ble.ReadHandlerFunc(func(req ble.Request, rsp ble.ResponseWriter) {
+			b := v[req.Offset():]
+			if len(b) > rsp.Cap() {
+				b = b[:rsp.Cap()]
+			}
+			rsp.Write(b)
+		}))
+	}
+	_, _, cln := connectPair(t, withServices(svc))
+
+	p, err := cln.DiscoverProfile(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cs []*ble.Characteristic
+	for _, c := range svc.Characteristics {
+		cs = append(cs, p.FindCharacteristic(c))
+	}
+
+	// The second value is truncated and the third left out of the response,
+	// they're read with further requests.
+	vv, err := cln.ReadMultipleCharacteristics(cs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, v := range values {
+		if !bytes.Equal(vv[i], v) || !bytes.Equal(cs[i].Value, v) {
+			t.Fatalf("read %q, value %q, want %q", vv[i], cs[i].Value, v)
+		}
+	}
+}
+
+func TestSignedWrite(t *testing.T) {
+	writes := make(chan string, 2)
+	su := ble.MustParse("00010000-0001-1000-8000-00805F9B34FB")
+	signedUUID := ble.MustParse("00010001-0001-1000-8000-00805F9B34FB")
+	plainUUID := ble.MustParse("00010002-0001-1000-8000-00805F9B34FB")
+	svc := ble.NewService(su)
+	for _, cu := range []ble.UUID{signedUUID, plainUUID} {
+		c := svc.NewCharacteristic(cu)
+		c.HandleWrite(ble.WriteHandlerFunc(func(req ble.Request, rsp ble.ResponseWriter) {
+			writes <- string(req.Data())
+		}))
+		if cu.Equal(signedUUID) {
+			c.Property = ble.CharSignedWrite
+		}
+	}
+	central, peripheral, cln := connectPair(t,
+		centralOpts(ble.OptEnableSecurity(bond.NewMemoryBondManager())),
+		peripheralOpts(ble.OptEnableSecurity(bond.NewMemoryBondManager())),
+		withServices(svc))
+
+	discover := func(cln ble.Client) (*ble.Characteristic, *ble.Characteristic) {
+		p, err := cln.DiscoverProfile(true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p.FindCharacteristic(ble.NewCharacteristic(signedUUID)), p.FindCharacteristic(ble.NewCharacteristic(plainUUID))
+	}
+
+	// Without a signing key, the write fails.
+	signed, _ := discover(cln)
+	if err := cln.WriteCharacteristic(signed, []byte("unsigned"), true); err == nil {
+		t.Fatal("signed write without a signing key")
+	}
+	if err := cln.Pair(ble.AuthData{}, time.Second); err != nil {
+		t.Fatal(err)
+	}
+	cln.CancelConnection()
+	<-cln.Disconnected()
+	if err := peripheral.HCI.Advertise(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The reconnection isn't encrypted, so the writes are signed.
+	cln, err := central.Dial(context.Background(), peripheral.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cln.CancelConnection()
+	signed, plain := discover(cln)
+	if err := cln.WriteCharacteristic(signed, []byte("signed"), true); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case w := <-writes:
+		if w != "signed" {
+			t.Fatalf("wrote %q", w)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("signed write not handled")
+	}
+
+	// A signed write to a characteristic without the property is dropped.
+	forged := *plain
+	forged.Property = ble.CharSignedWrite
+	if err := cln.WriteCharacteristic(&forged, []byte("forged"), true); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case w := <-writes:
+		t.Fatalf("signed write %q handled", w)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+func TestServiceChanged(t *testing.T) {
+	newService := func(u string) *ble.Service {
+		svc := ble.NewService(ble.MustParse(u))
+		svc.NewCharacteristic(ble.MustParse(u)).SetValue([]byte(u[:8]))
+		return svc
+	}
+	svcA := newService("000A0000-0001-1000-8000-00805F9B34FB")
+	svcB := newService("000B0000-0001-1000-8000-00805F9B34FB")
+	_, peripheral, cln := connectPair(t, withServices(svcA))
+
+	p, err := cln.DiscoverProfile(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sc := p.FindCharacteristic(ble.NewCharacteristic(ble.ServiceChangedUUID))
+	if sc == nil {
+		t.Fatal("service changed not discovered")
+	}
+	ranges := make(chan []byte, 4)
+	if err := cln.Subscribe(sc, true, func(id uint, b []byte) { ranges <- b }); err != nil {
+		t.Fatal(err)
+	}
+
+	indicated := func(svc *ble.Service) {
+		t.Helper()
+		select {
+		case b := <-ranges:
+			want := []byte{byte(svc.Handle), byte(svc.Handle >> 8), byte(svc.EndHandle), byte(svc.EndHandle >> 8)}
+			if !bytes.Equal(b, want) {
+				t.Fatalf("services changed % X, want % X", b, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatal("services changed not indicated")
+		}
+	}
+
+	if err := peripheral.AddService(svcB); err != nil {
+		t.Fatal(err)
+	}
+	indicated(svcB)
+	if svcB.Handle <= svcA.EndHandle {
+		t.Fatalf("service b at 0x%04X, in service a 0x%04X-0x%04X", svcB.Handle, svcA.Handle, svcA.EndHandle)
+	}
+
+	handleB := svcB.Handle
+	if err := peripheral.RemoveService(svcA); err != nil {
+		t.Fatal(err)
+	}
+	indicated(svcA)
+
+	p, err = cln.DiscoverProfile(true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.FindService(svcA) != nil {
+		t.Fatal("removed service discovered")
+	}
+	s := p.FindService(svcB)
+	if s == nil || s.Handle != handleB {
+		t.Fatalf("service b %+v, want handle 0x%04X", s, handleB)
+	}
+	b, err := cln.ReadCharacteristic(s.Characteristics[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "000B0000" {
+		t.Fatalf("read %q", b)
+	}
+}
+
+func TestDatabaseHash(t *testing.T) {
+	newService := func(u string) *ble.Service {
+		svc := ble.NewService(ble.MustParse(u))
+		svc.NewCharacteristic(ble.MustParse(u)).SetValue([]byte(u[:8]))
+		return svc
+	}
+	svcA := newService("000A0000-0001-1000-8000-00805F9B34FB")
+	svcB := newService("000B0000-0001-1000-8000-00805F9B34FB")
+	central, peripheral, cln := connectPair(t, withServices(svcA))
+
+	p, err := cln.DiscoverAndCacheProfile(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(p.Hash) != 16 {
+		t.Fatalf("database hash % X", p.Hash)
+	}
+	csf := p.FindCharacteristic(ble.NewCharacteristic(ble.ClientSupportedFeaturesUUID))
+	if csf == nil {
+		t.Fatal("client supported features not discovered")
+	}
+	if err := cln.WriteCharacteristic(csf, []byte{0x01}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := cln.WriteCharacteristic(csf, []byte{0x00}, false); err != ble.ErrValueNotAllowed {
+		t.Fatalf("robust caching disabled: %v", err)
+	}
+
+	// The hash is unchanged, the profile isn't rediscovered.
+	p2, err := cln.DiscoverAndCacheProfile(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p2 != p {
+		t.Fatal("profile rediscovered")
+	}
+
+	if err := peripheral.AddService(svcB); err != nil {
+		t.Fatal(err)
+	}
+
+	// The client is change-unaware until it's told it's out of sync.
+	c := p.FindCharacteristic(ble.NewCharacteristic(svcA.Characteristics[0].UUID))
+	if _, err := cln.ReadCharacteristic(c); err != ble.ErrDBOutOfSync {
+		t.Fatalf("read while change-unaware: %v", err)
+	}
+	if _, err := cln.ReadCharacteristic(c); err != nil {
+		t.Fatal(err)
+	}
+
+	p3, err := cln.DiscoverAndCacheProfile(false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Equal(p3.Hash, p.Hash) {
+		t.Fatal("database hash unchanged")
+	}
+	if p3.FindService(svcB) == nil {
+		t.Fatal("added service not discovered")
+	}
+
+	// The state of a client which isn't bonded isn't kept once it disconnects.
+	cln.CancelConnection()
+	<-cln.Disconnected()
+	if err := peripheral.HCI.Advertise(); err != nil {
+		t.Fatal(err)
+	}
+	cln, err = central.Dial(context.Background(), peripheral.Address())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer cln.CancelConnection()
+	if _, err := cln.DiscoverProfile(true); err != nil {
+		t.Fatal(err)
+	}
+	b, err := cln.ReadCharacteristic(p3.FindCharacteristic(ble.NewCharacteristic(ble.ClientSupportedFeaturesUUID)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(b, []byte{0x00}) {
+		t.Fatalf("client supported features % X after reconnecting", b)
+	}
+}
@@ -0,0 +1,224 @@
+package linux
+
+import (
+	"context"
+	"strings"
+	"sync"
+
+	"github.com/pkg/errors"
+	"github.com/rigado/ble"
+	"github.com/rigado/ble/linux/hci"
+)
+
+// ErrNoFreeDevice is returned by DevicePool.Dial when none of the radios can take another connection.
+var ErrNoFreeDevice = errors.New("no device with a free connection slot")
+
+// DevicePool drives several HCI controllers, e.g. the radios of a gateway, as one.
+// Scanning runs on all of them, and connections are spread across them.
+type DevicePool struct {
+	devices []*Device
+
+	sync.Mutex
+	maxConns int
+	limit    map[*Device]int
+	dialing  map[*Device]bool
+
+	// dialed is closed, and replaced, whenever a device is done dialing.
+	dialed chan struct{}
+}
+
+// NewDevicePool opens a Device for each of the transport options, e.g.
+// ble.OptTransportHCISocket or ble.OptTransportH4Uart. The remaining options
+// are applied to every device.
+func NewDevicePool(transports []ble.Option, opts ...ble.Option) (*DevicePool, error) {
+	if len(transports) == 0 {
+		return nil, errors.New("no transports")
+	}
+
+	p := &DevicePool{
+		limit:   make(map[*Device]int),
+		dialing: make(map[*Device]bool),
+		dialed:  make(chan struct{}),
+	}
+	for i, t := range transports {
+		dopts := append([]ble.Option{t}, opts...)
+		d, err := NewDevice(dopts...)
+		if err != nil {
+			p.Stop()
+			return nil, errors.Wrapf(err, "can't open device %d", i)
+		}
+		p.devices = append(p.devices, d)
+	}
+	return p, nil
+}
+
+// Devices returns the devices of the pool, in the order of the transports.
+func (p *DevicePool) Devices() []*Device {
+	return p.devices
+}
+
+// SetMaxConnections limits the number of connections per device.
+// A value of 0, the default, only limits the devices once their controller
+// refused a connection for lack of resources.
+func (p *DevicePool) SetMaxConnections(n int) {
+	p.Lock()
+	defer p.Unlock()
+	p.maxConns = n
+}
+
+// Stop closes all devices of the pool.
+func (p *DevicePool) Stop() error {
+	var err error
+	for _, d := range p.devices {
+		if e := d.Stop(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// ControllerAdvertisement is an advertisement received by a device of a DevicePool.
+// ToMap adds the address of the receiving controller as AdvertisementMapKeys.Controller.
+type ControllerAdvertisement struct {
+	ble.Advertisement
+	Controller ble.Addr
+}
+
+// ToMap returns the advertisement fields, tagged with the controller address.
+func (a *ControllerAdvertisement) ToMap() (map[string]interface{}, error) {
+	m, err := a.Advertisement.ToMap()
+	if m != nil {
+		m[ble.AdvertisementMapKeys.Controller] = strings.Replace(a.Controller.String(), ":", "", -1)
+	}
+	return m, err
+}
+
+// Scan scans on all devices until ctx is done, and passes the merged
+// advertisements to h as *ControllerAdvertisement.
+func (p *DevicePool) Scan(ctx context.Context, allowDup bool, h ble.AdvHandler) error {
+	if err := p.NonblockingScan(allowDup, h); err != nil {
+		return err
+	}
+	<-ctx.Done()
+	if err := p.StopScan(); err != nil {
+		return err
+	}
+	return ctx.Err()
+}
+
+// NonblockingScan starts scanning on all devices, and passes the merged
+// advertisements to h as *ControllerAdvertisement.
+func (p *DevicePool) NonblockingScan(allowDup bool, h ble.AdvHandler) error {
+	for i, d := range p.devices {
+		ctrl := d.Address()
+		ah := func(a ble.Advertisement) {
+			h(&ControllerAdvertisement{Advertisement: a, Controller: ctrl})
+		}
+		if err := d.NonblockingScan(allowDup, ah); err != nil {
+			for _, started := range p.devices[:i] {
+				started.StopScan()
+			}
+			return errors.Wrapf(err, "can't scan on %s", ctrl)
+		}
+	}
+	return nil
+}
+
+// StopScan stops scanning on all devices.
+func (p *DevicePool) StopScan() error {
+	var err error
+	for _, d := range p.devices {
+		if e := d.StopScan(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return err
+}
+
+// Dial connects to a on the device with the fewest connections that is not
+// already dialing and has a free connection slot. If the devices with a free
+// slot are all dialing, it waits for one of them to be done. If the controller
+// refuses the connection for lack of resources, the next device is tried.
+func (p *DevicePool) Dial(ctx context.Context, a ble.Addr) (ble.Client, error) {
+	tried := make(map[*Device]bool)
+	for {
+		d, dialed := p.pick(tried)
+		if d == nil && dialed != nil {
+			select {
+			case <-dialed:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		if d == nil {
+			return nil, ErrNoFreeDevice
+		}
+		tried[d] = true
+
+		cln, err := d.Dial(ctx, a)
+		p.Lock()
+		delete(p.dialing, d)
+		close(p.dialed)
+		p.dialed = make(chan struct{})
+		if err != nil && isConnLimit(err) {
+			// Remember the controller's capacity.
+			p.limit[d] = d.HCI.Connections()
+			p.Unlock()
+			continue
+		}
+		p.Unlock()
+		return cln, err
+	}
+}
+
+// pick reserves the least loaded device with a free connection slot. If the
+// devices with a free slot are all dialing, it returns the channel closed once
+// one of them is done instead.
+func (p *DevicePool) pick(tried map[*Device]bool) (*Device, <-chan struct{}) {
+	p.Lock()
+	defer p.Unlock()
+
+	var best *Device
+	bestConns := 0
+	busy := false
+	for _, d := range p.devices {
+		if tried[d] {
+			continue
+		}
+		n := d.HCI.Connections()
+		if p.maxConns > 0 && n >= p.maxConns {
+			continue
+		}
+		if l, ok := p.limit[d]; ok {
+			if n >= l {
+				continue
+			}
+			// A connection was closed since, the controller may have a slot again.
+			delete(p.limit, d)
+		}
+		if p.dialing[d] {
+			busy = true
+			continue
+		}
+		if best == nil || n < bestConns {
+			best, bestConns = d, n
+		}
+	}
+	if best != nil {
+		p.dialing[best] = true
+		return best, nil
+	}
+	if busy {
+		return nil, p.dialed
+	}
+	return nil, nil
+}
+
+func isConnLimit(err error) bool {
+	switch errors.Cause(err) {
+	case hci.ErrConnLimit, hci.ErrMemoryCapacity, hci.ErrLimitedResource:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,147 @@
+package linux
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/rigado/ble"
+	"github.com/rigado/ble/linux/hci/virtual"
+)
+
+func newController(t *testing.T, air *virtual.Air, addr string) *virtual.Controller {
+	c, err := air.NewController(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c
+}
+
+// newDevicePool returns a pool of a device for each of the controllers.
+func newDevicePool(t *testing.T, ctrls ...*virtual.Controller) *DevicePool {
+	var transports []ble.Option
+	for _, c := range ctrls {
+		transports = append(transports, ble.OptTransportVirtual(c))
+	}
+	p, err := NewDevicePool(transports, ble.OptDialerTimeout(time.Second), ble.OptAdvHandlerSync(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Stop() })
+	return p
+}
+
+// advertisingPeripherals returns advertising peripherals of the addresses.
+func advertisingPeripherals(t *testing.T, ctx context.Context, air *virtual.Air, addrs ...string) []*Device {
+	var ps []*Device
+	for _, addr := range addrs {
+		p, err := NewDevice(ble.OptTransportVirtual(newController(t, air, addr)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { p.Stop() })
+		go p.AdvertiseNameAndServices(ctx, "peripheral")
+
+		wctx, cancel := context.WithTimeout(ctx, time.Second)
+		err = air.WaitAdvertising(wctx, addr)
+		cancel()
+		if err != nil {
+			t.Fatalf("%v not advertising: %v", addr, err)
+		}
+		ps = append(ps, p)
+	}
+	return ps
+}
+
+func TestDevicePool(t *testing.T) {
+	air := virtual.NewAir()
+	pool := newDevicePool(t, newController(t, air, "00:00:00:00:00:01"), newController(t, air, "00:00:00:00:00:02"))
+	pool.SetMaxConnections(1)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ps := advertisingPeripherals(t, ctx, air, "00:00:00:00:01:01", "00:00:00:00:01:02", "00:00:00:00:01:03")
+
+	// The connections are spread across the devices.
+	used := make(map[string]bool)
+	for _, p := range ps[:2] {
+		cln, err := pool.Dial(context.Background(), p.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cln.CancelConnection()
+		used[cln.Conn().LocalAddr().String()] = true
+	}
+	if len(used) != 2 {
+		t.Fatalf("connections made by %v", used)
+	}
+
+	if _, err := pool.Dial(context.Background(), ps[2].Address()); err != ErrNoFreeDevice {
+		t.Fatalf("dial with no free device returned %v", err)
+	}
+}
+
+func TestDevicePoolConnLimit(t *testing.T) {
+	air := virtual.NewAir()
+	c1 := newController(t, air, "00:00:00:00:00:01")
+	c2 := newController(t, air, "00:00:00:00:00:02")
+	c1.SetMaxConnections(1)
+	c2.SetMaxConnections(1)
+	pool := newDevicePool(t, c1, c2)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ps := advertisingPeripherals(t, ctx, air, "00:00:00:00:01:01", "00:00:00:00:01:02", "00:00:00:00:01:03")
+
+	for _, p := range ps[:2] {
+		cln, err := pool.Dial(context.Background(), p.Address())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer cln.CancelConnection()
+	}
+
+	// The controllers refuse the third connection in the connection complete
+	// event. Both are tried, well before the dialer timeout.
+	start := time.Now()
+	if _, err := pool.Dial(context.Background(), ps[2].Address()); err != ErrNoFreeDevice {
+		t.Fatalf("dial beyond the controller limits returned %v", err)
+	}
+	if d := time.Since(start); d >= time.Second {
+		t.Fatalf("dial took %v", d)
+	}
+	for _, d := range pool.Devices() {
+		if l, ok := pool.limit[d]; !ok || l != 1 {
+			t.Fatalf("limit of %v is %v, %v", d.Address(), l, ok)
+		}
+	}
+}
+
+func TestDevicePoolBusy(t *testing.T) {
+	air := virtual.NewAir()
+	pool := newDevicePool(t, newController(t, air, "00:00:00:00:00:01"))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ps := advertisingPeripherals(t, ctx, air, "00:00:00:00:01:01", "00:00:00:00:01:02")
+
+	// The device dials one peripheral after the other.
+	type result struct {
+		cln ble.Client
+		err error
+	}
+	results := make(chan result, len(ps))
+	for _, p := range ps {
+		go func(a ble.Addr) {
+			cln, err := pool.Dial(context.Background(), a)
+			results <- result{cln, err}
+		}(p.Address())
+	}
+	for range ps {
+		r := <-results
+		if r.err != nil {
+			t.Fatal(r.err)
+		}
+		defer r.cln.CancelConnection()
+	}
+}
@@ -26,6 +26,26 @@ var funcMap = template.FuncMap{
 		s = strings.Replace(s, "_", "", -1)
 		return s
 	},
+	"slice": func(t string) bool {
+		return strings.HasPrefix(t, "[]")
+	},
+	"elemSize": func(t string) int {
+		if t == "[]uint16" {
+			return 2
+		}
+		return 1
+	},
+	// variable reports whether the fields include slices, which are variable length.
+	"variable": func(fields []field) bool {
+		for _, f := range fields {
+			for _, t := range f {
+				if strings.HasPrefix(t, "[]") {
+					return true
+				}
+			}
+		}
+		return false
+	},
 	"reset": func() string {
 		cnt = 0
 		return ""
@@ -93,6 +113,9 @@ var funcMap = template.FuncMap{
 		case "uint8":
 			s = fmt.Sprintf("func (r %s) %s () %s { return r[%d]}\n", n, k, v, cnt)
 			cnt++
+		case "int8":
+			s = fmt.Sprintf("func (r %s) %s () %s { return int8(r[%d])}\n", n, k, v, cnt)
+			cnt++
 		case "uint16":
 			s = fmt.Sprintf("func (r %s) %s () %s { return binary.LittleEndian.Uint16(r[%d:])}\n", n, k, v, cnt)
 			cnt += 2
@@ -284,7 +307,7 @@ func main() {
 		}
 		genEvt(b, w, t)
 	case "signal":
-		fmt.Fprintf(w, "package l2cap\n")
+		fmt.Fprintf(w, "package hci\n")
 		t, err := template.New(*tmpl).Funcs(funcMap).Parse(string(input("signal.tmpl")))
 		if err != nil {
 			log.Fatalf("parsing: %s", err)
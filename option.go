@@ -1,6 +1,7 @@
 package ble
 
 import (
+	"io"
 	"time"
 
 	"github.com/rigado/ble/linux/hci/cmd"
@@ -9,8 +10,11 @@ import (
 // DeviceOption is an interface which the device should implement to allow using configuration options
 type DeviceOption interface {
 	SetDialerTimeout(time.Duration) error
+	SetConnectMTU(mtu int) error
+	SetDefaultPHY(tx, rx uint8) error
 	SetListenerTimeout(time.Duration) error
 	SetConnParams(cmd.LECreateConnection) error
+	SetConnParamsPolicy(ConnParamsPolicy) error
 	SetScanParams(cmd.LESetScanParameters) error
 	SetAdvParams(cmd.LESetAdvertisingParameters) error
 	SetPeripheralRole() error
@@ -22,7 +26,17 @@ type DeviceOption interface {
 	SetTransportHCISocket(id int) error
 	SetTransportH4Socket(addr string, timeout time.Duration) error
 	SetTransportH4Uart(path string, baud int) error
+	SetTransportVirtual(rwc io.ReadWriteCloser) error
 	SetGattCacheFile(filename string)
+	SetGattCache(c GattCache)
+	SetExtendedAdvertising(enable bool) error
+	SetEATT(bearers int) error
+	SetEATTServer(enable bool) error
+	SetPairingAgent(a PairingAgent) error
+	SetIOCapability(c IOCapability) error
+	SetMITMProtection(enable bool) error
+	SetBonding(enable bool) error
+	SetSecureConnectionsOnly(enable bool) error
 }
 
 // An Option is a configuration function, which configures the device.
@@ -41,6 +55,21 @@ func OptDialerTimeout(d time.Duration) Option {
 	}
 }
 
+// OptConnectMTU exchanges the ATT_MTU right after connecting to a peripheral.
+func OptConnectMTU(mtu int) Option {
+	return func(opt DeviceOption) error {
+		return opt.SetConnectMTU(mtu)
+	}
+}
+
+// OptDefaultPHY sets the PHYs preferred for all connections, as bitmasks of
+// PHYMask1M, PHYMask2M and PHYMaskCoded; 0 means no preference.
+func OptDefaultPHY(tx, rx uint8) Option {
+	return func(opt DeviceOption) error {
+		return opt.SetDefaultPHY(tx, rx)
+	}
+}
+
 // OptListenerTimeout sets dialing timeout for Listener.
 func OptListenerTimeout(d time.Duration) Option {
 	return func(opt DeviceOption) error {
@@ -57,6 +86,14 @@ func OptConnParams(param cmd.LECreateConnection) Option {
 	}
 }
 
+// OptConnParamsPolicy sets the policy deciding on the connection parameter requests
+// of remote devices. Without a policy, valid parameters are accepted.
+func OptConnParamsPolicy(p ConnParamsPolicy) Option {
+	return func(opt DeviceOption) error {
+		return opt.SetConnParamsPolicy(p)
+	}
+}
+
 // OptScanParams overrides default scanning parameters.
 func OptScanParams(param cmd.LESetScanParameters) Option {
 	return func(opt DeviceOption) error {
@@ -137,9 +174,92 @@ func OptTransportH4Uart(path string, baud int) Option {
 	}
 }
 
+// OptTransportVirtual set an in-process transport, e.g. an emulated controller of
+// the linux/hci/virtual package
+func OptTransportVirtual(rwc io.ReadWriteCloser) Option {
+	return func(opt DeviceOption) error {
+		return opt.SetTransportVirtual(rwc)
+	}
+}
+
+// OptGattCacheFile caches the discovered profiles in the directory filename, see
+// the cache package.
 func OptGattCacheFile(filename string) Option {
 	return func(opt DeviceOption) error {
 		opt.SetGattCacheFile(filename)
 		return nil
 	}
 }
+
+// OptGattCache caches the discovered profiles in c, e.g. a cache of the cache
+// package configured with a TTL.
+func OptGattCache(c GattCache) Option {
+	return func(opt DeviceOption) error {
+		opt.SetGattCache(c)
+		return nil
+	}
+}
+
+// OptPairingAgent sets the agent interacting with the user during pairing. Without
+// an agent, the device pairs with the NoInputNoOutput IO capability, unless the
+// AuthData passed to Pair holds a passkey.
+func OptPairingAgent(a PairingAgent) Option {
+	return func(opt DeviceOption) error {
+		return opt.SetPairingAgent(a)
+	}
+}
+
+// OptIOCapability sets the input and output capabilities advertised when pairing,
+// if there is a pairing agent.
+func OptIOCapability(c IOCapability) Option {
+	return func(opt DeviceOption) error {
+		return opt.SetIOCapability(c)
+	}
+}
+
+// OptMITMProtection requires pairing methods protecting against man-in-the-middle
+// attacks, pairing with Just Works fails.
+func OptMITMProtection(enable bool) Option {
+	return func(opt DeviceOption) error {
+		return opt.SetMITMProtection(enable)
+	}
+}
+
+// OptBonding stores the keys distributed when pairing, so the devices can encrypt
+// the following connections without pairing again.
+func OptBonding(enable bool) Option {
+	return func(opt DeviceOption) error {
+		return opt.SetBonding(enable)
+	}
+}
+
+// OptSecureConnectionsOnly refuses legacy pairing.
+func OptSecureConnectionsOnly(enable bool) Option {
+	return func(opt DeviceOption) error {
+		return opt.SetSecureConnectionsOnly(enable)
+	}
+}
+
+// OptExtendedAdvertising uses the LE Advertising Extensions commands for scanning,
+// advertising and connecting, if the controller supports them.
+func OptExtendedAdvertising(enable bool) Option {
+	return func(opt DeviceOption) error {
+		return opt.SetExtendedAdvertising(enable)
+	}
+}
+
+// OptEATT sets the number of Enhanced ATT bearers the device opens as a central,
+// once the link is encrypted.
+func OptEATT(bearers int) Option {
+	return func(opt DeviceOption) error {
+		return opt.SetEATT(bearers)
+	}
+}
+
+// OptEATTServer accepts the Enhanced ATT bearers opened by remote clients, on
+// encrypted links only.
+func OptEATTServer(enable bool) Option {
+	return func(opt DeviceOption) error {
+		return opt.SetEATTServer(enable)
+	}
+}
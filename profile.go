@@ -33,6 +33,10 @@ const (
 // A Profile is composed of one or more services necessary to fulfill a use case.
 type Profile struct {
 	Services []*Service
+
+	// Hash is the Database Hash of the server the profile was discovered on, if
+	// the server has one. [Vol 3, Part G, 7.3]
+	Hash []byte
 }
 
 // Find searches discovered profile for the specified target's type and UUID.
@@ -3,4 +3,67 @@ package ble
 type AuthData struct {
 	Passkey int
 	OOBData []byte
-}
\ No newline at end of file
+
+	// RemoteOOB is the LE Secure Connections out of band data received from the
+	// remote device, e.g. over NFC, if not nil.
+	RemoteOOB *OOBData
+}
+
+// OOBData is the out of band data of LE Secure Connections pairing, which devices
+// exchange over NFC or a QR code before pairing. The values are in the byte order
+// of the SMP PDUs, which is also the one of the LE Secure Connections Confirmation
+// Value and Random Value AD types. [Vol 3, Part H, 2.3.5.6.4]
+type OOBData struct {
+	// Confirm is f4(PKx, PKx, Random, 0), PKx being the X coordinate of the public
+	// key of the device.
+	Confirm []byte
+
+	// Random is the 128 bits random value of the device.
+	Random []byte
+}
+
+// IOCapability is the input and output capabilities of a device, which select
+// the pairing method. [Vol 3, Part H, 2.3.2]
+type IOCapability byte
+
+// IO capabilities [Vol 3, Part H, 3.5.1, Table 3.4]
+const (
+	IOCapDisplayOnly     IOCapability = 0x00
+	IOCapDisplayYesNo    IOCapability = 0x01
+	IOCapKeyboardOnly    IOCapability = 0x02
+	IOCapNoInputNoOutput IOCapability = 0x03
+	IOCapKeyboardDisplay IOCapability = 0x04
+)
+
+// KeypressType is a key the user pressed on the remote device while entering a
+// passkey. [Vol 3, Part H, 3.5.8]
+type KeypressType byte
+
+// Keypress notification types [Vol 3, Part H, 3.5.8, Table 3.13]
+const (
+	KeypressEntryStarted   KeypressType = 0x00
+	KeypressDigitEntered   KeypressType = 0x01
+	KeypressDigitErased    KeypressType = 0x02
+	KeypressCleared        KeypressType = 0x03
+	KeypressEntryCompleted KeypressType = 0x04
+)
+
+// A PairingAgent interacts with the user during pairing. RequestPasskey and
+// ConfirmNumericComparison are called on their own goroutine, and must return
+// before the pairing times out; the other methods must not wait for the user.
+type PairingAgent interface {
+	// DisplayPasskey shows the passkey the user enters on the remote device.
+	DisplayPasskey(addr Addr, passkey uint32)
+
+	// RequestPasskey returns the passkey the remote device shows, as entered by
+	// the user. Pairing fails if an error is returned.
+	RequestPasskey(addr Addr) (uint32, error)
+
+	// ConfirmNumericComparison reports whether the user confirmed the remote
+	// device shows the same value. Pairing fails if false, or an error is returned.
+	ConfirmNumericComparison(addr Addr, value uint32) (bool, error)
+
+	// Keypress is notified of the keys the user presses on the remote device,
+	// while entering the passkey.
+	Keypress(addr Addr, kind KeypressType)
+}